@@ -0,0 +1,263 @@
+package compositelimiter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InfDuration is returned as the wait time for requests that one of the limits can never allow
+const InfDuration = time.Duration(math.MaxInt64)
+
+// Limiter is the part every algorithm in this repo has in common
+type Limiter interface {
+	Allow(n int) bool
+	TimeUntilAllowed(n int) time.Duration
+	ExceedsCapacity(n int) bool
+}
+
+// CostLimiter is a Limiter that also takes fractional costs, all the algorithms in this repo are.
+// Children that aren't are asked about the cost rounded up.
+type CostLimiter interface {
+	Limiter
+	AllowCost(cost float64) bool
+	TimeUntilAllowedCost(cost float64) time.Duration
+}
+
+// Debiter is a Limiter that can be charged after the fact, all the algorithms in this repo are
+type Debiter interface {
+	Debit(cost float64)
+}
+
+// Limit is one named child of a CompositeLimiter
+type Limit struct {
+	Name    string
+	Limiter Limiter
+}
+
+// Decision is the outcome of Check
+type Decision struct {
+	Allowed bool
+	// names of the limits that turned the request away, in the order they were added
+	DeniedBy []string
+	// longest wait of the limits in DeniedBy, InfDuration if one of them can never allow n
+	RetryAfter time.Duration
+}
+
+// CompositeLimiter enforces several limits at once, e.g. 10 req/s and 1000 req/hour.
+// A request only counts against the limits when every one of them allows it, so a
+// denial by one limit never uses up the others.
+//
+// The children must only be used through the composite, and their TimeUntilAllowed
+// must return 0 exactly when Allow would succeed.
+type CompositeLimiter struct {
+	limits   []Limit
+	allowed  int64
+	denied   int64
+	deniedBy map[string]int64
+	log      *log.Logger
+	mu       sync.Mutex
+}
+
+func NewCompositeLimiter(limits ...Limit) (*CompositeLimiter, error) {
+	if len(limits) == 0 {
+		return nil, errors.New("at least one limit is required")
+	}
+	names := make(map[string]bool, len(limits))
+	for _, l := range limits {
+		if l.Name == "" || l.Limiter == nil {
+			return nil, errors.New("every limit needs a name and a limiter")
+		}
+		if names[l.Name] {
+			return nil, fmt.Errorf("duplicate limit %q", l.Name)
+		}
+		names[l.Name] = true
+	}
+	return &CompositeLimiter{
+		limits:   append([]Limit(nil), limits...),
+		deniedBy: make(map[string]int64),
+		log:      log.Default(),
+	}, nil
+}
+
+func (c *CompositeLimiter) SetLogger(logger *log.Logger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if logger != nil {
+		c.log = logger
+	}
+}
+
+// Check asks every limit about n and only commits it when all of them allow it
+func (c *CompositeLimiter) Check(n int) Decision {
+	return c.CheckCost(float64(n))
+}
+
+// CheckCost is Check for a request that costs a fraction of a unit, or several
+func (c *CompositeLimiter) CheckCost(cost float64) Decision {
+	if !(cost > 0) {
+		return Decision{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// nothing is taken until every limit has room, checking doesn't change them
+	var d Decision
+	for _, l := range c.limits {
+		if wait := timeUntilAllowed(l.Limiter, cost); wait > 0 {
+			d.DeniedBy = append(d.DeniedBy, l.Name)
+			d.RetryAfter = max(d.RetryAfter, wait)
+		}
+	}
+	if len(d.DeniedBy) > 0 {
+		c.deny(cost, d)
+		return d
+	}
+
+	for _, l := range c.limits {
+		if !allow(l.Limiter, cost) {
+			// only happens when the child is used on its own as well, the limits before it are already taken
+			d.DeniedBy = []string{l.Name}
+			d.RetryAfter = timeUntilAllowed(l.Limiter, cost)
+			c.deny(cost, d)
+			return d
+		}
+	}
+	// the counters are in whole requests, a fraction counts as one
+	c.allowed += int64(math.Ceil(cost))
+	d.Allowed = true
+	c.log.Printf("allowed a cost of %g by %d limits", cost, len(c.limits))
+	return d
+}
+
+// deny counts a rejected request, c.mu must be held
+func (c *CompositeLimiter) deny(cost float64, d Decision) {
+	units := int64(math.Ceil(cost))
+	c.denied += units
+	for _, name := range d.DeniedBy {
+		c.deniedBy[name] += units
+	}
+	c.log.Printf("denied a cost of %g by %s, retry after %v", cost, strings.Join(d.DeniedBy, ", "), d.RetryAfter)
+}
+
+// allow takes cost from l, rounded up when l only counts whole requests
+func allow(l Limiter, cost float64) bool {
+	if cl, ok := l.(CostLimiter); ok {
+		return cl.AllowCost(cost)
+	}
+	return l.Allow(int(math.Ceil(cost)))
+}
+
+func timeUntilAllowed(l Limiter, cost float64) time.Duration {
+	if cl, ok := l.(CostLimiter); ok {
+		return cl.TimeUntilAllowedCost(cost)
+	}
+	return l.TimeUntilAllowed(int(math.Ceil(cost)))
+}
+
+func (c *CompositeLimiter) Allow(n int) bool {
+	return c.Check(n).Allowed
+}
+
+func (c *CompositeLimiter) AllowCost(cost float64) bool {
+	return c.CheckCost(cost).Allowed
+}
+
+// TryCost is AllowCost that also says how long to wait when it denies, InfDuration
+// when one of the limits can never allow cost
+func (c *CompositeLimiter) TryCost(cost float64) (bool, time.Duration) {
+	d := c.CheckCost(cost)
+	return d.Allowed, d.RetryAfter
+}
+
+// Debit charges cost to every limit after the fact, e.g. for the bytes of a response
+// that already went out. Limits that can't be debited are skipped.
+func (c *CompositeLimiter) Debit(cost float64) {
+	if !(cost > 0) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, l := range c.limits {
+		if d, ok := l.Limiter.(Debiter); ok {
+			d.Debit(cost)
+		}
+	}
+}
+
+// TimeUntilAllowed is the longest wait of all the limits
+func (c *CompositeLimiter) TimeUntilAllowed(n int) time.Duration {
+	return c.TimeUntilAllowedCost(float64(n))
+}
+
+func (c *CompositeLimiter) TimeUntilAllowedCost(cost float64) time.Duration {
+	if !(cost > 0) {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var wait time.Duration
+	for _, l := range c.limits {
+		wait = max(wait, timeUntilAllowed(l.Limiter, cost))
+	}
+	return wait
+}
+
+// ExceedsCapacity reports whether one of the limits can never allow n
+func (c *CompositeLimiter) ExceedsCapacity(n int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, l := range c.limits {
+		if l.Limiter.ExceedsCapacity(n) {
+			return true
+		}
+	}
+	return false
+}
+
+// Limit returns the child called name
+func (c *CompositeLimiter) Limit(name string) (Limiter, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, l := range c.limits {
+		if l.Name == name {
+			return l.Limiter, true
+		}
+	}
+	return nil, false
+}
+
+// Limits returns the children in the order they are checked
+func (c *CompositeLimiter) Limits() []Limit {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Limit(nil), c.limits...)
+}
+
+// Stats returns the requests allowed and denied, deniedBy counts the denials of each limit.
+// A request denied by two limits counts for both.
+func (c *CompositeLimiter) Stats() (allowed, denied int64, deniedBy map[string]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deniedBy = make(map[string]int64, len(c.deniedBy))
+	for name, count := range c.deniedBy {
+		deniedBy[name] = count
+	}
+	return c.allowed, c.denied, deniedBy
+}
+
+func (c *CompositeLimiter) ResetStats() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.allowed = 0
+	c.denied = 0
+	c.deniedBy = make(map[string]int64)
+}
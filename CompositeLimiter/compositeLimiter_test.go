@@ -0,0 +1,261 @@
+package compositelimiter
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"slices"
+	"testing"
+	"time"
+)
+
+// counter allows max requests in total, wait is what it reports once they are used up
+type counter struct {
+	Used int           `json:"used"`
+	Max  int           `json:"max"`
+	Wait time.Duration `json:"-"`
+}
+
+func (c *counter) Allow(n int) bool {
+	if n <= 0 || c.Used+n > c.Max {
+		return false
+	}
+	c.Used += n
+	return true
+}
+
+func (c *counter) TimeUntilAllowed(n int) time.Duration {
+	if c.ExceedsCapacity(n) {
+		return InfDuration
+	}
+	if c.Used+n > c.Max {
+		return c.Wait
+	}
+	return 0
+}
+
+func (c *counter) ExceedsCapacity(n int) bool { return n > c.Max }
+
+func (c *counter) MarshalJSON() ([]byte, error) {
+	type plain counter
+	return json.Marshal((*plain)(c))
+}
+
+func (c *counter) UnmarshalJSON(data []byte) error {
+	type plain counter
+	return json.Unmarshal(data, (*plain)(c))
+}
+
+// costCounter is a counter that also takes fractional costs
+type costCounter struct {
+	Used, Max float64
+}
+
+func (c *costCounter) Allow(n int) bool { return c.AllowCost(float64(n)) }
+func (c *costCounter) TimeUntilAllowed(n int) time.Duration {
+	return c.TimeUntilAllowedCost(float64(n))
+}
+func (c *costCounter) ExceedsCapacity(n int) bool { return float64(n) > c.Max }
+
+func (c *costCounter) AllowCost(cost float64) bool {
+	if !(cost > 0) || c.Used+cost > c.Max {
+		return false
+	}
+	c.Used += cost
+	return true
+}
+
+func (c *costCounter) TimeUntilAllowedCost(cost float64) time.Duration {
+	if c.Used+cost > c.Max {
+		return time.Second
+	}
+	return 0
+}
+
+func (c *costCounter) Debit(cost float64) {
+	c.Used = max(c.Used, min(c.Used+cost, c.Max))
+}
+
+func newQuietComposite(t *testing.T, limits ...Limit) *CompositeLimiter {
+	t.Helper()
+	c, err := NewCompositeLimiter(limits...)
+	if err != nil {
+		t.Fatalf("NewCompositeLimiter failed: %v", err)
+	}
+	c.SetLogger(log.New(io.Discard, "", 0))
+	return c
+}
+
+func TestNewCompositeLimiter(t *testing.T) {
+	if _, err := NewCompositeLimiter(); err == nil {
+		t.Errorf("no limits should fail")
+	}
+	if _, err := NewCompositeLimiter(Limit{Name: "second"}); err == nil {
+		t.Errorf("a limit without a limiter should fail")
+	}
+	if _, err := NewCompositeLimiter(Limit{"second", &counter{Max: 1}}, Limit{"second", &counter{Max: 1}}); err == nil {
+		t.Errorf("duplicate names should fail")
+	}
+}
+
+func TestCheckCommitsOnlyWhenAllAllow(t *testing.T) {
+	second := &counter{Max: 2, Wait: time.Second}
+	hour := &counter{Max: 3, Wait: time.Hour}
+	c := newQuietComposite(t, Limit{"second", second}, Limit{"hour", hour})
+
+	for i := 0; i < 2; i++ {
+		if d := c.Check(1); !d.Allowed {
+			t.Fatalf("Check(1) at %d should be allowed, denied by %v", i, d.DeniedBy)
+		}
+	}
+
+	d := c.Check(1)
+	if d.Allowed || !slices.Equal(d.DeniedBy, []string{"second"}) || d.RetryAfter != time.Second {
+		t.Errorf("Expected a denial by second after 1s, got %+v", d)
+	}
+	// the denial by second must not use up the hourly limit
+	if hour.Used != 2 {
+		t.Errorf("Expected the hourly limit untouched by the denial, used %d", hour.Used)
+	}
+
+	second.Used = 0
+	c.Check(1)
+	d = c.Check(1)
+	if d.Allowed || !slices.Equal(d.DeniedBy, []string{"hour"}) || d.RetryAfter != time.Hour {
+		t.Errorf("Expected a denial by hour after 1h, got %+v", d)
+	}
+	if second.Used != 1 {
+		t.Errorf("Expected the denial by hour to leave second at 1, got %d", second.Used)
+	}
+}
+
+func TestRetryAfterIsTheLongestWait(t *testing.T) {
+	c := newQuietComposite(t,
+		Limit{"second", &counter{Max: 1, Wait: time.Second}},
+		Limit{"hour", &counter{Max: 1, Wait: time.Hour}},
+		Limit{"day", &counter{Max: 5, Wait: 24 * time.Hour}},
+	)
+	c.Allow(1)
+
+	d := c.Check(1)
+	if !slices.Equal(d.DeniedBy, []string{"second", "hour"}) {
+		t.Errorf("Expected second and hour to deny, got %v", d.DeniedBy)
+	}
+	if d.RetryAfter != time.Hour {
+		t.Errorf("Expected retry after 1h, got %v", d.RetryAfter)
+	}
+	if wait := c.TimeUntilAllowed(1); wait != time.Hour {
+		t.Errorf("Expected TimeUntilAllowed 1h, got %v", wait)
+	}
+
+	if !c.ExceedsCapacity(2) {
+		t.Errorf("2 is more than second can ever allow")
+	}
+	if d := c.Check(2); d.RetryAfter != InfDuration {
+		t.Errorf("Expected InfDuration for a request that never fits, got %v", d.RetryAfter)
+	}
+	if c.Allow(0) {
+		t.Errorf("Allow(0) should be denied")
+	}
+}
+
+func TestCheckCost(t *testing.T) {
+	exact := &costCounter{Max: 2}
+	whole := &counter{Max: 4, Wait: time.Minute}
+	c := newQuietComposite(t, Limit{"exact", exact}, Limit{"whole", whole})
+
+	// exact is charged 0.5, whole only counts whole requests and takes 1
+	if d := c.CheckCost(0.5); !d.Allowed {
+		t.Fatalf("CheckCost(0.5) should be allowed, denied by %v", d.DeniedBy)
+	}
+	if exact.Used != 0.5 || whole.Used != 1 {
+		t.Errorf("Expected 0.5 and 1 used, got %v and %d", exact.Used, whole.Used)
+	}
+
+	c.AllowCost(1.5)
+	d := c.CheckCost(0.5)
+	if d.Allowed || !slices.Equal(d.DeniedBy, []string{"exact"}) || d.RetryAfter != time.Second {
+		t.Errorf("Expected a denial by exact after 1s, got %+v", d)
+	}
+	if wait := c.TimeUntilAllowedCost(0.5); wait != time.Second {
+		t.Errorf("Expected to wait 1s, got %v", wait)
+	}
+	if c.AllowCost(0) {
+		t.Errorf("A cost of 0 should be denied")
+	}
+
+	allowed, denied, _ := c.Stats()
+	if allowed != 3 || denied != 1 {
+		t.Errorf("Expected 3 allowed and 1 denied, rounded up, got %d and %d", allowed, denied)
+	}
+}
+
+func TestDebit(t *testing.T) {
+	exact := &costCounter{Max: 2}
+	whole := &counter{Max: 4, Wait: time.Minute}
+	c := newQuietComposite(t, Limit{"exact", exact}, Limit{"whole", whole})
+
+	// whole can't be debited and is left alone, exact fills up without going over
+	c.Debit(1.5)
+	c.Debit(1.5)
+	if exact.Used != 2 || whole.Used != 0 {
+		t.Errorf("Expected 2 and 0 used, got %v and %d", exact.Used, whole.Used)
+	}
+	if c.AllowCost(0.5) {
+		t.Errorf("Expected the debited limit to deny")
+	}
+}
+
+func TestStats(t *testing.T) {
+	c := newQuietComposite(t,
+		Limit{"second", &counter{Max: 1, Wait: time.Second}},
+		Limit{"hour", &counter{Max: 1, Wait: time.Hour}},
+	)
+	c.Allow(1)
+	c.Allow(1)
+	c.Allow(1)
+
+	allowed, denied, deniedBy := c.Stats()
+	if allowed != 1 || denied != 2 {
+		t.Errorf("Expected 1 allowed and 2 denied, got %d and %d", allowed, denied)
+	}
+	if deniedBy["second"] != 2 || deniedBy["hour"] != 2 {
+		t.Errorf("Expected both limits to deny twice, got %v", deniedBy)
+	}
+
+	c.ResetStats()
+	if allowed, denied, deniedBy := c.Stats(); allowed != 0 || denied != 0 || len(deniedBy) != 0 {
+		t.Errorf("Expected empty stats after reset, got %d, %d, %v", allowed, denied, deniedBy)
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	c := newQuietComposite(t, Limit{"second", &counter{Max: 5}}, Limit{"hour", &counter{Max: 50}})
+	c.Allow(3)
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %v", err)
+	}
+
+	// a limit added since the state was saved keeps its own state
+	day := &counter{Max: 500}
+	restored := newQuietComposite(t, Limit{"second", &counter{Max: 5}}, Limit{"day", day})
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatalf("UnmarshalJSON failed: %v", err)
+	}
+	second, _ := restored.Limit("second")
+	if used := second.(*counter).Used; used != 3 {
+		t.Errorf("Expected second restored with 3 used, got %d", used)
+	}
+	if day.Used != 0 {
+		t.Errorf("Expected day untouched, got %d used", day.Used)
+	}
+	if _, ok := restored.Limit("hour"); ok {
+		t.Errorf("hour is not a limit of the restored composite")
+	}
+
+	if err := json.Unmarshal([]byte("garbage"), restored); err == nil {
+		t.Errorf("UnmarshalJSON should fail for garbage")
+	}
+}
@@ -0,0 +1,3 @@
+module compositelimiter
+
+go 1.24.4
@@ -0,0 +1,49 @@
+package compositelimiter
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MarshalJSON saves the state of every limit by name, each in its own JSON format
+func (c *CompositeLimiter) MarshalJSON() ([]byte, error) {
+	states := make(map[string]json.RawMessage)
+	for _, l := range c.Limits() {
+		m, ok := l.Limiter.(json.Marshaler)
+		if !ok {
+			return nil, fmt.Errorf("limit %q can't save its state", l.Name)
+		}
+		data, err := m.MarshalJSON()
+		if err != nil {
+			return nil, fmt.Errorf("limit %q: %w", l.Name, err)
+		}
+		states[l.Name] = data
+	}
+	return json.Marshal(states)
+}
+
+// UnmarshalJSON restores the limits saved by MarshalJSON. Saved limits that no longer
+// exist are skipped and new limits keep their current state.
+func (c *CompositeLimiter) UnmarshalJSON(data []byte) error {
+	var states map[string]json.RawMessage
+	if err := json.Unmarshal(data, &states); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, l := range c.limits {
+		state, ok := states[l.Name]
+		if !ok {
+			continue
+		}
+		u, ok := l.Limiter.(json.Unmarshaler)
+		if !ok {
+			return fmt.Errorf("limit %q can't restore its state", l.Name)
+		}
+		if err := u.UnmarshalJSON(state); err != nil {
+			return fmt.Errorf("limit %q: %w", l.Name, err)
+		}
+	}
+	return nil
+}
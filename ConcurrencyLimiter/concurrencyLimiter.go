@@ -0,0 +1,230 @@
+package concurrencylimiter
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// ErrQueueFull is returned by Acquire when maxQueue requests are already waiting
+var ErrQueueFull = errors.New("concurrency limiter queue is full")
+
+// ExceedsCapacityError is returned by Acquire when n is larger than the limit can ever allow
+type ExceedsCapacityError struct {
+	Requested   int
+	MaxInFlight int
+}
+
+func (e *ExceedsCapacityError) Error() string {
+	return fmt.Sprintf("requested %d slots but max in flight is %d", e.Requested, e.MaxInFlight)
+}
+
+// waiter is one blocked Acquire, ready is closed once its slots are taken
+type waiter struct {
+	n     int
+	ready chan struct{}
+}
+
+// ConcurrencyLimiter caps how many requests are in flight at once. Unlike the rate
+// limiters it doesn't care how fast requests arrive, only how many are running.
+// Requests over the cap wait in FIFO order, up to maxQueue of them.
+type ConcurrencyLimiter struct {
+	maxInFlight int
+	maxQueue    int
+	inFlight    int
+	waiters     list.List
+	acquired    int
+	rejected    int
+	log         *log.Logger
+	mu          sync.Mutex
+}
+
+// NewConcurrencyLimiter allows maxInFlight slots at once, maxQueue 0 rejects instead of waiting
+func NewConcurrencyLimiter(maxInFlight, maxQueue int) (*ConcurrencyLimiter, error) {
+	if maxInFlight <= 0 {
+		return nil, errors.New("maxInFlight must be positive")
+	}
+	if maxQueue < 0 {
+		return nil, errors.New("maxQueue cant be negative")
+	}
+	return &ConcurrencyLimiter{
+		maxInFlight: maxInFlight,
+		maxQueue:    maxQueue,
+		log:         log.Default(),
+	}, nil
+}
+
+func (cl *ConcurrencyLimiter) SetLogger(logger *log.Logger) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if logger != nil {
+		cl.log = logger
+	}
+}
+
+// TryAcquire takes n slots if they are free right now, it never waits
+func (cl *ConcurrencyLimiter) TryAcquire(n int) bool {
+	if n <= 0 {
+		return false
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	// waiting requests go first, otherwise a stream of small ones could starve them
+	if cl.waiters.Len() == 0 && cl.inFlight+n <= cl.maxInFlight {
+		cl.inFlight += n
+		cl.acquired++
+		return true
+	}
+	cl.rejected++
+	cl.log.Printf("Rejected: need %d slots, %d of %d in flight", n, cl.inFlight, cl.maxInFlight)
+	return false
+}
+
+// Acquire takes n slots, waiting in line behind earlier requests until they are free.
+// It fails right away with ErrQueueFull when the queue is full, and with ctx.Err()
+// if ctx is done first. Every successful Acquire must be followed by Release(n).
+func (cl *ConcurrencyLimiter) Acquire(ctx context.Context, n int) error {
+	if n <= 0 {
+		return errors.New("n must be positive")
+	}
+
+	cl.mu.Lock()
+	if n > cl.maxInFlight {
+		cl.rejected++
+		cl.log.Printf("Rejected: need %d slots, max in flight is %d", n, cl.maxInFlight)
+		err := &ExceedsCapacityError{Requested: n, MaxInFlight: cl.maxInFlight}
+		cl.mu.Unlock()
+		return err
+	}
+	if cl.waiters.Len() == 0 && cl.inFlight+n <= cl.maxInFlight {
+		cl.inFlight += n
+		cl.acquired++
+		cl.mu.Unlock()
+		return nil
+	}
+	if cl.waiters.Len() >= cl.maxQueue {
+		cl.rejected++
+		cl.log.Printf("Rejected: %d requests already queued", cl.waiters.Len())
+		cl.mu.Unlock()
+		return ErrQueueFull
+	}
+
+	w := &waiter{n: n, ready: make(chan struct{})}
+	elem := cl.waiters.PushBack(w)
+	cl.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+		select {
+		case <-w.ready:
+			// got the slots while giving up, hand them back
+			cl.inFlight -= n
+			cl.acquired--
+		default:
+			cl.waiters.Remove(elem)
+		}
+		cl.rejected++
+		// the next in line may fit now that this one is gone
+		cl.notifyWaiters()
+		return ctx.Err()
+	}
+}
+
+// Release gives back n slots taken by Acquire or TryAcquire
+func (cl *ConcurrencyLimiter) Release(n int) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if n > cl.inFlight {
+		panic(fmt.Sprintf("concurrencylimiter: released %d slots but only %d are in flight", n, cl.inFlight))
+	}
+	cl.inFlight -= n
+	cl.notifyWaiters()
+}
+
+// notifyWaiters hands free slots to waiters in FIFO order. It stops at the first
+// one that doesn't fit so a large request is not passed by smaller ones forever.
+func (cl *ConcurrencyLimiter) notifyWaiters() {
+	for {
+		front := cl.waiters.Front()
+		if front == nil {
+			return
+		}
+		w := front.Value.(*waiter)
+		if cl.inFlight+w.n > cl.maxInFlight {
+			return
+		}
+		cl.inFlight += w.n
+		cl.acquired++
+		cl.waiters.Remove(front)
+		close(w.ready)
+	}
+}
+
+// Update changes the limits without dropping requests in flight or in the queue.
+// A non-positive maxInFlight or a negative maxQueue leaves that value unchanged.
+// Shrinking the queue only turns away new requests, the ones already waiting keep their place.
+func (cl *ConcurrencyLimiter) Update(newMaxInFlight, newMaxQueue int) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if newMaxInFlight > 0 {
+		cl.maxInFlight = newMaxInFlight
+	}
+	if newMaxQueue >= 0 {
+		cl.maxQueue = newMaxQueue
+	}
+	cl.notifyWaiters()
+}
+
+func (cl *ConcurrencyLimiter) ExceedsCapacity(n int) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return n > cl.maxInFlight
+}
+
+func (cl *ConcurrencyLimiter) Stats() (acquired, rejected int) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.acquired, cl.rejected
+}
+
+func (cl *ConcurrencyLimiter) ResetStats() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.acquired, cl.rejected = 0, 0
+}
+
+func (cl *ConcurrencyLimiter) InFlight() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.inFlight
+}
+
+// Queued is the number of Acquire calls waiting for a slot
+func (cl *ConcurrencyLimiter) Queued() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.waiters.Len()
+}
+
+func (cl *ConcurrencyLimiter) MaxInFlight() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.maxInFlight
+}
+
+func (cl *ConcurrencyLimiter) MaxQueue() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.maxQueue
+}
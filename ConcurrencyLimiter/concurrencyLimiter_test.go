@@ -0,0 +1,272 @@
+package concurrencylimiter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newQuietLimiter(t *testing.T, maxInFlight, maxQueue int) *ConcurrencyLimiter {
+	t.Helper()
+	cl, err := NewConcurrencyLimiter(maxInFlight, maxQueue)
+	if err != nil {
+		t.Fatalf("NewConcurrencyLimiter failed: %v", err)
+	}
+	cl.SetLogger(log.New(io.Discard, "", 0))
+	return cl
+}
+
+// waitQueued polls until n requests are waiting, Acquire gives no other signal
+func waitQueued(t *testing.T, cl *ConcurrencyLimiter, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for cl.Queued() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d queued, got %d", n, cl.Queued())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNewConcurrencyLimiter(t *testing.T) {
+	if _, err := NewConcurrencyLimiter(0, 1); err == nil {
+		t.Errorf("maxInFlight 0 should fail")
+	}
+	if _, err := NewConcurrencyLimiter(1, -1); err == nil {
+		t.Errorf("negative maxQueue should fail")
+	}
+}
+
+func TestTryAcquire(t *testing.T) {
+	cl := newQuietLimiter(t, 3, 0)
+
+	if !cl.TryAcquire(2) || !cl.TryAcquire(1) {
+		t.Fatalf("TryAcquire within the limit should succeed")
+	}
+	if cl.TryAcquire(1) {
+		t.Errorf("TryAcquire over the limit should fail")
+	}
+	if cl.InFlight() != 3 {
+		t.Errorf("Expected 3 in flight, got %d", cl.InFlight())
+	}
+
+	cl.Release(1)
+	if !cl.TryAcquire(1) {
+		t.Errorf("TryAcquire after Release should succeed")
+	}
+
+	acquired, rejected := cl.Stats()
+	if acquired != 3 || rejected != 1 {
+		t.Errorf("Expected 3 acquired and 1 rejected, got %d and %d", acquired, rejected)
+	}
+}
+
+func TestAcquireFIFO(t *testing.T) {
+	cl := newQuietLimiter(t, 1, 3)
+	cl.TryAcquire(1)
+
+	var (
+		mu    sync.Mutex
+		order []int
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := cl.Acquire(context.Background(), 1); err != nil {
+				t.Errorf("Acquire %d failed: %v", i, err)
+				return
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			cl.Release(1)
+		}(i)
+		// queue them one at a time so the order is known
+		waitQueued(t, cl, i+1)
+	}
+
+	cl.Release(1)
+	wg.Wait()
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("Expected FIFO order, got %v", order)
+		}
+	}
+	if cl.InFlight() != 0 || cl.Queued() != 0 {
+		t.Errorf("Expected nothing in flight or queued, got %d and %d", cl.InFlight(), cl.Queued())
+	}
+}
+
+func TestAcquireQueueFull(t *testing.T) {
+	cl := newQuietLimiter(t, 1, 1)
+	cl.TryAcquire(1)
+
+	go cl.Acquire(context.Background(), 1)
+	waitQueued(t, cl, 1)
+
+	if err := cl.Acquire(context.Background(), 1); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+
+	var capErr *ExceedsCapacityError
+	if err := cl.Acquire(context.Background(), 2); !errors.As(err, &capErr) || capErr.MaxInFlight != 1 {
+		t.Errorf("Expected ExceedsCapacityError, got %v", err)
+	}
+}
+
+func TestAcquireCanceled(t *testing.T) {
+	cl := newQuietLimiter(t, 2, 2)
+	cl.TryAcquire(1)
+
+	// a large request at the front blocks the ones behind it
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() { errs <- cl.Acquire(ctx, 2) }()
+	waitQueued(t, cl, 1)
+
+	small := make(chan error, 1)
+	go func() { small <- cl.Acquire(context.Background(), 1) }()
+	waitQueued(t, cl, 2)
+
+	if err := <-errs; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	// once the large one gave up the small one fits
+	select {
+	case err := <-small:
+		if err != nil {
+			t.Errorf("Acquire after cancel failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Small request was not woken up after the one in front gave up")
+	}
+	if cl.InFlight() != 2 {
+		t.Errorf("Expected 2 in flight, got %d", cl.InFlight())
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	cl := newQuietLimiter(t, 1, 5)
+	cl.TryAcquire(1)
+
+	done := make(chan error, 1)
+	go func() { done <- cl.Acquire(context.Background(), 1) }()
+	waitQueued(t, cl, 1)
+
+	// growing the limit lets the waiter in without a Release
+	cl.Update(2, -1)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Acquire failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Waiter was not woken up by Update")
+	}
+	if cl.MaxInFlight() != 2 || cl.MaxQueue() != 5 {
+		t.Errorf("Expected max in flight 2 and queue 5, got %d and %d", cl.MaxInFlight(), cl.MaxQueue())
+	}
+
+	cl.Update(0, 0)
+	if cl.MaxInFlight() != 2 || cl.MaxQueue() != 0 {
+		t.Errorf("Expected max in flight 2 and queue 0, got %d and %d", cl.MaxInFlight(), cl.MaxQueue())
+	}
+	if err := cl.Acquire(context.Background(), 1); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected ErrQueueFull without a queue, got %v", err)
+	}
+}
+
+func TestReleaseTooMuch(t *testing.T) {
+	cl := newQuietLimiter(t, 1, 0)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Release without Acquire should panic")
+		}
+	}()
+	cl.Release(1)
+}
+
+func TestGradientLimit(t *testing.T) {
+	if _, err := NewGradientLimit(GradientConfig{InitialLimit: 20, MinLimit: 1, MaxLimit: 10, Smoothing: 1}); err == nil {
+		t.Errorf("InitialLimit above MaxLimit should fail")
+	}
+	g, err := NewGradientLimit(GradientConfig{InitialLimit: 10, MinLimit: 2, MaxLimit: 100, Smoothing: 1})
+	if err != nil {
+		t.Fatalf("NewGradientLimit failed: %v", err)
+	}
+
+	// at the min RTT the limit grows by sqrt(limit)
+	if limit := g.OnSample(100*time.Millisecond, 10, false); limit != 13 {
+		t.Errorf("Expected 10 + sqrt(10) = 13, got %d", limit)
+	}
+	// twice the min RTT halves it, plus the headroom
+	if limit := g.OnSample(200*time.Millisecond, 13, false); limit != 10 {
+		t.Errorf("Expected 13.16 * 0.5 + sqrt(13.16) = 10, got %d", limit)
+	}
+	if g.MinRTT() != 100*time.Millisecond || g.RTT() != 200*time.Millisecond {
+		t.Errorf("Expected min RTT 100ms and RTT 200ms, got %v and %v", g.MinRTT(), g.RTT())
+	}
+
+	// an idle backend doesn't grow the limit
+	if limit := g.OnSample(100*time.Millisecond, 1, false); limit != 10 {
+		t.Errorf("Expected the limit to stay at 10 when far below it, got %d", limit)
+	}
+	if limit := g.OnSample(100*time.Millisecond, 1, true); limit != 9 {
+		t.Errorf("Expected a drop to back off to 9, got %d", limit)
+	}
+
+	for range 20 {
+		g.OnSample(time.Second, 10, true)
+	}
+	if g.Limit() != 2 {
+		t.Errorf("Expected the limit to stop at 2, got %d", g.Limit())
+	}
+}
+
+func TestGradientMinRTTReset(t *testing.T) {
+	g, _ := NewGradientLimit(GradientConfig{InitialLimit: 10, MinLimit: 1, MaxLimit: 100, Smoothing: 0.5, MinRTTReset: 20 * time.Millisecond})
+
+	g.OnSample(10*time.Millisecond, 10, false)
+	g.OnSample(50*time.Millisecond, 10, false)
+	if g.MinRTT() != 10*time.Millisecond {
+		t.Errorf("Expected min RTT 10ms, got %v", g.MinRTT())
+	}
+
+	// the backend got slower for good, the min RTT follows after a reset
+	time.Sleep(25 * time.Millisecond)
+	g.OnSample(50*time.Millisecond, 10, false)
+	if g.MinRTT() != 50*time.Millisecond {
+		t.Errorf("Expected min RTT 50ms after the reset, got %v", g.MinRTT())
+	}
+}
+
+func TestAdaptiveConcurrencyLimiter(t *testing.T) {
+	acl, err := NewAdaptiveConcurrencyLimiter(GradientConfig{InitialLimit: 4, MinLimit: 1, MaxLimit: 50, Smoothing: 1}, 0)
+	if err != nil {
+		t.Fatalf("NewAdaptiveConcurrencyLimiter failed: %v", err)
+	}
+	acl.SetLogger(log.New(io.Discard, "", 0))
+
+	for range 4 {
+		acl.TryAcquire(1)
+	}
+	if acl.TryAcquire(1) {
+		t.Errorf("TryAcquire over the initial limit should fail")
+	}
+
+	acl.Release(1)
+	acl.Observe(10*time.Millisecond, 4, false)
+	if acl.MaxInFlight() != 6 {
+		t.Errorf("Expected 4 + sqrt(4) = 6 slots, got %d", acl.MaxInFlight())
+	}
+	if !acl.TryAcquire(1) || !acl.TryAcquire(1) || !acl.TryAcquire(1) {
+		t.Errorf("TryAcquire within the grown limit should succeed")
+	}
+}
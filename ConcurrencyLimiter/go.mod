@@ -0,0 +1,3 @@
+module concurrencylimiter
+
+go 1.24.4
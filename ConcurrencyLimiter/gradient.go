@@ -0,0 +1,153 @@
+package concurrencylimiter
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// GradientConfig tunes GradientLimit
+type GradientConfig struct {
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+	// weight of each new estimate, 1 follows every sample, lower values move slower
+	Smoothing float64
+	// how often the min RTT is forgotten and measured again, so it can follow a backend
+	// that got slower for good. 0 keeps the lowest RTT ever seen.
+	MinRTTReset time.Duration
+}
+
+func (c GradientConfig) validate() error {
+	var errs []error
+	if c.MinLimit <= 0 || c.MaxLimit < c.MinLimit {
+		errs = append(errs, errors.New("limits must satisfy 0 < MinLimit <= MaxLimit"))
+	}
+	if c.InitialLimit < c.MinLimit || c.InitialLimit > c.MaxLimit {
+		errs = append(errs, errors.New("InitialLimit must be between MinLimit and MaxLimit"))
+	}
+	if c.Smoothing <= 0 || c.Smoothing > 1 {
+		errs = append(errs, errors.New("Smoothing must be above 0 and at most 1"))
+	}
+	if c.MinRTTReset < 0 {
+		errs = append(errs, errors.New("MinRTTReset cant be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// backoff is what the limit is multiplied by when a request was dropped
+const backoff = 0.9
+
+// GradientLimit finds the concurrency a backend can take by comparing the RTT of each
+// request to the lowest RTT seen, in the style of Netflix's concurrency-limits.
+// When requests get slower than the min RTT they are queueing somewhere, so the limit
+// shrinks by minRTT/rtt. Otherwise it grows by sqrt(limit), the headroom that lets it
+// probe for more.
+type GradientLimit struct {
+	cfg       GradientConfig
+	limit     float64
+	minRTT    time.Duration
+	rtt       time.Duration // last sample
+	lastReset time.Time
+	mu        sync.Mutex
+}
+
+func NewGradientLimit(cfg GradientConfig) (*GradientLimit, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &GradientLimit{cfg: cfg, limit: float64(cfg.InitialLimit), lastReset: time.Now()}, nil
+}
+
+// OnSample records a finished request and returns the new limit. inFlight is the number
+// of requests in flight when it started, dropped reports a request that failed or timed out.
+func (g *GradientLimit) OnSample(rtt time.Duration, inFlight int, dropped bool) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if rtt <= 0 {
+		return g.current()
+	}
+	if g.cfg.MinRTTReset > 0 && time.Since(g.lastReset) >= g.cfg.MinRTTReset {
+		g.minRTT = 0
+		g.lastReset = time.Now()
+	}
+	if g.minRTT == 0 || rtt < g.minRTT {
+		g.minRTT = rtt
+	}
+	g.rtt = rtt
+
+	var newLimit float64
+	switch {
+	case dropped:
+		newLimit = g.limit * backoff
+	case float64(inFlight) < g.limit/2:
+		// far below the limit the RTT says nothing about it, don't grow on an idle backend
+		return g.current()
+	default:
+		// never drop more than half at once, a single slow request shouldn't collapse the limit
+		gradient := max(0.5, min(1, float64(g.minRTT)/float64(rtt)))
+		newLimit = g.limit*gradient + math.Sqrt(g.limit)
+	}
+
+	g.limit = g.limit*(1-g.cfg.Smoothing) + newLimit*g.cfg.Smoothing
+	g.limit = max(float64(g.cfg.MinLimit), min(float64(g.cfg.MaxLimit), g.limit))
+	return g.current()
+}
+
+func (g *GradientLimit) current() int {
+	return int(g.limit)
+}
+
+func (g *GradientLimit) Limit() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.current()
+}
+
+// MinRTT is the lowest RTT seen since the last reset, the RTT without any queueing
+func (g *GradientLimit) MinRTT() time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.minRTT
+}
+
+// RTT is the RTT of the last sample
+func (g *GradientLimit) RTT() time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.rtt
+}
+
+// AdaptiveConcurrencyLimiter is a ConcurrencyLimiter whose max in flight follows a GradientLimit.
+// Report every request to Observe once it's done, before or after releasing it.
+type AdaptiveConcurrencyLimiter struct {
+	*ConcurrencyLimiter
+	gradient *GradientLimit
+}
+
+func NewAdaptiveConcurrencyLimiter(cfg GradientConfig, maxQueue int) (*AdaptiveConcurrencyLimiter, error) {
+	gradient, err := NewGradientLimit(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cl, err := NewConcurrencyLimiter(cfg.InitialLimit, maxQueue)
+	if err != nil {
+		return nil, err
+	}
+	return &AdaptiveConcurrencyLimiter{ConcurrencyLimiter: cl, gradient: gradient}, nil
+}
+
+// Observe feeds one finished request to the gradient and applies the new limit
+func (acl *AdaptiveConcurrencyLimiter) Observe(rtt time.Duration, inFlight int, dropped bool) {
+	acl.Update(acl.gradient.OnSample(rtt, inFlight, dropped), -1)
+}
+
+func (acl *AdaptiveConcurrencyLimiter) MinRTT() time.Duration {
+	return acl.gradient.MinRTT()
+}
+
+func (acl *AdaptiveConcurrencyLimiter) RTT() time.Duration {
+	return acl.gradient.RTT()
+}
@@ -1,21 +1,32 @@
-package main
+package fixedwindowcounter
 
 import (
 	"errors"
 	"log"
+	"math"
 	"sync"
 	"time"
 )
 
+// InfDuration is returned as the wait time for requests that can never fit in a window
+const InfDuration = time.Duration(math.MaxInt64)
+
+// Cost is how many requests a request counts as. Fractions like 0.1 for a cheap read are
+// counted exactly, Allow(n) is AllowCost(Cost(n)).
+type Cost = float64
+
 type FixedWindowCounter struct {
 	WindowSize      time.Duration
 	MaxRequests     int64
 	CurrentWindow   int64
-	RequestCount    int64
+	RequestCount    int64 // whole requests in the current window
 	RequestsAllowed int64
 	RequestsDenied  int64
 	logger          *log.Logger
 	mu              sync.RWMutex
+
+	// the part of a request fractional costs add on top of RequestCount, in [0, 1)
+	fraction float64
 }
 
 func NewFixedWindowCounter(windowSize time.Duration, maxRequests int64) (*FixedWindowCounter, error) {
@@ -43,36 +54,140 @@ func (fwc *FixedWindowCounter) Allow(n int) bool {
 	if n <= 0 {
 		return false
 	}
+	return fwc.AllowCost(Cost(n))
+}
+
+// AllowCost counts a request of cost if the window has room for it, a cost that isn't
+// positive is never allowed. Allowed and denied totals add it rounded up to whole requests.
+func (fwc *FixedWindowCounter) AllowCost(cost Cost) bool {
+	allowed, _ := fwc.TryCost(cost)
+	return allowed
+}
+
+// TryCost is AllowCost that also says how long to wait when it rejects, decided under
+// one lock. The wait is InfDuration when cost never fits, whatever the caller does.
+func (fwc *FixedWindowCounter) TryCost(cost Cost) (bool, time.Duration) {
+	if !(cost > 0) {
+		return false, InfDuration
+	}
 
 	fwc.mu.Lock()
 	defer fwc.mu.Unlock()
 
-	windowStart := time.Now().Truncate(fwc.WindowSize).Unix()
+	units := int64(math.Ceil(cost))
+	if cost > float64(fwc.MaxRequests) {
+		fwc.RequestsDenied += units
+		if fwc.logger != nil {
+			fwc.logger.Printf("denied %g requests, more than the window limit %d", cost, fwc.MaxRequests)
+		}
+		return false, InfDuration
+	}
+
+	fwc.advance()
+
+	// checking if allowing cost would exceed the limit
+	if fwc.count()+cost <= float64(fwc.MaxRequests) {
+		fwc.setCount(fwc.count() + cost)
+		fwc.RequestsAllowed += units
+		if fwc.logger != nil {
+			fwc.logger.Printf("allowed %g requests, count: %g/%d", cost, fwc.count(), fwc.MaxRequests)
+		}
+		return true, 0
+	}
+
+	fwc.RequestsDenied += units
+	if fwc.logger != nil {
+		fwc.logger.Printf("denied %g requests, limit exceeded: %g/%d", cost, fwc.count(), fwc.MaxRequests)
+	}
+	return false, fwc.timeUntilAllowed(cost)
+}
+
+// Debit counts cost against the current window after the fact, e.g. for the bytes of a
+// response that already went out. It never fails, a big debit fills the window instead of going over.
+func (fwc *FixedWindowCounter) Debit(cost Cost) {
+	if !(cost > 0) {
+		return
+	}
+
+	fwc.mu.Lock()
+	defer fwc.mu.Unlock()
+
+	fwc.advance()
+	fwc.setCount(max(fwc.count(), min(fwc.count()+cost, float64(fwc.MaxRequests))))
+}
+
+// AllowUpTo admits as many of n requests as are left in the current window and returns
+// how many that were, the rest count as denied
+func (fwc *FixedWindowCounter) AllowUpTo(n int) int {
+	if n <= 0 {
+		return 0
+	}
+
+	fwc.mu.Lock()
+	defer fwc.mu.Unlock()
+
+	fwc.advance()
+
+	// Update can leave the count above a lowered limit
+	granted := max(min(int64(n), int64(float64(fwc.MaxRequests)-fwc.count())), 0)
+	fwc.RequestCount += granted
+	fwc.RequestsAllowed += granted
+	fwc.RequestsDenied += int64(n) - granted
+	if fwc.logger != nil {
+		fwc.logger.Printf("allowed %d of %d requests, count: %g/%d", granted, n, fwc.count(), fwc.MaxRequests)
+	}
+	return int(granted)
+}
 
-	// if new window then requestCount becomes 0
+// advance starts a new window with a count of 0 once the current one is over, fwc.mu must be held
+func (fwc *FixedWindowCounter) advance() {
+	windowStart := time.Now().Truncate(fwc.WindowSize).Unix()
 	if windowStart != fwc.CurrentWindow {
 		fwc.CurrentWindow = windowStart
-		fwc.RequestCount = 0
+		fwc.setCount(0)
 		if fwc.logger != nil {
 			fwc.logger.Printf("window reset, new window starts at %s", time.Unix(windowStart, 0).Format("15:04:05"))
 		}
 	}
+}
 
-	// checking if allowing n requests would exceed the limit
-	if fwc.RequestCount+int64(n) <= fwc.MaxRequests {
-		fwc.RequestCount += int64(n)
-		fwc.RequestsAllowed += int64(n)
-		if fwc.logger != nil {
-			fwc.logger.Printf("allowed %d requests, count: %d/%d", n, fwc.RequestCount, fwc.MaxRequests)
-		}
-		return true
+// Update changes window size and limit at runtime, non-positive values are left unchanged.
+// The count of the current window is rescaled to the new window size so usage carries over.
+func (fwc *FixedWindowCounter) Update(newWindowSize time.Duration, newMaxRequests int64) {
+	fwc.mu.Lock()
+	defer fwc.mu.Unlock()
+
+	now := time.Now()
+	// a finished window counts as empty
+	if now.Truncate(fwc.WindowSize).Unix() != fwc.CurrentWindow {
+		fwc.setCount(0)
+	}
+
+	if newWindowSize > 0 && newWindowSize != fwc.WindowSize {
+		fwc.setCount(fwc.count() * float64(newWindowSize) / float64(fwc.WindowSize))
+		fwc.WindowSize = newWindowSize
+	}
+	fwc.CurrentWindow = now.Truncate(fwc.WindowSize).Unix()
+
+	if newMaxRequests > 0 {
+		fwc.MaxRequests = newMaxRequests
 	}
 
-	fwc.RequestsDenied += int64(n)
 	if fwc.logger != nil {
-		fwc.logger.Printf("denied %d requests, limit exceeded: %d/%d", n, fwc.RequestCount, fwc.MaxRequests)
+		fwc.logger.Printf("updated window to %s with limit %d, count: %g", fwc.WindowSize, fwc.MaxRequests, fwc.count())
 	}
-	return false
+}
+
+// count is the exact count of the current window, fractional costs included. fwc.mu must be held.
+func (fwc *FixedWindowCounter) count() float64 {
+	return float64(fwc.RequestCount) + fwc.fraction
+}
+
+// setCount splits c into RequestCount and fraction, fwc.mu must be held
+func (fwc *FixedWindowCounter) setCount(c float64) {
+	whole := math.Floor(c)
+	fwc.RequestCount = int64(whole)
+	fwc.fraction = c - whole
 }
 
 func (fwc *FixedWindowCounter) SetLogger(logger *log.Logger) {
@@ -89,13 +204,33 @@ func (fwc *FixedWindowCounter) Stats() (currentCount, maxRequests int64, windowS
 	return fwc.RequestCount, fwc.MaxRequests, windowStartTime
 }
 
+// Count returns the count of the current window with the fractional costs that Stats leaves out
+func (fwc *FixedWindowCounter) Count() float64 {
+	fwc.mu.RLock()
+	defer fwc.mu.RUnlock()
+	return fwc.count()
+}
+
+// Totals returns requests allowed and denied since the last Reset
+func (fwc *FixedWindowCounter) Totals() (allowed, denied int64) {
+	fwc.mu.RLock()
+	defer fwc.mu.RUnlock()
+	return fwc.RequestsAllowed, fwc.RequestsDenied
+}
+
+func (fwc *FixedWindowCounter) GetWindowSize() time.Duration {
+	fwc.mu.RLock()
+	defer fwc.mu.RUnlock()
+	return fwc.WindowSize
+}
+
 func (fwc *FixedWindowCounter) Reset() {
 	fwc.mu.Lock()
 	defer fwc.mu.Unlock()
 
 	fwc.CurrentWindow = time.Now().Truncate(fwc.WindowSize).Unix() // remove or comment this line if you choose to keep the current window boundary
 
-	fwc.RequestCount = 0
+	fwc.setCount(0)
 	fwc.RequestsAllowed = 0
 	fwc.RequestsDenied = 0
 
@@ -112,3 +247,45 @@ func (fwc *FixedWindowCounter) TimeUntilReset() time.Duration {
 	windowEnd := windowStart.Add(fwc.WindowSize)
 	return time.Until(windowEnd)
 }
+
+func (fwc *FixedWindowCounter) TimeUntilAllowed(n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	return fwc.TimeUntilAllowedCost(Cost(n))
+}
+
+// TimeUntilAllowedCost is how long until the window has room for cost, InfDuration above the limit
+func (fwc *FixedWindowCounter) TimeUntilAllowedCost(cost Cost) time.Duration {
+	if !(cost > 0) {
+		return 0
+	}
+
+	fwc.mu.RLock()
+	defer fwc.mu.RUnlock()
+
+	return fwc.timeUntilAllowed(cost)
+}
+
+// timeUntilAllowed is TimeUntilAllowedCost, fwc.mu must be held
+func (fwc *FixedWindowCounter) timeUntilAllowed(cost Cost) time.Duration {
+	if cost > float64(fwc.MaxRequests) {
+		return InfDuration
+	}
+
+	windowStart := time.Unix(fwc.CurrentWindow, 0)
+	windowEnd := windowStart.Add(fwc.WindowSize)
+	now := time.Now()
+	// counter resets once the window is over
+	if !now.Before(windowEnd) || fwc.count()+cost <= float64(fwc.MaxRequests) {
+		return 0
+	}
+	return windowEnd.Sub(now)
+}
+
+// ExceedsCapacity reports whether n can never be allowed, no matter how long the caller waits
+func (fwc *FixedWindowCounter) ExceedsCapacity(n int) bool {
+	fwc.mu.RLock()
+	defer fwc.mu.RUnlock()
+	return int64(n) > fwc.MaxRequests
+}
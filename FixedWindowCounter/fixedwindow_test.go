@@ -1,6 +1,8 @@
-package main
+package fixedwindowcounter
 
 import (
+	"encoding/json"
+	"math"
 	"sync"
 	"testing"
 	"time"
@@ -69,6 +71,75 @@ func TestAllow(t *testing.T) {
 	}
 }
 
+func TestAllowUpTo(t *testing.T) {
+	// an hour long window won't roll over during the test
+	fwc, _ := NewFixedWindowCounter(time.Hour, 10)
+	fwc.SetLogger(nil)
+
+	if granted := fwc.AllowUpTo(4); granted != 4 {
+		t.Errorf("Expected all 4 to be granted, got %d", granted)
+	}
+	if granted := fwc.AllowUpTo(8); granted != 6 {
+		t.Errorf("Expected the 6 left in the window, got %d", granted)
+	}
+	if granted := fwc.AllowUpTo(1); granted != 0 {
+		t.Errorf("Expected nothing from a full window, got %d", granted)
+	}
+	if granted := fwc.AllowUpTo(0); granted != 0 {
+		t.Errorf("AllowUpTo(0) should grant nothing, got %d", granted)
+	}
+	if allowed, denied := fwc.Totals(); allowed != 10 || denied != 3 {
+		t.Errorf("Expected 10 allowed and 3 denied, got %d and %d", allowed, denied)
+	}
+}
+
+func TestAllowCost(t *testing.T) {
+	fwc, _ := NewFixedWindowCounter(time.Hour, 2)
+	fwc.SetLogger(nil)
+
+	for i := range 3 {
+		if !fwc.AllowCost(0.5) {
+			t.Errorf("Expected cheap request %d to be allowed", i)
+		}
+	}
+	if fwc.AllowCost(0.75) {
+		t.Errorf("Expected 0.75 to exceed the 0.5 left")
+	}
+	if !fwc.AllowCost(0.5) {
+		t.Errorf("Expected the last 0.5 to fit")
+	}
+	if wait := fwc.TimeUntilAllowedCost(0.1); wait <= 0 {
+		t.Errorf("Expected to wait for the next window, got %v", wait)
+	}
+	if fwc.AllowCost(0) || fwc.TimeUntilAllowedCost(2.5) != InfDuration {
+		t.Errorf("Expected 0 to be denied and 2.5 to never fit")
+	}
+	// totals count whole requests, rounded up
+	if allowed, denied := fwc.Totals(); allowed != 4 || denied != 1 {
+		t.Errorf("Expected 4 allowed and 1 denied, got %d and %d", allowed, denied)
+	}
+}
+
+func TestDebit(t *testing.T) {
+	fwc, _ := NewFixedWindowCounter(time.Hour, 2)
+	fwc.SetLogger(nil)
+
+	fwc.Debit(1.5)
+	if !fwc.AllowCost(0.5) || fwc.AllowCost(0.1) {
+		t.Errorf("Expected 0.5 to be left after a debit of 1.5")
+	}
+	// a full window stays full
+	fwc.Debit(5)
+	fwc.Debit(-1)
+	if fwc.RequestCount != 2 {
+		t.Errorf("Expected a count of 2, got %v", fwc.RequestCount)
+	}
+	// debits aren't requests
+	if allowed, denied := fwc.Totals(); allowed != 1 || denied != 1 {
+		t.Errorf("Expected 1 allowed and 1 denied, got %d and %d", allowed, denied)
+	}
+}
+
 func TestConcurrency(t *testing.T) {
 	fwc, err := NewFixedWindowCounter(10*time.Second, 50)
 	if err != nil {
@@ -138,3 +209,126 @@ func TestTimeUntilReset(t *testing.T) {
 		t.Errorf("Wait time should decrease, was %v, now %v", waitTime, newWaitTime)
 	}
 }
+
+func TestExceedsLimit(t *testing.T) {
+	fwc, err := NewFixedWindowCounter(time.Minute, 3)
+	if err != nil {
+		t.Fatalf("NewFixedWindowCounter failed: %v", err)
+	}
+
+	if fwc.Allow(4) {
+		t.Error("Allow(4) with limit 3 should fail")
+	}
+	if delay := fwc.TimeUntilAllowed(4); delay != InfDuration {
+		t.Errorf("Expected infinite delay, got %v", delay)
+	}
+	if delay := fwc.TimeUntilAllowed(3); delay != 0 {
+		t.Errorf("Expected no delay for an empty window, got %v", delay)
+	}
+
+	fwc.Allow(3)
+	if delay := fwc.TimeUntilAllowed(1); delay <= 0 || delay > time.Minute {
+		t.Errorf("Expected delay until window reset, got %v", delay)
+	}
+
+	if ok, delay := fwc.TryCost(4); ok || delay != InfDuration {
+		t.Errorf("Expected TryCost(4) to never fit, got %v and %v", ok, delay)
+	}
+	if ok, delay := fwc.TryCost(1); ok || delay <= 0 || delay > time.Minute {
+		t.Errorf("Expected TryCost(1) to wait for the window reset, got %v and %v", ok, delay)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	fwc, err := NewFixedWindowCounter(time.Hour, 100)
+	if err != nil {
+		t.Fatalf("NewFixedWindowCounter failed: %v", err)
+	}
+	fwc.Allow(60)
+
+	// limit only
+	fwc.Update(0, 80)
+	count, max, _ := fwc.Stats()
+	if count != 60 || max != 80 {
+		t.Errorf("Expected count=60, max=80, got count=%v, max=%d", count, max)
+	}
+
+	// halving the window halves the usage
+	fwc.Update(30*time.Minute, 0)
+	count, max, _ = fwc.Stats()
+	if count != 30 || max != 80 {
+		t.Errorf("Expected count=30, max=80, got count=%v, max=%d", count, max)
+	}
+	if fwc.WindowSize != 30*time.Minute {
+		t.Errorf("Expected window 30m, got %v", fwc.WindowSize)
+	}
+
+	if !fwc.Allow(50) {
+		t.Error("Allow(50) should fit with count 30 and max 80")
+	}
+	if fwc.Allow(1) {
+		t.Error("Allow(1) should fail at the new limit")
+	}
+
+	// rescaling keeps the fraction instead of rounding it up to a whole request
+	exact, _ := NewFixedWindowCounter(time.Hour, 100)
+	exact.Allow(5)
+	exact.Update(10*time.Minute, 0)
+	if count, _, _ := exact.Stats(); count != 0 || math.Abs(exact.Count()-5.0/6) > 1e-9 {
+		t.Errorf("Expected a count of 5/6 in whole requests 0, got %d and %v", count, exact.Count())
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	fwc, _ := NewFixedWindowCounter(time.Hour, 100)
+	fwc.Allow(60)
+	fwc.Allow(50)
+
+	data, err := fwc.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+
+	// restoring overwrites whatever the counter was created with
+	restored, _ := NewFixedWindowCounter(time.Minute, 5)
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %v", err)
+	}
+	count, max, _ := restored.Stats()
+	if count != 60 || max != 100 || restored.GetWindowSize() != time.Hour {
+		t.Errorf("Expected count=60, max=100, window=1h, got count=%v, max=%d, window=%v", count, max, restored.GetWindowSize())
+	}
+	if allowed, denied := restored.Totals(); allowed != 60 || denied != 50 {
+		t.Errorf("Expected allowed=60, denied=50, got allowed=%d, denied=%d", allowed, denied)
+	}
+	if restored.Allow(41) {
+		t.Error("Allow(41) should fail, the restored window only has 40 left")
+	}
+
+	if err := restored.UnmarshalBinary(nil); err == nil {
+		t.Error("UnmarshalBinary of empty data should fail")
+	}
+}
+
+func TestUnmarshalJSON_WindowExpired(t *testing.T) {
+	fwc, _ := NewFixedWindowCounter(time.Second, 10)
+	fwc.Allow(10)
+	// pretend the snapshot was taken two windows ago
+	fwc.CurrentWindow -= 2
+
+	data, err := json.Marshal(fwc)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	var restored FixedWindowCounter
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if count, _, _ := restored.Stats(); count != 0 {
+		t.Errorf("Expected an empty window after it expired during downtime, got %v", count)
+	}
+	if !restored.Allow(10) {
+		t.Error("Allow(10) should succeed in the new window")
+	}
+}
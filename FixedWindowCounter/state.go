@@ -0,0 +1,110 @@
+package fixedwindowcounter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// stateVersion is bumped whenever the layout of counterState changes
+const stateVersion = 2
+
+// counterState is everything a FixedWindowCounter needs to pick up where it left off,
+// the same struct is used for the JSON and the binary encoding
+type counterState struct {
+	Version         uint8   `json:"version"`
+	WindowSize      int64   `json:"window_size"` // nanoseconds
+	MaxRequests     int64   `json:"max_requests"`
+	CurrentWindow   int64   `json:"current_window"` // unix seconds
+	RequestCount    float64 `json:"request_count"`  // fractional costs included
+	RequestsAllowed int64   `json:"requests_allowed"`
+	RequestsDenied  int64   `json:"requests_denied"`
+}
+
+func (fwc *FixedWindowCounter) state() counterState {
+	fwc.mu.RLock()
+	defer fwc.mu.RUnlock()
+	return counterState{
+		Version:         stateVersion,
+		WindowSize:      int64(fwc.WindowSize),
+		MaxRequests:     fwc.MaxRequests,
+		CurrentWindow:   fwc.CurrentWindow,
+		RequestCount:    fwc.count(),
+		RequestsAllowed: fwc.RequestsAllowed,
+		RequestsDenied:  fwc.RequestsDenied,
+	}
+}
+
+// restore replaces the counter with s, a window that ended since s was taken starts empty
+func (fwc *FixedWindowCounter) restore(s counterState) error {
+	if s.Version != stateVersion {
+		return fmt.Errorf("unsupported state version %d", s.Version)
+	}
+	if s.WindowSize <= 0 || s.MaxRequests <= 0 || s.RequestCount < 0 {
+		return errors.New("invalid fixed window state")
+	}
+
+	fwc.mu.Lock()
+	defer fwc.mu.Unlock()
+
+	fwc.WindowSize = time.Duration(s.WindowSize)
+	fwc.MaxRequests = s.MaxRequests
+	fwc.CurrentWindow = s.CurrentWindow
+	fwc.setCount(s.RequestCount)
+	fwc.RequestsAllowed = s.RequestsAllowed
+	fwc.RequestsDenied = s.RequestsDenied
+	if fwc.logger == nil {
+		fwc.logger = log.Default()
+	}
+
+	if windowStart := time.Now().Truncate(fwc.WindowSize).Unix(); windowStart != fwc.CurrentWindow {
+		fwc.CurrentWindow = windowStart
+		fwc.setCount(0)
+	}
+	return nil
+}
+
+func (fwc *FixedWindowCounter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fwc.state())
+}
+
+func (fwc *FixedWindowCounter) UnmarshalJSON(data []byte) error {
+	var s counterState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	// version 1 only had whole counts, JSON reads them the same
+	if s.Version == 1 {
+		s.Version = stateVersion
+	}
+	return fwc.restore(s)
+}
+
+func (fwc *FixedWindowCounter) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, fwc.state()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (fwc *FixedWindowCounter) UnmarshalBinary(data []byte) error {
+	var s counterState
+	if len(data) != binary.Size(s) {
+		return fmt.Errorf("invalid fixed window state: %d bytes", len(data))
+	}
+	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &s); err != nil {
+		return err
+	}
+	// version 1 had the same layout with int64 counts
+	if s.Version == 1 {
+		s.RequestCount = float64(int64(math.Float64bits(s.RequestCount)))
+		s.Version = stateVersion
+	}
+	return fwc.restore(s)
+}
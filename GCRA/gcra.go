@@ -0,0 +1,281 @@
+package gcra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// InfDuration is returned as the wait time for requests that can never be allowed
+const InfDuration = time.Duration(math.MaxInt64)
+
+// Cost is how many tokens a request takes. Fractions like 0.1 for a cheap read push the
+// tat ahead by that share of the emission interval, Allow(n) is AllowCost(Cost(n)).
+type Cost = float64
+
+// ExceedsCapacityError is returned by Wait when n is larger than the burst
+type ExceedsCapacityError struct {
+	Requested int
+	Burst     int
+}
+
+func (e *ExceedsCapacityError) Error() string {
+	return fmt.Sprintf("requested %d but burst is %d", e.Requested, e.Burst)
+}
+
+// GCRA behaves like a token bucket holding burst tokens that refill at rate per second,
+// but its whole state is one timestamp: the theoretical arrival time (tat) of the next request.
+// A request is allowed once tat - burst*emissionInterval is not in the future.
+type GCRA struct {
+	burst            int
+	emissionInterval time.Duration // time for one token to come back, 1/rate
+	tat              time.Time
+	allowed          int
+	rejected         int
+	log              *log.Logger
+	mu               sync.Mutex
+}
+
+func NewGCRA(burst int, rate float64) (*GCRA, error) {
+	if burst <= 0 {
+		return nil, errors.New("burst must be positive")
+	}
+	interval, err := emissionInterval(rate)
+	if err != nil {
+		return nil, err
+	}
+	return &GCRA{
+		burst:            burst,
+		emissionInterval: interval,
+		tat:              time.Now(),
+		log:              log.Default(),
+	}, nil
+}
+
+func emissionInterval(rate float64) (time.Duration, error) {
+	if rate <= 0 || math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return 0, errors.New("rate must be positive")
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+	if interval <= 0 {
+		return 0, errors.New("rate is too high, must be at most one per nanosecond")
+	}
+	return interval, nil
+}
+
+func (g *GCRA) SetLogger(logger *log.Logger) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if logger != nil {
+		g.log = logger
+	}
+}
+
+// tolerance is how far tat may run ahead of now, the burst expressed as time
+func (g *GCRA) tolerance() time.Duration {
+	return time.Duration(g.burst) * g.emissionInterval
+}
+
+// wait is how long cost has to wait at now and the tat it would leave behind
+func (g *GCRA) wait(cost float64, now time.Time) (time.Duration, time.Time) {
+	tat := g.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	newTat := tat.Add(time.Duration(cost * float64(g.emissionInterval)))
+	allowAt := newTat.Add(-g.tolerance())
+	if allowAt.After(now) {
+		return allowAt.Sub(now), newTat
+	}
+	return 0, newTat
+}
+
+func (g *GCRA) Allow(n int) bool {
+	if n <= 0 {
+		return false
+	}
+	return g.AllowCost(Cost(n))
+}
+
+// AllowCost allows a request of cost if the burst has room, a cost that isn't positive is never allowed
+func (g *GCRA) AllowCost(cost Cost) bool {
+	allowed, _ := g.TryCost(cost)
+	return allowed
+}
+
+// TryCost is AllowCost that also says how long to wait when it rejects, decided under
+// one lock. The wait is InfDuration when cost never fits, whatever the caller does.
+func (g *GCRA) TryCost(cost Cost) (bool, time.Duration) {
+	if !(cost > 0) {
+		return false, InfDuration
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if cost > float64(g.burst) {
+		g.rejected++
+		g.log.Printf("Rejected: need %g, burst is %d", cost, g.burst)
+		return false, InfDuration
+	}
+
+	wait, newTat := g.wait(cost, time.Now())
+	if wait > 0 {
+		g.rejected++
+		g.log.Printf("Rejected: need %g, retry in %s", cost, wait)
+		return false, wait
+	}
+
+	g.tat = newTat
+	g.allowed++
+	return true, 0
+}
+
+// Debit moves the TAT for cost after the fact, e.g. for the bytes of a response that
+// already went out. It never fails, a big debit uses up the burst instead of going past it.
+func (g *GCRA) Debit(cost Cost) {
+	if !(cost > 0) {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	tat := g.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	// the TAT is never more than the burst ahead of now
+	newTat := tat.Add(time.Duration(cost * float64(g.emissionInterval)))
+	if limit := now.Add(g.tolerance()); newTat.After(limit) {
+		newTat = limit
+	}
+	if newTat.After(g.tat) {
+		g.tat = newTat
+	}
+}
+
+// TimeUntilAllowed is exact, Allow(n) succeeds once it has passed unless other requests came first
+func (g *GCRA) TimeUntilAllowed(n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	return g.TimeUntilAllowedCost(Cost(n))
+}
+
+// TimeUntilAllowedCost is TimeUntilAllowed for a fractional cost, InfDuration above the burst
+func (g *GCRA) TimeUntilAllowedCost(cost Cost) time.Duration {
+	if !(cost > 0) {
+		return 0
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if cost > float64(g.burst) {
+		return InfDuration
+	}
+	wait, _ := g.wait(cost, time.Now())
+	return wait
+}
+
+// Wait blocks until n is allowed or ctx is done
+func (g *GCRA) Wait(ctx context.Context, n int) error {
+	if n <= 0 {
+		return errors.New("n must be positive")
+	}
+
+	for {
+		if g.Allow(n) {
+			return nil
+		}
+		delay := g.TimeUntilAllowed(n)
+		// checked on every pass since Update can shrink the burst while we wait
+		if delay == InfDuration {
+			return &ExceedsCapacityError{Requested: n, Burst: g.Burst()}
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Update changes burst and rate at runtime, non-positive values are left unchanged.
+// Like TokenBucket.Update the available tokens are kept, capped at the new burst.
+func (g *GCRA) Update(newBurst int, newRate float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	available := g.available(now)
+
+	if newBurst > 0 {
+		g.burst = newBurst
+	}
+	if interval, err := emissionInterval(newRate); err == nil {
+		g.emissionInterval = interval
+	}
+
+	available = min(available, float64(g.burst))
+	used := float64(g.burst) - available
+	g.tat = now.Add(time.Duration(used * float64(g.emissionInterval)))
+}
+
+// available is the number of tokens a token bucket would hold at now
+func (g *GCRA) available(now time.Time) float64 {
+	ahead := g.tat.Sub(now)
+	if ahead <= 0 {
+		return float64(g.burst)
+	}
+	return max(0, float64(g.tolerance()-ahead)/float64(g.emissionInterval))
+}
+
+// ExceedsCapacity reports whether n can never be allowed, no matter how long the caller waits
+func (g *GCRA) ExceedsCapacity(n int) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return n > g.burst
+}
+
+func (g *GCRA) Stats() (allowed, rejected int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.allowed, g.rejected
+}
+
+func (g *GCRA) ResetStats() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.allowed = 0
+	g.rejected = 0
+}
+
+func (g *GCRA) Burst() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.burst
+}
+
+// Rate is the number of tokens that come back per second
+func (g *GCRA) Rate() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return float64(time.Second) / float64(g.emissionInterval)
+}
+
+// AvailableTokens is how many requests of 1 would be allowed right now
+func (g *GCRA) AvailableTokens() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.available(time.Now())
+}
@@ -0,0 +1,239 @@
+package gcra
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+func newQuietGCRA(t *testing.T, burst int, rate float64) *GCRA {
+	t.Helper()
+	g, err := NewGCRA(burst, rate)
+	if err != nil {
+		t.Fatalf("NewGCRA failed: %v", err)
+	}
+	g.SetLogger(log.New(io.Discard, "", 0))
+	return g
+}
+
+func TestNewGCRA(t *testing.T) {
+	if _, err := NewGCRA(0, 1); err == nil {
+		t.Errorf("burst 0 should fail")
+	}
+	if _, err := NewGCRA(1, 0); err == nil {
+		t.Errorf("rate 0 should fail")
+	}
+	if _, err := NewGCRA(1, 2e9); err == nil {
+		t.Errorf("rate above one per nanosecond should fail")
+	}
+}
+
+func TestAllow(t *testing.T) {
+	g := newQuietGCRA(t, 5, 10)
+
+	for i := 0; i < 5; i++ {
+		if !g.Allow(1) {
+			t.Errorf("Allow(1) at %d should succeed within the burst", i)
+		}
+	}
+	if g.Allow(1) {
+		t.Errorf("Allow(1) after the burst should fail")
+	}
+
+	// one token comes back every 100ms
+	time.Sleep(210 * time.Millisecond)
+	if !g.Allow(2) {
+		t.Errorf("Allow(2) should succeed after 200ms")
+	}
+	if g.Allow(1) {
+		t.Errorf("Allow(1) should fail after using the refilled tokens")
+	}
+
+	if g.Allow(0) || g.Allow(-1) {
+		t.Errorf("Allow with non-positive n should fail")
+	}
+}
+
+func TestAllowCost(t *testing.T) {
+	g := newQuietGCRA(t, 2, 10)
+
+	// 1.5 and 0.5 use up the burst of 2
+	if !g.AllowCost(1.5) || !g.AllowCost(0.5) {
+		t.Errorf("Expected 1.5 and 0.5 to fit in the burst")
+	}
+	if g.AllowCost(0.5) {
+		t.Errorf("Expected the burst to be used up")
+	}
+	// half a token comes back after 50ms
+	if wait := g.TimeUntilAllowedCost(0.5); wait < 40*time.Millisecond || wait > 50*time.Millisecond {
+		t.Errorf("Expected to wait about 50ms, got %v", wait)
+	}
+	if g.AllowCost(0) || g.TimeUntilAllowedCost(2.5) != InfDuration {
+		t.Errorf("Expected 0 to be rejected and 2.5 to never fit")
+	}
+}
+
+func TestDebit(t *testing.T) {
+	g := newQuietGCRA(t, 2, 10)
+
+	g.Debit(1.5)
+	if !g.AllowCost(0.5) || g.AllowCost(0.1) {
+		t.Errorf("Expected 0.5 to be left after a debit of 1.5")
+	}
+	// a debit past the burst only uses it up, one token is back after 100ms
+	g.Debit(10)
+	if wait := g.TimeUntilAllowed(1); wait < 90*time.Millisecond || wait > 100*time.Millisecond {
+		t.Errorf("Expected to wait about 100ms, got %v", wait)
+	}
+}
+
+func TestTimeUntilAllowed(t *testing.T) {
+	g := newQuietGCRA(t, 2, 10)
+
+	if delay := g.TimeUntilAllowed(2); delay != 0 {
+		t.Errorf("Expected no delay for a full burst, got %v", delay)
+	}
+	g.Allow(2)
+
+	delay := g.TimeUntilAllowed(1)
+	if delay <= 90*time.Millisecond || delay > 100*time.Millisecond {
+		t.Errorf("Expected just under 100ms for one token, got %v", delay)
+	}
+	if delay2 := g.TimeUntilAllowed(2); delay2 <= delay+90*time.Millisecond {
+		t.Errorf("Expected about 200ms for two tokens, got %v", delay2)
+	}
+
+	// the retry after is exact, not an estimate
+	time.Sleep(delay)
+	if !g.Allow(1) {
+		t.Errorf("Allow(1) should succeed right after TimeUntilAllowed")
+	}
+}
+
+func TestExceedsCapacity(t *testing.T) {
+	g := newQuietGCRA(t, 3, 1)
+
+	if g.Allow(4) {
+		t.Errorf("Allow(4) with burst 3 should fail")
+	}
+	if !g.ExceedsCapacity(4) || g.ExceedsCapacity(3) {
+		t.Errorf("Only requests above the burst exceed capacity")
+	}
+	if delay := g.TimeUntilAllowed(4); delay != InfDuration {
+		t.Errorf("Expected infinite delay, got %v", delay)
+	}
+
+	var capErr *ExceedsCapacityError
+	if err := g.Wait(context.Background(), 4); !errors.As(err, &capErr) || capErr.Burst != 3 {
+		t.Errorf("Expected ExceedsCapacityError with burst 3, got %v", err)
+	}
+}
+
+func TestWait(t *testing.T) {
+	g := newQuietGCRA(t, 1, 10)
+	g.Allow(1)
+
+	start := time.Now()
+	if err := g.Wait(context.Background(), 1); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("Expected to wait about 100ms, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := g.Wait(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	g := newQuietGCRA(t, 10, 1)
+	g.Allow(6)
+
+	// growing keeps the available tokens
+	g.Update(20, -1)
+	if g.Burst() != 20 || g.Rate() != 1 {
+		t.Errorf("Expected burst 20 and rate 1, got %d and %f", g.Burst(), g.Rate())
+	}
+	if tokens := g.AvailableTokens(); tokens < 3.9 || tokens > 4.1 {
+		t.Errorf("Expected about 4 tokens after growing, got %.2f", tokens)
+	}
+
+	// shrinking caps them
+	g.Update(2, 5)
+	if tokens := g.AvailableTokens(); tokens < 1.9 || tokens > 2 {
+		t.Errorf("Expected 2 tokens after shrinking, got %.2f", tokens)
+	}
+	if g.Rate() != 5 {
+		t.Errorf("Expected rate 5, got %f", g.Rate())
+	}
+}
+
+func TestStats(t *testing.T) {
+	g := newQuietGCRA(t, 2, 1)
+	g.Allow(2)
+	g.Allow(1)
+	g.Allow(3)
+
+	allowed, rejected := g.Stats()
+	if allowed != 1 || rejected != 2 {
+		t.Errorf("Expected 1 allowed and 2 rejected, got %d and %d", allowed, rejected)
+	}
+
+	g.ResetStats()
+	if allowed, rejected = g.Stats(); allowed != 0 || rejected != 0 {
+		t.Errorf("After reset: got %d,%d", allowed, rejected)
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	g := newQuietGCRA(t, 5, 1)
+	g.Allow(5)
+
+	data, err := g.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+
+	// restoring overwrites whatever the limiter was created with
+	restored := newQuietGCRA(t, 100, 50)
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %v", err)
+	}
+	if restored.Burst() != 5 || restored.Rate() != 1 {
+		t.Errorf("Expected burst 5 and rate 1, got %d and %f", restored.Burst(), restored.Rate())
+	}
+	if restored.Allow(1) {
+		t.Errorf("Allow(1) on a restored empty limiter should fail")
+	}
+
+	if err := restored.UnmarshalBinary(data[:4]); err == nil {
+		t.Errorf("UnmarshalBinary of truncated data should fail")
+	}
+}
+
+func TestUnmarshalJSON_Refills(t *testing.T) {
+	g := newQuietGCRA(t, 10, 1)
+	g.Allow(10)
+	// pretend the snapshot was taken 5 seconds ago
+	g.tat = g.tat.Add(-5 * time.Second)
+
+	data, err := json.Marshal(g)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	var restored GCRA
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if tokens := restored.AvailableTokens(); tokens < 4.9 || tokens > 5.1 {
+		t.Errorf("Expected about 5 tokens after 5s of downtime, got %.2f", tokens)
+	}
+}
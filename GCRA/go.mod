@@ -0,0 +1,3 @@
+module gcra
+
+go 1.24.4
@@ -0,0 +1,97 @@
+package gcra
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// stateVersion is bumped whenever the layout of gcraState changes
+const stateVersion = 1
+
+// gcraState is everything a GCRA needs to pick up where it left off,
+// the same struct is used for the JSON and the binary encoding
+type gcraState struct {
+	Version          uint8 `json:"version"`
+	Burst            int64 `json:"burst"`
+	EmissionInterval int64 `json:"emission_interval"` // nanoseconds
+	TAT              int64 `json:"tat"`               // unix nanoseconds
+	Allowed          int64 `json:"allowed"`
+	Rejected         int64 `json:"rejected"`
+}
+
+func (g *GCRA) state() gcraState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return gcraState{
+		Version:          stateVersion,
+		Burst:            int64(g.burst),
+		EmissionInterval: int64(g.emissionInterval),
+		TAT:              g.tat.UnixNano(),
+		Allowed:          int64(g.allowed),
+		Rejected:         int64(g.rejected),
+	}
+}
+
+// restore replaces the limiter with s. The tat is absolute so the downtime
+// counts as refill on its own, nothing needs to be advanced.
+func (g *GCRA) restore(s gcraState) error {
+	if s.Version != stateVersion {
+		return fmt.Errorf("unsupported state version %d", s.Version)
+	}
+	if s.Burst <= 0 || s.EmissionInterval <= 0 {
+		return errors.New("invalid gcra state")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.burst = int(s.Burst)
+	g.emissionInterval = time.Duration(s.EmissionInterval)
+	g.tat = time.Unix(0, s.TAT)
+	g.allowed = int(s.Allowed)
+	g.rejected = int(s.Rejected)
+	// a clock that went backwards can't leave us more than fully used
+	if limit := time.Now().Add(g.tolerance()); g.tat.After(limit) {
+		g.tat = limit
+	}
+	if g.log == nil {
+		g.log = log.Default()
+	}
+	return nil
+}
+
+func (g *GCRA) MarshalJSON() ([]byte, error) {
+	return json.Marshal(g.state())
+}
+
+func (g *GCRA) UnmarshalJSON(data []byte) error {
+	var s gcraState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return g.restore(s)
+}
+
+func (g *GCRA) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, g.state()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (g *GCRA) UnmarshalBinary(data []byte) error {
+	var s gcraState
+	if len(data) != binary.Size(s) {
+		return fmt.Errorf("invalid gcra state: %d bytes", len(data))
+	}
+	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &s); err != nil {
+		return err
+	}
+	return g.restore(s)
+}
@@ -1,13 +1,32 @@
-package main
+package leakybucket
 
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
+	"math"
 	"sync"
 	"time"
 )
 
+// InfDuration is returned as the wait time for requests that can never fit in the bucket
+const InfDuration = time.Duration(math.MaxInt64)
+
+// Cost is how much of the bucket a request fills. Fractions like 0.1 for a cheap read
+// are queued exactly, Allow(n) is AllowCost(Cost(n)).
+type Cost = float64
+
+// ExceedsCapacityError is returned by Take when n is larger than the bucket can ever hold
+type ExceedsCapacityError struct {
+	Requested int
+	Capacity  int64
+}
+
+func (e *ExceedsCapacityError) Error() string {
+	return fmt.Sprintf("requested %d but bucket capacity is %d", e.Requested, e.Capacity)
+}
+
 type LeakyBucket struct {
 	capacity          int64
 	leakRate          float64
@@ -89,26 +108,88 @@ func (lb *LeakyBucket) Allow(n int) bool {
 	if n <= 0 {
 		return false
 	}
+	return lb.AllowCost(Cost(n))
+}
+
+// AllowCost queues a request of cost if it fits, a cost that isn't positive is never allowed.
+// The dropped count adds a fractional cost rounded up to whole requests.
+func (lb *LeakyBucket) AllowCost(cost Cost) bool {
+	allowed, _ := lb.TryCost(cost)
+	return allowed
+}
+
+// TryCost is AllowCost that also says how long to wait when it drops, decided under
+// one lock. The wait is InfDuration when cost never fits, whatever the caller does.
+func (lb *LeakyBucket) TryCost(cost Cost) (bool, time.Duration) {
+	if !(cost > 0) {
+		return false, InfDuration
+	}
 
 	lb.mutex.Lock()
 	defer lb.mutex.Unlock()
 
 	lb.leak()
 
-	if lb.queue+float64(n) > float64(lb.capacity) {
-		lb.requestsDropped += int64(n)
+	if cost > float64(lb.capacity) {
+		lb.requestsDropped += int64(math.Ceil(cost))
 		if lb.logger != nil {
-			lb.logger.Printf("dropped %d requests, queue full -> %.2f/%d", n, lb.queue, lb.capacity)
+			lb.logger.Printf("dropped %g requests, more than capacity %d", cost, lb.capacity)
 		}
-		return false
+		return false, InfDuration
 	}
 
-	lb.queue += float64(n)
+	if lb.queue+cost > float64(lb.capacity) {
+		lb.requestsDropped += int64(math.Ceil(cost))
+		if lb.logger != nil {
+			lb.logger.Printf("dropped %g requests, queue full -> %.2f/%d", cost, lb.queue, lb.capacity)
+		}
+		return false, lb.timeUntilSpace(cost)
+	}
+
+	lb.queue += cost
 	if lb.logger != nil {
-		lb.logger.Printf("queued %d requests, queue size -> %.2f/%d", n, lb.queue, lb.capacity)
+		lb.logger.Printf("queued %g requests, queue size -> %.2f/%d", cost, lb.queue, lb.capacity)
 	}
-	return true
+	return true, 0
+}
 
+// Debit adds cost to the queue after the fact, e.g. for the bytes of a response that
+// already went out. It never fails, a big debit fills the bucket instead of overflowing it.
+func (lb *LeakyBucket) Debit(cost Cost) {
+	if !(cost > 0) {
+		return
+	}
+
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	lb.leak()
+	lb.queue = max(lb.queue, min(lb.queue+cost, float64(lb.capacity)))
+}
+
+// Update changes capacity and leak rate (per second) at runtime, non-positive values are left unchanged.
+// Requests already queued above a smaller capacity are dropped.
+func (lb *LeakyBucket) Update(newCapacity int64, newLeakRate float64) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	// settle what leaked at the old rate first
+	lb.leak()
+
+	if newCapacity > 0 {
+		lb.capacity = newCapacity
+		if lb.queue > float64(newCapacity) {
+			overflow := lb.queue - float64(newCapacity)
+			lb.requestsDropped += int64(overflow)
+			lb.queue = float64(newCapacity)
+			if lb.logger != nil {
+				lb.logger.Printf("dropped %.2f queued requests after shrinking capacity to %d", overflow, newCapacity)
+			}
+		}
+	}
+	if newLeakRate > 0 {
+		lb.leakRate = newLeakRate
+	}
 }
 
 func (lb *LeakyBucket) Take(ctx context.Context, n int) error {
@@ -121,8 +202,14 @@ func (lb *LeakyBucket) Take(ctx context.Context, n int) error {
 		}
 		lb.mutex.RLock()
 		waitTime := lb.TimeUntilSpace(n)
+		capacity := lb.capacity
 		lb.mutex.RUnlock()
 
+		// would loop forever otherwise
+		if waitTime == InfDuration {
+			return &ExceedsCapacityError{Requested: n, Capacity: capacity}
+		}
+
 		if waitTime <= 0 {
 			continue
 		}
@@ -141,13 +228,22 @@ func (lb *LeakyBucket) Take(ctx context.Context, n int) error {
 }
 
 func (lb *LeakyBucket) TimeUntilSpace(n int) time.Duration {
+	return lb.timeUntilSpace(float64(n))
+}
+
+// timeUntilSpace is TimeUntilSpace for a fractional cost, lb.mutex must be held
+func (lb *LeakyBucket) timeUntilSpace(cost float64) time.Duration {
+	if cost > float64(lb.capacity) {
+		return InfDuration
+	}
+
 	currentQueue := lb.getCurrentQueue()
 
-	if currentQueue+float64(n) <= float64(lb.capacity) {
+	if currentQueue+cost <= float64(lb.capacity) {
 		return 0
 	}
 
-	spaceNeeded := currentQueue + float64(n) - float64(lb.capacity)
+	spaceNeeded := currentQueue + cost - float64(lb.capacity)
 	secondsNeeded := spaceNeeded / lb.leakRate
 
 	return time.Duration(secondsNeeded * float64(time.Second))
@@ -157,11 +253,26 @@ func (lb *LeakyBucket) TimeUntilAllowed(n int) time.Duration {
 	if n <= 0 {
 		return 0
 	}
+	return lb.TimeUntilAllowedCost(Cost(n))
+}
+
+// TimeUntilAllowedCost is how long until the queue has room for cost, InfDuration if it never fits
+func (lb *LeakyBucket) TimeUntilAllowedCost(cost Cost) time.Duration {
+	if !(cost > 0) {
+		return 0
+	}
 
 	lb.mutex.RLock()
 	defer lb.mutex.RUnlock()
 
-	return lb.TimeUntilSpace(n)
+	return lb.timeUntilSpace(cost)
+}
+
+// ExceedsCapacity reports whether n can never be allowed, no matter how long the caller waits
+func (lb *LeakyBucket) ExceedsCapacity(n int) bool {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+	return int64(n) > lb.capacity
 }
 
 func (lb *LeakyBucket) QueueSize() float64 {
@@ -171,10 +282,14 @@ func (lb *LeakyBucket) QueueSize() float64 {
 }
 
 func (lb *LeakyBucket) Capacity() int64 {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
 	return lb.capacity
 }
 
 func (lb *LeakyBucket) LeakRate() float64 {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
 	return lb.leakRate
 }
 
@@ -1,7 +1,9 @@
-package main
+package leakybucket
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"sync"
 	"testing"
 	"time"
@@ -32,6 +34,43 @@ func TestAllow(t *testing.T) {
 	}
 }
 
+func TestAllowCost(t *testing.T) {
+	lb, _ := NewLeakyBucket(2, 1.0, PerSecond)
+	lb.SetLogger(nil)
+
+	if !lb.AllowCost(1.5) || !lb.AllowCost(0.5) {
+		t.Errorf("Expected 1.5 and 0.5 to fill the bucket")
+	}
+	if lb.AllowCost(0.25) {
+		t.Errorf("Expected a full bucket to drop 0.25")
+	}
+	if wait := lb.TimeUntilAllowedCost(0.25); wait < 200*time.Millisecond || wait > 250*time.Millisecond {
+		t.Errorf("Expected to wait about 250ms, got %v", wait)
+	}
+	if lb.AllowCost(0) || lb.AllowCost(2.5) {
+		t.Errorf("Expected 0 and a cost above the capacity to be dropped")
+	}
+	// the dropped 0.25 and 2.5 count as whole requests
+	if _, dropped, _ := lb.Stats(); dropped != 4 {
+		t.Errorf("Expected 4 dropped, got %d", dropped)
+	}
+}
+
+func TestDebit(t *testing.T) {
+	lb, _ := NewLeakyBucket(2, 1.0, PerSecond)
+	lb.SetLogger(nil)
+
+	lb.Debit(1.5)
+	if !lb.AllowCost(0.5) || lb.AllowCost(0.1) {
+		t.Errorf("Expected 0.5 to be left after a debit of 1.5")
+	}
+	// a full bucket stays full, one request leaks after a second
+	lb.Debit(5)
+	if wait := lb.TimeUntilAllowed(1); wait < 900*time.Millisecond || wait > time.Second {
+		t.Errorf("Expected to wait about 1s, got %v", wait)
+	}
+}
+
 // blocks and waits until space is available
 func TestTake(t *testing.T) {
 	lb, err := NewLeakyBucket(3, 2.0, PerSecond)
@@ -80,6 +119,28 @@ func TestTake_ContextCancelled(t *testing.T) {
 	}
 }
 
+func TestTake_ExceedsCapacity(t *testing.T) {
+	lb, err := NewLeakyBucket(3, 1.0, PerSecond)
+	if err != nil {
+		t.Fatalf("NewLeakyBucket failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	err = lb.Take(ctx, 4)
+	var capErr *ExceedsCapacityError
+	if !errors.As(err, &capErr) {
+		t.Fatalf("Should return ExceedsCapacityError but returned: %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Error("Take should give up before the context expires")
+	}
+	if delay := lb.TimeUntilAllowed(4); delay != InfDuration {
+		t.Errorf("Expected infinite delay, got %v", delay)
+	}
+}
+
 func TestStats(t *testing.T) {
 	lb, err := NewLeakyBucket(3, 1.0, PerSecond)
 	if err != nil {
@@ -113,6 +174,96 @@ func TestStats(t *testing.T) {
 	}
 }
 
+func TestUpdate(t *testing.T) {
+	lb, err := NewLeakyBucket(5, 1.0, PerSecond)
+	if err != nil {
+		t.Fatalf("NewLeakyBucket failed: %v", err)
+	}
+	lb.Allow(5)
+
+	// shrinking drops what no longer fits
+	lb.Update(3, -1)
+	if lb.Capacity() != 3 {
+		t.Errorf("Expected capacity 3, got %d", lb.Capacity())
+	}
+	if lb.LeakRate() != 1.0 {
+		t.Errorf("Leak rate should stay 1, got %.2f", lb.LeakRate())
+	}
+	if queue := lb.QueueSize(); queue > 3 {
+		t.Errorf("Queue should be trimmed to 3, got %.2f", queue)
+	}
+	_, dropped, _ := lb.Stats()
+	if dropped < 1 {
+		t.Errorf("Expected trimmed requests to be counted as dropped, got %d", dropped)
+	}
+
+	lb.Update(0, 4.0)
+	if lb.Capacity() != 3 || lb.LeakRate() != 4.0 {
+		t.Errorf("Expected capacity 3 and leak rate 4, got %d and %.2f", lb.Capacity(), lb.LeakRate())
+	}
+
+	lb.Update(10, 2.0)
+	if !lb.Allow(7) {
+		t.Error("Allow(7) should fit after growing capacity to 10")
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	lb, err := NewLeakyBucket(5, 1.0, PerSecond)
+	if err != nil {
+		t.Fatalf("NewLeakyBucket failed: %v", err)
+	}
+	lb.Allow(5)
+	lb.Allow(1)
+
+	data, err := lb.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+
+	// restoring overwrites whatever the bucket was created with
+	restored, _ := NewLeakyBucket(100, 50, PerSecond)
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %v", err)
+	}
+	if restored.Capacity() != 5 || restored.LeakRate() != 1.0 {
+		t.Errorf("Expected capacity 5 and leak rate 1, got %d and %.2f", restored.Capacity(), restored.LeakRate())
+	}
+	if queue := restored.QueueSize(); queue < 4.9 {
+		t.Errorf("Restored bucket should still be full, got queue %.2f", queue)
+	}
+	if _, dropped, _ := restored.Stats(); dropped != 1 {
+		t.Errorf("Expected 1 dropped after restore, got %d", dropped)
+	}
+
+	if err := restored.UnmarshalBinary([]byte{1, 2, 3}); err == nil {
+		t.Errorf("UnmarshalBinary of garbage should fail")
+	}
+}
+
+func TestUnmarshalJSON_Leaks(t *testing.T) {
+	lb, _ := NewLeakyBucket(5, 1.0, PerSecond)
+	lb.Allow(5)
+	// pretend the snapshot was taken 3 seconds ago
+	lb.lastLeakTime = time.Now().Add(-3 * time.Second)
+
+	data, err := json.Marshal(lb)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	var restored LeakyBucket
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if queue := restored.QueueSize(); queue < 1.9 || queue > 2.1 {
+		t.Errorf("Expected queue of about 2 after 3s of downtime, got %.2f", queue)
+	}
+	if processed, _, _ := restored.Stats(); processed != 3 {
+		t.Errorf("Expected 3 requests leaked during downtime, got %d", processed)
+	}
+}
+
 // tests for bucket is safe under concurrent access (Concurrency Test)
 func TestConcurrency(t *testing.T) {
 	lb, err := NewLeakyBucket(100, 10.0, PerSecond)
@@ -0,0 +1,100 @@
+package leakybucket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// stateVersion is bumped whenever the layout of bucketState changes
+const stateVersion = 1
+
+// bucketState is everything a LeakyBucket needs to pick up where it left off,
+// the same struct is used for the JSON and the binary encoding
+type bucketState struct {
+	Version      uint8   `json:"version"`
+	Capacity     int64   `json:"capacity"`
+	LeakRate     float64 `json:"leak_rate"` // per second
+	Queue        float64 `json:"queue"`
+	LastLeakTime int64   `json:"last_leak_time"` // unix nanoseconds
+	Processed    int64   `json:"requests_processed"`
+	Dropped      int64   `json:"requests_dropped"`
+}
+
+func (lb *LeakyBucket) state() bucketState {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+	return bucketState{
+		Version:      stateVersion,
+		Capacity:     lb.capacity,
+		LeakRate:     lb.leakRate,
+		Queue:        lb.queue,
+		LastLeakTime: lb.lastLeakTime.UnixNano(),
+		Processed:    lb.requestsProcessed,
+		Dropped:      lb.requestsDropped,
+	}
+}
+
+// restore replaces the bucket with s and leaks it for the time that passed since s was taken
+func (lb *LeakyBucket) restore(s bucketState) error {
+	if s.Version != stateVersion {
+		return fmt.Errorf("unsupported state version %d", s.Version)
+	}
+	if s.Capacity <= 0 || s.LeakRate <= 0 || s.Queue < 0 {
+		return errors.New("invalid leaky bucket state")
+	}
+
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	lb.capacity = s.Capacity
+	lb.leakRate = s.LeakRate
+	lb.queue = min(s.Queue, float64(s.Capacity))
+	lb.requestsProcessed = s.Processed
+	lb.requestsDropped = s.Dropped
+	lb.lastLeakTime = time.Unix(0, s.LastLeakTime)
+	if now := time.Now(); lb.lastLeakTime.After(now) {
+		lb.lastLeakTime = now
+	}
+	if lb.logger == nil {
+		lb.logger = log.Default()
+	}
+
+	lb.leak()
+	return nil
+}
+
+func (lb *LeakyBucket) MarshalJSON() ([]byte, error) {
+	return json.Marshal(lb.state())
+}
+
+func (lb *LeakyBucket) UnmarshalJSON(data []byte) error {
+	var s bucketState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return lb.restore(s)
+}
+
+func (lb *LeakyBucket) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, lb.state()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (lb *LeakyBucket) UnmarshalBinary(data []byte) error {
+	var s bucketState
+	if len(data) != binary.Size(s) {
+		return fmt.Errorf("invalid leaky bucket state: %d bytes", len(data))
+	}
+	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &s); err != nil {
+		return err
+	}
+	return lb.restore(s)
+}
@@ -1,18 +1,26 @@
-package main
+package slidingwindowcounter
 
 import (
 	"errors"
 	"log"
+	"math"
 	"sync"
 	"time"
 )
 
+// InfDuration is returned as the wait time for requests that can never fit in the window
+const InfDuration = time.Duration(math.MaxInt64)
+
+// Cost is how many requests a request counts as. Fractions like 0.1 for a cheap read are
+// counted exactly, Allow(n) is AllowCost(Cost(n)).
+type Cost = float64
+
 type SlidingWindow struct {
 	windowSize            time.Duration
 	maxRequests           int64
 	currentWindow         int64
-	lastWindowRequests    int64
-	currentWindowRequests int64
+	lastWindowRequests    float64 // sums of the costs allowed in each window
+	currentWindowRequests float64
 	RequestCount          int64
 	PrevCount             int64
 	Log                   *log.Logger
@@ -50,24 +58,44 @@ func (sw *SlidingWindow) Allow(n int) bool {
 	if n <= 0 {
 		return false
 	}
+	return sw.AllowCost(Cost(n))
+}
+
+// AllowCost counts a request of cost if the sliding count has room for it, a cost that isn't
+// positive is never allowed. Allowed and denied totals add it rounded up to whole requests.
+func (sw *SlidingWindow) AllowCost(cost Cost) bool {
+	allowed, _ := sw.TryCost(cost)
+	return allowed
+}
+
+// TryCost is AllowCost that also says how long to wait when it rejects, decided under
+// one lock. The wait is InfDuration when cost never fits, whatever the caller does.
+func (sw *SlidingWindow) TryCost(cost Cost) (bool, time.Duration) {
+	if !(cost > 0) {
+		return false, InfDuration
+	}
 
 	sw.mu.Lock()
 	defer sw.mu.Unlock()
 
-	now := time.Now()
-	currentWindowStart := now.Truncate(sw.windowSize)
-	currentWindowNano := currentWindowStart.UnixNano()
+	units := int64(math.Ceil(cost))
+	if cost > float64(sw.maxRequests) {
+		sw.requestsDenied += units
+		if sw.logger != nil {
+			sw.logger.Printf("denied %g requests: more than the window limit %d", cost, sw.maxRequests)
+		}
+		return false, InfDuration
+	}
 
-	if currentWindowNano != sw.currentWindow {
-		sw.lastWindowRequests = sw.currentWindowRequests
-		sw.currentWindowRequests = 0
-		sw.currentWindow = currentWindowNano
+	now := time.Now()
+	if currentWindowNano := now.Truncate(sw.windowSize).UnixNano(); currentWindowNano != sw.currentWindow {
+		sw.shift(now)
 
 		if sw.logger != nil {
-			sw.logger.Printf("window shifeted: last window requests= %d, new window = %s", sw.lastWindowRequests, time.Unix(currentWindowNano, 0).Format("15:04:05")) // for "23:59:59" style
+			sw.logger.Printf("window shifeted: last window requests= %g, new window = %s", sw.lastWindowRequests, time.Unix(0, currentWindowNano).Format("15:04:05")) // for "23:59:59" style
 		}
 	}
-	windowStart := time.Unix(0, currentWindowNano).UTC()
+	windowStart := time.Unix(0, sw.currentWindow).UTC()
 	windowElapsed := now.Sub(windowStart)
 	if windowElapsed < 0 {
 		windowElapsed = 0
@@ -77,24 +105,44 @@ func (sw *SlidingWindow) Allow(n int) bool {
 		doneRatio = 1.0
 	}
 
-	carryOver := float64(sw.lastWindowRequests)
-	sliding := float64(sw.currentWindowRequests) + (1.0-doneRatio)*carryOver // sliding window formula
+	carryOver := sw.lastWindowRequests
+	sliding := sw.currentWindowRequests + (1.0-doneRatio)*carryOver // sliding window formula
 
-	if sliding+float64(n) <= float64(sw.maxRequests) {
-		sw.currentWindowRequests += int64(n)
-		sw.requestsAllowed += int64(n)
+	if sliding+cost <= float64(sw.maxRequests) {
+		sw.currentWindowRequests += cost
+		sw.requestsAllowed += units
 
 		if sw.logger != nil {
-			sw.logger.Printf("allowed %d requests: sliding count = %.2f, current = %d, last = %d, done = %.2f", n, sliding, sw.currentWindowRequests, sw.lastWindowRequests, doneRatio)
+			sw.logger.Printf("allowed %g requests: sliding count = %.2f, current = %g, last = %g, done = %.2f", cost, sliding, sw.currentWindowRequests, sw.lastWindowRequests, doneRatio)
 		}
-		return true
+		return true, 0
 	}
 
-	sw.requestsDenied += int64(n)
+	sw.requestsDenied += units
 	if sw.logger != nil {
-		sw.logger.Printf("denied %d requests: sliding count = %.2f (exceed limit = %d)", n, sliding+float64(n), sw.maxRequests)
+		sw.logger.Printf("denied %g requests: sliding count = %.2f (exceed limit = %d)", cost, sliding+cost, sw.maxRequests)
+	}
+	return false, sw.timeUntilAllowed(cost)
+}
+
+// Debit counts cost against the current window after the fact, e.g. for the bytes of a
+// response that already went out. It never fails, a big debit fills the sliding count instead of going over.
+func (sw *SlidingWindow) Debit(cost Cost) {
+	if !(cost > 0) {
+		return
+	}
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	now := time.Now()
+	sw.shift(now)
+	doneRatio := float64(now.Sub(time.Unix(0, sw.currentWindow))) / float64(sw.windowSize)
+	sliding := sw.currentWindowRequests + (1.0-doneRatio)*sw.lastWindowRequests
+	room := float64(sw.maxRequests) - sliding
+	if room > 0 {
+		sw.currentWindowRequests += min(cost, room)
 	}
-	return false
 }
 
 func (sw *SlidingWindow) Stats() (currentCount float64, maxRequests int64, windowStart time.Time) {
@@ -111,7 +159,7 @@ func (sw *SlidingWindow) Stats() (currentCount float64, maxRequests int64, windo
 		doneRatio = 1.0
 	}
 
-	sliding := float64(sw.currentWindowRequests) + (1.0-doneRatio)*float64(sw.lastWindowRequests)
+	sliding := sw.currentWindowRequests + (1.0-doneRatio)*sw.lastWindowRequests
 
 	return sliding, sw.maxRequests, windowStart
 }
@@ -134,6 +182,52 @@ func (sw *SlidingWindow) Reset() {
 	}
 }
 
+// Update changes window size and limit at runtime, non-positive values are left unchanged.
+// Both window counts are rescaled to the new window size so the sliding count carries over.
+func (sw *SlidingWindow) Update(newWindowSize time.Duration, newMaxRequests int64) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if newWindowSize > 0 && newWindowSize != sw.windowSize {
+		now := time.Now()
+		// move the counts forward first if windows shifted since the last request
+		sw.shift(now)
+
+		ratio := float64(newWindowSize) / float64(sw.windowSize)
+		sw.lastWindowRequests = math.Ceil(sw.lastWindowRequests * ratio)
+		sw.currentWindowRequests = math.Ceil(sw.currentWindowRequests * ratio)
+		sw.windowSize = newWindowSize
+		sw.currentWindow = now.Truncate(newWindowSize).UnixNano()
+	}
+	if newMaxRequests > 0 {
+		sw.maxRequests = newMaxRequests
+	}
+
+	if sw.logger != nil {
+		sw.logger.Printf("updated window to %s with limit %d: current = %g, last = %g", sw.windowSize, sw.maxRequests, sw.currentWindowRequests, sw.lastWindowRequests)
+	}
+}
+
+// shift moves the counts forward for the windows that passed since the last request
+func (sw *SlidingWindow) shift(now time.Time) {
+	windowStart := time.Unix(0, sw.currentWindow).UTC()
+	switch elapsed := now.Sub(windowStart); {
+	case elapsed >= 2*sw.windowSize:
+		sw.lastWindowRequests = 0
+		sw.currentWindowRequests = 0
+	case elapsed >= sw.windowSize:
+		sw.lastWindowRequests = sw.currentWindowRequests
+		sw.currentWindowRequests = 0
+	}
+	sw.currentWindow = now.Truncate(sw.windowSize).UnixNano()
+}
+
+func (sw *SlidingWindow) GetWindowSize() time.Duration {
+	sw.mu.RLock()
+	defer sw.mu.RUnlock()
+	return sw.windowSize
+}
+
 func (sw *SlidingWindow) SetLogger(logger *log.Logger) {
 	sw.mu.Lock()
 	defer sw.mu.Unlock()
@@ -144,27 +238,61 @@ func (sw *SlidingWindow) TimeUntilAllowed(n int) time.Duration {
 	if n <= 0 {
 		return 0
 	}
+	return sw.TimeUntilAllowedCost(Cost(n))
+}
+
+// TimeUntilAllowedCost is how long until the sliding count has room for cost, InfDuration above the limit
+func (sw *SlidingWindow) TimeUntilAllowedCost(cost Cost) time.Duration {
+	if !(cost > 0) {
+		return 0
+	}
 
 	sw.mu.RLock()
 	defer sw.mu.RUnlock()
 
-	windowStart := time.Unix(0, sw.currentWindow).UTC()
-	now := time.Now()
-	elapsed := now.Sub(windowStart)
+	return sw.timeUntilAllowed(cost)
+}
 
-	if elapsed >= sw.windowSize {
-		return 0
+// timeUntilAllowed is TimeUntilAllowedCost, sw.mu must be held
+func (sw *SlidingWindow) timeUntilAllowed(cost Cost) time.Duration {
+	if cost > float64(sw.maxRequests) {
+		return InfDuration
 	}
 
+	// the counts as Allow would see them after moving to the window of now
+	now := time.Now()
+	current, last := sw.currentWindowRequests, sw.lastWindowRequests
+	switch elapsed := now.Sub(time.Unix(0, sw.currentWindow)); {
+	case elapsed >= 2*sw.windowSize:
+		current, last = 0, 0
+	case elapsed >= sw.windowSize:
+		current, last = 0, current
+	}
+	elapsed := now.Sub(now.Truncate(sw.windowSize))
+
 	doneRatio := float64(elapsed) / float64(sw.windowSize)
-	slidingCount := float64(sw.currentWindowRequests) + (1.0-doneRatio)*float64(sw.lastWindowRequests)
+	slidingCount := current + (1.0-doneRatio)*last
+	room := float64(sw.maxRequests) - cost
 
-	if slidingCount+float64(n) <= float64(sw.maxRequests) {
+	if slidingCount <= room {
 		return 0
 	}
 
 	// Waiting until current window ends
-	return sw.windowSize - elapsed
+	if current > room {
+		return sw.windowSize - elapsed
+	}
+
+	// the carry over shrinks through the window, waiting until enough of it is gone
+	neededRatio := 1.0 - (room-current)/last
+	return time.Duration(math.Ceil(neededRatio*float64(sw.windowSize))) - elapsed
+}
+
+// ExceedsCapacity reports whether n can never be allowed, no matter how long the caller waits
+func (sw *SlidingWindow) ExceedsCapacity(n int) bool {
+	sw.mu.RLock()
+	defer sw.mu.RUnlock()
+	return int64(n) > sw.maxRequests
 }
 
 // stats for metrics
@@ -181,7 +309,7 @@ func (sw *SlidingWindow) DetailedStats() (allowed, denied int64, currentSlidingC
 		doneRatio = 1.0
 	}
 
-	slidingCount := float64(sw.currentWindowRequests) + (1.0-doneRatio)*float64(sw.lastWindowRequests)
+	slidingCount := sw.currentWindowRequests + (1.0-doneRatio)*sw.lastWindowRequests
 
 	return sw.requestsAllowed, sw.requestsDenied, slidingCount
 }
@@ -1,6 +1,7 @@
-package main
+package slidingwindowcounter
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 )
@@ -85,6 +86,60 @@ func TestReset(t *testing.T) {
 		t.Errorf("Should allow requests after reset")
 	}
 }
+func TestAllowCost(t *testing.T) {
+	// an hour long window has no carry over during the test
+	swc, _ := NewSlidingWindow(time.Hour, 2)
+	swc.SetLogger(nil)
+
+	for i := range 4 {
+		if !swc.AllowCost(0.5) {
+			t.Errorf("Expected cheap request %d to be allowed", i)
+		}
+	}
+	if swc.AllowCost(0.1) {
+		t.Errorf("Expected a full window to deny 0.1")
+	}
+	if wait := swc.TimeUntilAllowedCost(0.1); wait <= 0 {
+		t.Errorf("Expected to wait for room, got %v", wait)
+	}
+	if swc.AllowCost(0) || swc.TimeUntilAllowedCost(2.5) != InfDuration {
+		t.Errorf("Expected 0 to be denied and 2.5 to never fit")
+	}
+	// totals count whole requests, rounded up
+	if allowed, denied, count := swc.DetailedStats(); allowed != 4 || denied != 1 || count != 2 {
+		t.Errorf("Expected 4 allowed, 1 denied and a count of 2, got %d, %d and %v", allowed, denied, count)
+	}
+}
+
+func TestDebit(t *testing.T) {
+	swc, _ := NewSlidingWindow(time.Hour, 2)
+	swc.SetLogger(nil)
+
+	swc.Debit(1.5)
+	if !swc.AllowCost(0.5) || swc.AllowCost(0.1) {
+		t.Errorf("Expected 0.5 to be left after a debit of 1.5")
+	}
+	// a full window stays full
+	swc.Debit(5)
+	if allowed, denied, count := swc.DetailedStats(); allowed != 1 || denied != 1 || count != 2 {
+		t.Errorf("Expected 1 allowed, 1 denied and a count of 2, got %d, %d and %v", allowed, denied, count)
+	}
+}
+
+func TestTryCostAfterIdleWindows(t *testing.T) {
+	swc, _ := NewSlidingWindow(time.Hour, 10)
+	swc.SetLogger(nil)
+
+	if ok, _ := swc.TryCost(10); !ok {
+		t.Fatalf("Expected a full window to be allowed")
+	}
+	// pretend the window was filled three windows ago
+	swc.currentWindow -= int64(3 * time.Hour)
+	if ok, wait := swc.TryCost(10); !ok {
+		t.Errorf("Expected nothing to carry over after two idle windows, denied with a wait of %v", wait)
+	}
+}
+
 func TestWindow(t *testing.T) {
 	swc, _ := NewSlidingWindow(100*time.Millisecond, 5)
 	swc.Allow(5)
@@ -110,6 +165,42 @@ func TestInvalidRequests(t *testing.T) {
 		t.Errorf("Allow(-1) should return false")
 	}
 }
+func TestExceedsLimit(t *testing.T) {
+	swc, _ := NewSlidingWindow(time.Minute, 5)
+
+	if swc.Allow(6) {
+		t.Errorf("Allow(6) with limit 5 should fail")
+	}
+	if delay := swc.TimeUntilAllowed(6); delay != InfDuration {
+		t.Errorf("Expected infinite delay, got %v", delay)
+	}
+	_, denied, _ := swc.DetailedStats()
+	if denied != 6 {
+		t.Errorf("Expected denied=6, got %d", denied)
+	}
+}
+func TestUpdate(t *testing.T) {
+	swc, _ := NewSlidingWindow(time.Hour, 100)
+	swc.Allow(40)
+
+	swc.Update(0, 50)
+	count, max, _ := swc.Stats()
+	if count != 40 || max != 50 {
+		t.Errorf("Expected count=40, max=50 but got count=%.2f, max=%d", count, max)
+	}
+	if swc.Allow(20) {
+		t.Errorf("Allow(20) should fail with the lowered limit")
+	}
+
+	// doubling the window doubles the usage
+	swc.Update(2*time.Hour, 0)
+	if swc.windowSize != 2*time.Hour {
+		t.Errorf("Expected window 2h, got %v", swc.windowSize)
+	}
+	if swc.currentWindowRequests != 80 {
+		t.Errorf("Expected current window count 80, got %v", swc.currentWindowRequests)
+	}
+}
 func TestUntilAllowed(t *testing.T) {
 	swc, _ := NewSlidingWindow(100*time.Millisecond, 5)
 
@@ -130,4 +221,74 @@ func TestUntilAllowed(t *testing.T) {
 	if delay := swc.TimeUntilAllowed(0); delay != 0 {
 		t.Errorf("Expected 0 delay for invalid input, got %v", delay)
 	}
+
+	// the full window is over, its count only carries over into the window of now
+	swc.currentWindow = time.Now().Truncate(swc.windowSize).Add(-swc.windowSize).UnixNano()
+	delay = swc.TimeUntilAllowed(1)
+	if allowed := swc.Allow(1); allowed != (delay == 0) {
+		t.Errorf("TimeUntilAllowed returned %v but Allow returned %v", delay, allowed)
+	}
+	if delay > swc.windowSize {
+		t.Errorf("Expected delay be less than window size=%v but got %v", swc.windowSize, delay)
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	swc, _ := NewSlidingWindow(time.Hour, 100)
+	swc.Allow(40)
+	swc.Allow(70)
+
+	data, err := swc.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+
+	// restoring overwrites whatever the window was created with
+	restored, _ := NewSlidingWindow(time.Minute, 5)
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %v", err)
+	}
+	if restored.GetWindowSize() != time.Hour {
+		t.Errorf("Expected window 1h, got %v", restored.GetWindowSize())
+	}
+	allowed, denied, count := restored.DetailedStats()
+	if allowed != 40 || denied != 70 || count != 40 {
+		t.Errorf("Expected allowed=40, denied=70, count=40 but got %d, %d, %.2f", allowed, denied, count)
+	}
+	if restored.Allow(61) {
+		t.Errorf("Allow(61) should fail with 40 of 100 already used")
+	}
+
+	if err := restored.UnmarshalBinary(data[1:]); err == nil {
+		t.Errorf("UnmarshalBinary of truncated data should fail")
+	}
+}
+
+func TestUnmarshalJSON_Shifts(t *testing.T) {
+	swc, _ := NewSlidingWindow(time.Hour, 100)
+	swc.Allow(40)
+	// pretend the snapshot was taken in the previous window
+	swc.currentWindow -= int64(time.Hour)
+
+	data, err := json.Marshal(swc)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	var restored SlidingWindow
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if restored.lastWindowRequests != 40 || restored.currentWindowRequests != 0 {
+		t.Errorf("Expected last=40, current=0 after one window of downtime, got last=%v, current=%v",
+			restored.lastWindowRequests, restored.currentWindowRequests)
+	}
+
+	// two windows later nothing is left
+	swc.currentWindow -= int64(time.Hour)
+	data, _ = json.Marshal(swc)
+	json.Unmarshal(data, &restored)
+	if count, _, _ := restored.Stats(); count != 0 {
+		t.Errorf("Expected an empty window after two windows of downtime, got %.2f", count)
+	}
 }
@@ -0,0 +1,111 @@
+package slidingwindowcounter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// stateVersion is bumped whenever the layout of windowState changes
+const stateVersion = 2
+
+// windowState is everything a SlidingWindow needs to pick up where it left off,
+// the same struct is used for the JSON and the binary encoding
+type windowState struct {
+	Version               uint8   `json:"version"`
+	WindowSize            int64   `json:"window_size"` // nanoseconds
+	MaxRequests           int64   `json:"max_requests"`
+	CurrentWindow         int64   `json:"current_window"` // unix nanoseconds
+	LastWindowRequests    float64 `json:"last_window_requests"`
+	CurrentWindowRequests float64 `json:"current_window_requests"`
+	RequestsAllowed       int64   `json:"requests_allowed"`
+	RequestsDenied        int64   `json:"requests_denied"`
+}
+
+func (sw *SlidingWindow) state() windowState {
+	sw.mu.RLock()
+	defer sw.mu.RUnlock()
+	return windowState{
+		Version:               stateVersion,
+		WindowSize:            int64(sw.windowSize),
+		MaxRequests:           sw.maxRequests,
+		CurrentWindow:         sw.currentWindow,
+		LastWindowRequests:    sw.lastWindowRequests,
+		CurrentWindowRequests: sw.currentWindowRequests,
+		RequestsAllowed:       sw.requestsAllowed,
+		RequestsDenied:        sw.requestsDenied,
+	}
+}
+
+// restore replaces the window with s and shifts it for the windows that passed since s was taken
+func (sw *SlidingWindow) restore(s windowState) error {
+	if s.Version != stateVersion {
+		return fmt.Errorf("unsupported state version %d", s.Version)
+	}
+	if s.WindowSize <= 0 || s.MaxRequests <= 0 || s.LastWindowRequests < 0 || s.CurrentWindowRequests < 0 {
+		return errors.New("invalid sliding window state")
+	}
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	sw.windowSize = time.Duration(s.WindowSize)
+	sw.maxRequests = s.MaxRequests
+	sw.currentWindow = s.CurrentWindow
+	sw.lastWindowRequests = s.LastWindowRequests
+	sw.currentWindowRequests = s.CurrentWindowRequests
+	sw.requestsAllowed = s.RequestsAllowed
+	sw.requestsDenied = s.RequestsDenied
+	if sw.logger == nil {
+		sw.logger = log.Default()
+	}
+
+	sw.shift(time.Now())
+	return nil
+}
+
+func (sw *SlidingWindow) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sw.state())
+}
+
+func (sw *SlidingWindow) UnmarshalJSON(data []byte) error {
+	var s windowState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	// version 1 only had whole counts, JSON reads them the same
+	if s.Version == 1 {
+		s.Version = stateVersion
+	}
+	return sw.restore(s)
+}
+
+func (sw *SlidingWindow) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, sw.state()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (sw *SlidingWindow) UnmarshalBinary(data []byte) error {
+	var s windowState
+	if len(data) != binary.Size(s) {
+		return fmt.Errorf("invalid sliding window state: %d bytes", len(data))
+	}
+	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &s); err != nil {
+		return err
+	}
+	// version 1 had the same layout with int64 counts
+	if s.Version == 1 {
+		s.LastWindowRequests = float64(int64(math.Float64bits(s.LastWindowRequests)))
+		s.CurrentWindowRequests = float64(int64(math.Float64bits(s.CurrentWindowRequests)))
+		s.Version = stateVersion
+	}
+	return sw.restore(s)
+}
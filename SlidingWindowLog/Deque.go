@@ -1,4 +1,4 @@
-package main
+package slidingwindowlog
 
 type Deque[T any] struct {
 	items []T
@@ -51,6 +51,24 @@ func (d *Deque[T]) IsEmpty() bool {
 	return d.size == 0
 }
 
+// At returns the i-th item counting from the front
+func (d *Deque[T]) At(i int) (T, bool) {
+	var data T
+	if i < 0 || i >= d.size {
+		return data, false
+	}
+	return d.items[(d.front+i)%len(d.items)], true
+}
+
+// Items returns a copy of the items from front to back
+func (d *Deque[T]) Items() []T {
+	items := make([]T, d.size)
+	for i := range items {
+		items[i] = d.items[(d.front+i)%len(d.items)]
+	}
+	return items
+}
+
 func (d *Deque[T]) resize() {
 	newCapacity := len(d.items) * 2
 	newItems := make([]T, newCapacity)
@@ -1,16 +1,32 @@
-package main
+package slidingwindowlog
 
 import (
 	"errors"
 	"log"
+	"math"
+	"sort"
 	"sync"
 	"time"
 )
 
+// InfDuration is returned as the wait time for requests that can never fit in the window
+const InfDuration = time.Duration(math.MaxInt64)
+
+// Cost is how many requests a request counts as. Fractions like 0.1 for a cheap read are
+// logged exactly, Allow(n) decides like AllowCost(Cost(n)).
+type Cost = float64
+
+// entry is one logged request, Allow(n) logs n entries of cost 1
+type entry struct {
+	at   time.Time
+	cost float64
+}
+
 type SlidingWindowLog struct {
 	windowSize  time.Duration
 	maxRequests int64
-	requestLog  *Deque[time.Time] // storing timestamps of requests
+	requestLog  *Deque[entry] // storing timestamps and costs of requests
+	used        float64       // sum of the costs in requestLog
 	logger      *log.Logger
 	mu          sync.RWMutex
 }
@@ -26,7 +42,7 @@ func NewSlidingWindowLog(windowSize time.Duration, maxRequests int64) (*SlidingW
 	return &SlidingWindowLog{
 		windowSize:  windowSize,
 		maxRequests: maxRequests,
-		requestLog:  NewDeque[time.Time](),
+		requestLog:  NewDeque[entry](),
 		logger:      log.Default(),
 	}, nil
 }
@@ -39,7 +55,145 @@ func (sw *SlidingWindowLog) Allow(n int) bool {
 	sw.mu.Lock()
 	defer sw.mu.Unlock()
 
+	if int64(n) > sw.maxRequests {
+		if sw.logger != nil {
+			sw.logger.Printf("denied %d requests, more than the window limit %d", n, sw.maxRequests)
+		}
+		return false
+	}
+
+	now := time.Now()
+	sw.removeExpired(now)
+
+	if sw.used+float64(n) <= float64(sw.maxRequests) {
+		for range n {
+			sw.push(entry{at: now, cost: 1})
+		}
+
+		if sw.logger != nil {
+			sw.logger.Printf("allowed %d requests, current count: %g/%d",
+				n, sw.used, sw.maxRequests)
+		}
+		return true
+	}
+
+	if sw.logger != nil {
+		sw.logger.Printf("denied %d requests, limit exceeded: %g/%d",
+			n, sw.used, sw.maxRequests)
+	}
+	return false
+}
+
+// AllowCost logs a request of cost as one entry if the window has room for it,
+// a cost that isn't positive is never allowed
+func (sw *SlidingWindowLog) AllowCost(cost Cost) bool {
+	allowed, _ := sw.TryCost(cost)
+	return allowed
+}
+
+// TryCost is AllowCost that also says how long to wait when it rejects, decided under
+// one lock. The wait is InfDuration when cost never fits, whatever the caller does.
+func (sw *SlidingWindowLog) TryCost(cost Cost) (bool, time.Duration) {
+	if !(cost > 0) {
+		return false, InfDuration
+	}
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if cost > float64(sw.maxRequests) {
+		if sw.logger != nil {
+			sw.logger.Printf("denied %g requests, more than the window limit %d", cost, sw.maxRequests)
+		}
+		return false, InfDuration
+	}
+
 	now := time.Now()
+	sw.removeExpired(now)
+
+	if sw.used+cost > float64(sw.maxRequests) {
+		if sw.logger != nil {
+			sw.logger.Printf("denied %g requests, limit exceeded: %g/%d", cost, sw.used, sw.maxRequests)
+		}
+		return false, sw.timeUntilAllowed(cost)
+	}
+
+	sw.push(entry{at: now, cost: cost})
+	if sw.logger != nil {
+		sw.logger.Printf("allowed %g requests, current count: %g/%d", cost, sw.used, sw.maxRequests)
+	}
+	return true, 0
+}
+
+// Debit logs cost after the fact, e.g. for the bytes of a response that already went out.
+// It never fails, a big debit fills the window instead of going over.
+func (sw *SlidingWindowLog) Debit(cost Cost) {
+	if !(cost > 0) {
+		return
+	}
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	now := time.Now()
+	sw.removeExpired(now)
+	if room := float64(sw.maxRequests) - sw.used; room > 0 {
+		sw.push(entry{at: now, cost: min(cost, room)})
+	}
+}
+
+// AllowUpTo admits as many of n requests as still fit in the window and returns how
+// many that were, 0 when the window is full
+func (sw *SlidingWindowLog) AllowUpTo(n int) int {
+	if n <= 0 {
+		return 0
+	}
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	now := time.Now()
+	sw.removeExpired(now)
+
+	granted := int(min(float64(n), math.Floor(float64(sw.maxRequests)-sw.used)))
+	if granted <= 0 {
+		if sw.logger != nil {
+			sw.logger.Printf("denied %d requests, window is full: %g/%d", n, sw.used, sw.maxRequests)
+		}
+		return 0
+	}
+	for range granted {
+		sw.push(entry{at: now, cost: 1})
+	}
+
+	if sw.logger != nil {
+		sw.logger.Printf("allowed %d of %d requests, current count: %g/%d",
+			granted, n, sw.used, sw.maxRequests)
+	}
+	return granted
+}
+
+// push logs e, sw.mu must be held
+func (sw *SlidingWindowLog) push(e entry) {
+	sw.requestLog.PushBack(e)
+	sw.used += e.cost
+}
+
+// popFront drops the oldest entry, sw.mu must be held
+func (sw *SlidingWindowLog) popFront() {
+	e, ok := sw.requestLog.PopFront()
+	if !ok {
+		return
+	}
+	sw.used -= e.cost
+	// keeps float rounding from piling up
+	if sw.requestLog.IsEmpty() {
+		sw.used = 0
+	}
+}
+
+// removeExpired drops the requests that fell out of the window
+func (sw *SlidingWindowLog) removeExpired(now time.Time) {
 	windowStart := now.Add(-sw.windowSize) // doing minus here to go back in time by window size
 
 	// removing expired requests from front
@@ -48,71 +202,112 @@ func (sw *SlidingWindowLog) Allow(n int) bool {
 			break
 		}
 
-		frontTime, exists := sw.requestLog.PeekFront()
+		front, exists := sw.requestLog.PeekFront()
 		if !exists {
 			break
 		}
-		if frontTime.After(windowStart) {
+		if front.at.After(windowStart) {
 			break
 		}
 
 		// Removing expired request
-		sw.requestLog.PopFront()
+		sw.popFront()
 	}
-
-	if int64(sw.requestLog.Size())+int64(n) <= sw.maxRequests {
-		for range n {
-			sw.requestLog.PushBack(now)
-		}
-
-		if sw.logger != nil {
-			sw.logger.Printf("allowed %d requests, current count: %d/%d",
-				n, sw.requestLog.Size(), sw.maxRequests)
-		}
-		return true
-	}
-
-	if sw.logger != nil {
-		sw.logger.Printf("denied %d requests, limit exceeded: %d/%d",
-			n, sw.requestLog.Size(), sw.maxRequests)
-	}
-	return false
 }
 
-func (sw *SlidingWindowLog) Stats() (currentCount, maxRequests int64, windowStart time.Time) {
+// Stats returns the sum of the costs logged in the window, the expired ones included until the next Allow
+func (sw *SlidingWindowLog) Stats() (currentCount float64, maxRequests int64, windowStart time.Time) {
 	sw.mu.RLock()
 	defer sw.mu.RUnlock()
 
 	now := time.Now()
 	windowStart = now.Add(-sw.windowSize)
 
-	return int64(sw.requestLog.Size()), sw.maxRequests, windowStart
+	return sw.used, sw.maxRequests, windowStart
 }
 
 func (sw *SlidingWindowLog) TimeUntilAllowed(n int) time.Duration {
+	return sw.TimeUntilAllowedCost(Cost(n))
+}
+
+// TimeUntilAllowedCost is how long until enough of the log expired to make room for cost
+func (sw *SlidingWindowLog) TimeUntilAllowedCost(cost Cost) time.Duration {
+	if !(cost > 0) {
+		return 0
+	}
+
 	sw.mu.RLock()
 	defer sw.mu.RUnlock()
 
-	if int64(sw.requestLog.Size())+int64(n) <= sw.maxRequests {
-		return 0
+	return sw.timeUntilAllowed(cost)
+}
+
+// timeUntilAllowed is TimeUntilAllowedCost, sw.mu must be held
+func (sw *SlidingWindowLog) timeUntilAllowed(cost Cost) time.Duration {
+	if cost > float64(sw.maxRequests) {
+		return InfDuration
 	}
 
-	// Find the oldest request that would need to expire
-	requestsToRemove := int64(sw.requestLog.Size()) + int64(n) - sw.maxRequests
+	// expired entries are only dropped by Allow, skip them without changing the log
+	now := time.Now()
+	windowStart := now.Add(-sw.windowSize)
+	size := sw.requestLog.Size()
+	expired := sort.Search(size, func(i int) bool {
+		e, _ := sw.requestLog.At(i)
+		return e.at.After(windowStart)
+	})
 
-	if requestsToRemove >= int64(sw.requestLog.Size()) {
-		// Need to wait for all current requests to expire
-		if sw.requestLog.IsEmpty() {
-			return 0
+	used := 0.0
+	for i := expired; i < size; i++ {
+		e, _ := sw.requestLog.At(i)
+		used += e.cost
+	}
+	toRemove := used + cost - float64(sw.maxRequests)
+	if toRemove <= 0 {
+		return 0
+	}
+
+	// the newest of the requests that have to leave the window decides the wait
+	for i := expired; i < size; i++ {
+		e, _ := sw.requestLog.At(i)
+		toRemove -= e.cost
+		if toRemove <= 0 {
+			return e.at.Add(sw.windowSize).Sub(now)
 		}
-		oldestRequest, exists := sw.requestLog.PeekFront()
-		if !exists {
-			return 0
+	}
+	// float rounding left a sliver, everything in the log has to go
+	last, _ := sw.requestLog.At(size - 1)
+	return last.at.Add(sw.windowSize).Sub(now)
+}
+
+// ExceedsCapacity reports whether n can never be allowed, no matter how long the caller waits
+func (sw *SlidingWindowLog) ExceedsCapacity(n int) bool {
+	sw.mu.RLock()
+	defer sw.mu.RUnlock()
+	return int64(n) > sw.maxRequests
+}
+
+// Update changes window size and limit at runtime, non-positive values are left unchanged.
+// When the limit shrinks the oldest entries are trimmed so the log never holds more than maxRequests.
+func (sw *SlidingWindowLog) Update(newWindowSize time.Duration, newMaxRequests int64) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if newWindowSize > 0 {
+		// timestamps are absolute so they stay valid, expired ones get removed on the next Allow
+		sw.windowSize = newWindowSize
+	}
+	if newMaxRequests > 0 {
+		sw.maxRequests = newMaxRequests
+		for sw.used > float64(sw.maxRequests) {
+			sw.popFront()
 		}
-		return time.Until(oldestRequest.Add(sw.windowSize))
 	}
 
-	return sw.windowSize
+	if sw.logger != nil {
+		sw.logger.Printf("updated window to %s with limit %d, current count: %g",
+			sw.windowSize, sw.maxRequests, sw.used)
+	}
 }
 
 func (sw *SlidingWindowLog) Reset() {
@@ -120,7 +315,8 @@ func (sw *SlidingWindowLog) Reset() {
 	defer sw.mu.Unlock()
 
 	// clearing the deque
-	sw.requestLog = NewDeque[time.Time]()
+	sw.requestLog = NewDeque[entry]()
+	sw.used = 0
 
 	if sw.logger != nil {
 		sw.logger.Printf("sliding window reset")
@@ -134,9 +330,13 @@ func (sw *SlidingWindowLog) SetLogger(logger *log.Logger) {
 }
 
 func (sw *SlidingWindowLog) GetWindowSize() time.Duration {
+	sw.mu.RLock()
+	defer sw.mu.RUnlock()
 	return sw.windowSize
 }
 
 func (sw *SlidingWindowLog) GetMaxRequests() int64 {
+	sw.mu.RLock()
+	defer sw.mu.RUnlock()
 	return sw.maxRequests
 }
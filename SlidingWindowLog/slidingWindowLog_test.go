@@ -1,6 +1,9 @@
-package main
+package slidingwindowlog
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 )
@@ -27,13 +30,13 @@ func TestStats(t *testing.T) {
 
 	count, max, _ := swl.Stats()
 	if count != 0 || max != 5 {
-		t.Errorf("Expected count=0, max=5 but got count=%d, max=%d", count, max)
+		t.Errorf("Expected count=0, max=5 but got count=%v, max=%d", count, max)
 	}
 
 	swl.Allow(3)
 	count, max, _ = swl.Stats()
 	if count != 3 || max != 5 {
-		t.Errorf("Expected count=3, max=5, got count=%d, max=%d", count, max)
+		t.Errorf("Expected count=3, max=5, got count=%v, max=%d", count, max)
 	}
 }
 
@@ -71,6 +74,72 @@ func TestAllow(t *testing.T) {
 
 }
 
+func TestAllowUpTo(t *testing.T) {
+	sw, _ := NewSlidingWindowLog(200*time.Millisecond, 5)
+	sw.SetLogger(nil)
+
+	if granted := sw.AllowUpTo(3); granted != 3 {
+		t.Errorf("Expected all 3 to be granted, got %d", granted)
+	}
+	if granted := sw.AllowUpTo(10); granted != 2 {
+		t.Errorf("Expected the 2 left in the window, got %d", granted)
+	}
+	if granted := sw.AllowUpTo(1); granted != 0 {
+		t.Errorf("Expected nothing from a full window, got %d", granted)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if granted := sw.AllowUpTo(10); granted != 5 {
+		t.Errorf("Expected the whole window once it slid past, got %d", granted)
+	}
+}
+
+func TestAllowCost(t *testing.T) {
+	sw, _ := NewSlidingWindowLog(100*time.Millisecond, 2)
+	sw.SetLogger(nil)
+
+	if !sw.AllowCost(1.5) || !sw.AllowCost(0.5) {
+		t.Errorf("Expected 1.5 and 0.5 to fit in the window")
+	}
+	if sw.AllowCost(0.25) {
+		t.Errorf("Expected the window to be full")
+	}
+	if count, _, _ := sw.Stats(); count != 2 {
+		t.Errorf("Expected a count of 2, got %v", count)
+	}
+	if wait := sw.TimeUntilAllowedCost(0.25); wait <= 0 || wait > 100*time.Millisecond {
+		t.Errorf("Expected to wait for the 1.5 to leave the window, got %v", wait)
+	}
+	if sw.AllowCost(0) || sw.TimeUntilAllowedCost(2.5) != InfDuration {
+		t.Errorf("Expected 0 to be rejected and 2.5 to never fit")
+	}
+
+	time.Sleep(120 * time.Millisecond)
+	if !sw.AllowCost(2) {
+		t.Errorf("Expected the whole window once it slid past")
+	}
+}
+
+func TestDebit(t *testing.T) {
+	sw, _ := NewSlidingWindowLog(100*time.Millisecond, 2)
+	sw.SetLogger(nil)
+
+	sw.Debit(1.5)
+	if !sw.AllowCost(0.5) || sw.AllowCost(0.1) {
+		t.Errorf("Expected 0.5 to be left after a debit of 1.5")
+	}
+	// a full window stays full
+	sw.Debit(5)
+	if count, _, _ := sw.Stats(); count != 2 {
+		t.Errorf("Expected a count of 2, got %v", count)
+	}
+
+	time.Sleep(120 * time.Millisecond)
+	if !sw.AllowCost(2) {
+		t.Errorf("Expected the debits to slide out of the window")
+	}
+}
+
 func TestTimeUntilAllowed(t *testing.T) {
 	swl, _ := NewSlidingWindowLog(100*time.Millisecond, 5)
 
@@ -82,4 +151,104 @@ func TestTimeUntilAllowed(t *testing.T) {
 	if delay := swl.TimeUntilAllowed(1); delay <= 0 {
 		t.Errorf("should be positive delay but got: %v", delay)
 	}
+
+	// the wait is until the entries that have to go leave the window
+	time.Sleep(50 * time.Millisecond)
+	if delay := swl.TimeUntilAllowed(1); delay <= 0 || delay > 50*time.Millisecond {
+		t.Errorf("Expected at most 50ms until the first entries expire, got %v", delay)
+	}
+
+	// expired entries no longer count, even before Allow drops them
+	time.Sleep(60 * time.Millisecond)
+	if delay := swl.TimeUntilAllowed(5); delay != 0 {
+		t.Errorf("Expected no delay once the window passed, got %v", delay)
+	}
+}
+
+func TestExceedsLimit(t *testing.T) {
+	swl, _ := NewSlidingWindowLog(time.Minute, 5)
+
+	if swl.Allow(6) {
+		t.Errorf("Allow(6) with limit 5 should fail")
+	}
+	if delay := swl.TimeUntilAllowed(6); delay != InfDuration {
+		t.Errorf("Expected infinite delay, got %v", delay)
+	}
+	if !swl.Allow(5) {
+		t.Errorf("Allow(5) should still succeed")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	swl, _ := NewSlidingWindowLog(time.Minute, 5)
+	swl.Allow(5)
+
+	// shrinking the limit trims the log
+	swl.Update(0, 3)
+	count, max, _ := swl.Stats()
+	if count != 3 || max != 3 {
+		t.Errorf("Expected count=3, max=3, got count=%v, max=%d", count, max)
+	}
+	if swl.GetWindowSize() != time.Minute {
+		t.Errorf("Window size should stay 1m, got %v", swl.GetWindowSize())
+	}
+
+	swl.Update(100*time.Millisecond, 10)
+	if swl.GetWindowSize() != 100*time.Millisecond || swl.GetMaxRequests() != 10 {
+		t.Errorf("Expected window 100ms and max 10, got %v and %d", swl.GetWindowSize(), swl.GetMaxRequests())
+	}
+	time.Sleep(120 * time.Millisecond)
+	if !swl.Allow(10) {
+		t.Errorf("old entries should expire with the shorter window")
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	swl, _ := NewSlidingWindowLog(time.Minute, 5)
+	swl.Allow(3)
+
+	data, err := swl.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+
+	// restoring overwrites whatever the log was created with
+	restored, _ := NewSlidingWindowLog(time.Second, 100)
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %v", err)
+	}
+	count, max, _ := restored.Stats()
+	if count != 3 || max != 5 || restored.GetWindowSize() != time.Minute {
+		t.Errorf("Expected count=3, max=5, window=1m, got count=%v, max=%d, window=%v", count, max, restored.GetWindowSize())
+	}
+	if restored.Allow(3) {
+		t.Errorf("Allow(3) should fail with 3 of 5 already used")
+	}
+
+	if err := restored.UnmarshalBinary(data[:len(data)-8]); err == nil {
+		t.Errorf("UnmarshalBinary with a missing timestamp should fail")
+	}
+}
+
+func TestUnmarshalJSON_Expires(t *testing.T) {
+	now := time.Now()
+	// one request from before the downtime, one still in the window
+	data := fmt.Sprintf(`{"version":1,"window_size":%d,"max_requests":2,"requests":[%d,%d]}`,
+		time.Minute, now.Add(-2*time.Minute).UnixNano(), now.Add(-30*time.Second).UnixNano())
+
+	var restored SlidingWindowLog
+	if err := json.Unmarshal([]byte(data), &restored); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if count, _, _ := restored.Stats(); count != 1 {
+		t.Errorf("Expected the expired request to be dropped, got count=%v", count)
+	}
+	if !restored.Allow(1) {
+		t.Errorf("Allow(1) should succeed with one slot free")
+	}
+
+	out, _ := json.Marshal(&restored)
+	if !strings.Contains(string(out), `"max_requests":2`) {
+		t.Errorf("Expected max_requests in %s", out)
+	}
 }
@@ -0,0 +1,170 @@
+package slidingwindowlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// stateVersion is bumped whenever the layout of logState changes
+const stateVersion = 2
+
+// logState is everything a SlidingWindowLog needs to pick up where it left off
+type logState struct {
+	Version     uint8     `json:"version"`
+	WindowSize  int64     `json:"window_size"` // nanoseconds
+	MaxRequests int64     `json:"max_requests"`
+	Requests    []int64   `json:"requests"` // unix nanoseconds, oldest first
+	Costs       []float64 `json:"costs"`    // cost of each request
+}
+
+// logHeader is the fixed size part of the binary encoding, followed by Count timestamps
+type logHeader struct {
+	Version     uint8
+	WindowSize  int64
+	MaxRequests int64
+	Count       uint32
+}
+
+func (sw *SlidingWindowLog) state() logState {
+	sw.mu.RLock()
+	defer sw.mu.RUnlock()
+
+	var (
+		requests []int64
+		costs    []float64
+	)
+	for _, e := range sw.requestLog.Items() {
+		requests = append(requests, e.at.UnixNano())
+		costs = append(costs, e.cost)
+	}
+	return logState{
+		Version:     stateVersion,
+		WindowSize:  int64(sw.windowSize),
+		MaxRequests: sw.maxRequests,
+		Requests:    requests,
+		Costs:       costs,
+	}
+}
+
+// upgrade turns a version 1 state, where every request cost 1, into the current version
+func (s *logState) upgrade() {
+	if s.Version != 1 {
+		return
+	}
+	s.Costs = make([]float64, len(s.Requests))
+	for i := range s.Costs {
+		s.Costs[i] = 1
+	}
+	s.Version = stateVersion
+}
+
+// restore replaces the log with s and drops the requests that expired since s was taken
+func (sw *SlidingWindowLog) restore(s logState) error {
+	if s.Version != stateVersion {
+		return fmt.Errorf("unsupported state version %d", s.Version)
+	}
+	if s.WindowSize <= 0 || s.MaxRequests <= 0 || len(s.Costs) != len(s.Requests) {
+		return errors.New("invalid sliding window log state")
+	}
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	sw.windowSize = time.Duration(s.WindowSize)
+	sw.maxRequests = s.MaxRequests
+	sw.requestLog = NewDeque[entry]()
+	sw.used = 0
+	for i, ts := range s.Requests {
+		if i > 0 && ts < s.Requests[i-1] {
+			return errors.New("invalid sliding window log state: requests out of order")
+		}
+		if !(s.Costs[i] > 0) {
+			return errors.New("invalid sliding window log state: cost must be positive")
+		}
+		sw.push(entry{at: time.Unix(0, ts), cost: s.Costs[i]})
+	}
+	// never hold more than the limit, the oldest ones go first
+	for sw.used > float64(sw.maxRequests) {
+		sw.popFront()
+	}
+	if sw.logger == nil {
+		sw.logger = log.Default()
+	}
+
+	sw.removeExpired(time.Now())
+	return nil
+}
+
+func (sw *SlidingWindowLog) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sw.state())
+}
+
+func (sw *SlidingWindowLog) UnmarshalJSON(data []byte) error {
+	var s logState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	s.upgrade()
+	return sw.restore(s)
+}
+
+func (sw *SlidingWindowLog) MarshalBinary() ([]byte, error) {
+	s := sw.state()
+	header := logHeader{
+		Version:     s.Version,
+		WindowSize:  s.WindowSize,
+		MaxRequests: s.MaxRequests,
+		Count:       uint32(len(s.Requests)),
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, header); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.BigEndian, s.Requests); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.BigEndian, s.Costs); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (sw *SlidingWindowLog) UnmarshalBinary(data []byte) error {
+	var header logHeader
+	r := bytes.NewReader(data)
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return fmt.Errorf("invalid sliding window log state: %w", err)
+	}
+	// a timestamp and a cost of 8 bytes each per request, version 1 had no costs
+	size := 16
+	if header.Version == 1 {
+		size = 8
+	}
+	if r.Len() != int(header.Count)*size {
+		return fmt.Errorf("invalid sliding window log state: %d bytes for %d requests", r.Len(), header.Count)
+	}
+
+	s := logState{
+		Version:     header.Version,
+		WindowSize:  header.WindowSize,
+		MaxRequests: header.MaxRequests,
+		Requests:    make([]int64, header.Count),
+	}
+	if err := binary.Read(r, binary.BigEndian, s.Requests); err != nil {
+		return err
+	}
+	if header.Version != 1 {
+		s.Costs = make([]float64, header.Count)
+		if err := binary.Read(r, binary.BigEndian, s.Costs); err != nil {
+			return err
+		}
+	}
+	s.upgrade()
+	return sw.restore(s)
+}
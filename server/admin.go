@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// every change made through the admin API is written here
+var auditLog = log.New(os.Stdout, "audit: ", log.LstdFlags|log.LUTC)
+
+type limiterResponse struct {
+	Name      string        `json:"name"`
+	Algorithm string        `json:"algorithm"`
+	Config    LimiterConfig `json:"config"`
+	Keys      int           `json:"keys"`
+	// fill rate picked by an adaptive token bucket, it replaces config.fill_rate
+	AdaptiveFillRate float64 `json:"adaptive_fill_rate,omitempty"`
+	// state of the key asked for with ?key=, in the format of the state file
+	State json.RawMessage `json:"state,omitempty"`
+}
+
+// fields left out keep their current value
+type updateRequest struct {
+	Capacity    *int64    `json:"capacity"`
+	FillRate    *float64  `json:"fill_rate"`
+	LeakRate    *float64  `json:"leak_rate"`
+	WindowSize  *Duration `json:"window_size"` // e.g. "10s"
+	MaxRequests *int64    `json:"max_requests"`
+	ExcessBurst *int64    `json:"excess_burst"`
+	PeakRate    *float64  `json:"peak_rate"`
+	PeakBurst   *int64    `json:"peak_burst"`
+}
+
+type adminAPI struct {
+	token string
+	rl    *reloader
+}
+
+func newAdminAPI(token string, rl *reloader) *adminAPI {
+	return &adminAPI{token: token, rl: rl}
+}
+
+func (a *adminAPI) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/limiters", a.requireToken(a.listLimiters))
+	mux.HandleFunc("GET /admin/limiters/{name}", a.requireToken(a.getLimiter))
+	mux.HandleFunc("PUT /admin/limiters/{name}", a.requireToken(a.updateLimiter))
+	mux.HandleFunc("GET /admin/bans", a.requireToken(a.listBans))
+	mux.HandleFunc("DELETE /admin/limiters/{name}/bans", a.requireToken(a.liftBan))
+}
+
+// checks the bearer token in constant time
+func (a *adminAPI) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, http.StatusUnauthorized, "missing or invalid admin token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (a *adminAPI) listLimiters(w http.ResponseWriter, r *http.Request) {
+	resp := []limiterResponse{}
+	for _, m := range a.rl.current.Load().all() {
+		resp = append(resp, describe(m))
+	}
+	sort.Slice(resp, func(i, j int) bool { return resp[i].Name < resp[j].Name })
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (a *adminAPI) getLimiter(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	m, ok := a.rl.current.Load().limiter(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("limiter %q not found", name))
+		return
+	}
+
+	resp := describe(m)
+	if r.URL.Query().Has("key") {
+		key := r.URL.Query().Get("key")
+		l, ok := m.lookup(key)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("limiter %q has no state for key %q", name, key))
+			return
+		}
+		state, err := json.Marshal(l)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp.State = state
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (a *adminAPI) updateLimiter(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := a.rl.current.Load().limiter(name); !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("limiter %q not found", name))
+		return
+	}
+
+	var req updateRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	// no other update or reload may change the config between reading and updating it,
+	// or one of them would be lost
+	a.rl.mu.Lock()
+	defer a.rl.mu.Unlock()
+	// a reload may have removed it while the body was read
+	m, ok := a.rl.current.Load().limiter(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("limiter %q not found", name))
+		return
+	}
+
+	before := m.config()
+	after, err := req.apply(before)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	m.update(after)
+	m.updateLimitMetrics()
+	a.rl.setOverride(name, m.algorithm, req)
+
+	auditLog.Printf("limiter=%s remote=%s %s", name, r.RemoteAddr, configChanges(before, after))
+	writeJSON(w, http.StatusOK, describe(m))
+}
+
+// listBans returns the active bans of every limiter with a penalty
+func (a *adminAPI) listBans(w http.ResponseWriter, r *http.Request) {
+	resp := []ban{}
+	now := time.Now()
+	for name, m := range a.rl.current.Load().all() {
+		if p := m.penaltyBox(); p != nil {
+			resp = append(resp, p.active(name, now)...)
+		}
+	}
+	sort.SliceStable(resp, func(i, j int) bool { return resp[i].Limiter < resp[j].Limiter })
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// liftBan ends the ban of the key given with ?key=
+func (a *adminAPI) liftBan(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	m, ok := a.rl.current.Load().limiter(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("limiter %q not found", name))
+		return
+	}
+	p := m.penaltyBox()
+	if p == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("limiter %q has no penalty", name))
+		return
+	}
+	if !r.URL.Query().Has("key") {
+		writeError(w, http.StatusBadRequest, "key is required")
+		return
+	}
+	key := r.URL.Query().Get("key")
+	if !p.lift(key, time.Now()) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("key %q is not banned by limiter %q", key, name))
+		return
+	}
+
+	auditLog.Printf("limiter=%s remote=%s lifted ban of key=%q", name, r.RemoteAddr, key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apply returns cfg with the fields of req set, checked the same way as the config file
+func (req updateRequest) apply(cfg LimiterConfig) (LimiterConfig, error) {
+	if req == (updateRequest{}) {
+		return cfg, errors.New("at least one of capacity, fill_rate, leak_rate, window_size, max_requests, excess_burst, peak_rate or peak_burst is required")
+	}
+	if req.Capacity != nil {
+		cfg.Capacity = *req.Capacity
+	}
+	if req.FillRate != nil {
+		cfg.FillRate = *req.FillRate
+	}
+	if req.LeakRate != nil {
+		cfg.LeakRate = *req.LeakRate
+	}
+	if req.WindowSize != nil {
+		cfg.WindowSize = *req.WindowSize
+	}
+	if req.MaxRequests != nil {
+		cfg.MaxRequests = *req.MaxRequests
+	}
+	if req.ExcessBurst != nil {
+		cfg.ExcessBurst = *req.ExcessBurst
+	}
+	if req.PeakRate != nil {
+		cfg.PeakRate = *req.PeakRate
+	}
+	if req.PeakBurst != nil {
+		cfg.PeakBurst = *req.PeakBurst
+	}
+	return cfg, cfg.Validate()
+}
+
+// merge returns req with the fields set in newer replaced
+func (req updateRequest) merge(newer updateRequest) updateRequest {
+	if newer.Capacity != nil {
+		req.Capacity = newer.Capacity
+	}
+	if newer.FillRate != nil {
+		req.FillRate = newer.FillRate
+	}
+	if newer.LeakRate != nil {
+		req.LeakRate = newer.LeakRate
+	}
+	if newer.WindowSize != nil {
+		req.WindowSize = newer.WindowSize
+	}
+	if newer.MaxRequests != nil {
+		req.MaxRequests = newer.MaxRequests
+	}
+	if newer.ExcessBurst != nil {
+		req.ExcessBurst = newer.ExcessBurst
+	}
+	if newer.PeakRate != nil {
+		req.PeakRate = newer.PeakRate
+	}
+	if newer.PeakBurst != nil {
+		req.PeakBurst = newer.PeakBurst
+	}
+	return req
+}
+
+// configChanges lists the changed fields as field=old->new
+func configChanges(before, after LimiterConfig) string {
+	var changes []string
+	add := func(field string, old, new any) {
+		if old != new {
+			changes = append(changes, fmt.Sprintf("%s=%v->%v", field, old, new))
+		}
+	}
+	add("capacity", before.Capacity, after.Capacity)
+	add("fill_rate", before.FillRate, after.FillRate)
+	add("leak_rate", before.LeakRate, after.LeakRate)
+	add("window_size", time.Duration(before.WindowSize), time.Duration(after.WindowSize))
+	add("max_requests", before.MaxRequests, after.MaxRequests)
+	add("excess_burst", before.ExcessBurst, after.ExcessBurst)
+	add("peak_rate", before.PeakRate, after.PeakRate)
+	add("peak_burst", before.PeakBurst, after.PeakBurst)
+	if len(changes) == 0 {
+		return "unchanged"
+	}
+	return strings.Join(changes, " ")
+}
+
+func describe(m *metricsLimiterSet) limiterResponse {
+	resp := limiterResponse{
+		Name:      m.name,
+		Algorithm: m.algorithm,
+		Config:    m.config(),
+		Keys:      m.size(),
+	}
+	if rate, ok := m.adaptiveRate(); ok {
+		resp.AdaptiveFillRate = rate
+	}
+	return resp
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAdmin(t *testing.T) (*http.ServeMux, *reloader) {
+	t.Helper()
+	cfg, err := ParseConfig([]byte(`{
+		"limiters": [
+			{"name": "api", "algorithm": "token_bucket", "capacity": 10, "fill_rate": 1,
+				"penalty": {"rejections": 1, "window": "1m", "ban": "10m"}},
+			{"name": "login", "algorithm": "fixed_window", "window_size": "1m", "max_requests": 5}
+		],
+		"rules": [{"path": "/api/**", "limiter": "api", "key": "ip"}]
+	}`))
+	if err != nil {
+		t.Fatalf("config should be valid: %v", err)
+	}
+	rl, err := newStaticReloader(cfg)
+	if err != nil {
+		t.Fatalf("newStaticReloader failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	newAdminAPI("secret", rl).register(mux)
+	return mux, rl
+}
+
+func adminRequest(mux *http.ServeMux, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminAuth(t *testing.T) {
+	mux, _ := newTestAdmin(t)
+
+	if rec := adminRequest(mux, http.MethodGet, "/admin/limiters", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", rec.Code)
+	}
+	if rec := adminRequest(mux, http.MethodGet, "/admin/limiters/api", "wrong", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with wrong token, got %d", rec.Code)
+	}
+	if rec := adminRequest(mux, http.MethodGet, "/admin/limiters/missing", "secret", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown limiter, got %d", rec.Code)
+	}
+}
+
+func TestAdminGetAndUpdate(t *testing.T) {
+	mux, rl := newTestAdmin(t)
+
+	rec := adminRequest(mux, http.MethodGet, "/admin/limiters", "secret", "")
+	var list []limiterResponse
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if rec.Code != http.StatusOK || len(list) != 2 || list[0].Name != "api" || list[1].Name != "login" {
+		t.Fatalf("Expected both limiters sorted by name, got %d: %s", rec.Code, rec.Body)
+	}
+
+	rl.current.Load().limiters["api"].get("10.0.0.1").Allow(4)
+	rec = adminRequest(mux, http.MethodGet, "/admin/limiters/api?key=10.0.0.1", "secret", "")
+	var got limiterResponse
+	json.Unmarshal(rec.Body.Bytes(), &got)
+	if rec.Code != http.StatusOK || got.Keys != 2 || !strings.Contains(string(got.State), `"capacity":10`) {
+		t.Errorf("Expected 2 keys and the state of 10.0.0.1, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := adminRequest(mux, http.MethodGet, "/admin/limiters/api?key=10.0.0.9", "secret", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a key without state, got %d", rec.Code)
+	}
+
+	rec = adminRequest(mux, http.MethodPut, "/admin/limiters/login", "secret", `{"window_size": "30s"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if cfg := rl.current.Load().limiters["login"].config(); time.Duration(cfg.WindowSize) != 30*time.Second || cfg.MaxRequests != 5 {
+		t.Errorf("Expected window 30s and max 5, got %+v", cfg)
+	}
+
+	for _, body := range []string{`{}`, `{"max_requests": -1}`, `{"fill_rate": 2}`} {
+		rec = adminRequest(mux, http.MethodPut, "/admin/limiters/login", "secret", body)
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for %s, got %d", body, rec.Code)
+		}
+		var errResp map[string]string
+		if json.Unmarshal(rec.Body.Bytes(), &errResp) != nil || errResp["error"] == "" {
+			t.Errorf("Expected JSON error for %s, got %s", body, rec.Body)
+		}
+	}
+
+	rec = adminRequest(mux, http.MethodPut, "/admin/limiters/api", "secret", `{"burst": 5}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unknown field, got %d", rec.Code)
+	}
+}
+
+func TestAdminBans(t *testing.T) {
+	mux, rl := newTestAdmin(t)
+	rl.current.Load().limiters["api"].penalize("10.0.0.1")
+
+	rec := adminRequest(mux, http.MethodGet, "/admin/bans", "secret", "")
+	var bans []ban
+	json.Unmarshal(rec.Body.Bytes(), &bans)
+	if rec.Code != http.StatusOK || len(bans) != 1 || bans[0].Limiter != "api" || bans[0].Key != "10.0.0.1" || bans[0].Bans != 1 {
+		t.Fatalf("Expected the ban of 10.0.0.1, got %d: %s", rec.Code, rec.Body)
+	}
+	if remaining := time.Duration(bans[0].Remaining); remaining <= 9*time.Minute || remaining > 10*time.Minute {
+		t.Errorf("Expected about 10m left, got %v", remaining)
+	}
+
+	if rec := adminRequest(mux, http.MethodDelete, "/admin/limiters/api/bans?key=10.0.0.1", "secret", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 lifting the ban, got %d: %s", rec.Code, rec.Body)
+	}
+	if _, ok := rl.current.Load().limiters["api"].banned("10.0.0.1"); ok {
+		t.Errorf("Expected the ban to be lifted")
+	}
+
+	for path, want := range map[string]int{
+		"/admin/limiters/api/bans?key=10.0.0.1":   http.StatusNotFound,
+		"/admin/limiters/api/bans":                http.StatusBadRequest,
+		"/admin/limiters/login/bans?key=10.0.0.1": http.StatusNotFound,
+	} {
+		if rec := adminRequest(mux, http.MethodDelete, path, "secret", ""); rec.Code != want {
+			t.Errorf("DELETE %s: expected %d, got %d", path, want, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// header names client_ip.headers may list
+const (
+	headerForwarded     = "Forwarded"
+	headerXForwardedFor = "X-Forwarded-For"
+	headerXRealIP       = "X-Real-IP"
+)
+
+// defaultIPHeaders are checked in this order when client_ip.headers is left out
+var defaultIPHeaders = []string{headerForwarded, headerXForwardedFor, headerXRealIP}
+
+// ipHeader returns the header name as the constants above spell it, false if it isn't one of them
+func ipHeader(name string) (string, bool) {
+	for _, h := range defaultIPHeaders {
+		if strings.EqualFold(name, h) {
+			return h, true
+		}
+	}
+	return "", false
+}
+
+// ipExtractor finds the client address of a request behind trusted proxies. The nil
+// extractor trusts no proxy and always uses the address of the connection.
+type ipExtractor struct {
+	trusted    []netip.Prefix
+	headers    []string
+	ipv6Prefix int
+}
+
+// newIPExtractor builds an extractor from an already validated config, nil when there is nothing to configure
+func newIPExtractor(cfg ClientIPConfig) *ipExtractor {
+	if !cfg.enabled() {
+		return nil
+	}
+	e := &ipExtractor{headers: defaultIPHeaders, ipv6Prefix: cfg.IPv6Prefix}
+	if len(cfg.Headers) > 0 {
+		e.headers = nil
+		for _, h := range cfg.Headers {
+			name, _ := ipHeader(h)
+			e.headers = append(e.headers, name)
+		}
+	}
+	for _, s := range cfg.TrustedProxies {
+		p, _ := parsePrefix(s)
+		e.trusted = append(e.trusted, p)
+	}
+	return e
+}
+
+// parseNode reads an address as proxies write it: "192.0.2.1", "192.0.2.1:80",
+// "2001:db8::1", "[2001:db8::1]:80" or any of those in quotes. The zone is dropped
+// and IPv4-mapped IPv6 addresses become IPv4.
+func parseNode(s string) (netip.Addr, bool) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.WithZone("").Unmap(), true
+}
+
+func (e *ipExtractor) isTrusted(addr netip.Addr) bool {
+	for _, p := range e.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// addr is the client address of r. Headers only count when the connection comes from a
+// trusted proxy, and then the chain is walked from the right: the first hop that isn't a
+// trusted proxy is the client. A hop that can't be parsed ends the walk at the one before it.
+func (e *ipExtractor) addr(r *http.Request) (netip.Addr, bool) {
+	peer, ok := parseNode(r.RemoteAddr)
+	if !ok || e == nil || !e.isTrusted(peer) {
+		return peer, ok
+	}
+	for _, name := range e.headers {
+		hops := forwardedHops(r, name)
+		if len(hops) == 0 {
+			continue
+		}
+		client := peer
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, ok := parseNode(hops[i])
+			if !ok {
+				break
+			}
+			client = addr
+			if !e.isTrusted(addr) {
+				break
+			}
+		}
+		return client, true
+	}
+	return peer, true
+}
+
+// forwardedHops lists the addresses a header carries, the client first and the proxy
+// closest to us last. Several instances of the header are one list in order.
+func forwardedHops(r *http.Request, name string) []string {
+	var hops []string
+	for _, v := range r.Header.Values(name) {
+		switch name {
+		case headerXRealIP:
+			hops = append(hops, v)
+		case headerXForwardedFor:
+			hops = append(hops, strings.Split(v, ",")...)
+		case headerForwarded:
+			// RFC 7239: for=192.0.2.60;proto=http, for="[2001:db8::17]:4711"
+			for _, element := range strings.Split(v, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+					if strings.EqualFold(key, "for") {
+						hops = append(hops, value)
+					}
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// clientIP is the key of the "ip" rules, the client address with IPv6 cut to the
+// configured prefix so one allocation counts as one client
+func (e *ipExtractor) clientIP(r *http.Request) string {
+	addr, ok := e.addr(r)
+	if !ok {
+		// not an IP, e.g. a unix socket, the host still makes a key but a port would
+		// give every connection its own
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			return host
+		}
+		return r.RemoteAddr
+	}
+	if e != nil && e.ipv6Prefix > 0 && addr.Is6() {
+		// the prefix was validated, it fits
+		p, _ := addr.Prefix(e.ipv6Prefix)
+		return p.String()
+	}
+	return addr.String()
+}
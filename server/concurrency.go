@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"concurrencylimiter"
+)
+
+// concurrencyLimit is one named in-flight cap from the config, with its metrics
+type concurrencyLimit struct {
+	*concurrencylimiter.ConcurrencyLimiter
+	name string
+
+	mu  sync.Mutex
+	cfg ConcurrencyConfig
+	// set for adaptive limits, it moves max in flight after every request
+	gradient *concurrencylimiter.GradientLimit
+}
+
+func newConcurrencyLimit(cfg ConcurrencyConfig) (*concurrencyLimit, error) {
+	cl, err := concurrencylimiter.NewConcurrencyLimiter(cfg.MaxInFlight, cfg.MaxQueue)
+	if err != nil {
+		return nil, err
+	}
+	cl.SetLogger(quietLogger)
+	gradient, err := newGradient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &concurrencyLimit{ConcurrencyLimiter: cl, name: cfg.Name, cfg: cfg, gradient: gradient}, nil
+}
+
+// newGradient returns nil unless cfg is adaptive
+func newGradient(cfg ConcurrencyConfig) (*concurrencylimiter.GradientLimit, error) {
+	if !cfg.Adaptive.enabled() {
+		return nil, nil
+	}
+	a := cfg.Adaptive
+	smoothing := a.Smoothing
+	if smoothing == 0 {
+		smoothing = defaultSmoothing
+	}
+	return concurrencylimiter.NewGradientLimit(concurrencylimiter.GradientConfig{
+		InitialLimit: cfg.MaxInFlight,
+		MinLimit:     a.MinLimit,
+		MaxLimit:     a.MaxLimit,
+		Smoothing:    smoothing,
+		MinRTTReset:  time.Duration(a.MinRTTReset),
+	})
+}
+
+func (c *concurrencyLimit) config() ConcurrencyConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cfg
+}
+
+// update changes the limits in place, requests in flight or queued are kept.
+// A new max_in_flight or adaptive config starts an adaptive limit over.
+func (c *concurrencyLimit) update(cfg ConcurrencyConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	maxInFlight := cfg.MaxInFlight
+	if cfg.Adaptive != c.cfg.Adaptive || cfg.MaxInFlight != c.cfg.MaxInFlight {
+		// config was checked before it got here
+		c.gradient, _ = newGradient(cfg)
+	} else if c.gradient != nil {
+		maxInFlight = 0 // keep the learned limit
+	}
+	c.cfg = cfg
+	c.Update(maxInFlight, cfg.MaxQueue)
+}
+
+// adaptive returns the gradient of an adaptive limit, nil otherwise
+func (c *concurrencyLimit) adaptive() *concurrencylimiter.GradientLimit {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gradient
+}
+
+// acquire takes a slot for one request, waiting at most queue_timeout in line.
+// The returned func gives the slot back and must be called once the request is done,
+// failed reports a request that errored so an adaptive limit backs off.
+func (c *concurrencyLimit) acquire(ctx context.Context) (func(failed bool), error) {
+	if timeout := time.Duration(c.config().QueueTimeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if err := c.Acquire(ctx, 1); err != nil {
+		reason := "timeout"
+		switch {
+		case errors.Is(err, concurrencylimiter.ErrQueueFull):
+			reason = "queue_full"
+		case errors.Is(err, context.Canceled):
+			reason = "canceled"
+		}
+		concurrencyRejectedTotal.WithLabelValues(c.name, reason).Inc()
+		return nil, err
+	}
+
+	// the RTT starts once the request holds its slot, time in the queue is not the backend's
+	start, inFlight := time.Now(), c.InFlight()
+	return func(failed bool) {
+		c.Release(1)
+		if gradient := c.adaptive(); gradient != nil {
+			limit := gradient.OnSample(time.Since(start), inFlight, failed)
+			c.mu.Lock()
+			// an update may have swapped the gradient in the meantime
+			if c.gradient == gradient {
+				c.Update(limit, -1)
+			}
+			c.mu.Unlock()
+		}
+	}, nil
+}
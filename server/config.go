@@ -0,0 +1,831 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Algorithms the config can ask for
+const (
+	TokenBucket   = "token_bucket"
+	LeakyBucket   = "leaky_bucket"
+	FixedWindow   = "fixed_window"
+	SlidingWindow = "sliding_window"
+	SlidingLog    = "sliding_log"
+	GCRA          = "gcra"
+	Composite     = "composite"
+	SingleRateTCM = "srtcm"
+	TwoRateTCM    = "trtcm"
+	MultiBucket   = "multi_token_bucket"
+	Hierarchy     = "hierarchy"
+)
+
+var algorithms = []string{TokenBucket, LeakyBucket, FixedWindow, SlidingWindow, SlidingLog, GCRA, Composite, SingleRateTCM, TwoRateTCM, MultiBucket, Hierarchy}
+
+type Config struct {
+	Limiters    []LimiterConfig     `json:"limiters"`
+	Concurrency []ConcurrencyConfig `json:"concurrency,omitempty"`
+	Rules       []RuleConfig        `json:"rules"`
+	// checked before every rule, deny lists first
+	Lists []AccessListConfig `json:"lists,omitempty"`
+	// how the "ip" key and the lists find the client behind proxies
+	ClientIP ClientIPConfig `json:"client_ip,omitzero"`
+}
+
+// ClientIPConfig trusts the forwarding headers of requests that come from trusted_proxies.
+// The first address from the right that isn't a trusted proxy is the client.
+type ClientIPConfig struct {
+	// CIDRs or single addresses of the load balancers and proxies in front of the server
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+	// "Forwarded", "X-Forwarded-For" and/or "X-Real-IP", the first one a request has is
+	// used, defaults to all three in that order
+	Headers []string `json:"headers,omitempty"`
+	// groups IPv6 clients by this prefix, e.g. 64 so an allocation is one client. 0 keeps the whole address.
+	IPv6Prefix int `json:"ipv6_prefix,omitempty"`
+}
+
+func (c ClientIPConfig) enabled() bool {
+	return len(c.TrustedProxies) > 0 || len(c.Headers) > 0 || c.IPv6Prefix != 0
+}
+
+func (c ClientIPConfig) Validate() error {
+	var errs []error
+	for _, s := range c.TrustedProxies {
+		if _, err := parsePrefix(s); err != nil {
+			errs = append(errs, fmt.Errorf("invalid trusted proxy %q", s))
+		}
+	}
+	if len(c.Headers) > 0 && len(c.TrustedProxies) == 0 {
+		errs = append(errs, errors.New("headers is not used without trusted_proxies"))
+	}
+	for _, h := range c.Headers {
+		if _, ok := ipHeader(h); !ok {
+			errs = append(errs, fmt.Errorf(`unsupported header %q, must be "Forwarded", "X-Forwarded-For" or "X-Real-IP"`, h))
+		}
+	}
+	if c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+		errs = append(errs, errors.New("ipv6_prefix must be between 0 and 128"))
+	}
+	return errors.Join(errs...)
+}
+
+// LimiterConfig declares one named limiter, only the fields used by its algorithm may be set
+type LimiterConfig struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"`
+
+	Capacity int64   `json:"capacity,omitempty"`  // token_bucket, leaky_bucket, gcra (the burst), srtcm and trtcm (committed burst)
+	FillRate float64 `json:"fill_rate,omitempty"` // token_bucket, gcra, srtcm and trtcm (committed rate), tokens per second
+	LeakRate float64 `json:"leak_rate,omitempty"` // leaky_bucket, requests per second
+
+	ExcessBurst int64   `json:"excess_burst,omitempty"` // srtcm, requests over the committed burst marked yellow
+	PeakRate    float64 `json:"peak_rate,omitempty"`    // trtcm, requests over it are red
+	PeakBurst   int64   `json:"peak_burst,omitempty"`   // trtcm
+
+	WindowSize  Duration `json:"window_size,omitempty"`  // fixed_window, sliding_window, sliding_log
+	MaxRequests int64    `json:"max_requests,omitempty"` // fixed_window, sliding_window, sliding_log
+
+	// token_bucket, moves the fill rate with latency and errors, fill_rate is where it starts
+	Adaptive AdaptiveConfig `json:"adaptive,omitzero"`
+	// token_bucket, tokens a burst may overdraw the bucket by, paid back before anything else goes through
+	MaxDebt int64 `json:"max_debt,omitempty"`
+	// token_bucket, ramps a cold bucket up to capacity and fill_rate
+	Warmup WarmupConfig `json:"warmup,omitzero"`
+
+	// composite, every one of these limits has to allow a request
+	Limits []LimiterConfig `json:"limits,omitempty"`
+
+	// multi_token_bucket, one bucket per resource, every one of them has to have room
+	Dimensions []DimensionConfig `json:"dimensions,omitempty"`
+
+	// hierarchy, nested token buckets from the root down, a request has to fit every one on its path
+	Levels []LevelConfig `json:"levels,omitempty"`
+
+	// any algorithm, bans keys that keep getting rejected
+	Penalty PenaltyConfig `json:"penalty,omitzero"`
+}
+
+// PenaltyConfig bans a key for ban once it was rejected rejections times within window.
+// Every ban in a row is multiplier times longer, up to max_ban.
+type PenaltyConfig struct {
+	Rejections int      `json:"rejections"`
+	Window     Duration `json:"window"`
+	Ban        Duration `json:"ban"`
+	Multiplier float64  `json:"multiplier,omitempty"` // 1 or left out keeps every ban the same
+	MaxBan     Duration `json:"max_ban,omitempty"`    // required with a multiplier
+}
+
+func (p PenaltyConfig) enabled() bool {
+	return p != PenaltyConfig{}
+}
+
+func (p PenaltyConfig) Validate() error {
+	var errs []error
+	if p.Rejections <= 0 {
+		errs = append(errs, errors.New("rejections must be positive"))
+	}
+	if p.Window <= 0 || p.Ban <= 0 {
+		errs = append(errs, errors.New("window and ban must be positive"))
+	}
+	switch {
+	case p.Multiplier != 0 && p.Multiplier < 1:
+		errs = append(errs, errors.New("multiplier must be at least 1"))
+	case p.Multiplier > 1 && p.MaxBan <= 0:
+		errs = append(errs, errors.New("max_ban is required with a multiplier"))
+	case p.MaxBan != 0 && p.MaxBan < p.Ban:
+		errs = append(errs, errors.New("max_ban must be at least ban"))
+	}
+	return errors.Join(errs...)
+}
+
+// what happens to a request on an access list
+const (
+	ListAllow = "allow" // skips every rate and concurrency limit
+	ListDeny  = "deny"  // rejected with 403
+)
+
+// defaultAPIKeyHeader carries the API key when api_key_header is left out
+const defaultAPIKeyHeader = "X-API-Key"
+
+// AccessListConfig matches requests by client IP, API key or header value, a request
+// matching any one of the entries is on the list
+type AccessListConfig struct {
+	Name   string `json:"name"`
+	Action string `json:"action"` // "allow" or "deny"
+	// CIDRs like "10.0.0.0/8" or single addresses
+	CIDRs   []string `json:"cidrs,omitempty"`
+	APIKeys []string `json:"api_keys,omitempty"`
+	// header carrying the API key, defaults to X-API-Key
+	APIKeyHeader string `json:"api_key_header,omitempty"`
+	// header name to the exact values that match
+	Headers map[string][]string `json:"headers,omitempty"`
+}
+
+func (l AccessListConfig) apiKeyHeader() string {
+	if l.APIKeyHeader == "" {
+		return defaultAPIKeyHeader
+	}
+	return l.APIKeyHeader
+}
+
+func (l AccessListConfig) Validate() error {
+	var errs []error
+	if l.Name == "" {
+		errs = append(errs, errors.New("name is required"))
+	}
+	if l.Action != ListAllow && l.Action != ListDeny {
+		errs = append(errs, fmt.Errorf(`invalid action %q, must be "allow" or "deny"`, l.Action))
+	}
+	if len(l.CIDRs) == 0 && len(l.APIKeys) == 0 && len(l.Headers) == 0 {
+		errs = append(errs, errors.New("at least one of cidrs, api_keys or headers is required"))
+	}
+	for _, s := range l.CIDRs {
+		if _, err := parsePrefix(s); err != nil {
+			errs = append(errs, fmt.Errorf("invalid cidr %q", s))
+		}
+	}
+	if l.APIKeyHeader != "" && len(l.APIKeys) == 0 {
+		errs = append(errs, errors.New("api_key_header is not used without api_keys"))
+	}
+	for _, name := range slices.Sorted(maps.Keys(l.Headers)) {
+		if len(l.Headers[name]) == 0 {
+			errs = append(errs, fmt.Errorf("headers: %q needs at least one value", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DimensionConfig is one resource of a multi_token_bucket, e.g. requests or bytes
+type DimensionConfig struct {
+	Name     string  `json:"name"`
+	Capacity int64   `json:"capacity"`
+	FillRate float64 `json:"fill_rate"` // tokens per second
+}
+
+// LevelConfig is one level of a hierarchy, e.g. the service, each tenant or each user
+type LevelConfig struct {
+	Name     string  `json:"name"`
+	Capacity int64   `json:"capacity"`
+	FillRate float64 `json:"fill_rate"` // tokens per second
+	// rate up to which a node may borrow idle tokens of its parent, 0 never borrows
+	Ceil float64 `json:"ceil,omitempty"`
+}
+
+// sameLimits reports whether both configs have the same limits by name and algorithm,
+// the same dimensions and the same levels, only then can the limiters of one be updated
+// to the other in place
+func (l LimiterConfig) sameLimits(other LimiterConfig) bool {
+	return slices.EqualFunc(l.Limits, other.Limits, func(a, b LimiterConfig) bool {
+		return a.Name == b.Name && a.Algorithm == b.Algorithm && a.sameLimits(b)
+	}) && slices.EqualFunc(l.Dimensions, other.Dimensions, func(a, b DimensionConfig) bool {
+		return a.Name == b.Name
+	}) && slices.EqualFunc(l.Levels, other.Levels, func(a, b LevelConfig) bool {
+		// a level can start borrowing in place, but not stop
+		return a.Name == b.Name && (a.Ceil > 0) == (b.Ceil > 0)
+	})
+}
+
+// AdaptiveConfig raises the fill rate by increase every interval the requests stay under
+// target, and multiplies it by decrease when they don't
+type AdaptiveConfig struct {
+	MinFillRate   float64  `json:"min_fill_rate"`
+	MaxFillRate   float64  `json:"max_fill_rate"`
+	Increase      float64  `json:"increase"`
+	Decrease      float64  `json:"decrease"`
+	TargetLatency Duration `json:"target_latency,omitempty"` // mean handler latency
+	MaxErrorRate  float64  `json:"max_error_rate,omitempty"` // share of 5xx responses, 0.05 is 5%
+	Interval      Duration `json:"interval"`
+}
+
+func (a AdaptiveConfig) enabled() bool {
+	return a != AdaptiveConfig{}
+}
+
+// WarmupConfig starts a bucket at fraction of its capacity and fill rate and ramps it up
+// over period. After idle_reset without requests it is cold again.
+type WarmupConfig struct {
+	Period    Duration `json:"period"`
+	Fraction  float64  `json:"fraction"`
+	IdleReset Duration `json:"idle_reset,omitempty"` // 0 never goes cold again
+}
+
+func (w WarmupConfig) enabled() bool {
+	return w != WarmupConfig{}
+}
+
+func (w WarmupConfig) Validate() error {
+	var errs []error
+	if w.Period <= 0 {
+		errs = append(errs, errors.New("period must be positive"))
+	}
+	if w.Fraction <= 0 || w.Fraction > 1 {
+		errs = append(errs, errors.New("fraction must be between 0 and 1"))
+	}
+	if w.IdleReset < 0 {
+		errs = append(errs, errors.New("idle_reset can't be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// ConcurrencyConfig caps the requests in flight at once, shared by every rule that names it
+type ConcurrencyConfig struct {
+	Name        string `json:"name"`
+	MaxInFlight int    `json:"max_in_flight"`
+	MaxQueue    int    `json:"max_queue,omitempty"` // requests waiting for a slot, 0 turns them away right away
+	// how long a queued request waits for a slot, 0 waits as long as the client does
+	QueueTimeout Duration `json:"queue_timeout,omitempty"`
+
+	// follows the backend's RTT, max_in_flight is where it starts
+	Adaptive AdaptiveConcurrencyConfig `json:"adaptive,omitzero"`
+}
+
+// defaultSmoothing is used when adaptive.smoothing is left out
+const defaultSmoothing = 0.2
+
+// AdaptiveConcurrencyConfig moves max_in_flight by comparing each request's RTT to the
+// lowest one seen, see concurrencylimiter.GradientLimit
+type AdaptiveConcurrencyConfig struct {
+	MinLimit    int      `json:"min_limit"`
+	MaxLimit    int      `json:"max_limit"`
+	Smoothing   float64  `json:"smoothing,omitempty"`     // weight of each new estimate, default 0.2
+	MinRTTReset Duration `json:"min_rtt_reset,omitempty"` // how often the min RTT is measured again, 0 never
+}
+
+func (a AdaptiveConcurrencyConfig) enabled() bool {
+	return a != AdaptiveConcurrencyConfig{}
+}
+
+// RuleConfig sends requests matching path and method to a limiter.
+// Rules are checked in order and the first match wins.
+type RuleConfig struct {
+	// path.Match pattern, a trailing "/**" also matches everything below it
+	Path    string `json:"path"`
+	Method  string `json:"method,omitempty"` // empty matches any method
+	Limiter string `json:"limiter,omitempty"`
+	// name of a concurrency limit applied after the rate limit, at least one of the two is required
+	Concurrency string `json:"concurrency,omitempty"`
+	// "global" (default), "ip", "header:<name>" or "query:<name>"
+	Key string `json:"key,omitempty"`
+	// hierarchy limiters only, one key like the above per level below the root
+	Keys []string `json:"keys,omitempty"`
+	// what a request takes from the limiter, fractions like 0.1 allowed, defaults to 1
+	Cost float64 `json:"cost,omitempty"`
+	// cost per dimension of a multi_token_bucket, dimensions left out take cost
+	Costs map[string]float64 `json:"costs,omitempty"`
+	// "request_bytes", "response_bytes" or "duration" to charge cost per byte or second
+	// instead of per request, a request always counts as at least 1
+	CostBy string `json:"cost_by,omitempty"`
+}
+
+// what a request is charged by, see RuleConfig.CostBy
+const (
+	CostByRequestBytes  = "request_bytes"
+	CostByResponseBytes = "response_bytes"
+	CostByDuration      = "duration"
+)
+
+// Duration reads "10s" style strings from JSON
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New(`duration must be a string like "10s"`)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// LoadConfig reads and validates a JSON config file
+func LoadConfig(filename string) (*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+func ParseConfig(data []byte) (*Config, error) {
+	var cfg Config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate reports every problem in the config at once
+func (c *Config) Validate() error {
+	var errs []error
+	if len(c.Limiters) == 0 && len(c.Concurrency) == 0 {
+		errs = append(errs, errors.New("at least one limiter is required"))
+	}
+
+	names := make(map[string]bool)
+	byName := make(map[string]LimiterConfig)
+	for i, l := range c.Limiters {
+		where := fmt.Sprintf("limiters[%d]", i)
+		if l.Name != "" {
+			where = fmt.Sprintf("limiters[%d] %q", i, l.Name)
+		}
+		if err := l.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", where, err))
+		}
+		if names[l.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate limiter name", where))
+		}
+		names[l.Name] = true
+		byName[l.Name] = l
+	}
+
+	concurrency := make(map[string]bool)
+	for i, cc := range c.Concurrency {
+		where := fmt.Sprintf("concurrency[%d]", i)
+		if cc.Name != "" {
+			where = fmt.Sprintf("concurrency[%d] %q", i, cc.Name)
+		}
+		if err := cc.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", where, err))
+		}
+		if concurrency[cc.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate concurrency name", where))
+		}
+		concurrency[cc.Name] = true
+	}
+
+	if err := c.ClientIP.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("client_ip: %w", err))
+	}
+
+	lists := make(map[string]bool)
+	for i, l := range c.Lists {
+		where := fmt.Sprintf("lists[%d]", i)
+		if l.Name != "" {
+			where = fmt.Sprintf("lists[%d] %q", i, l.Name)
+		}
+		if err := l.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", where, err))
+		}
+		if lists[l.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate list name", where))
+		}
+		lists[l.Name] = true
+	}
+
+	for i, r := range c.Rules {
+		where := fmt.Sprintf("rules[%d] %q", i, r.Path)
+		if err := r.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", where, err))
+		}
+		if r.Limiter != "" && !names[r.Limiter] {
+			errs = append(errs, fmt.Errorf("%s: unknown limiter %q", where, r.Limiter))
+		}
+		if len(r.Costs) > 0 && names[r.Limiter] {
+			if err := r.validateCosts(byName[r.Limiter]); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", where, err))
+			}
+		}
+		if names[r.Limiter] {
+			if err := r.validateKeys(byName[r.Limiter]); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", where, err))
+			}
+			// one ban of the shared key would shut everybody out
+			if byName[r.Limiter].Penalty.enabled() && r.global() {
+				errs = append(errs, fmt.Errorf("%s: limiter %q has a penalty, it can't be used with a global key", where, r.Limiter))
+			}
+		}
+		if r.Concurrency != "" && !concurrency[r.Concurrency] {
+			errs = append(errs, fmt.Errorf("%s: unknown concurrency %q", where, r.Concurrency))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (l LimiterConfig) Validate() error {
+	var errs []error
+	if l.Name == "" {
+		errs = append(errs, errors.New("name is required"))
+	}
+
+	positive := func(field string, set bool) {
+		if !set {
+			errs = append(errs, fmt.Errorf("%s must be positive for %s", field, l.Algorithm))
+		}
+	}
+	unused := func(field string, set bool) {
+		if set {
+			errs = append(errs, fmt.Errorf("%s is not used by %s", field, l.Algorithm))
+		}
+	}
+
+	if l.Adaptive.enabled() {
+		if l.Algorithm == TokenBucket {
+			if err := l.Adaptive.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("adaptive: %w", err))
+			}
+		} else {
+			unused("adaptive", true)
+		}
+	}
+
+	if l.Warmup.enabled() {
+		if l.Algorithm == TokenBucket {
+			if err := l.Warmup.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("warmup: %w", err))
+			}
+		} else {
+			unused("warmup", true)
+		}
+	}
+
+	if l.Penalty.enabled() {
+		if err := l.Penalty.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("penalty: %w", err))
+		}
+	}
+
+	if l.Algorithm == TokenBucket {
+		if l.MaxDebt < 0 {
+			errs = append(errs, errors.New("max_debt can't be negative"))
+		}
+	} else {
+		unused("max_debt", l.MaxDebt != 0)
+	}
+
+	if l.Algorithm != Composite {
+		unused("limits", len(l.Limits) > 0)
+	}
+	if l.Algorithm != MultiBucket {
+		unused("dimensions", len(l.Dimensions) > 0)
+	}
+	if l.Algorithm != Hierarchy {
+		unused("levels", len(l.Levels) > 0)
+	}
+	if l.Algorithm != SingleRateTCM {
+		unused("excess_burst", l.ExcessBurst != 0)
+	}
+	if l.Algorithm != TwoRateTCM {
+		unused("peak_rate", l.PeakRate != 0)
+		unused("peak_burst", l.PeakBurst != 0)
+	}
+
+	switch l.Algorithm {
+	case TokenBucket, LeakyBucket, GCRA:
+		positive("capacity", l.Capacity > 0)
+		if l.Algorithm != LeakyBucket {
+			positive("fill_rate", l.FillRate > 0)
+			unused("leak_rate", l.LeakRate != 0)
+		} else {
+			positive("leak_rate", l.LeakRate > 0)
+			unused("fill_rate", l.FillRate != 0)
+		}
+		unused("window_size", l.WindowSize != 0)
+		unused("max_requests", l.MaxRequests != 0)
+	case FixedWindow, SlidingWindow, SlidingLog:
+		positive("window_size", l.WindowSize > 0)
+		positive("max_requests", l.MaxRequests > 0)
+		unused("capacity", l.Capacity != 0)
+		unused("fill_rate", l.FillRate != 0)
+		unused("leak_rate", l.LeakRate != 0)
+	case SingleRateTCM, TwoRateTCM:
+		positive("capacity", l.Capacity > 0)
+		positive("fill_rate", l.FillRate > 0)
+		unused("leak_rate", l.LeakRate != 0)
+		unused("window_size", l.WindowSize != 0)
+		unused("max_requests", l.MaxRequests != 0)
+		if l.ExcessBurst < 0 {
+			errs = append(errs, errors.New("excess_burst can't be negative"))
+		}
+		if l.Algorithm == TwoRateTCM {
+			positive("peak_burst", l.PeakBurst > 0)
+			if l.PeakRate < l.FillRate {
+				errs = append(errs, errors.New("peak_rate must be at least fill_rate"))
+			}
+		}
+	case Composite:
+		if len(l.Limits) == 0 {
+			errs = append(errs, errors.New("limits is required for composite"))
+		}
+		unused("capacity", l.Capacity != 0)
+		unused("fill_rate", l.FillRate != 0)
+		unused("leak_rate", l.LeakRate != 0)
+		unused("window_size", l.WindowSize != 0)
+		unused("max_requests", l.MaxRequests != 0)
+		errs = append(errs, l.validateLimits()...)
+	case MultiBucket:
+		if len(l.Dimensions) == 0 {
+			errs = append(errs, errors.New("dimensions is required for multi_token_bucket"))
+		}
+		unused("capacity", l.Capacity != 0)
+		unused("fill_rate", l.FillRate != 0)
+		unused("leak_rate", l.LeakRate != 0)
+		unused("window_size", l.WindowSize != 0)
+		unused("max_requests", l.MaxRequests != 0)
+		errs = append(errs, l.validateDimensions()...)
+	case Hierarchy:
+		if len(l.Levels) == 0 {
+			errs = append(errs, errors.New("levels is required for hierarchy"))
+		}
+		unused("capacity", l.Capacity != 0)
+		unused("fill_rate", l.FillRate != 0)
+		unused("leak_rate", l.LeakRate != 0)
+		unused("window_size", l.WindowSize != 0)
+		unused("max_requests", l.MaxRequests != 0)
+		errs = append(errs, l.validateLevels()...)
+	case "":
+		errs = append(errs, fmt.Errorf("algorithm is required, one of %s", strings.Join(algorithms, ", ")))
+	default:
+		errs = append(errs, fmt.Errorf("unknown algorithm %q, must be one of %s", l.Algorithm, strings.Join(algorithms, ", ")))
+	}
+	return errors.Join(errs...)
+}
+
+// validateLimits checks the limits of a composite, they can't be composites or adaptive themselves
+func (l LimiterConfig) validateLimits() []error {
+	var errs []error
+	names := make(map[string]bool)
+	for i, child := range l.Limits {
+		where := fmt.Sprintf("limits[%d]", i)
+		if child.Name != "" {
+			where = fmt.Sprintf("limits[%d] %q", i, child.Name)
+		}
+		switch {
+		case child.Algorithm == Composite:
+			errs = append(errs, fmt.Errorf("%s: a composite can't contain another composite", where))
+		case child.Algorithm == Hierarchy:
+			errs = append(errs, fmt.Errorf("%s: a composite can't contain a hierarchy", where))
+		case child.Adaptive.enabled():
+			errs = append(errs, fmt.Errorf("%s: adaptive is not supported inside a composite", where))
+		case child.Penalty.enabled():
+			errs = append(errs, fmt.Errorf("%s: penalty is not supported inside a composite", where))
+		default:
+			if err := child.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", where, err))
+			}
+		}
+		if names[child.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate limit name", where))
+		}
+		names[child.Name] = true
+	}
+	return errs
+}
+
+// validateDimensions checks the dimensions of a multi_token_bucket
+func (l LimiterConfig) validateDimensions() []error {
+	var errs []error
+	names := make(map[string]bool)
+	for i, d := range l.Dimensions {
+		where := fmt.Sprintf("dimensions[%d]", i)
+		if d.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: name is required", where))
+		} else {
+			where = fmt.Sprintf("dimensions[%d] %q", i, d.Name)
+		}
+		if d.Capacity <= 0 || d.FillRate <= 0 {
+			errs = append(errs, fmt.Errorf("%s: capacity and fill_rate must be positive", where))
+		}
+		if names[d.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate dimension name", where))
+		}
+		names[d.Name] = true
+	}
+	return errs
+}
+
+// validateLevels checks the levels of a hierarchy, the first one is the root and has nothing to borrow from
+func (l LimiterConfig) validateLevels() []error {
+	var errs []error
+	names := make(map[string]bool)
+	for i, lv := range l.Levels {
+		where := fmt.Sprintf("levels[%d]", i)
+		if lv.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: name is required", where))
+		} else {
+			where = fmt.Sprintf("levels[%d] %q", i, lv.Name)
+		}
+		if lv.Capacity <= 0 || lv.FillRate <= 0 {
+			errs = append(errs, fmt.Errorf("%s: capacity and fill_rate must be positive", where))
+		}
+		switch {
+		case i == 0 && lv.Ceil != 0:
+			errs = append(errs, fmt.Errorf("%s: ceil is not used by the root level", where))
+		case lv.Ceil != 0 && lv.Ceil < lv.FillRate:
+			errs = append(errs, fmt.Errorf("%s: ceil must be at least fill_rate", where))
+		}
+		if names[lv.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate level name", where))
+		}
+		names[lv.Name] = true
+	}
+	return errs
+}
+
+func (a AdaptiveConfig) Validate() error {
+	var errs []error
+	if a.MinFillRate <= 0 || a.MaxFillRate < a.MinFillRate {
+		errs = append(errs, errors.New("min_fill_rate must be positive and at most max_fill_rate"))
+	}
+	if a.Increase <= 0 {
+		errs = append(errs, errors.New("increase must be positive"))
+	}
+	if a.Decrease <= 0 || a.Decrease >= 1 {
+		errs = append(errs, errors.New("decrease must be between 0 and 1"))
+	}
+	if a.TargetLatency < 0 || a.MaxErrorRate < 0 || a.MaxErrorRate > 1 {
+		errs = append(errs, errors.New("target_latency can't be negative and max_error_rate must be between 0 and 1"))
+	}
+	if a.TargetLatency == 0 && a.MaxErrorRate == 0 {
+		errs = append(errs, errors.New("target_latency or max_error_rate is required"))
+	}
+	if a.Interval <= 0 {
+		errs = append(errs, errors.New("interval must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+func (c ConcurrencyConfig) Validate() error {
+	var errs []error
+	if c.Name == "" {
+		errs = append(errs, errors.New("name is required"))
+	}
+	if c.MaxInFlight <= 0 {
+		errs = append(errs, errors.New("max_in_flight must be positive"))
+	}
+	if c.MaxQueue < 0 {
+		errs = append(errs, errors.New("max_queue can't be negative"))
+	}
+	if c.QueueTimeout < 0 {
+		errs = append(errs, errors.New("queue_timeout can't be negative"))
+	}
+	if a := c.Adaptive; a.enabled() {
+		if a.MinLimit <= 0 || a.MaxLimit < a.MinLimit {
+			errs = append(errs, errors.New("adaptive: min_limit must be positive and at most max_limit"))
+		} else if c.MaxInFlight < a.MinLimit || c.MaxInFlight > a.MaxLimit {
+			errs = append(errs, errors.New("adaptive: max_in_flight must be between min_limit and max_limit"))
+		}
+		if a.Smoothing < 0 || a.Smoothing > 1 {
+			errs = append(errs, errors.New("adaptive: smoothing must be between 0 and 1"))
+		}
+		if a.MinRTTReset < 0 {
+			errs = append(errs, errors.New("adaptive: min_rtt_reset can't be negative"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r RuleConfig) Validate() error {
+	var errs []error
+	if !strings.HasPrefix(r.Path, "/") {
+		errs = append(errs, errors.New("path must start with /"))
+	} else if _, err := path.Match(strings.TrimSuffix(r.Path, "/**"), ""); err != nil {
+		errs = append(errs, fmt.Errorf("invalid path pattern: %w", err))
+	}
+
+	switch r.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+	default:
+		errs = append(errs, fmt.Errorf("unsupported method %q", r.Method))
+	}
+
+	if r.Limiter == "" && r.Concurrency == "" {
+		errs = append(errs, errors.New("limiter or concurrency is required"))
+	}
+	if _, err := newKeyFunc(r.Key, nil); err != nil {
+		errs = append(errs, err)
+	}
+	for _, spec := range r.Keys {
+		if _, err := newKeyFunc(spec, nil); err != nil {
+			errs = append(errs, fmt.Errorf("keys: %w", err))
+		}
+	}
+	if len(r.Keys) > 0 && r.Key != "" {
+		errs = append(errs, errors.New("key and keys can't both be set"))
+	}
+	if r.Cost < 0 {
+		errs = append(errs, errors.New("cost must be positive"))
+	} else if r.Cost != 0 && r.Limiter == "" {
+		errs = append(errs, errors.New("cost is not used without a limiter"))
+	}
+	for _, name := range slices.Sorted(maps.Keys(r.Costs)) {
+		if r.Costs[name] < 0 {
+			errs = append(errs, fmt.Errorf("costs: %q can't be negative", name))
+		}
+	}
+	switch r.CostBy {
+	case "", CostByRequestBytes, CostByResponseBytes, CostByDuration:
+		if r.CostBy != "" && r.Limiter == "" {
+			errs = append(errs, errors.New("cost_by is not used without a limiter"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf(`invalid cost_by %q, must be "request_bytes", "response_bytes" or "duration"`, r.CostBy))
+	}
+	return errors.Join(errs...)
+}
+
+// validateCosts checks that the costs of r name dimensions of l, the limiter of the rule
+func (r RuleConfig) validateCosts(l LimiterConfig) error {
+	if l.Algorithm != MultiBucket {
+		return fmt.Errorf("costs is only used with a multi_token_bucket limiter")
+	}
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(r.Costs)) {
+		if !slices.ContainsFunc(l.Dimensions, func(d DimensionConfig) bool { return d.Name == name }) {
+			errs = append(errs, fmt.Errorf("costs: unknown dimension %q", name))
+		}
+	}
+	// dimensions left out take cost, which is never 0
+	free := !slices.ContainsFunc(l.Dimensions, func(d DimensionConfig) bool {
+		cost, ok := r.Costs[d.Name]
+		return !ok || cost > 0
+	})
+	if free {
+		errs = append(errs, errors.New("costs: at least one dimension must cost something"))
+	}
+	return errors.Join(errs...)
+}
+
+// global reports whether every request of r shares one key
+func (r RuleConfig) global() bool {
+	return (r.Key == "" || r.Key == "global") && len(r.Keys) == 0
+}
+
+// validateKeys checks that a rule has one key per level below the root of a hierarchy
+// limiter, and no keys for any other limiter
+func (r RuleConfig) validateKeys(l LimiterConfig) error {
+	if l.Algorithm != Hierarchy {
+		if len(r.Keys) > 0 {
+			return errors.New("keys is only used with a hierarchy limiter")
+		}
+		return nil
+	}
+	if r.Key != "" {
+		return errors.New("key is not used with a hierarchy limiter, use keys")
+	}
+	if want := max(len(l.Levels)-1, 0); len(r.Keys) != want {
+		return fmt.Errorf("keys must have one key per level below the root, %d for limiter %q", want, l.Name)
+	}
+	return nil
+}
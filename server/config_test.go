@@ -0,0 +1,261 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := LoadConfig("config.example.json")
+	if err != nil {
+		t.Fatalf("example config should be valid: %v", err)
+	}
+	if len(cfg.Limiters) != 10 || len(cfg.Rules) != 10 {
+		t.Errorf("Expected 10 limiters and 10 rules, got %d and %d", len(cfg.Limiters), len(cfg.Rules))
+	}
+	if time.Duration(cfg.Limiters[1].WindowSize) != time.Minute {
+		t.Errorf("Expected window_size 1m, got %v", time.Duration(cfg.Limiters[1].WindowSize))
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want []string // every message should show up in the error
+	}{
+		{
+			name: "no limiters",
+			json: `{"limiters": []}`,
+			want: []string{"at least one limiter is required"},
+		},
+		{
+			name: "unknown algorithm",
+			json: `{"limiters": [{"name": "a", "algorithm": "magic"}]}`,
+			want: []string{`limiters[0] "a": unknown algorithm "magic"`},
+		},
+		{
+			name: "missing and unused fields",
+			json: `{"limiters": [{"name": "a", "algorithm": "token_bucket", "capacity": 10, "window_size": "1s"}]}`,
+			want: []string{"fill_rate must be positive for token_bucket", "window_size is not used by token_bucket"},
+		},
+		{
+			name: "gcra without a rate",
+			json: `{"limiters": [{"name": "a", "algorithm": "gcra", "capacity": 5, "leak_rate": 1}]}`,
+			want: []string{"fill_rate must be positive for gcra", "leak_rate is not used by gcra"},
+		},
+		{
+			name: "duplicate names",
+			json: `{"limiters": [
+				{"name": "a", "algorithm": "fixed_window", "window_size": "1s", "max_requests": 1},
+				{"name": "a", "algorithm": "sliding_log", "window_size": "1s", "max_requests": 1}
+			]}`,
+			want: []string{`limiters[1] "a": duplicate limiter name`},
+		},
+		{
+			name: "bad rules",
+			json: `{"limiters": [{"name": "a", "algorithm": "leaky_bucket", "capacity": 1, "leak_rate": 1}],
+				"rules": [{"path": "api", "method": "FETCH", "limiter": "b", "key": "cookie:x"}]}`,
+			want: []string{"path must start with /", `unsupported method "FETCH"`, `unknown limiter "b"`, `invalid key "cookie:x"`},
+		},
+		{
+			name: "bad concurrency",
+			json: `{"limiters": [{"name": "a", "algorithm": "fixed_window", "window_size": "1s", "max_requests": 1}],
+				"concurrency": [{"name": "c", "max_in_flight": 0, "max_queue": -1}],
+				"rules": [{"path": "/api"}, {"path": "/api/**", "limiter": "a", "concurrency": "d"}]}`,
+			want: []string{`concurrency[0] "c": max_in_flight must be positive`, "max_queue can't be negative",
+				"limiter or concurrency is required", `unknown concurrency "d"`},
+		},
+		{
+			name: "bad adaptive concurrency",
+			json: `{"concurrency": [
+				{"name": "a", "max_in_flight": 50, "adaptive": {"min_limit": 1, "max_limit": 10, "smoothing": 2}},
+				{"name": "b", "max_in_flight": 5, "adaptive": {"min_limit": 0, "max_limit": 10}}
+			]}`,
+			want: []string{`concurrency[0] "a": adaptive: max_in_flight must be between min_limit and max_limit`,
+				"adaptive: smoothing must be between 0 and 1", `concurrency[1] "b": adaptive: min_limit must be positive`},
+		},
+		{
+			name: "bad adaptive",
+			json: `{"limiters": [
+				{"name": "a", "algorithm": "token_bucket", "capacity": 10, "fill_rate": 1,
+					"adaptive": {"min_fill_rate": 5, "max_fill_rate": 2, "increase": 1, "decrease": 2, "interval": "1s"}},
+				{"name": "b", "algorithm": "fixed_window", "window_size": "1s", "max_requests": 1,
+					"adaptive": {"min_fill_rate": 1, "max_fill_rate": 2, "increase": 1, "decrease": 0.5, "max_error_rate": 0.1, "interval": "1s"}}
+			]}`,
+			want: []string{"adaptive: min_fill_rate must be positive and at most max_fill_rate", "decrease must be between 0 and 1",
+				"target_latency or max_error_rate is required", "adaptive is not used by fixed_window"},
+		},
+		{
+			name: "bad warmup",
+			json: `{"limiters": [
+				{"name": "a", "algorithm": "token_bucket", "capacity": 10, "fill_rate": 1,
+					"warmup": {"period": "0s", "fraction": 1.5}},
+				{"name": "b", "algorithm": "gcra", "capacity": 10, "fill_rate": 1,
+					"warmup": {"period": "1m", "fraction": 0.5}}
+			]}`,
+			want: []string{"warmup: period must be positive", "fraction must be between 0 and 1", "warmup is not used by gcra"},
+		},
+		{
+			name: "bad max_debt",
+			json: `{"limiters": [
+				{"name": "a", "algorithm": "token_bucket", "capacity": 10, "fill_rate": 1, "max_debt": -1},
+				{"name": "b", "algorithm": "gcra", "capacity": 10, "fill_rate": 1, "max_debt": 5}
+			]}`,
+			want: []string{"max_debt can't be negative", "max_debt is not used by gcra"},
+		},
+		{
+			name: "bad multi_token_bucket",
+			json: `{"limiters": [
+				{"name": "a", "algorithm": "multi_token_bucket", "capacity": 5},
+				{"name": "b", "algorithm": "multi_token_bucket", "dimensions": [
+					{"name": "requests", "capacity": 10, "fill_rate": 1},
+					{"name": "requests", "capacity": 0, "fill_rate": 1}
+				]},
+				{"name": "c", "algorithm": "gcra", "capacity": 10, "fill_rate": 1, "dimensions": [{"name": "bytes", "capacity": 10, "fill_rate": 1}]}
+			],
+			"rules": [
+				{"path": "/b", "limiter": "b", "costs": {"rows": 1, "requests": -1}},
+				{"path": "/c", "limiter": "c", "costs": {"bytes": 1}},
+				{"path": "/z", "limiter": "b", "costs": {"requests": 0}}
+			]}`,
+			want: []string{
+				"dimensions is required for multi_token_bucket", "capacity is not used by multi_token_bucket",
+				`dimensions[1] "requests": capacity and fill_rate must be positive`, `dimensions[1] "requests": duplicate dimension name`,
+				"dimensions is not used by gcra",
+				`costs: "requests" can't be negative`, `costs: unknown dimension "rows"`,
+				"costs is only used with a multi_token_bucket limiter",
+				"costs: at least one dimension must cost something",
+			},
+		},
+		{
+			name: "bad cost",
+			json: `{"limiters": [{"name": "a", "algorithm": "gcra", "capacity": 10, "fill_rate": 1}],
+				"concurrency": [{"name": "c", "max_in_flight": 5}],
+				"rules": [
+					{"path": "/a", "limiter": "a", "cost": -0.5},
+					{"path": "/c", "concurrency": "c", "cost": 2}
+				]}`,
+			want: []string{"cost must be positive", "cost is not used without a limiter"},
+		},
+		{
+			name: "bad penalty",
+			json: `{"limiters": [
+				{"name": "a", "algorithm": "gcra", "capacity": 10, "fill_rate": 1, "penalty": {"rejections": 0, "window": "1m"}},
+				{"name": "b", "algorithm": "fixed_window", "window_size": "1m", "max_requests": 5,
+					"penalty": {"rejections": 3, "window": "1m", "ban": "1m", "multiplier": 2}},
+				{"name": "c", "algorithm": "composite", "limits": [
+					{"name": "x", "algorithm": "gcra", "capacity": 10, "fill_rate": 1, "penalty": {"rejections": 3, "window": "1m", "ban": "1m"}}
+				]}
+			],
+			"rules": [{"path": "/b", "limiter": "b", "key": "global"}, {"path": "/c", "limiter": "b"}]}`,
+			want: []string{"penalty: rejections must be positive", "window and ban must be positive",
+				"max_ban is required with a multiplier", "penalty is not supported inside a composite",
+				`rules[0] "/b": limiter "b" has a penalty, it can't be used with a global key`,
+				`rules[1] "/c": limiter "b" has a penalty, it can't be used with a global key`},
+		},
+		{
+			name: "bad lists",
+			json: `{"limiters": [{"name": "a", "algorithm": "gcra", "capacity": 10, "fill_rate": 1}],
+				"lists": [
+					{"name": "ops", "action": "skip", "cidrs": ["10.0.0.0/33", "10.1.0.1"]},
+					{"name": "ops", "action": "allow", "api_key_header": "X-Token", "headers": {"X-Env": []}},
+					{"action": "deny"}
+				]}`,
+			want: []string{`lists[0] "ops": invalid action "skip"`, `invalid cidr "10.0.0.0/33"`,
+				`lists[1] "ops": duplicate list name`, "api_key_header is not used without api_keys", `headers: "X-Env" needs at least one value`,
+				"lists[2]: name is required", "at least one of cidrs, api_keys or headers is required"},
+		},
+		{
+			name: "bad client_ip",
+			json: `{"limiters": [{"name": "a", "algorithm": "gcra", "capacity": 10, "fill_rate": 1}],
+				"client_ip": {"trusted_proxies": ["10.0.0.0/8", "proxy"], "headers": ["X-Client-IP"], "ipv6_prefix": 129}}`,
+			want: []string{`client_ip: invalid trusted proxy "proxy"`, `unsupported header "X-Client-IP"`, "ipv6_prefix must be between 0 and 128"},
+		},
+		{
+			name: "bad cost_by",
+			json: `{"limiters": [{"name": "a", "algorithm": "gcra", "capacity": 10, "fill_rate": 1}],
+				"concurrency": [{"name": "c", "max_in_flight": 5}],
+				"rules": [
+					{"path": "/a", "limiter": "a", "cost_by": "rows"},
+					{"path": "/c", "concurrency": "c", "cost_by": "duration"}
+				]}`,
+			want: []string{`invalid cost_by "rows"`, "cost_by is not used without a limiter"},
+		},
+		{
+			name: "bad color markers",
+			json: `{"limiters": [
+				{"name": "a", "algorithm": "srtcm", "capacity": 5, "fill_rate": 1, "excess_burst": -1, "peak_rate": 2},
+				{"name": "b", "algorithm": "trtcm", "capacity": 5, "fill_rate": 2, "peak_rate": 1},
+				{"name": "c", "algorithm": "token_bucket", "capacity": 5, "fill_rate": 1, "excess_burst": 5}
+			]}`,
+			want: []string{"excess_burst can't be negative", "peak_rate is not used by srtcm",
+				`limiters[1] "b": peak_burst must be positive for trtcm`, "peak_rate must be at least fill_rate",
+				"excess_burst is not used by token_bucket"},
+		},
+		{
+			name: "bad composite",
+			json: `{"limiters": [
+				{"name": "a", "algorithm": "composite", "capacity": 5},
+				{"name": "b", "algorithm": "composite", "limits": [
+					{"name": "x", "algorithm": "fixed_window", "window_size": "1s"},
+					{"name": "x", "algorithm": "composite"}
+				]},
+				{"name": "c", "algorithm": "gcra", "capacity": 5, "fill_rate": 1, "limits": [{"name": "x"}]}
+			]}`,
+			want: []string{"limits is required for composite", "capacity is not used by composite",
+				`limits[0] "x": max_requests must be positive for fixed_window`,
+				`limits[1] "x": a composite can't contain another composite`, `limits[1] "x": duplicate limit name`,
+				"limits is not used by gcra"},
+		},
+		{
+			name: "bad hierarchy",
+			json: `{"limiters": [
+				{"name": "a", "algorithm": "hierarchy", "capacity": 5},
+				{"name": "b", "algorithm": "hierarchy", "levels": [
+					{"name": "service", "capacity": 100, "fill_rate": 100, "ceil": 200},
+					{"name": "tenant", "capacity": 10, "fill_rate": 10, "ceil": 5},
+					{"name": "tenant", "capacity": 0, "fill_rate": 1}
+				]},
+				{"name": "c", "algorithm": "gcra", "capacity": 5, "fill_rate": 1, "levels": [{"name": "x"}]},
+				{"name": "d", "algorithm": "composite", "limits": [{"name": "x", "algorithm": "hierarchy"}]}
+			],
+			"rules": [
+				{"path": "/b", "limiter": "b", "keys": ["header:X-Tenant"]},
+				{"path": "/k", "limiter": "b", "key": "ip", "keys": ["ip", "cookie:x"]},
+				{"path": "/c", "limiter": "c", "keys": ["ip"]}
+			]}`,
+			want: []string{"levels is required for hierarchy", "capacity is not used by hierarchy",
+				`levels[0] "service": ceil is not used by the root level`, `levels[1] "tenant": ceil must be at least fill_rate`,
+				`levels[2] "tenant": capacity and fill_rate must be positive`, `levels[2] "tenant": duplicate level name`,
+				"levels is not used by gcra", `limits[0] "x": a composite can't contain a hierarchy`,
+				`rules[0] "/b": keys must have one key per level below the root, 2 for limiter "b"`,
+				`keys: invalid key "cookie:x"`, "key and keys can't both be set", "key is not used with a hierarchy limiter, use keys",
+				"keys is only used with a hierarchy limiter"},
+		},
+		{
+			name: "unknown field",
+			json: `{"limiters": [{"name": "a", "algorithm": "token_bucket", "burst": 5}]}`,
+			want: []string{`unknown field "burst"`},
+		},
+		{
+			name: "bad duration",
+			json: `{"limiters": [{"name": "a", "algorithm": "fixed_window", "window_size": 10, "max_requests": 1}]}`,
+			want: []string{"duration must be a string"},
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseConfig([]byte(tt.json))
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+			continue
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: expected error to contain %q, got: %v", tt.name, want, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,37 @@
+module server
+
+go 1.24.4
+
+require (
+	compositelimiter v0.0.0
+	concurrencylimiter v0.0.0
+	fixedwindowcounter v0.0.0
+	gcra v0.0.0
+	github.com/prometheus/client_golang v1.23.0
+	github.com/prometheus/client_model v0.6.2
+	leakybucket v0.0.0
+	slidingwindowcounter v0.0.0
+	slidingwindowlog v0.0.0
+	tokenbucket v0.0.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/common v0.65.0 // indirect
+	github.com/prometheus/procfs v0.16.1 // indirect
+	golang.org/x/sys v0.33.0 // indirect
+	google.golang.org/protobuf v1.36.6 // indirect
+)
+
+replace (
+	compositelimiter => ../CompositeLimiter
+	concurrencylimiter => ../ConcurrencyLimiter
+	fixedwindowcounter => ../FixedWindowCounter
+	gcra => ../GCRA
+	leakybucket => ../LeakyBucket
+	slidingwindowcounter => ../SlidingWindowCounter
+	slidingwindowlog => ../SlidingWindowLog
+	tokenbucket => ../tokenBucket
+)
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"compositelimiter"
+	"fixedwindowcounter"
+	"gcra"
+	"leakybucket"
+	"slidingwindowcounter"
+	"slidingwindowlog"
+	"tokenbucket"
+)
+
+// Limiter is the part every algorithm has in common, the JSON methods save and restore its state
+type Limiter interface {
+	Allow(n int) bool
+	AllowCost(cost float64) bool
+	// TryCost is AllowCost with the wait when it rejects, infDuration when cost never fits
+	TryCost(cost float64) (bool, time.Duration)
+	TimeUntilAllowed(n int) time.Duration
+	TimeUntilAllowedCost(cost float64) time.Duration
+	ExceedsCapacity(n int) bool
+	// Debit charges cost after the fact, never going past what the limiter can hold
+	Debit(cost float64)
+	json.Marshaler
+	json.Unmarshaler
+}
+
+var quietLogger = log.New(io.Discard, "", 0)
+
+// newLimiter builds a limiter from an already validated config
+func newLimiter(cfg LimiterConfig) (Limiter, error) {
+	var (
+		l   Limiter
+		err error
+	)
+	switch cfg.Algorithm {
+	case TokenBucket:
+		var tb *tokenbucket.TokenBucket
+		tb, err = tokenbucket.NewTokenBucket(int(cfg.Capacity), float64(cfg.Capacity), cfg.FillRate)
+		if err == nil {
+			err = errors.Join(tb.SetWarmup(cfg.Warmup.toBucket()), tb.SetMaxDebt(int(cfg.MaxDebt)))
+		}
+		l = tb
+	case LeakyBucket:
+		l, err = leakybucket.NewLeakyBucket(cfg.Capacity, cfg.LeakRate, leakybucket.PerSecond)
+	case FixedWindow:
+		l, err = fixedwindowcounter.NewFixedWindowCounter(time.Duration(cfg.WindowSize), cfg.MaxRequests)
+	case SlidingWindow:
+		l, err = slidingwindowcounter.NewSlidingWindow(time.Duration(cfg.WindowSize), cfg.MaxRequests)
+	case SlidingLog:
+		l, err = slidingwindowlog.NewSlidingWindowLog(time.Duration(cfg.WindowSize), cfg.MaxRequests)
+	case GCRA:
+		l, err = gcra.NewGCRA(int(cfg.Capacity), cfg.FillRate)
+	case Composite:
+		l, err = newComposite(cfg)
+	case SingleRateTCM:
+		l, err = tokenbucket.NewSingleRateMarker(cfg.FillRate, int(cfg.Capacity), int(cfg.ExcessBurst))
+	case TwoRateTCM:
+		l, err = tokenbucket.NewTwoRateMarker(cfg.FillRate, int(cfg.Capacity), cfg.PeakRate, int(cfg.PeakBurst))
+	case MultiBucket:
+		dims := make([]tokenbucket.Dimension, len(cfg.Dimensions))
+		for i, d := range cfg.Dimensions {
+			dims[i] = tokenbucket.Dimension{Name: d.Name, Capacity: int(d.Capacity), FillRate: d.FillRate}
+		}
+		l, err = tokenbucket.NewMultiBucket(dims...)
+	case Hierarchy:
+		levels := make([]tokenbucket.Level, len(cfg.Levels))
+		for i, lv := range cfg.Levels {
+			levels[i] = tokenbucket.Level{Name: lv.Name, Capacity: int(lv.Capacity), FillRate: lv.FillRate, Ceil: lv.Ceil}
+		}
+		var h *tokenbucket.Hierarchy
+		h, err = tokenbucket.NewHierarchy(levels...)
+		l = &hierarchyLimiter{Hierarchy: h}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the algorithms log every decision, too noisy with many limiters
+	if s, ok := l.(interface{ SetLogger(*log.Logger) }); ok {
+		s.SetLogger(quietLogger)
+	}
+	return l, nil
+}
+
+// newComposite builds every limit of a composite config
+func newComposite(cfg LimiterConfig) (*compositelimiter.CompositeLimiter, error) {
+	limits := make([]compositelimiter.Limit, 0, len(cfg.Limits))
+	for _, lc := range cfg.Limits {
+		l, err := newLimiter(lc)
+		if err != nil {
+			return nil, fmt.Errorf("limit %q: %w", lc.Name, err)
+		}
+		limits = append(limits, compositelimiter.Limit{Name: lc.Name, Limiter: l})
+	}
+	return compositelimiter.NewCompositeLimiter(limits...)
+}
+
+// hierarchyLimiter is the tree of a hierarchy limiter seen from the leaf of keys,
+// the set keeps the whole tree under "" and the keys of a request pick the path
+type hierarchyLimiter struct {
+	*tokenbucket.Hierarchy
+	keys []string
+}
+
+// at returns the view of the tree for key, one escaped value per level below the root joined with "/"
+func (hl *hierarchyLimiter) at(key string) *hierarchyLimiter {
+	if key == "" {
+		return hl
+	}
+	keys := strings.Split(key, "/")
+	for i, k := range keys {
+		// joinPath escaped it, a bad escape was sent as is
+		if v, err := url.PathUnescape(k); err == nil {
+			keys[i] = v
+		}
+	}
+	return &hierarchyLimiter{Hierarchy: hl.Hierarchy, keys: keys}
+}
+
+// joinPath is the key of a request to a hierarchy limiter, see hierarchyLimiter.at.
+// Without any key it is "", like for every other limiter.
+func joinPath(keys []string) string {
+	if !slices.ContainsFunc(keys, func(k string) bool { return k != "" }) {
+		return ""
+	}
+	escaped := make([]string, len(keys))
+	for i, k := range keys {
+		escaped[i] = url.PathEscape(k)
+	}
+	return strings.Join(escaped, "/")
+}
+
+func (hl *hierarchyLimiter) Allow(n int) bool {
+	return hl.Hierarchy.Allow(n, hl.keys...)
+}
+
+func (hl *hierarchyLimiter) AllowCost(cost float64) bool {
+	return hl.CheckCost(cost, hl.keys...).Allowed
+}
+
+func (hl *hierarchyLimiter) TryCost(cost float64) (bool, time.Duration) {
+	d := hl.CheckCost(cost, hl.keys...)
+	return d.Allowed, d.RetryAfter
+}
+
+func (hl *hierarchyLimiter) TimeUntilAllowed(n int) time.Duration {
+	return hl.Hierarchy.TimeUntilAllowed(n, hl.keys...)
+}
+
+func (hl *hierarchyLimiter) TimeUntilAllowedCost(cost float64) time.Duration {
+	return hl.Hierarchy.TimeUntilAllowedCost(cost, hl.keys...)
+}
+
+func (hl *hierarchyLimiter) Debit(cost float64) {
+	hl.Hierarchy.Debit(cost, hl.keys...)
+}
+
+// limiterSet holds one limiter per key, all built from the same config. Keys that sat
+// idle long enough to be back where a new limiter starts are dropped.
+type limiterSet struct {
+	cfg      LimiterConfig
+	mu       sync.Mutex
+	limiters map[string]Limiter
+	// when every key was last asked for, the default key "" is never dropped
+	lastUsed  map[string]time.Time
+	lastSweep time.Time
+	// set for adaptive token buckets, its rate replaces fill_rate for every key
+	aimd *tokenbucket.AIMD
+	// set when the config has a penalty, it bans keys on its own
+	penalty *penaltyBox
+}
+
+func newLimiterSet(cfg LimiterConfig) (*limiterSet, error) {
+	// build one up front so bad values fail at startup, not on the first request
+	aimd, err := newAIMD(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &limiterSet{cfg: cfg, aimd: aimd}
+	if cfg.Penalty.enabled() {
+		s.penalty = newPenaltyBox(cfg.Penalty)
+	}
+	l, err := newLimiter(s.effective())
+	if err != nil {
+		return nil, err
+	}
+	s.limiters = map[string]Limiter{"": l}
+	s.lastUsed = make(map[string]time.Time)
+	s.lastSweep = time.Now()
+	return s, nil
+}
+
+// newAIMD returns nil unless cfg is an adaptive token bucket
+func newAIMD(cfg LimiterConfig) (*tokenbucket.AIMD, error) {
+	if !cfg.Adaptive.enabled() {
+		return nil, nil
+	}
+	a := cfg.Adaptive
+	return tokenbucket.NewAIMD(tokenbucket.AIMDConfig{
+		MinRate:       a.MinFillRate,
+		MaxRate:       a.MaxFillRate,
+		Increase:      a.Increase,
+		Decrease:      a.Decrease,
+		TargetLatency: time.Duration(a.TargetLatency),
+		MaxErrorRate:  a.MaxErrorRate,
+		Interval:      time.Duration(a.Interval),
+	}, cfg.FillRate)
+}
+
+// toBucket converts the config, the zero config turns warm-up off
+func (w WarmupConfig) toBucket() tokenbucket.WarmupConfig {
+	return tokenbucket.WarmupConfig{
+		Period:    time.Duration(w.Period),
+		Fraction:  w.Fraction,
+		IdleReset: time.Duration(w.IdleReset),
+	}
+}
+
+// effective is cfg with the adaptive fill rate, s.mu must be held
+func (s *limiterSet) effective() LimiterConfig {
+	cfg := s.cfg
+	if s.aimd != nil {
+		cfg.FillRate = s.aimd.Rate()
+	}
+	return cfg
+}
+
+func (s *limiterSet) get(key string) Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// one tree holds every key of a hierarchy and drops idle nodes itself
+	if hl, ok := s.limiters[""].(*hierarchyLimiter); ok {
+		return hl.at(key)
+	}
+
+	now := time.Now()
+	if ttl := idleTTL(s.cfg); now.Sub(s.lastSweep) >= ttl {
+		s.sweep(now, ttl)
+	}
+
+	l, ok := s.limiters[key]
+	if !ok {
+		// config was checked when the set was created
+		l, _ = newLimiter(s.effective())
+		s.limiters[key] = l
+	}
+	if key != "" {
+		s.lastUsed[key] = now
+	}
+	return l
+}
+
+// sweep drops the keys nobody asked for within ttl, s.mu must be held
+func (s *limiterSet) sweep(now time.Time, ttl time.Duration) {
+	for key, used := range s.lastUsed {
+		if now.Sub(used) >= ttl {
+			delete(s.limiters, key)
+			delete(s.lastUsed, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+// idleTTL is how long a key has to sit idle until its limiter is back where a new one
+// starts: the bucket is full or drained, the window is over. An evicted token bucket
+// with warm-up comes back cold, idle_reset keeps it around at least that long.
+func idleTTL(cfg LimiterConfig) time.Duration {
+	fillRate := cfg.FillRate
+	if cfg.Adaptive.enabled() {
+		// the adaptive rate never goes below its minimum
+		fillRate = cfg.Adaptive.MinFillRate
+	}
+	var ttl time.Duration
+	switch cfg.Algorithm {
+	case TokenBucket:
+		ttl = max(secondsOf(float64(cfg.Capacity+cfg.MaxDebt)/fillRate), time.Duration(cfg.Warmup.IdleReset))
+	case GCRA:
+		ttl = secondsOf(float64(cfg.Capacity) / fillRate)
+	case LeakyBucket:
+		ttl = secondsOf(float64(cfg.Capacity) / cfg.LeakRate)
+	case FixedWindow, SlidingLog:
+		ttl = time.Duration(cfg.WindowSize)
+	case SlidingWindow:
+		// the last window still counts for the whole next one
+		ttl = 2 * time.Duration(cfg.WindowSize)
+	case SingleRateTCM:
+		ttl = secondsOf(float64(cfg.Capacity+cfg.ExcessBurst) / fillRate)
+	case TwoRateTCM:
+		ttl = max(secondsOf(float64(cfg.Capacity)/fillRate), secondsOf(float64(cfg.PeakBurst)/cfg.PeakRate))
+	case MultiBucket:
+		for _, d := range cfg.Dimensions {
+			ttl = max(ttl, secondsOf(float64(d.Capacity)/d.FillRate))
+		}
+	case Composite:
+		for _, lc := range cfg.Limits {
+			ttl = max(ttl, idleTTL(lc))
+		}
+	case Hierarchy:
+		for _, lv := range cfg.Levels {
+			ttl = max(ttl, secondsOf(float64(lv.Capacity)/lv.FillRate))
+		}
+	}
+	return ttl
+}
+
+// secondsOf converts seconds to a Duration, rounded up so a key is never dropped early
+func secondsOf(seconds float64) time.Duration {
+	if seconds >= float64(infDuration)/float64(time.Second) {
+		return infDuration
+	}
+	return time.Duration(math.Ceil(seconds * float64(time.Second)))
+}
+
+// lookup returns the limiter of key without creating one
+func (s *limiterSet) lookup(key string) (Limiter, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.limiters[key]
+	return l, ok
+}
+
+// update applies a new config of the same algorithm to every key without losing their state.
+// A new fill_rate or adaptive config starts the adaptive rate over.
+func (s *limiterSet) update(cfg LimiterConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cfg.Adaptive != s.cfg.Adaptive || cfg.FillRate != s.cfg.FillRate {
+		// config was checked before it got here
+		s.aimd, _ = newAIMD(cfg)
+	}
+	// bans survive a new penalty config, only removing it lifts them
+	switch {
+	case !cfg.Penalty.enabled():
+		s.penalty = nil
+	case s.penalty == nil:
+		s.penalty = newPenaltyBox(cfg.Penalty)
+	default:
+		s.penalty.update(cfg.Penalty)
+	}
+	s.cfg = cfg
+	s.applyAll()
+}
+
+// applyAll pushes the effective config to every key, s.mu must be held
+func (s *limiterSet) applyAll() {
+	cfg := s.effective()
+	for _, l := range s.limiters {
+		applyConfig(l, cfg)
+	}
+}
+
+// observe feeds a finished request to the adaptive rate, it returns the rate and
+// true when that moved the fill rate of every key
+func (s *limiterSet) observe(latency time.Duration, failed bool) (float64, bool) {
+	s.mu.Lock()
+	aimd := s.aimd
+	s.mu.Unlock()
+	if aimd == nil {
+		return 0, false
+	}
+
+	rate, adjusted := aimd.Observe(latency, failed)
+	if adjusted {
+		s.mu.Lock()
+		// an update may have swapped the controller in the meantime
+		if s.aimd == aimd {
+			s.applyAll()
+		}
+		s.mu.Unlock()
+	}
+	return rate, adjusted
+}
+
+// adaptiveRate is the fill rate picked by the adaptive controller, false if there is none
+func (s *limiterSet) adaptiveRate() (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aimd == nil {
+		return 0, false
+	}
+	return s.aimd.Rate(), true
+}
+
+// applyConfig changes the limits of l in place
+func applyConfig(l Limiter, cfg LimiterConfig) {
+	window := time.Duration(cfg.WindowSize)
+	switch l := l.(type) {
+	case *tokenbucket.TokenBucket:
+		l.Update(int(cfg.Capacity), cfg.FillRate)
+		// a bucket that is already warming keeps its place on the ramp
+		l.SetWarmup(cfg.Warmup.toBucket())
+		l.SetMaxDebt(int(cfg.MaxDebt))
+	case *leakybucket.LeakyBucket:
+		l.Update(cfg.Capacity, cfg.LeakRate)
+	case *fixedwindowcounter.FixedWindowCounter:
+		l.Update(window, cfg.MaxRequests)
+	case *slidingwindowcounter.SlidingWindow:
+		l.Update(window, cfg.MaxRequests)
+	case *slidingwindowlog.SlidingWindowLog:
+		l.Update(window, cfg.MaxRequests)
+	case *gcra.GCRA:
+		l.Update(int(cfg.Capacity), cfg.FillRate)
+	case *tokenbucket.SingleRateMarker:
+		l.Update(cfg.FillRate, int(cfg.Capacity), int(cfg.ExcessBurst))
+	case *tokenbucket.TwoRateMarker:
+		l.Update(cfg.FillRate, int(cfg.Capacity), cfg.PeakRate, int(cfg.PeakBurst))
+	case *tokenbucket.MultiBucket:
+		for _, d := range cfg.Dimensions {
+			l.UpdateDimension(d.Name, int(d.Capacity), d.FillRate)
+		}
+	case *hierarchyLimiter:
+		for _, lv := range cfg.Levels {
+			l.UpdateLevel(lv.Name, int(lv.Capacity), lv.FillRate, lv.Ceil)
+		}
+	case *compositelimiter.CompositeLimiter:
+		for _, lc := range cfg.Limits {
+			if child, ok := l.Limit(lc.Name); ok {
+				applyConfig(child.(Limiter), lc)
+			}
+		}
+	}
+}
+
+// snapshot returns the state of every key
+func (s *limiterSet) snapshot() (map[string]json.RawMessage, error) {
+	s.mu.Lock()
+	limiters := make(map[string]Limiter, len(s.limiters))
+	for key, l := range s.limiters {
+		limiters[key] = l
+	}
+	s.mu.Unlock()
+
+	states := make(map[string]json.RawMessage, len(limiters))
+	for key, l := range limiters {
+		data, err := json.Marshal(l)
+		if err != nil {
+			return nil, err
+		}
+		states[key] = data
+	}
+	return states, nil
+}
+
+// restore replaces the keys in states with their saved state, the current config wins over the saved limits.
+// Every key is decoded before any is replaced, keys that fail to decode are skipped and returned as the error.
+func (s *limiterSet) restore(states map[string]json.RawMessage) error {
+	s.mu.Lock()
+	cfg := s.effective()
+	s.mu.Unlock()
+	restored := make(map[string]Limiter, len(states))
+	var errs []error
+	for key, data := range states {
+		l, err := newLimiter(cfg)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, l); err != nil {
+			errs = append(errs, fmt.Errorf("key %q: %w", key, err))
+			continue
+		}
+		applyConfig(l, cfg)
+		restored[key] = l
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for key, l := range restored {
+		s.limiters[key] = l
+		if key != "" {
+			s.lastUsed[key] = now
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// penaltyBox returns the penalty box of the set, nil without a penalty
+func (s *limiterSet) penaltyBox() *penaltyBox {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.penalty
+}
+
+func (s *limiterSet) config() LimiterConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// size is the number of keys, the number of nodes in the tree for a hierarchy
+func (s *limiterSet) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if hl, ok := s.limiters[""].(*hierarchyLimiter); ok {
+		return hl.Len()
+	}
+	return len(s.limiters)
+}
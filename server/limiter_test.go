@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterSetEvictsIdleKeys(t *testing.T) {
+	// full again 50ms after the last request
+	s, err := newLimiterSet(LimiterConfig{Algorithm: TokenBucket, Capacity: 1, FillRate: 20})
+	if err != nil {
+		t.Fatalf("newLimiterSet failed: %v", err)
+	}
+	for _, key := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		s.get(key).Allow(1)
+	}
+	s.get("").Allow(1)
+	if s.size() != 4 {
+		t.Fatalf("Expected 4 keys, got %d", s.size())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	s.get("10.0.0.4")
+	if s.size() != 2 {
+		t.Errorf("Expected the idle keys to be dropped, leaving the default and the new one, got %d keys", s.size())
+	}
+	if _, ok := s.lookup("10.0.0.1"); ok {
+		t.Error("idle key should be gone")
+	}
+	if _, ok := s.lookup(""); !ok {
+		t.Error("default key should never be dropped")
+	}
+}
+
+func TestIdleTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  LimiterConfig
+		want time.Duration
+	}{
+		{"token bucket", LimiterConfig{Algorithm: TokenBucket, Capacity: 10, FillRate: 2}, 5 * time.Second},
+		{"debt is paid back first", LimiterConfig{Algorithm: TokenBucket, Capacity: 10, FillRate: 2, MaxDebt: 10}, 10 * time.Second},
+		{"adaptive refills at its slowest", LimiterConfig{Algorithm: TokenBucket, Capacity: 10, FillRate: 2,
+			Adaptive: AdaptiveConfig{MinFillRate: 1, MaxFillRate: 5}}, 10 * time.Second},
+		{"leaky bucket", LimiterConfig{Algorithm: LeakyBucket, Capacity: 10, LeakRate: 5}, 2 * time.Second},
+		{"sliding window", LimiterConfig{Algorithm: SlidingWindow, WindowSize: Duration(time.Minute), MaxRequests: 5}, 2 * time.Minute},
+		{"composite", LimiterConfig{Algorithm: Composite, Limits: []LimiterConfig{
+			{Name: "second", Algorithm: TokenBucket, Capacity: 10, FillRate: 10},
+			{Name: "hour", Algorithm: FixedWindow, WindowSize: Duration(time.Hour), MaxRequests: 1000},
+		}}, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := idleTTL(tt.cfg); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
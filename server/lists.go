@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// accessList matches requests by client IP, API key or header value
+type accessList struct {
+	name     string
+	action   string
+	prefixes []netip.Prefix
+	// API keys are looked up in apiKeyHeader
+	apiKeyHeader string
+	apiKeys      map[string]bool
+	// canonical header name to the values that match
+	headers map[string]map[string]bool
+}
+
+// parsePrefix reads a CIDR or a single address, which matches only itself
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	return p.Masked(), err
+}
+
+// newAccessList builds a list from an already validated config
+func newAccessList(cfg AccessListConfig) *accessList {
+	l := &accessList{
+		name:         cfg.Name,
+		action:       cfg.Action,
+		apiKeyHeader: http.CanonicalHeaderKey(cfg.apiKeyHeader()),
+		apiKeys:      make(map[string]bool, len(cfg.APIKeys)),
+		headers:      make(map[string]map[string]bool, len(cfg.Headers)),
+	}
+	for _, s := range cfg.CIDRs {
+		p, _ := parsePrefix(s)
+		l.prefixes = append(l.prefixes, p)
+	}
+	for _, key := range cfg.APIKeys {
+		l.apiKeys[key] = true
+	}
+	for name, values := range cfg.Headers {
+		set := make(map[string]bool, len(values))
+		for _, v := range values {
+			set[v] = true
+		}
+		l.headers[http.CanonicalHeaderKey(name)] = set
+	}
+	return l
+}
+
+// matches reports whether the request comes from one of the addresses, carries one
+// of the API keys or has one of the header values
+func (l *accessList) matches(r *http.Request, ip *ipExtractor) bool {
+	if len(l.prefixes) > 0 {
+		if addr, ok := ip.addr(r); ok {
+			if slices.ContainsFunc(l.prefixes, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+				return true
+			}
+		}
+	}
+	if key := r.Header.Get(l.apiKeyHeader); key != "" && l.apiKeys[key] {
+		return true
+	}
+	for name, values := range l.headers {
+		for _, v := range r.Header.Values(name) {
+			if values[v] {
+				return true
+			}
+		}
+	}
+	return false
+}
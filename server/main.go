@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func main() {
+	opts, err := parseOptions(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Printf("Invalid options:\n%v\n", err)
+		os.Exit(1)
+	}
+
+	// either a config file with many limiters or one limiter picked with ALGORITHM
+	var rl *reloader
+	if opts.configFile != "" {
+		var cfg *Config
+		rl, cfg, err = newReloader(opts.configFile)
+		if err != nil {
+			fmt.Printf("Invalid config %s:\n%v\n", opts.configFile, err)
+			os.Exit(1)
+		}
+		log.Printf("Loaded %d limiters and %d rules from %s\n", len(cfg.Limiters), len(cfg.Rules), opts.configFile)
+	} else {
+		cfg, err := opts.singleConfig()
+		if err == nil {
+			rl, err = newStaticReloader(cfg)
+		}
+		if err != nil {
+			fmt.Printf("Invalid %s limiter:\n%v\n", opts.limiter.Algorithm, err)
+			os.Exit(1)
+		}
+		log.Printf("Running one %s limiter %q on /api/ keyed by %s\n", opts.limiter.Algorithm, defaultLimiter, opts.key)
+		if len(cfg.Concurrency) > 0 {
+			log.Printf("At most %d requests in flight, %d queued\n", cfg.Concurrency[0].MaxInFlight, cfg.Concurrency[0].MaxQueue)
+		}
+	}
+
+	// Restoring the last snapshot so a restart doesn't reset every limiter
+	stopSnapshots, snapshotsDone := func() {}, make(chan struct{})
+	if opts.stateFile != "" {
+		restored, err := rl.loadState(opts.stateFile)
+		if err != nil {
+			log.Printf("Ignoring state in %s: %v\n", opts.stateFile, err)
+		} else if restored > 0 {
+			log.Printf("Restored %d limiters from %s\n", restored, opts.stateFile)
+		}
+		var ctx context.Context
+		ctx, stopSnapshots = context.WithCancel(context.Background())
+		go func() {
+			rl.snapshotLoop(ctx, opts.stateFile, opts.snapshotInterval)
+			close(snapshotsDone)
+		}()
+	}
+
+	// every other path stands in for the protected API
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Method: %s, Path: %s, Status: %d", r.Method, r.URL.Path, http.StatusOK)
+		fmt.Fprintln(w, "Request allowed")
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/", rl.middleware(api))
+
+	// Admin API stays off unless a token is configured, env only so it doesn't show up in ps
+	if adminToken := os.Getenv("ADMIN_TOKEN"); adminToken != "" {
+		newAdminAPI(adminToken, rl).register(mux)
+		log.Printf("Admin API enabled: http://localhost:%s/admin/limiters\n", opts.port)
+	}
+
+	server := &http.Server{
+		Addr:         ":" + opts.port,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	log.Printf("Server starting on :%s ...\n", opts.port)
+	log.Printf("Metrics: http://localhost:%s/metrics\n", opts.port)
+	log.Printf("Test this endpoint: http://localhost:%s/api/request\n", opts.port)
+
+	if opts.configFile != "" {
+		// kill -HUP re-reads the config, a bad file leaves the running one in place
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				log.Println("SIGHUP received, reloading config...")
+				rl.reload()
+			}
+		}()
+
+		if opts.watchInterval > 0 {
+			go rl.watch(context.Background(), opts.watchInterval)
+			log.Printf("Watching %s for changes every %s\n", opts.configFile, opts.watchInterval)
+		}
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		<-quit
+		log.Println("Shutting down server...")
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+		close(stopped)
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+
+	// last snapshot once no more requests come in and the loop can't overwrite it
+	if opts.stateFile != "" {
+		stopSnapshots()
+		<-snapshotsDone
+		if err := rl.saveState(opts.stateFile); err != nil {
+			log.Fatalf("Saving state to %s failed: %v", opts.stateFile, err)
+		}
+		log.Printf("State saved to %s\n", opts.stateFile)
+	}
+}
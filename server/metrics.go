@@ -0,0 +1,478 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"compositelimiter"
+	"tokenbucket"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// same value the algorithms return from TimeUntilAllowed for impossible requests
+const infDuration = time.Duration(math.MaxInt64)
+
+// Prometheus metrics, shared by every algorithm
+var (
+	requestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ratelimit_requests_total",
+			Help: "Requests checked by a limiter, by result (allowed, rejected, exceeds_capacity, banned)",
+		},
+		[]string{"limiter", "algorithm", "result"},
+	)
+
+	keysGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ratelimit_keys",
+			Help: "Number of keys with their own limiter state",
+		},
+		[]string{"limiter", "algorithm"},
+	)
+
+	limitGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ratelimit_limit",
+			Help: "Configured capacity or max requests per window",
+		},
+		[]string{"limiter", "algorithm"},
+	)
+
+	adaptiveFillRateGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ratelimit_adaptive_fill_rate",
+			Help: "Fill rate picked by an adaptive token bucket, tokens per second",
+		},
+		[]string{"limiter", "algorithm"},
+	)
+
+	compositeDeniedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ratelimit_composite_denied_total",
+			Help: "Requests denied by one limit of a composite limiter, a request hitting two limits counts for both",
+		},
+		[]string{"limiter", "limit"},
+	)
+
+	dimensionDeniedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ratelimit_dimension_denied_total",
+			Help: "Requests denied by one dimension of a multi token bucket, a request short in two dimensions counts for both",
+		},
+		[]string{"limiter", "dimension"},
+	)
+
+	availableGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ratelimit_available",
+			Help: "Tokens left for the key of the last request, below zero while a token bucket is in debt",
+		},
+		[]string{"limiter", "algorithm"},
+	)
+
+	dimensionAvailableGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ratelimit_dimension_available",
+			Help: "Tokens left in each dimension of a multi token bucket for the key of the last request",
+		},
+		[]string{"limiter", "dimension"},
+	)
+
+	dimensionLimitGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ratelimit_dimension_limit",
+			Help: "Configured capacity of each dimension of a multi token bucket",
+		},
+		[]string{"limiter", "dimension"},
+	)
+
+	debitedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ratelimit_debited_cost_total",
+			Help: "Cost charged to a limiter after the handler ran, by response bytes or duration",
+		},
+		[]string{"limiter", "algorithm"},
+	)
+
+	bansTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ratelimit_bans_total",
+			Help: "Keys banned by the penalty of a limiter",
+		},
+		[]string{"limiter", "algorithm"},
+	)
+
+	listHitsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ratelimit_list_hits_total",
+			Help: "Requests matched by an allow or deny list",
+		},
+		[]string{"list", "action"},
+	)
+
+	markedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ratelimit_marked_total",
+			Help: "Requests classified by a three color marker, by color (green, yellow, red)",
+		},
+		[]string{"limiter", "color"},
+	)
+
+	concurrencyRejectedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ratelimit_concurrency_rejected_total",
+			Help: "Requests turned away by a concurrency limit, by reason (queue_full, timeout, canceled)",
+		},
+		[]string{"concurrency", "reason"},
+	)
+
+	configReloadsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ratelimit_config_reloads_total",
+			Help: "Config reloads by result (success, failure)",
+		},
+		[]string{"result"},
+	)
+)
+
+// Wrapping limiter set with metrics
+type metricsLimiterSet struct {
+	*limiterSet
+	name      string
+	algorithm string
+}
+
+func newMetricsLimiterSet(set *limiterSet) *metricsLimiterSet {
+	cfg := set.config()
+	return &metricsLimiterSet{limiterSet: set, name: cfg.Name, algorithm: cfg.Algorithm}
+}
+
+func (m *metricsLimiterSet) updateLimitMetrics() {
+	cfg := m.config()
+	limit := cfg.Capacity
+	if limit == 0 {
+		limit = cfg.MaxRequests
+	}
+	// a composite has no single limit, its limits show up in the denied counter,
+	// the levels of a hierarchy in the node metrics
+	switch cfg.Algorithm {
+	case Composite, Hierarchy:
+	case MultiBucket:
+		for _, d := range cfg.Dimensions {
+			dimensionLimitGauge.WithLabelValues(m.name, d.Name).Set(float64(d.Capacity))
+		}
+	default:
+		limitGauge.WithLabelValues(m.name, m.algorithm).Set(float64(limit))
+	}
+	keysGauge.WithLabelValues(m.name, m.algorithm).Set(float64(m.size()))
+	if rate, ok := m.adaptiveRate(); ok {
+		adaptiveFillRateGauge.WithLabelValues(m.name, m.algorithm).Set(rate)
+	} else {
+		adaptiveFillRateGauge.DeleteLabelValues(m.name, m.algorithm)
+	}
+}
+
+// removeMetrics drops the gauges of a limiter that is no longer configured
+func (m *metricsLimiterSet) removeMetrics() {
+	limitGauge.DeleteLabelValues(m.name, m.algorithm)
+	keysGauge.DeleteLabelValues(m.name, m.algorithm)
+	adaptiveFillRateGauge.DeleteLabelValues(m.name, m.algorithm)
+	availableGauge.DeleteLabelValues(m.name, m.algorithm)
+	compositeDeniedTotal.DeletePartialMatch(prometheus.Labels{"limiter": m.name})
+	dimensionDeniedTotal.DeletePartialMatch(prometheus.Labels{"limiter": m.name})
+	dimensionAvailableGauge.DeletePartialMatch(prometheus.Labels{"limiter": m.name})
+	dimensionLimitGauge.DeletePartialMatch(prometheus.Labels{"limiter": m.name})
+	markedTotal.DeletePartialMatch(prometheus.Labels{"limiter": m.name})
+	debitedTotal.DeletePartialMatch(prometheus.Labels{"limiter": m.name})
+	bansTotal.DeletePartialMatch(prometheus.Labels{"limiter": m.name})
+}
+
+// observe reports a finished request to an adaptive limiter, other limiters ignore it
+func (m *metricsLimiterSet) observe(latency time.Duration, failed bool) {
+	if rate, adjusted := m.limiterSet.observe(latency, failed); adjusted {
+		adaptiveFillRateGauge.WithLabelValues(m.name, m.algorithm).Set(rate)
+	}
+}
+
+// decision is the outcome of checking one request against a limiter
+type decision struct {
+	allowed bool
+	// how long to wait when rejected, infDuration if it never fits
+	retryAfter time.Duration
+	// the limits of a composite, dimensions or levels of a hierarchy that rejected the request
+	deniedBy []string
+	// green, yellow or red when the limiter is a three color marker
+	color string
+}
+
+// tokenCounter is implemented by the token bucket and by GCRA, which derives the count from its TAT
+type tokenCounter interface {
+	AvailableTokens() float64
+}
+
+// setAvailable reports the tokens left in l, limiters without a token count are skipped
+func (m *metricsLimiterSet) setAvailable(l Limiter) {
+	if tc, ok := l.(tokenCounter); ok {
+		availableGauge.WithLabelValues(m.name, m.algorithm).Set(tc.AvailableTokens())
+	}
+}
+
+// colorMarker is implemented by the srtcm and trtcm limiters, Mark replaces Allow for them
+type colorMarker interface {
+	TryMarkCost(cost float64) (tokenbucket.Color, time.Duration)
+}
+
+// allow checks one request of cost against the limiter of key. costs has one cost per
+// dimension when the limiter is a multi token bucket.
+func (m *metricsLimiterSet) allow(key string, cost float64, costs []float64) decision {
+	l := m.get(key)
+	labels := []string{m.name, m.algorithm}
+
+	var d decision
+	switch l := l.(type) {
+	case *compositelimiter.CompositeLimiter:
+		cd := l.CheckCost(cost)
+		d.allowed, d.deniedBy, d.retryAfter = cd.Allowed, cd.DeniedBy, cd.RetryAfter
+		for _, limit := range d.deniedBy {
+			compositeDeniedTotal.WithLabelValues(m.name, limit).Inc()
+		}
+	case *tokenbucket.MultiBucket:
+		md := l.Check(costs...)
+		d.allowed, d.deniedBy, d.retryAfter = md.Allowed, md.DeniedBy, md.RetryAfter
+		for _, dim := range d.deniedBy {
+			dimensionDeniedTotal.WithLabelValues(m.name, dim).Inc()
+		}
+		_, _, dims := l.Stats()
+		for _, dim := range dims {
+			dimensionAvailableGauge.WithLabelValues(m.name, dim.Name).Set(dim.Available)
+		}
+	case *hierarchyLimiter:
+		hd := l.CheckCost(cost, l.keys...)
+		d.allowed, d.deniedBy, d.retryAfter = hd.Allowed, hd.DeniedBy, hd.RetryAfter
+	case colorMarker:
+		color, wait := l.TryMarkCost(cost)
+		d.allowed, d.color, d.retryAfter = color != tokenbucket.Red, color.String(), wait
+		markedTotal.WithLabelValues(m.name, d.color).Inc()
+	default:
+		// one call decides and says why, so a concurrent Update can't change the answer in between
+		d.allowed, d.retryAfter = l.TryCost(cost)
+		m.setAvailable(l)
+	}
+
+	if d.allowed {
+		requestsTotal.WithLabelValues(append(labels, "allowed")...).Inc()
+		keysGauge.WithLabelValues(labels...).Set(float64(m.size()))
+		return d
+	}
+	result := "rejected"
+	if d.retryAfter == infDuration {
+		result = "exceeds_capacity"
+	}
+	requestsTotal.WithLabelValues(append(labels, result)...).Inc()
+	return d
+}
+
+// banned reports whether key sits in the penalty box, and for how long still. A banned
+// request counts as rejected without asking the limiter.
+func (m *metricsLimiterSet) banned(key string) (time.Duration, bool) {
+	p := m.penaltyBox()
+	if p == nil {
+		return 0, false
+	}
+	wait, ok := p.banned(key, time.Now())
+	if ok {
+		requestsTotal.WithLabelValues(m.name, m.algorithm, "banned").Inc()
+	}
+	return wait, ok
+}
+
+// penalize counts a rejection of key, it returns the length of the ban when that got key banned
+func (m *metricsLimiterSet) penalize(key string) (time.Duration, bool) {
+	p := m.penaltyBox()
+	if p == nil {
+		return 0, false
+	}
+	d, ok := p.reject(key, time.Now())
+	if ok {
+		bansTotal.WithLabelValues(m.name, m.algorithm).Inc()
+	}
+	return d, ok
+}
+
+// debit charges cost to the limiter of key once the request is done, costs has one cost
+// per dimension when the limiter is a multi token bucket
+func (m *metricsLimiterSet) debit(key string, cost float64, costs []float64) {
+	switch l := m.get(key).(type) {
+	case *tokenbucket.MultiBucket:
+		l.DebitCosts(costs...)
+		_, _, dims := l.Stats()
+		for _, dim := range dims {
+			dimensionAvailableGauge.WithLabelValues(m.name, dim.Name).Set(dim.Available)
+		}
+	default:
+		l.Debit(cost)
+		m.setAvailable(l)
+	}
+	debitedTotal.WithLabelValues(m.name, m.algorithm).Add(cost)
+}
+
+// concurrencyCollector reads the concurrency limits when scraped. Queued requests block
+// inside Acquire, so there is no point in the request path to set a gauge from.
+type concurrencyCollector struct {
+	mu     sync.Mutex
+	limits map[string]*concurrencyLimit
+}
+
+var (
+	inFlightDesc    = prometheus.NewDesc("ratelimit_in_flight", "Requests holding a slot of a concurrency limit", []string{"concurrency"}, nil)
+	queuedDesc      = prometheus.NewDesc("ratelimit_queued", "Requests waiting for a slot of a concurrency limit", []string{"concurrency"}, nil)
+	maxInFlightDesc = prometheus.NewDesc("ratelimit_max_in_flight", "Max requests in flight, moves with an adaptive limit", []string{"concurrency"}, nil)
+	minRTTDesc      = prometheus.NewDesc("ratelimit_min_rtt_seconds", "Lowest RTT seen by an adaptive concurrency limit", []string{"concurrency"}, nil)
+	rttDesc         = prometheus.NewDesc("ratelimit_rtt_seconds", "RTT of the last request seen by an adaptive concurrency limit", []string{"concurrency"}, nil)
+
+	concurrencyMetrics = &concurrencyCollector{limits: make(map[string]*concurrencyLimit)}
+)
+
+func init() {
+	prometheus.MustRegister(concurrencyMetrics, banMetrics, hierarchyMetrics)
+}
+
+func (cc *concurrencyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- inFlightDesc
+	ch <- queuedDesc
+	ch <- maxInFlightDesc
+	ch <- minRTTDesc
+	ch <- rttDesc
+}
+
+func (cc *concurrencyCollector) Collect(ch chan<- prometheus.Metric) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for name, c := range cc.limits {
+		ch <- prometheus.MustNewConstMetric(inFlightDesc, prometheus.GaugeValue, float64(c.InFlight()), name)
+		ch <- prometheus.MustNewConstMetric(queuedDesc, prometheus.GaugeValue, float64(c.Queued()), name)
+		ch <- prometheus.MustNewConstMetric(maxInFlightDesc, prometheus.GaugeValue, float64(c.MaxInFlight()), name)
+		if gradient := c.adaptive(); gradient != nil {
+			ch <- prometheus.MustNewConstMetric(minRTTDesc, prometheus.GaugeValue, gradient.MinRTT().Seconds(), name)
+			ch <- prometheus.MustNewConstMetric(rttDesc, prometheus.GaugeValue, gradient.RTT().Seconds(), name)
+		}
+	}
+}
+
+// set replaces the limits being reported, called with the limits of every new router
+func (cc *concurrencyCollector) set(limits map[string]*concurrencyLimit) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.limits = limits
+}
+
+// banCollector counts the active bans when scraped, bans run out without a request to notice it
+type banCollector struct {
+	mu       sync.Mutex
+	limiters map[string]*metricsLimiterSet
+}
+
+var (
+	activeBansDesc = prometheus.NewDesc("ratelimit_active_bans", "Keys banned by the penalty of a limiter right now", []string{"limiter"}, nil)
+
+	banMetrics = &banCollector{}
+)
+
+func (bc *banCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeBansDesc
+}
+
+func (bc *banCollector) Collect(ch chan<- prometheus.Metric) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	now := time.Now()
+	for name, m := range bc.limiters {
+		if p := m.penaltyBox(); p != nil {
+			ch <- prometheus.MustNewConstMetric(activeBansDesc, prometheus.GaugeValue, float64(len(p.active(name, now))), name)
+		}
+	}
+}
+
+// set replaces the limiters being reported, called with the limiters of every new router
+func (bc *banCollector) set(limiters map[string]*metricsLimiterSet) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.limiters = limiters
+}
+
+// hierarchyCollector reports the nodes of the hierarchy limiters when scraped, nodes
+// come and go with their keys so there is no fixed set of series to keep up to date.
+// The leaves are one per key and reported summed up per level, so the keys of the
+// requests can't grow the number of series.
+type hierarchyCollector struct {
+	mu       sync.Mutex
+	limiters map[string]*metricsLimiterSet
+}
+
+var (
+	nodeLabels            = []string{"limiter", "level", "path"}
+	hierarchyAllowedDesc  = prometheus.NewDesc("ratelimit_hierarchy_allowed_total", "Requests allowed by a node of a hierarchy since the node was created, summed up over the leaves", nodeLabels, nil)
+	hierarchyRejectedDesc = prometheus.NewDesc("ratelimit_hierarchy_rejected_total", "Requests denied by a node of a hierarchy since the node was created, summed up over the leaves", nodeLabels, nil)
+	hierarchyBorrowedDesc = prometheus.NewDesc("ratelimit_hierarchy_borrowed_total", "Requests a node of a hierarchy let through on tokens borrowed from its parent, summed up over the leaves", nodeLabels, nil)
+	hierarchyTokensDesc   = prometheus.NewDesc("ratelimit_hierarchy_tokens", "Tokens left in a node of a hierarchy, summed up over the leaves", nodeLabels, nil)
+	hierarchyNodesDesc    = prometheus.NewDesc("ratelimit_hierarchy_nodes", "Nodes in a level of a hierarchy", []string{"limiter", "level"}, nil)
+
+	hierarchyMetrics = &hierarchyCollector{}
+)
+
+func (hc *hierarchyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- hierarchyAllowedDesc
+	ch <- hierarchyRejectedDesc
+	ch <- hierarchyBorrowedDesc
+	ch <- hierarchyTokensDesc
+	ch <- hierarchyNodesDesc
+}
+
+func (hc *hierarchyCollector) Collect(ch chan<- prometheus.Metric) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	for name, m := range hc.limiters {
+		l, ok := m.lookup("")
+		hl, isTree := l.(*hierarchyLimiter)
+		if !ok || !isTree {
+			continue
+		}
+		levels := m.config().Levels
+		leaf := levels[len(levels)-1].Name
+		nodes := make(map[string]int, len(levels))
+		leaves := tokenbucket.NodeStats{Level: leaf}
+		for _, n := range hl.Nodes() {
+			nodes[n.Level]++
+			if n.Level == leaf {
+				leaves.Allowed += n.Allowed
+				leaves.Rejected += n.Rejected
+				leaves.Borrowed += n.Borrowed
+				leaves.Tokens += n.Tokens
+				continue
+			}
+			collectNode(ch, name, n)
+		}
+		collectNode(ch, name, leaves)
+		for _, lc := range levels {
+			ch <- prometheus.MustNewConstMetric(hierarchyNodesDesc, prometheus.GaugeValue, float64(nodes[lc.Name]), name, lc.Name)
+		}
+	}
+}
+
+// collectNode sends the metrics of one node, or of all leaves with an empty path
+func collectNode(ch chan<- prometheus.Metric, limiter string, n tokenbucket.NodeStats) {
+	ch <- prometheus.MustNewConstMetric(hierarchyAllowedDesc, prometheus.CounterValue, float64(n.Allowed), limiter, n.Level, n.Path)
+	ch <- prometheus.MustNewConstMetric(hierarchyRejectedDesc, prometheus.CounterValue, float64(n.Rejected), limiter, n.Level, n.Path)
+	ch <- prometheus.MustNewConstMetric(hierarchyBorrowedDesc, prometheus.CounterValue, float64(n.Borrowed), limiter, n.Level, n.Path)
+	ch <- prometheus.MustNewConstMetric(hierarchyTokensDesc, prometheus.GaugeValue, n.Tokens, limiter, n.Level, n.Path)
+}
+
+// set replaces the limiters being reported, called with the limiters of every new router
+func (hc *hierarchyCollector) set(limiters map[string]*metricsLimiterSet) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.limiters = limiters
+}
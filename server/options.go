@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultLimiter is the name of the limiter built from -algorithm, the same name the per-algorithm servers use
+const defaultLimiter = "api_rate_limit"
+
+// defaultConcurrency is the name of the in-flight cap added by -max-in-flight
+const defaultConcurrency = "api_in_flight"
+
+// options holds the command line flags. Every flag can also be set with an env variable,
+// the flag wins when both are given.
+type options struct {
+	port             string
+	configFile       string
+	stateFile        string
+	snapshotInterval time.Duration
+	watchInterval    time.Duration
+
+	// used instead of a config file, one limiter for every /api path
+	limiter     LimiterConfig
+	key         string
+	concurrency ConcurrencyConfig
+}
+
+// envName is the env variable a flag falls back to, "fill-rate" reads FILL_RATE
+func envName(flagName string) string {
+	switch flagName {
+	case "config":
+		return "CONFIG_FILE"
+	case "state":
+		return "STATE_FILE"
+	}
+	return strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// limiterFlags can only be used without a config file
+var limiterFlags = []string{"algorithm", "capacity", "fill-rate", "leak-rate", "window-size", "max-requests", "key",
+	"max-in-flight", "max-queue", "queue-timeout"}
+
+func parseOptions(args []string, getenv func(string) string) (*options, error) {
+	o := &options{}
+	fs := flag.NewFlagSet("ratelimiter", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	fs.StringVar(&o.port, "port", "", "HTTP server port")
+	fs.StringVar(&o.configFile, "config", "", "path to the JSON limiter config")
+	fs.StringVar(&o.stateFile, "state", "", "file to save and restore limiter state across restarts")
+	fs.DurationVar(&o.snapshotInterval, "snapshot-interval", 30*time.Second, "how often state is saved")
+	fs.DurationVar(&o.watchInterval, "config-watch-interval", 0, "how often to check the config file for changes, 0 to only reload on SIGHUP")
+
+	fs.StringVar(&o.limiter.Algorithm, "algorithm", "", "one of "+strings.Join(algorithms, ", ")+", instead of a config file")
+	fs.Int64Var(&o.limiter.Capacity, "capacity", 0, "token_bucket, leaky_bucket, gcra (the burst)")
+	fs.Float64Var(&o.limiter.FillRate, "fill-rate", 0, "token_bucket, gcra, tokens per second")
+	fs.Float64Var(&o.limiter.LeakRate, "leak-rate", 0, "leaky_bucket, requests per second")
+	fs.DurationVar((*time.Duration)(&o.limiter.WindowSize), "window-size", 0, "fixed_window, sliding_window, sliding_log")
+	fs.Int64Var(&o.limiter.MaxRequests, "max-requests", 0, "fixed_window, sliding_window, sliding_log")
+	fs.StringVar(&o.key, "key", "global", `how requests are grouped: "global", "ip", "header:<name>" or "query:<name>"`)
+	fs.IntVar(&o.concurrency.MaxInFlight, "max-in-flight", 0, "also cap the requests in flight, 0 for no cap")
+	fs.IntVar(&o.concurrency.MaxQueue, "max-queue", 0, "requests that may wait for an in-flight slot")
+	fs.DurationVar((*time.Duration)(&o.concurrency.QueueTimeout), "queue-timeout", 0, "how long a request waits for an in-flight slot, 0 waits as long as the client")
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			fs.SetOutput(os.Stderr)
+			fmt.Fprintln(os.Stderr, "Usage of ratelimiter, every flag can also be set as an env variable (-fill-rate reads FILL_RATE):")
+			fs.PrintDefaults()
+		}
+		return nil, err
+	}
+
+	// env variables fill in whatever was not passed as a flag
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		value := getenv(envName(f.Name))
+		if set[f.Name] || value == "" {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %w", envName(f.Name), err))
+			return
+		}
+		set[f.Name] = true
+	})
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	if o.port == "" {
+		errs = append(errs, errors.New("PORT env variable or -port flag is required"))
+	}
+	if o.snapshotInterval <= 0 {
+		errs = append(errs, errors.New("snapshot interval must be positive"))
+	}
+	if o.watchInterval < 0 {
+		errs = append(errs, errors.New("config watch interval can't be negative"))
+	}
+
+	switch {
+	case o.configFile != "":
+		for _, name := range limiterFlags {
+			if set[name] {
+				errs = append(errs, fmt.Errorf("%s can't be combined with a config file, set it in the config instead", envName(name)))
+			}
+		}
+	case o.limiter.Algorithm == "":
+		errs = append(errs, errors.New("CONFIG_FILE or ALGORITHM is required"))
+	default:
+		if o.watchInterval > 0 {
+			errs = append(errs, errors.New("CONFIG_WATCH_INTERVAL needs a config file"))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// singleConfig is the config of -algorithm mode, every /api path shares one limiter
+func (o *options) singleConfig() (*Config, error) {
+	lc := o.limiter
+	lc.Name = defaultLimiter
+	cfg := &Config{
+		Limiters: []LimiterConfig{lc},
+		Rules:    []RuleConfig{{Path: "/api/**", Limiter: defaultLimiter, Key: o.key}},
+	}
+	if o.concurrency.MaxInFlight != 0 || o.concurrency.MaxQueue != 0 || o.concurrency.QueueTimeout != 0 {
+		cc := o.concurrency
+		cc.Name = defaultConcurrency
+		cfg.Concurrency = []ConcurrencyConfig{cc}
+		cfg.Rules[0].Concurrency = defaultConcurrency
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func env(vars map[string]string) func(string) string {
+	return func(name string) string { return vars[name] }
+}
+
+func TestParseOptions(t *testing.T) {
+	// env only, like the per-algorithm servers
+	o, err := parseOptions(nil, env(map[string]string{
+		"PORT": "8080", "ALGORITHM": "fixed_window", "WINDOW_SIZE": "10s", "MAX_REQUESTS": "5",
+	}))
+	if err != nil {
+		t.Fatalf("parseOptions failed: %v", err)
+	}
+	if o.port != "8080" || o.limiter.Algorithm != FixedWindow || time.Duration(o.limiter.WindowSize) != 10*time.Second || o.limiter.MaxRequests != 5 {
+		t.Errorf("Unexpected options %+v", o)
+	}
+	if o.key != "global" || o.snapshotInterval != 30*time.Second {
+		t.Errorf("Expected default key and snapshot interval, got %q and %v", o.key, o.snapshotInterval)
+	}
+
+	// flags win over env
+	o, err = parseOptions([]string{"-algorithm", "token_bucket", "-capacity", "10", "-fill-rate", "2.5"},
+		env(map[string]string{"PORT": "8080", "ALGORITHM": "leaky_bucket", "CAPACITY": "3"}))
+	if err != nil {
+		t.Fatalf("parseOptions failed: %v", err)
+	}
+	if o.limiter.Algorithm != TokenBucket || o.limiter.Capacity != 10 || o.limiter.FillRate != 2.5 {
+		t.Errorf("Flags should override env, got %+v", o.limiter)
+	}
+	cfg, err := o.singleConfig()
+	if err != nil {
+		t.Fatalf("singleConfig failed: %v", err)
+	}
+	if cfg.Limiters[0].Name != defaultLimiter || cfg.Rules[0].Path != "/api/**" {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+	if len(cfg.Concurrency) != 0 || cfg.Rules[0].Concurrency != "" {
+		t.Errorf("No concurrency limit without MAX_IN_FLIGHT, got %+v", cfg.Concurrency)
+	}
+
+	// MAX_IN_FLIGHT adds a concurrency limit to the same rule
+	o, err = parseOptions([]string{"-max-in-flight", "4", "-max-queue", "8"},
+		env(map[string]string{"PORT": "8080", "ALGORITHM": "token_bucket", "CAPACITY": "10", "FILL_RATE": "1"}))
+	if err != nil {
+		t.Fatalf("parseOptions failed: %v", err)
+	}
+	if cfg, err = o.singleConfig(); err != nil {
+		t.Fatalf("singleConfig failed: %v", err)
+	}
+	if len(cfg.Concurrency) != 1 || cfg.Concurrency[0].MaxInFlight != 4 || cfg.Rules[0].Concurrency != defaultConcurrency {
+		t.Errorf("Expected a concurrency limit of 4 on the api rule, got %+v", cfg)
+	}
+
+	// limits are checked the same way as the config file
+	o, _ = parseOptions(nil, env(map[string]string{"PORT": "8080", "ALGORITHM": "token_bucket", "CAPACITY": "10"}))
+	if _, err := o.singleConfig(); err == nil || !strings.Contains(err.Error(), "fill_rate must be positive") {
+		t.Errorf("Expected missing fill rate error, got %v", err)
+	}
+}
+
+func TestParseOptionsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{"no port", nil, map[string]string{"ALGORITHM": "token_bucket"}, "PORT"},
+		{"no limiter", nil, map[string]string{"PORT": "8080"}, "CONFIG_FILE or ALGORITHM is required"},
+		{"bad env value", nil, map[string]string{"PORT": "8080", "ALGORITHM": "fixed_window", "MAX_REQUESTS": "ten"}, "invalid MAX_REQUESTS"},
+		{"config and algorithm", []string{"-config", "c.json", "-algorithm", "token_bucket"}, map[string]string{"PORT": "8080"}, "ALGORITHM can't be combined"},
+		{"watch without config", nil, map[string]string{"PORT": "8080", "ALGORITHM": "token_bucket", "CONFIG_WATCH_INTERVAL": "5s"}, "needs a config file"},
+		{"unknown flag", []string{"-burst", "5"}, map[string]string{"PORT": "8080"}, "not defined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseOptions(tt.args, env(tt.env))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
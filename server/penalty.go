@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// offender is what the penalty box remembers about one key
+type offender struct {
+	// rejections within the window, oldest first
+	rejections []time.Time
+	// bans in a row, every one of them longer by multiplier
+	bans        int
+	lastBan     time.Duration
+	bannedUntil time.Time
+}
+
+// ban describes an active ban for the admin API
+type ban struct {
+	Limiter   string    `json:"limiter"`
+	Key       string    `json:"key"`
+	Until     time.Time `json:"until"`
+	Remaining Duration  `json:"remaining"`
+	// bans in a row, the duration grows with each one
+	Bans int `json:"bans"`
+}
+
+// penaltyBox bans the keys of a limiter that keep getting rejected, banned keys are
+// rejected without asking the limiter
+type penaltyBox struct {
+	mu        sync.Mutex
+	cfg       PenaltyConfig
+	offenders map[string]*offender
+	lastSweep time.Time
+}
+
+func newPenaltyBox(cfg PenaltyConfig) *penaltyBox {
+	return &penaltyBox{cfg: cfg, offenders: make(map[string]*offender)}
+}
+
+// update applies a new config, bans already handed out keep their end
+func (p *penaltyBox) update(cfg PenaltyConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cfg = cfg
+}
+
+// banned returns how long key is still banned for, false if it isn't
+func (p *penaltyBox) banned(key string, now time.Time) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	o, ok := p.offenders[key]
+	if !ok || !now.Before(o.bannedUntil) {
+		return 0, false
+	}
+	return o.bannedUntil.Sub(now), true
+}
+
+// reject counts a rejection of key, it returns the length of the ban when that one got key banned
+func (p *penaltyBox) reject(key string, now time.Time) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	window := time.Duration(p.cfg.Window)
+	if now.Sub(p.lastSweep) >= window {
+		p.sweep(now)
+	}
+
+	o, ok := p.offenders[key]
+	if !ok {
+		o = &offender{}
+		p.offenders[key] = o
+	}
+	o.rejections = append(o.rejections, now)
+	o.rejections = slices.DeleteFunc(o.rejections, func(t time.Time) bool { return now.Sub(t) >= window })
+	if len(o.rejections) < p.cfg.Rejections {
+		return 0, false
+	}
+
+	// a key that stayed out of trouble for as long as its last ban starts over
+	if now.Sub(o.bannedUntil) >= o.lastBan {
+		o.bans = 0
+	}
+	d := p.duration(o.bans)
+	o.bans++
+	o.lastBan = d
+	o.bannedUntil = now.Add(d)
+	o.rejections = nil
+	return d, true
+}
+
+// duration is the length of a ban after n bans in a row, p.mu must be held
+func (p *penaltyBox) duration(n int) time.Duration {
+	d := float64(p.cfg.Ban)
+	if p.cfg.Multiplier > 1 {
+		// max_ban is required with a multiplier
+		d = min(d*math.Pow(p.cfg.Multiplier, float64(n)), float64(p.cfg.MaxBan))
+	}
+	return time.Duration(d)
+}
+
+// sweep forgets the keys that have nothing left to remember, p.mu must be held
+func (p *penaltyBox) sweep(now time.Time) {
+	window := time.Duration(p.cfg.Window)
+	for key, o := range p.offenders {
+		recent := len(o.rejections) > 0 && now.Sub(o.rejections[len(o.rejections)-1]) < window
+		if !recent && now.Sub(o.bannedUntil) >= o.lastBan {
+			delete(p.offenders, key)
+		}
+	}
+	p.lastSweep = now
+}
+
+// lift ends the ban of key and forgets its rejections, false if it wasn't banned
+func (p *penaltyBox) lift(key string, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	o, ok := p.offenders[key]
+	if !ok || !now.Before(o.bannedUntil) {
+		return false
+	}
+	delete(p.offenders, key)
+	return true
+}
+
+// active lists the keys banned at now, sorted by key
+func (p *penaltyBox) active(limiter string, now time.Time) []ban {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var bans []ban
+	for key, o := range p.offenders {
+		if now.Before(o.bannedUntil) {
+			bans = append(bans, ban{
+				Limiter:   limiter,
+				Key:       key,
+				Until:     o.bannedUntil,
+				Remaining: Duration(o.bannedUntil.Sub(now)),
+				Bans:      o.bans,
+			})
+		}
+	}
+	slices.SortFunc(bans, func(a, b ban) int { return strings.Compare(a.Key, b.Key) })
+	return bans
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reloader owns the running router and swaps it when the config file changes
+type reloader struct {
+	filename string
+	mu       sync.Mutex // one reload or admin update at a time
+	current  atomic.Pointer[router]
+	modTime  time.Time
+	size     int64
+	saveMu   sync.Mutex // one saveState at a time
+
+	// admin updates by limiter name, a reload applies them on top of the file
+	overrides map[string]override
+}
+
+// override is every admin update of a limiter merged, it only holds for the algorithm it was made for
+type override struct {
+	algorithm string
+	req       updateRequest
+}
+
+func newReloader(filename string) (*reloader, *Config, error) {
+	rl := &reloader{filename: filename}
+	rl.stat()
+	cfg, err := LoadConfig(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	rt, err := newRouter(cfg, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	rl.current.Store(rt)
+	return rl, cfg, nil
+}
+
+// newStaticReloader runs cfg without a file behind it, reload always fails
+func newStaticReloader(cfg *Config) (*reloader, error) {
+	rt, err := newRouter(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	rl := &reloader{}
+	rl.current.Store(rt)
+	return rl, nil
+}
+
+// reload re-reads the file and applies it, a config that fails validation changes nothing
+func (rl *reloader) reload() error {
+	if rl.filename == "" {
+		return errors.New("no config file to reload")
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.stat()
+	cfg, err := LoadConfig(rl.filename)
+	if err == nil {
+		overrides := rl.applyOverrides(cfg)
+		var rt *router
+		if rt, err = newRouter(cfg, rl.current.Load()); err == nil {
+			rl.current.Store(rt)
+			rl.overrides = overrides
+		}
+	}
+	if err != nil {
+		configReloadsTotal.WithLabelValues("failure").Inc()
+		log.Printf("Config reload failed, keeping the running config:\n%v", err)
+		return err
+	}
+	configReloadsTotal.WithLabelValues("success").Inc()
+	log.Printf("Reloaded %d limiters and %d rules from %s\n", len(cfg.Limiters), len(cfg.Rules), rl.filename)
+	return nil
+}
+
+// setOverride keeps req for the next reloads, merged with the earlier updates of the limiter.
+// rl.mu must be held
+func (rl *reloader) setOverride(name, algorithm string, req updateRequest) {
+	if rl.overrides == nil {
+		rl.overrides = make(map[string]override)
+	}
+	if prev, ok := rl.overrides[name]; ok && prev.algorithm == algorithm {
+		req = prev.req.merge(req)
+	}
+	rl.overrides[name] = override{algorithm: algorithm, req: req}
+}
+
+// applyOverrides puts the admin updates on top of cfg and returns the ones still in use, an update
+// is dropped once its limiter is removed, changes its algorithm or no longer validates with it.
+// rl.mu must be held
+func (rl *reloader) applyOverrides(cfg *Config) map[string]override {
+	kept := make(map[string]override)
+	for i, lc := range cfg.Limiters {
+		o, ok := rl.overrides[lc.Name]
+		if !ok {
+			continue
+		}
+		if o.algorithm != lc.Algorithm {
+			auditLog.Printf("limiter=%s admin update dropped: algorithm changed to %s", lc.Name, lc.Algorithm)
+			continue
+		}
+		after, err := o.req.apply(lc)
+		if err != nil {
+			auditLog.Printf("limiter=%s admin update dropped: %v", lc.Name, err)
+			continue
+		}
+		cfg.Limiters[i] = after
+		kept[lc.Name] = o
+	}
+	return kept
+}
+
+// stat remembers the file version so watch only reloads on changes, returns true if it changed
+func (rl *reloader) stat() bool {
+	info, err := os.Stat(rl.filename)
+	if err != nil {
+		return false
+	}
+	changed := !info.ModTime().Equal(rl.modTime) || info.Size() != rl.size
+	rl.modTime, rl.size = info.ModTime(), info.Size()
+	return changed
+}
+
+// watch polls the file and reloads it whenever it changes
+func (rl *reloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rl.mu.Lock()
+			changed := rl.stat()
+			rl.mu.Unlock()
+			if changed {
+				log.Printf("%s changed, reloading", rl.filename)
+				rl.reload()
+			}
+		}
+	}
+}
+
+// middleware always uses the router of the latest successful reload
+func (rl *reloader) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl.current.Load().middleware(next).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, filename, data string) {
+	t.Helper()
+	if err := os.WriteFile(filename, []byte(data), 0o644); err != nil {
+		t.Fatalf("couldnt write config: %v", err)
+	}
+}
+
+const reloadBase = `{
+	"limiters": [
+		{"name": "api", "algorithm": "token_bucket", "capacity": 10, "fill_rate": 1},
+		{"name": "login", "algorithm": "fixed_window", "window_size": "1m", "max_requests": 5}
+	],
+	"rules": [{"path": "/api/**", "limiter": "api"}]
+}`
+
+func TestReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, filename, reloadBase)
+
+	rl, _, err := newReloader(filename)
+	if err != nil {
+		t.Fatalf("newReloader failed: %v", err)
+	}
+	before := rl.current.Load()
+	api, login := before.limiters["api"], before.limiters["login"]
+	api.get("").Allow(4)
+
+	// same algorithm is updated in place, changed algorithm is swapped
+	writeConfig(t, filename, `{
+		"limiters": [
+			{"name": "api", "algorithm": "token_bucket", "capacity": 20, "fill_rate": 2},
+			{"name": "login", "algorithm": "sliding_log", "window_size": "1m", "max_requests": 5},
+			{"name": "search", "algorithm": "sliding_window", "window_size": "1s", "max_requests": 5}
+		],
+		"rules": [{"path": "/api/**", "limiter": "api"}]
+	}`)
+	if err := rl.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	after := rl.current.Load()
+	if after.limiters["api"] != api {
+		t.Error("api limiter should be kept across the reload")
+	}
+	if got := api.config(); got.Capacity != 20 || got.FillRate != 2 {
+		t.Errorf("Expected capacity 20 and fill rate 2, got %d and %f", got.Capacity, got.FillRate)
+	}
+	if tokens := api.get("").(interface{ AvailableTokens() float64 }).AvailableTokens(); tokens > 7 {
+		t.Errorf("used tokens should carry over, got %.2f available", tokens)
+	}
+	if after.limiters["login"] == login || after.limiters["login"].algorithm != SlidingLog {
+		t.Error("login limiter should be replaced with a sliding_log")
+	}
+	if _, ok := after.limiters["search"]; !ok {
+		t.Error("search limiter should be added")
+	}
+
+	// a bad config changes nothing
+	writeConfig(t, filename, `{"limiters": [{"name": "api", "algorithm": "token_bucket", "capacity": 1}]}`)
+	if err := rl.reload(); err == nil {
+		t.Fatal("reload of an invalid config should fail")
+	}
+	if rl.current.Load() != after {
+		t.Error("router should stay the same after a failed reload")
+	}
+	if api.config().Capacity != 20 {
+		t.Errorf("api limiter should keep capacity 20, got %d", api.config().Capacity)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, filename, reloadBase)
+
+	rl, _, err := newReloader(filename)
+	if err != nil {
+		t.Fatalf("newReloader failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rl.watch(ctx, 10*time.Millisecond)
+
+	writeConfig(t, filename, `{"limiters": [{"name": "api", "algorithm": "token_bucket", "capacity": 50, "fill_rate": 1}]}`)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if rl.current.Load().limiters["api"].config().Capacity == 50 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("watch should pick up the changed file")
+}
+
+func TestReloadKeepsAdminUpdates(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, filename, reloadBase)
+
+	rl, _, err := newReloader(filename)
+	if err != nil {
+		t.Fatalf("newReloader failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	newAdminAPI("secret", rl).register(mux)
+	for _, body := range []string{`{"capacity": 30}`, `{"fill_rate": 3}`} {
+		if rec := adminRequest(mux, http.MethodPut, "/admin/limiters/api", "secret", body); rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %s, got %d: %s", body, rec.Code, rec.Body)
+		}
+	}
+
+	// the file changes something else, both admin updates stay
+	writeConfig(t, filename, `{
+		"limiters": [
+			{"name": "api", "algorithm": "token_bucket", "capacity": 10, "fill_rate": 1},
+			{"name": "login", "algorithm": "fixed_window", "window_size": "1m", "max_requests": 8}
+		]
+	}`)
+	if err := rl.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if got := rl.current.Load().limiters["api"].config(); got.Capacity != 30 || got.FillRate != 3 {
+		t.Errorf("Expected the admin capacity 30 and fill rate 3 after a reload, got %d and %f", got.Capacity, got.FillRate)
+	}
+	if got := rl.current.Load().limiters["login"].config(); got.MaxRequests != 8 {
+		t.Errorf("Expected max requests 8 from the file, got %d", got.MaxRequests)
+	}
+
+	// a new algorithm drops the update for good
+	writeConfig(t, filename, `{"limiters": [{"name": "api", "algorithm": "leaky_bucket", "capacity": 10, "leak_rate": 1}]}`)
+	if err := rl.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	writeConfig(t, filename, reloadBase)
+	if err := rl.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if got := rl.current.Load().limiters["api"].config(); got.Capacity != 10 || got.FillRate != 1 {
+		t.Errorf("Expected capacity 10 and fill rate 1 from the file, got %d and %f", got.Capacity, got.FillRate)
+	}
+}
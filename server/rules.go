@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// colorHeader carries the color of a three color marker on the request and the response
+const colorHeader = "X-RateLimit-Color"
+
+// maxCountedBody is the most a request_bytes rule reads to count a body without a Content-Length
+const maxCountedBody = 10 << 20
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// keyFunc picks the bucket a request is counted against
+type keyFunc func(r *http.Request) string
+
+// newKeyFunc parses a rule's key, ip finds the client address for "ip"
+func newKeyFunc(spec string, ip *ipExtractor) (keyFunc, error) {
+	switch {
+	case spec == "" || spec == "global":
+		return func(*http.Request) string { return "" }, nil
+	case spec == "ip":
+		return ip.clientIP, nil
+	case strings.HasPrefix(spec, "header:") && len(spec) > len("header:"):
+		name := http.CanonicalHeaderKey(strings.TrimPrefix(spec, "header:"))
+		return func(r *http.Request) string { return r.Header.Get(name) }, nil
+	case strings.HasPrefix(spec, "query:") && len(spec) > len("query:"):
+		name := strings.TrimPrefix(spec, "query:")
+		return func(r *http.Request) string { return r.URL.Query().Get(name) }, nil
+	}
+	return nil, fmt.Errorf(`invalid key %q, must be "global", "ip", "header:<name>" or "query:<name>"`, spec)
+}
+
+// newPathKeyFunc is newKeyFunc for the keys of a hierarchy rule, one per level below the root
+func newPathKeyFunc(specs []string, ip *ipExtractor) (keyFunc, error) {
+	funcs := make([]keyFunc, len(specs))
+	for i, spec := range specs {
+		f, err := newKeyFunc(spec, ip)
+		if err != nil {
+			return nil, err
+		}
+		funcs[i] = f
+	}
+	return func(r *http.Request) string {
+		keys := make([]string, len(funcs))
+		for i, f := range funcs {
+			keys[i] = f(r)
+		}
+		return joinPath(keys)
+	}, nil
+}
+
+type rule struct {
+	RuleConfig
+	key keyFunc
+	// dimension names when the limiter is a multi_token_bucket, nil otherwise
+	dims        []string
+	limiter     *metricsLimiterSet // nil if the rule only caps concurrency
+	concurrency *concurrencyLimit  // nil if the rule only limits the rate
+}
+
+// adaptive reports whether one of the limits needs to see how requests went
+func (r *rule) adaptive() bool {
+	if r.concurrency.adaptive() != nil {
+		return true
+	}
+	if r.limiter == nil {
+		return false
+	}
+	_, ok := r.limiter.adaptiveRate()
+	return ok
+}
+
+// cost is what one request takes from the limiter
+func (r *rule) cost() float64 {
+	if r.Cost == 0 {
+		return 1
+	}
+	return r.Cost
+}
+
+// costVector is the cost of every dimension in order for a request of units, nil unless
+// the limiter is a multi_token_bucket. Dimensions in Costs take their cost once, the
+// others take cost per unit.
+func (r *rule) costVector(units float64) []float64 {
+	if r.dims == nil {
+		return nil
+	}
+	costs := make([]float64, len(r.dims))
+	for i, name := range r.dims {
+		cost, ok := r.Costs[name]
+		if !ok {
+			cost = units * r.cost()
+		}
+		costs[i] = cost
+	}
+	return costs
+}
+
+// debitVector is costVector for units charged after the fact, the dimensions in Costs were paid up front
+func (r *rule) debitVector(units float64) []float64 {
+	costs := r.costVector(units)
+	for i, name := range r.dims {
+		if _, ok := r.Costs[name]; ok {
+			costs[i] = 0
+		}
+	}
+	return costs
+}
+
+// debitsAfter reports whether the cost is only known once the handler is done
+func (r *rule) debitsAfter() bool {
+	return r.CostBy == CostByResponseBytes || r.CostBy == CostByDuration
+}
+
+// units is what a request counts as before the handler runs, at least 1. Only the
+// request bytes are known this early, the rest is debited after the handler.
+func (r *rule) units(req *http.Request) (float64, error) {
+	if r.CostBy != CostByRequestBytes {
+		return 1, nil
+	}
+	n, err := bodySize(req)
+	return max(float64(n), 1), err
+}
+
+// bodySize is the Content-Length of req. A chunked body is read into memory to count
+// it, up to maxCountedBody, and handed on to the handler from there.
+func bodySize(req *http.Request) (int64, error) {
+	if req.ContentLength >= 0 || req.Body == nil {
+		return max(req.ContentLength, 0), nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxCountedBody+1))
+	if err != nil {
+		return 0, err
+	}
+	if len(body) > maxCountedBody {
+		return 0, errBodyTooLarge
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return req.ContentLength, nil
+}
+
+func (r *rule) matches(req *http.Request) bool {
+	if r.Method != "" && r.Method != req.Method {
+		return false
+	}
+	return matchPath(r.Path, req.URL.Path)
+}
+
+// matchPath is path.Match plus a trailing "/**" for whole subtrees
+func matchPath(pattern, p string) bool {
+	prefix, subtree := strings.CutSuffix(pattern, "/**")
+	if subtree {
+		// match the pattern against as many leading segments as it has
+		n := strings.Count(prefix, "/")
+		if parts := strings.SplitAfterN(p, "/", n+2); len(parts) > n {
+			p = strings.TrimSuffix(strings.Join(parts[:n+1], ""), "/")
+		}
+	}
+	ok, _ := path.Match(prefix, p)
+	return ok
+}
+
+// router holds the limiters and rules built from one config
+type router struct {
+	limiters    map[string]*metricsLimiterSet
+	concurrency map[string]*concurrencyLimit
+	rules       []*rule
+	// deny lists first, then allow lists, each in config order
+	lists []*accessList
+	// nil without a client_ip config
+	ip *ipExtractor
+}
+
+// newRouter builds the limiters and rules of cfg. Limiters in old with the same
+// name and algorithm (and the same limits for a composite) are kept and updated in place so their state survives a reload,
+// nothing in old is touched unless the whole config builds.
+// Concurrency limits are kept by name so requests in flight still count after a reload.
+func newRouter(cfg *Config, old *router) (*router, error) {
+	rt := &router{
+		limiters:    make(map[string]*metricsLimiterSet),
+		concurrency: make(map[string]*concurrencyLimit),
+		ip:          newIPExtractor(cfg.ClientIP),
+	}
+	var updates []func()
+	for _, lc := range cfg.Limiters {
+		if prev, ok := old.limiter(lc.Name); ok && prev.algorithm == lc.Algorithm && prev.config().sameLimits(lc) {
+			if !reflect.DeepEqual(prev.config(), lc) {
+				updates = append(updates, func() { prev.update(lc) })
+			}
+			rt.limiters[lc.Name] = prev
+			continue
+		}
+		set, err := newLimiterSet(lc)
+		if err != nil {
+			return nil, fmt.Errorf("limiter %q: %w", lc.Name, err)
+		}
+		rt.limiters[lc.Name] = newMetricsLimiterSet(set)
+	}
+	for _, cc := range cfg.Concurrency {
+		if prev, ok := old.concurrencyLimit(cc.Name); ok {
+			if prev.config() != cc {
+				updates = append(updates, func() { prev.update(cc) })
+			}
+			rt.concurrency[cc.Name] = prev
+			continue
+		}
+		c, err := newConcurrencyLimit(cc)
+		if err != nil {
+			return nil, fmt.Errorf("concurrency %q: %w", cc.Name, err)
+		}
+		rt.concurrency[cc.Name] = c
+	}
+	for _, rc := range cfg.Rules {
+		key, err := newKeyFunc(rc.Key, rt.ip)
+		if len(rc.Keys) > 0 {
+			key, err = newPathKeyFunc(rc.Keys, rt.ip)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ru := &rule{RuleConfig: rc, key: key, limiter: rt.limiters[rc.Limiter], concurrency: rt.concurrency[rc.Concurrency]}
+		if ru.limiter != nil && ru.limiter.algorithm == MultiBucket {
+			for _, d := range ru.limiter.config().Dimensions {
+				ru.dims = append(ru.dims, d.Name)
+			}
+		}
+		rt.rules = append(rt.rules, ru)
+	}
+	for _, action := range []string{ListDeny, ListAllow} {
+		for _, lc := range cfg.Lists {
+			if lc.Action == action {
+				rt.lists = append(rt.lists, newAccessList(lc))
+			}
+		}
+	}
+
+	// everything built, safe to change shared state now
+	for _, update := range updates {
+		update()
+	}
+	for name, m := range old.all() {
+		if rt.limiters[name] != m {
+			m.removeMetrics()
+		}
+	}
+	for _, m := range rt.limiters {
+		m.updateLimitMetrics()
+	}
+	for _, l := range old.accessLists() {
+		if !slices.ContainsFunc(rt.lists, func(n *accessList) bool { return n.name == l.name && n.action == l.action }) {
+			listHitsTotal.DeleteLabelValues(l.name, l.action)
+		}
+	}
+	concurrencyMetrics.set(rt.concurrency)
+	banMetrics.set(rt.limiters)
+	hierarchyMetrics.set(rt.limiters)
+	return rt, nil
+}
+
+func (rt *router) limiter(name string) (*metricsLimiterSet, bool) {
+	if rt == nil {
+		return nil, false
+	}
+	m, ok := rt.limiters[name]
+	return m, ok
+}
+
+func (rt *router) concurrencyLimit(name string) (*concurrencyLimit, bool) {
+	if rt == nil {
+		return nil, false
+	}
+	c, ok := rt.concurrency[name]
+	return c, ok
+}
+
+func (rt *router) all() map[string]*metricsLimiterSet {
+	if rt == nil {
+		return nil
+	}
+	return rt.limiters
+}
+
+func (rt *router) accessLists() []*accessList {
+	if rt == nil {
+		return nil
+	}
+	return rt.lists
+}
+
+// listed returns the first list r is on, deny lists before allow lists, nil if none
+func (rt *router) listed(r *http.Request) *accessList {
+	for _, l := range rt.lists {
+		if l.matches(r, rt.ip) {
+			listHitsTotal.WithLabelValues(l.name, l.action).Inc()
+			return l
+		}
+	}
+	return nil
+}
+
+func (rt *router) match(r *http.Request) *rule {
+	for _, ru := range rt.rules {
+		if ru.matches(r) {
+			return ru
+		}
+	}
+	return nil
+}
+
+// middleware applies the first matching rule, requests without a rule are not limited.
+// Requests on a deny list are rejected and those on an allow list skip the rules.
+// The rate limit is checked first so rejected requests never take an in-flight slot.
+func (rt *router) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l := rt.listed(r); l != nil {
+			if l.action == ListDeny {
+				log.Printf("Method: %s, Path: %s, List: %s, Status: %d", r.Method, r.URL.Path, l.name, http.StatusForbidden)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ru := rt.match(r)
+		if ru == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := ru.key(r)
+		var units float64
+		if ru.limiter != nil {
+			// a banned key is turned away before anything else, not even its body is read
+			if wait, ok := ru.limiter.banned(key); ok {
+				w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+				log.Printf("Method: %s, Path: %s, Limiter: %s, Status: %d, banned", r.Method, r.URL.Path, ru.Limiter, http.StatusTooManyRequests)
+				http.Error(w, "Temporarily banned after repeated rejections", http.StatusTooManyRequests)
+				return
+			}
+
+			var err error
+			if units, err = ru.units(r); err != nil {
+				status := http.StatusBadRequest
+				if errors.Is(err, errBodyTooLarge) {
+					status = http.StatusRequestEntityTooLarge
+				}
+				log.Printf("Method: %s, Path: %s, Limiter: %s, Status: %d, %v", r.Method, r.URL.Path, ru.Limiter, status, err)
+				http.Error(w, err.Error(), status)
+				return
+			}
+		}
+
+		// the slot comes before the rate limit, a request turned away for lack of one
+		// never reached the backend and must not use up its rate or count towards a ban
+		var release func(failed bool)
+		if ru.concurrency != nil {
+			var err error
+			if release, err = ru.concurrency.acquire(r.Context()); err != nil {
+				log.Printf("Method: %s, Path: %s, Concurrency: %s, Status: %d", r.Method, r.URL.Path, ru.Concurrency, http.StatusServiceUnavailable)
+				http.Error(w, "Too many requests in flight", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		if ru.limiter != nil {
+			d := ru.limiter.allow(key, units*ru.cost(), ru.costVector(units))
+			if !d.allowed {
+				if release != nil {
+					// the backend never saw the request, no RTT sample for an adaptive limit
+					ru.concurrency.Release(1)
+				}
+				// no Retry-After when waiting can never help
+				if d.retryAfter != infDuration {
+					w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(d.retryAfter.Seconds()))))
+				}
+				msg := "Rate limit exceeded"
+				if len(d.deniedBy) > 0 {
+					// a composite or multi token bucket says which of its limits was hit
+					msg += ": " + strings.Join(d.deniedBy, ", ")
+				}
+				log.Printf("Method: %s, Path: %s, Limiter: %s, Status: %d, %s", r.Method, r.URL.Path, ru.Limiter, http.StatusTooManyRequests, msg)
+				// requests without a key share one, banning it would shut all of them out
+				if key != "" {
+					if ban, ok := ru.limiter.penalize(key); ok {
+						log.Printf("Limiter: %s, Key: %q, banned for %v", ru.Limiter, key, ban)
+					}
+				}
+				http.Error(w, msg, http.StatusTooManyRequests)
+				return
+			}
+			if d.color != "" {
+				// the handler sees the color too, yellow requests can be deprioritized or tagged
+				r.Header.Set(colorHeader, d.color)
+				w.Header().Set(colorHeader, d.color)
+			}
+		}
+
+		// adaptive limits learn from the latency and status of the requests they let through,
+		// response_bytes rules are charged for what was written
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		if ru.adaptive() || ru.debitsAfter() {
+			w = sr
+		}
+
+		if release != nil {
+			defer func() { release(sr.status >= 500) }()
+		}
+
+		if ru.limiter != nil {
+			start := time.Now()
+			defer func() { ru.limiter.observe(time.Since(start), sr.status >= 500) }()
+		}
+		if ru.debitsAfter() {
+			start := time.Now()
+			defer func() {
+				units := float64(sr.written)
+				if ru.CostBy == CostByDuration {
+					units = time.Since(start).Seconds()
+				}
+				// the first unit was taken up front
+				if extra := units - 1; extra > 0 {
+					ru.limiter.debit(key, extra*ru.cost(), ru.debitVector(extra))
+				}
+			}()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder remembers the status code and how many body bytes the handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	n, err := sr.ResponseWriter.Write(b)
+	sr.written += int64(n)
+	return n, err
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
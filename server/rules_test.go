@@ -0,0 +1,933 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"compositelimiter"
+	"fixedwindowcounter"
+	"tokenbucket"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/api/login", "/api/login", true},
+		{"/api/login", "/api/logout", false},
+		{"/api/uploads/*", "/api/uploads/1", true},
+		{"/api/uploads/*", "/api/uploads/1/parts", false},
+		{"/api/**", "/api", true},
+		{"/api/**", "/api/a/b/c", true},
+		{"/api/**", "/apis", false},
+		{"/*/items/**", "/v1/items/1", true},
+	}
+	for _, tt := range tests {
+		if got := matchPath(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("matchPath(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	e := newIPExtractor(ClientIPConfig{TrustedProxies: []string{"10.0.0.0/8", "2001:db8:ffff::1"}, IPv6Prefix: 64})
+	xrealip := newIPExtractor(ClientIPConfig{TrustedProxies: []string{"10.0.0.1"}, Headers: []string{"x-real-ip"}})
+	tests := []struct {
+		name    string
+		e       *ipExtractor
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"no config", nil, "192.0.2.1:1000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "192.0.2.1"},
+		{"untrusted peer", e, "192.0.2.1:1000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "192.0.2.1"},
+		{"xff", e, "10.0.0.1:1000", map[string]string{"X-Forwarded-For": "198.51.100.1, 10.1.1.1"}, "198.51.100.1"},
+		// the client can write anything left of what our proxy appended
+		{"xff spoofed", e, "10.0.0.1:1000", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"xff all trusted", e, "10.0.0.1:1000", map[string]string{"X-Forwarded-For": "10.2.2.2, 10.1.1.1"}, "10.2.2.2"},
+		{"xff garbage", e, "10.0.0.1:1000", map[string]string{"X-Forwarded-For": "198.51.100.1, nonsense, 10.1.1.1"}, "10.1.1.1"},
+		{"forwarded", e, "10.0.0.1:1000", map[string]string{"Forwarded": `for=198.51.100.1;proto=https, for="[2001:db8:ffff::1]:443"`}, "198.51.100.1"},
+		{"forwarded wins", e, "10.0.0.1:1000", map[string]string{"Forwarded": "for=198.51.100.2", "X-Forwarded-For": "198.51.100.1"}, "198.51.100.2"},
+		{"ipv4-mapped", e, "10.0.0.1:1000", map[string]string{"X-Forwarded-For": "::ffff:198.51.100.1"}, "198.51.100.1"},
+		{"ipv6 grouped", e, "[2001:db8:ffff::1]:1000", map[string]string{"X-Forwarded-For": "2001:DB8:1:2:aaaa::5"}, "2001:db8:1:2::/64"},
+		{"x-real-ip", xrealip, "10.0.0.1:1000", map[string]string{"X-Real-IP": "198.51.100.1", "X-Forwarded-For": "198.51.100.9"}, "198.51.100.1"},
+		// not an IP, the port still goes
+		{"hostname", e, "gateway.local:1000", nil, "gateway.local"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remote
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		if got := tt.e.clientIP(req); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"limiters": [
+			{"name": "login", "algorithm": "fixed_window", "window_size": "1m", "max_requests": 1},
+			{"name": "api", "algorithm": "token_bucket", "capacity": 2, "fill_rate": 0.01}
+		],
+		"rules": [
+			{"path": "/api/login", "method": "POST", "limiter": "login", "key": "ip"},
+			{"path": "/api/**", "limiter": "api", "key": "header:X-API-Key"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("config should be valid: %v", err)
+	}
+	rt, err := newRouter(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	handler := rt.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	do := func(method, path, remote, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = remote
+		req.Header.Set("X-API-Key", apiKey)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// one login per ip
+	if rec := do(http.MethodPost, "/api/login", "10.0.0.1:1000", ""); rec.Code != http.StatusOK {
+		t.Errorf("first login should pass, got %d", rec.Code)
+	}
+	rec := do(http.MethodPost, "/api/login", "10.0.0.1:2000", "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("second login from same ip should be limited, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("limited response should carry Retry-After")
+	}
+	if rec := do(http.MethodPost, "/api/login", "10.0.0.2:1000", ""); rec.Code != http.StatusOK {
+		t.Errorf("login from another ip should pass, got %d", rec.Code)
+	}
+
+	// GET /api/login falls through to the api rule, keyed by api key
+	for i := range 2 {
+		if rec := do(http.MethodGet, "/api/login", "10.0.0.1:1000", "k1"); rec.Code != http.StatusOK {
+			t.Errorf("request %d with k1 should pass, got %d", i, rec.Code)
+		}
+	}
+	if rec := do(http.MethodGet, "/api/items", "10.0.0.1:1000", "k1"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("third request with k1 should be limited, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/api/items", "10.0.0.1:1000", "k2"); rec.Code != http.StatusOK {
+		t.Errorf("k2 has its own bucket, got %d", rec.Code)
+	}
+
+	// no rule, no limit
+	for range 5 {
+		if rec := do(http.MethodGet, "/health", "10.0.0.1:1000", ""); rec.Code != http.StatusOK {
+			t.Errorf("unmatched path should not be limited, got %d", rec.Code)
+		}
+	}
+}
+
+func TestConcurrencyMiddleware(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"limiters": [{"name": "api", "algorithm": "token_bucket", "capacity": 3, "fill_rate": 0.01}],
+		"concurrency": [{"name": "slow", "max_in_flight": 1}],
+		"rules": [
+			{"path": "/api/reports", "concurrency": "slow"},
+			{"path": "/api/**", "limiter": "api", "concurrency": "slow"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("config should be valid: %v", err)
+	}
+	rt, err := newRouter(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	handler := rt.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/reports" {
+			close(started)
+			<-finish
+		}
+	}))
+	do := func(path string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	done := make(chan int)
+	go func() { done <- do("/api/reports") }()
+	<-started
+
+	// the only slot is taken and there is no queue
+	if code := do("/api/items"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while the slot is taken, got %d", code)
+	}
+	close(finish)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("slow request should pass, got %d", code)
+	}
+
+	// the 503 wasn't charged, all 3 tokens go through one at a time
+	for i := range 3 {
+		if code := do("/api/items"); code != http.StatusOK {
+			t.Errorf("request %d should pass, got %d", i, code)
+		}
+	}
+	// rate limited requests give their slot back
+	if code := do("/api/items"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 once the bucket is empty, got %d", code)
+	}
+	if c := rt.concurrency["slow"]; c.InFlight() != 0 {
+		t.Errorf("Expected no requests in flight, got %d", c.InFlight())
+	}
+
+	// a reload keeps the same limit so requests in flight still count
+	cfg.Concurrency[0].MaxInFlight = 5
+	reloaded, err := newRouter(cfg, rt)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	if c := reloaded.concurrency["slow"]; c != rt.concurrency["slow"] || c.MaxInFlight() != 5 {
+		t.Errorf("Expected the limit to be kept and updated to 5")
+	}
+}
+
+func TestAdaptiveMiddleware(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"limiters": [{"name": "api", "algorithm": "token_bucket", "capacity": 100, "fill_rate": 4,
+			"adaptive": {"min_fill_rate": 1, "max_fill_rate": 8, "increase": 1, "decrease": 0.5,
+				"max_error_rate": 0.1, "interval": "50ms"}}],
+		"rules": [{"path": "/api/**", "limiter": "api", "key": "ip"}]
+	}`))
+	if err != nil {
+		t.Fatalf("config should be valid: %v", err)
+	}
+	rt, err := newRouter(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	handler := rt.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	do := func(path string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	api := rt.limiters["api"]
+	fillRate := func() float64 { return api.get("10.0.0.1").(*tokenbucket.TokenBucket).FillRate() }
+
+	// failing requests halve the fill rate of every key
+	api.aimd.Adjust() // start a fresh interval
+	do("/api/fail")
+	time.Sleep(60 * time.Millisecond)
+	do("/api/fail")
+	if rate, _ := api.adaptiveRate(); rate != 2 || fillRate() != 2 {
+		t.Errorf("Expected fill rate 2 after errors, got %f and %f", rate, fillRate())
+	}
+	if l := api.get("other"); l.(*tokenbucket.TokenBucket).FillRate() != 2 {
+		t.Errorf("New keys should start at the adaptive fill rate")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	do("/api/ok")
+	if rate, _ := api.adaptiveRate(); rate != 3 || fillRate() != 3 {
+		t.Errorf("Expected fill rate 3 after a healthy interval, got %f and %f", rate, fillRate())
+	}
+
+	// changing fill_rate starts over from there
+	lc := api.config()
+	lc.FillRate = 6
+	api.update(lc)
+	if rate, _ := api.adaptiveRate(); rate != 6 || fillRate() != 6 {
+		t.Errorf("Expected fill rate 6 after an update, got %f and %f", rate, fillRate())
+	}
+}
+
+func TestWarmupMiddleware(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"limiters": [{"name": "api", "algorithm": "token_bucket", "capacity": 10, "fill_rate": 1,
+			"warmup": {"period": "1m", "fraction": 0.2}}],
+		"rules": [{"path": "/api/**", "limiter": "api", "key": "ip"}]
+	}`))
+	if err != nil {
+		t.Fatalf("config should be valid: %v", err)
+	}
+	rt, err := newRouter(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	handler := rt.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	allowed := 0
+	for range 5 {
+		req := httptest.NewRequest(http.MethodGet, "/api/x", nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code == http.StatusOK {
+			allowed++
+		}
+	}
+	// a cold bucket holds a fifth of its capacity
+	if allowed != 2 {
+		t.Errorf("Expected 2 requests through a cold bucket, got %d", allowed)
+	}
+
+	// dropping the warmup config lets the bucket use its full capacity
+	api := rt.limiters["api"]
+	lc := api.config()
+	lc.Warmup = WarmupConfig{}
+	api.update(lc)
+	if tb := api.get("10.0.0.1").(*tokenbucket.TokenBucket); tb.Warming() {
+		t.Errorf("Expected warm-up to be off after the update")
+	}
+}
+
+func TestDebtMiddleware(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"limiters": [{"name": "jobs", "algorithm": "token_bucket", "capacity": 10, "fill_rate": 0.01, "max_debt": 20}],
+		"rules": [{"path": "/jobs", "limiter": "jobs", "cost": 8}]
+	}`))
+	if err != nil {
+		t.Fatalf("config should be valid: %v", err)
+	}
+	rt, err := newRouter(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	defer rt.limiters["jobs"].removeMetrics()
+	handler := rt.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// two jobs of 8 leave the bucket 6 in debt, the next one waits for it
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/jobs", nil))
+		if rec.Code != want {
+			t.Fatalf("request %d: expected %d, got %d", i, want, rec.Code)
+		}
+	}
+	if available := gaugeValue(t, availableGauge.WithLabelValues("jobs", TokenBucket)); available > -5.9 || available < -6 {
+		t.Errorf("Expected the debt of 6 in ratelimit_available, got %.2f", available)
+	}
+}
+
+func TestGCRAAvailable(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"limiters": [{"name": "webhooks", "algorithm": "gcra", "capacity": 5, "fill_rate": 0.01}],
+		"rules": [{"path": "/hooks", "limiter": "webhooks", "key": "ip"}]
+	}`))
+	if err != nil {
+		t.Fatalf("config should be valid: %v", err)
+	}
+	rt, err := newRouter(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	defer rt.limiters["webhooks"].removeMetrics()
+	handler := rt.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for range 2 {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/hooks", nil))
+	}
+	// derived from the TAT, 2 of the burst of 5 are used
+	if available := gaugeValue(t, availableGauge.WithLabelValues("webhooks", GCRA)); available < 2.9 || available > 3.01 {
+		t.Errorf("Expected 3 available, got %.2f", available)
+	}
+}
+
+// gaugeValue reads the current value of g
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		t.Fatalf("reading the gauge failed: %v", err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestCostMiddleware(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"limiters": [{"name": "api", "algorithm": "token_bucket", "capacity": 5, "fill_rate": 0.01}],
+		"rules": [
+			{"path": "/api/export", "limiter": "api", "cost": 5.5},
+			{"path": "/api/search", "limiter": "api", "cost": 2.5},
+			{"path": "/api/**", "limiter": "api", "cost": 0.1}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("config should be valid: %v", err)
+	}
+	rt, err := newRouter(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	handler := rt.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	// more than the bucket can ever hold, waiting doesn't help
+	if rec := do("/api/export"); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "" {
+		t.Errorf("Expected 429 without Retry-After for a cost above capacity, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	if rec := do("/api/search"); rec.Code != http.StatusOK {
+		t.Errorf("first search should be allowed, got %d", rec.Code)
+	}
+	// 2.5 tokens left, ten cheap reads take one of them
+	for i := range 10 {
+		if rec := do("/api/items"); rec.Code != http.StatusOK {
+			t.Fatalf("read %d should be allowed, got %d", i, rec.Code)
+		}
+	}
+	rec := do("/api/search")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("second search should be rejected with 1.5 tokens left, got %d", rec.Code)
+	}
+	// one more token at 0.01 per second is 100s away
+	if retry := rec.Header().Get("Retry-After"); retry != "100" {
+		t.Errorf("Expected Retry-After 100, got %q", retry)
+	}
+}
+
+func TestMultiBucketMiddleware(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"limiters": [{"name": "api", "algorithm": "multi_token_bucket", "dimensions": [
+			{"name": "requests", "capacity": 10, "fill_rate": 0.01},
+			{"name": "bytes", "capacity": 102400, "fill_rate": 1024}
+		]}],
+		"rules": [
+			{"path": "/api/download", "limiter": "api", "key": "ip", "costs": {"bytes": 49152}},
+			{"path": "/api/**", "limiter": "api", "key": "ip"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("config should be valid: %v", err)
+	}
+	rt, err := newRouter(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	handler := rt.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// a download costs 1 request and 48 KiB, two of them leave 4 KiB
+	for i := range 2 {
+		if rec := do("/api/download"); rec.Code != http.StatusOK {
+			t.Fatalf("download %d should be allowed, got %d", i, rec.Code)
+		}
+	}
+	rec := do("/api/download")
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "bytes") {
+		t.Errorf("third download should be denied by bytes, got %d %q", rec.Code, rec.Body.String())
+	}
+	// 44 KiB missing at 1 KiB per second
+	if retry := rec.Header().Get("Retry-After"); retry != "44" {
+		t.Errorf("Expected Retry-After 44, got %q", retry)
+	}
+	// requests without a byte cost still go through
+	if rec := do("/api/items"); rec.Code != http.StatusOK {
+		t.Errorf("a small request should be allowed, got %d", rec.Code)
+	}
+
+	allowed, rejected, dims := rt.limiters["api"].get("10.0.0.1").(*tokenbucket.MultiBucket).Stats()
+	if allowed != 3 || rejected != 1 || dims[0].Rejected != 0 || dims[1].Rejected != 1 {
+		t.Errorf("Expected 3 allowed and 1 rejected by bytes, got %d, %d, %+v", allowed, rejected, dims)
+	}
+}
+
+func TestHierarchyMiddleware(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"limiters": [{"name": "tenants", "algorithm": "hierarchy", "levels": [
+			{"name": "service", "capacity": 3, "fill_rate": 0.01},
+			{"name": "tenant", "capacity": 2, "fill_rate": 0.01}
+		]}],
+		"rules": [{"path": "/api/**", "limiter": "tenants", "keys": ["header:X-Tenant"]}]
+	}`))
+	if err != nil {
+		t.Fatalf("config should be valid: %v", err)
+	}
+	rt, err := newRouter(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	handler := rt.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+		req.Header.Set("X-Tenant", tenant)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := range 2 {
+		if rec := do("acme/eu"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d of acme should be allowed, got %d", i, rec.Code)
+		}
+	}
+	if rec := do("acme/eu"); rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "tenant") {
+		t.Errorf("acme should be denied by its tenant level, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := do("globex"); rec.Code != http.StatusOK {
+		t.Errorf("globex has its own tenant bucket, got %d", rec.Code)
+	}
+	// the service is out of tokens for everyone
+	if rec := do("initech"); rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "service") {
+		t.Errorf("initech should be denied by the service level, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	// a "/" in a key is part of the key, not another level
+	nodes := rt.limiters["tenants"].get("").(*hierarchyLimiter).Nodes()
+	if len(nodes) != 4 || nodes[1].Path != "acme/eu" || nodes[1].Allowed != 2 || nodes[1].Rejected != 1 {
+		t.Errorf("Expected the root and 3 tenants with acme/eu allowed twice, got %+v", nodes)
+	}
+	if rt.limiters["tenants"].size() != 4 {
+		t.Errorf("Expected 4 nodes, got %d", rt.limiters["tenants"].size())
+	}
+
+	// allowed, rejected, borrowed and tokens of the root and of the 3 tenants summed up,
+	// and the nodes of both levels
+	ch := make(chan prometheus.Metric, 32)
+	hierarchyMetrics.Collect(ch)
+	close(ch)
+	if len(ch) != 4+4+2 {
+		t.Errorf("Expected 10 metrics, got %d", len(ch))
+	}
+	for metric := range ch {
+		var pb dto.Metric
+		metric.Write(&pb)
+		for _, label := range pb.GetLabel() {
+			if label.GetName() == "path" && label.GetValue() != "" {
+				t.Errorf("Expected no path for the tenants, got %q", label.GetValue())
+			}
+		}
+		if strings.Contains(metric.Desc().String(), "ratelimit_hierarchy_allowed_total") && pb.GetLabel()[0].GetValue() == "tenant" && pb.GetCounter().GetValue() != 3 {
+			t.Errorf("Expected 3 requests allowed over all tenants, got %v", pb.GetCounter().GetValue())
+		}
+	}
+}
+
+func TestCostByMiddleware(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"limiters": [
+			{"name": "up", "algorithm": "token_bucket", "capacity": 1000, "fill_rate": 0.01},
+			{"name": "down", "algorithm": "token_bucket", "capacity": 1000, "fill_rate": 0.01}
+		],
+		"rules": [
+			{"path": "/upload", "limiter": "up", "cost_by": "request_bytes"},
+			{"path": "/download", "limiter": "down", "cost_by": "response_bytes"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("config should be valid: %v", err)
+	}
+	rt, err := newRouter(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	var received int
+	handler := rt.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = len(body)
+		if r.URL.Path == "/download" {
+			w.Write(make([]byte, 800))
+		}
+	}))
+	do := func(path string, body io.Reader) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, body))
+		return rec.Code
+	}
+
+	// 600 bytes by Content-Length leave 400
+	if code := do("/upload", strings.NewReader(strings.Repeat("a", 600))); code != http.StatusOK {
+		t.Fatalf("600 bytes should be allowed, got %d", code)
+	}
+	// a chunked body is counted, the handler still gets all of it
+	if code := do("/upload", io.MultiReader(strings.NewReader(strings.Repeat("a", 500)))); code != http.StatusTooManyRequests {
+		t.Errorf("500 chunked bytes should be rejected with 400 left, got %d", code)
+	}
+	if code := do("/upload", io.MultiReader(strings.NewReader(strings.Repeat("a", 300)))); code != http.StatusOK || received != 300 {
+		t.Errorf("300 chunked bytes should reach the handler, got %d and %d bytes", code, received)
+	}
+	if code := do("/upload", io.MultiReader(strings.NewReader(strings.Repeat("a", maxCountedBody+1)))); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("a chunked body past maxCountedBody should be refused, got %d", code)
+	}
+
+	// a download takes 1 up front and the rest of its 800 bytes after, the third finds the bucket empty
+	for i := range 2 {
+		if code := do("/download", nil); code != http.StatusOK {
+			t.Fatalf("download %d should be allowed, got %d", i, code)
+		}
+	}
+	if code := do("/download", nil); code != http.StatusTooManyRequests {
+		t.Errorf("third download should be rejected, got %d", code)
+	}
+	if tokens := rt.limiters["down"].get("").(*tokenbucket.TokenBucket).AvailableTokens(); tokens > 0.1 {
+		t.Errorf("Expected the downloads to empty the bucket, %.2f left", tokens)
+	}
+}
+
+func TestPenaltyMiddleware(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"limiters": [{"name": "api", "algorithm": "token_bucket", "capacity": 1, "fill_rate": 0.01,
+			"penalty": {"rejections": 2, "window": "1m", "ban": "10m"}}],
+		"rules": [{"path": "/api/**", "limiter": "api", "key": "ip"}]
+	}`))
+	if err != nil {
+		t.Fatalf("config should be valid: %v", err)
+	}
+	rt, err := newRouter(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	handler := rt.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+		req.RemoteAddr = ip + ":1000"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// one allowed, two rejected, the second rejection bans the key
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		if rec := do("10.0.0.1"); rec.Code != want {
+			t.Fatalf("request %d: expected %d, got %d", i, want, rec.Code)
+		}
+	}
+	rec := do("10.0.0.1")
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "banned") {
+		t.Errorf("Expected the key to be banned, got %d %q", rec.Code, rec.Body.String())
+	}
+	if retry := rec.Header().Get("Retry-After"); retry != "600" {
+		t.Errorf("Expected Retry-After 600, got %q", retry)
+	}
+	// the banned requests never reached the bucket
+	if processed, rejected, _ := rt.limiters["api"].get("10.0.0.1").(*tokenbucket.TokenBucket).Stats(); processed != 1 || rejected != 2 {
+		t.Errorf("Expected 1 processed and 2 rejected by the bucket, got %d and %d", processed, rejected)
+	}
+	if rec := do("10.0.0.2"); rec.Code != http.StatusOK {
+		t.Errorf("Other keys should not be banned, got %d", rec.Code)
+	}
+}
+
+func TestPenaltySkipsEmptyKey(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"limiters": [{"name": "api", "algorithm": "token_bucket", "capacity": 1, "fill_rate": 0.01,
+			"penalty": {"rejections": 1, "window": "1m", "ban": "10m"}}],
+		"rules": [{"path": "/api/**", "limiter": "api", "key": "header:X-API-Key"}]
+	}`))
+	if err != nil {
+		t.Fatalf("config should be valid: %v", err)
+	}
+	rt, err := newRouter(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	handler := rt.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// requests without the header share the empty key, rejected but never banned
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/items", nil))
+		if rec.Code != want || strings.Contains(rec.Body.String(), "banned") {
+			t.Fatalf("request %d: expected %d without a ban, got %d %q", i, want, rec.Code, rec.Body.String())
+		}
+	}
+	if bans := rt.limiters["api"].penaltyBox().active("api", time.Now()); len(bans) != 0 {
+		t.Errorf("Expected no bans, got %+v", bans)
+	}
+}
+
+func TestListsMiddleware(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"limiters": [{"name": "api", "algorithm": "token_bucket", "capacity": 1, "fill_rate": 0.01}],
+		"rules": [{"path": "/api/**", "limiter": "api"}],
+		"lists": [
+			{"name": "partners", "action": "allow", "cidrs": ["10.0.0.0/8", "2001:db8::/32"], "api_keys": ["k1"]},
+			{"name": "bad", "action": "deny", "cidrs": ["10.6.6.0/24"], "headers": {"User-Agent": ["badbot"]}}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("config should be valid: %v", err)
+	}
+	rt, err := newRouter(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	do := func(rt *router, addr string, header ...string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+		req.RemoteAddr = addr
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		rt.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// the bucket only has room for one request, the allow list goes past it
+	if code := do(rt, "192.0.2.1:1000"); code != http.StatusOK {
+		t.Fatalf("first request should be allowed, got %d", code)
+	}
+	for _, c := range []struct {
+		name   string
+		addr   string
+		header []string
+		want   int
+	}{
+		{"limited", "192.0.2.1:1000", nil, http.StatusTooManyRequests},
+		{"allowed cidr", "10.1.2.3:1000", nil, http.StatusOK},
+		{"allowed ipv6", "[2001:db8::1]:1000", nil, http.StatusOK},
+		{"allowed api key", "192.0.2.1:1000", []string{"X-API-Key", "k1"}, http.StatusOK},
+		{"wrong api key", "192.0.2.1:1000", []string{"X-API-Key", "k2"}, http.StatusTooManyRequests},
+		// deny lists come first, also inside an allowed range
+		{"denied cidr", "10.6.6.6:1000", nil, http.StatusForbidden},
+		{"denied header", "10.1.2.3:1000", []string{"User-Agent", "badbot"}, http.StatusForbidden},
+	} {
+		if code := do(rt, c.addr, c.header...); code != c.want {
+			t.Errorf("%s: expected %d, got %d", c.name, c.want, code)
+		}
+	}
+
+	// a reload replaces the lists
+	cfg.Lists = cfg.Lists[1:]
+	rt, err = newRouter(cfg, rt)
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if code := do(rt, "10.1.2.3:1000"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the partners list to be gone, got %d", code)
+	}
+}
+
+func TestPenaltyBox(t *testing.T) {
+	p := newPenaltyBox(PenaltyConfig{
+		Rejections: 2,
+		Window:     Duration(time.Minute),
+		Ban:        Duration(time.Minute),
+		Multiplier: 3,
+		MaxBan:     Duration(5 * time.Minute),
+	})
+	now := time.Now()
+	offend := func() (time.Duration, bool) {
+		p.reject("k", now)
+		now = now.Add(time.Second)
+		return p.reject("k", now)
+	}
+
+	// rejections further apart than the window don't add up
+	p.reject("k", now)
+	now = now.Add(2 * time.Minute)
+	if _, banned := p.reject("k", now); banned {
+		t.Errorf("Expected rejections 2m apart not to ban")
+	}
+	now = now.Add(2 * time.Minute)
+
+	// bans in a row grow by 3 up to max_ban
+	for i, want := range []time.Duration{time.Minute, 3 * time.Minute, 5 * time.Minute} {
+		d, banned := offend()
+		if !banned || d != want {
+			t.Fatalf("ban %d: expected %v, got %v %v", i, want, d, banned)
+		}
+		if wait, ok := p.banned("k", now); !ok || wait != want {
+			t.Errorf("ban %d: expected %v left, got %v %v", i, want, wait, ok)
+		}
+		now = now.Add(want)
+	}
+
+	// staying out of trouble as long as the last ban starts over
+	now = now.Add(5 * time.Minute)
+	if d, _ := offend(); d != time.Minute {
+		t.Errorf("Expected the ban to start over at 1m, got %v", d)
+	}
+	if bans := p.active("api", now); len(bans) != 1 || bans[0].Bans != 1 {
+		t.Errorf("Expected one active first ban, got %+v", bans)
+	}
+	if !p.lift("k", now) || p.lift("k", now) {
+		t.Errorf("Expected the ban to be lifted exactly once")
+	}
+}
+
+func TestAdaptiveConcurrencyMiddleware(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"concurrency": [{"name": "db", "max_in_flight": 2, "adaptive": {"min_limit": 1, "max_limit": 20, "smoothing": 1}}],
+		"rules": [{"path": "/api/**", "concurrency": "db"}]
+	}`))
+	if err != nil {
+		t.Fatalf("config should be valid: %v", err)
+	}
+	rt, err := newRouter(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	handler := rt.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	do := func(path string) {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	db := rt.concurrency["db"]
+
+	// the first request sets the min RTT, so the limit grows by sqrt(2)
+	do("/api/ok")
+	if db.MaxInFlight() != 3 {
+		t.Errorf("Expected the limit to grow to 3, got %d", db.MaxInFlight())
+	}
+	if db.adaptive().MinRTT() <= 0 {
+		t.Errorf("Expected a min RTT after the first request")
+	}
+
+	// errors back off
+	do("/api/fail")
+	do("/api/fail")
+	if db.MaxInFlight() != 2 {
+		t.Errorf("Expected errors to shrink the limit to 2, got %d", db.MaxInFlight())
+	}
+
+	// a reload that only touches the queue keeps the learned limit
+	cfg.Concurrency[0].MaxQueue = 5
+	if _, err := newRouter(cfg, rt); err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	if db.MaxInFlight() != 2 || db.MaxQueue() != 5 {
+		t.Errorf("Expected limit 2 and queue 5 after the reload, got %d and %d", db.MaxInFlight(), db.MaxQueue())
+	}
+}
+
+func TestCompositeMiddleware(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"limiters": [{"name": "partners", "algorithm": "composite", "limits": [
+			{"name": "per_second", "algorithm": "token_bucket", "capacity": 2, "fill_rate": 0.01},
+			{"name": "per_hour", "algorithm": "fixed_window", "window_size": "1h", "max_requests": 3}
+		]}],
+		"rules": [{"path": "/api/**", "limiter": "partners", "key": "header:X-API-Key"}]
+	}`))
+	if err != nil {
+		t.Fatalf("config should be valid: %v", err)
+	}
+	rt, err := newRouter(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	handler := rt.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+		req.Header.Set("X-API-Key", "k1")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := range 2 {
+		if rec := do(); rec.Code != http.StatusOK {
+			t.Errorf("request %d should pass, got %d", i, rec.Code)
+		}
+	}
+	rec := do()
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "per_second") {
+		t.Errorf("third request should be denied by per_second, got %d %q", rec.Code, rec.Body.String())
+	}
+	// 0.01 tokens per second, a token is 100s away
+	if retry := rec.Header().Get("Retry-After"); retry != "100" {
+		t.Errorf("Expected Retry-After 100, got %q", retry)
+	}
+
+	// the denial didn't count against the hourly limit
+	hour, _ := rt.limiters["partners"].get("k1").(*compositelimiter.CompositeLimiter).Limit("per_hour")
+	if count := hour.(*fixedwindowcounter.FixedWindowCounter).RequestCount; count != 2 {
+		t.Errorf("Expected 2 requests in the hourly window, got %v", count)
+	}
+
+	// new values for the same limits are applied in place
+	cfg.Limiters[0].Limits = slices.Clone(cfg.Limiters[0].Limits)
+	cfg.Limiters[0].Limits[1].MaxRequests = 5
+	if _, err := newRouter(cfg, rt); err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	if max := hour.(*fixedwindowcounter.FixedWindowCounter).MaxRequests; max != 5 {
+		t.Errorf("Expected the hourly limit updated to 5, got %d", max)
+	}
+
+	// a reload with other limits starts over, the old state doesn't fit them
+	cfg.Limiters[0].Limits = slices.Clone(cfg.Limiters[0].Limits)
+	cfg.Limiters[0].Limits[1].Name = "per_day"
+	reloaded, err := newRouter(cfg, rt)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	if reloaded.limiters["partners"] == rt.limiters["partners"] {
+		t.Errorf("Expected a new limiter when the limits of a composite change")
+	}
+}
+
+func TestColorMarkerMiddleware(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"limiters": [{"name": "streams", "algorithm": "trtcm", "capacity": 1, "fill_rate": 0.01, "peak_rate": 0.02, "peak_burst": 2}],
+		"rules": [{"path": "/api/**", "limiter": "streams"}]
+	}`))
+	if err != nil {
+		t.Fatalf("config should be valid: %v", err)
+	}
+	rt, err := newRouter(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	var seen string
+	handler := rt.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get(colorHeader)
+	}))
+	do := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+		// a client can't pick its own color
+		req.Header.Set(colorHeader, "green")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, want := range []string{"green", "yellow"} {
+		rec := do()
+		if rec.Code != http.StatusOK || rec.Header().Get(colorHeader) != want || seen != want {
+			t.Errorf("Expected a %s request to pass, got %d with %q, handler saw %q", want, rec.Code, rec.Header().Get(colorHeader), seen)
+		}
+	}
+
+	// red is dropped until the peak bucket has a token again
+	rec := do()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected a red request to be limited, got %d", rec.Code)
+	}
+	if retry := rec.Header().Get("Retry-After"); retry != "50" {
+		t.Errorf("Expected Retry-After 50, got %q", retry)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshot is the layout of the state file
+type snapshot struct {
+	Limiters map[string]limiterSnapshot `json:"limiters"`
+}
+
+type limiterSnapshot struct {
+	Algorithm string                     `json:"algorithm"`
+	Keys      map[string]json.RawMessage `json:"keys"`
+}
+
+func (rt *router) snapshot() (*snapshot, error) {
+	s := &snapshot{Limiters: make(map[string]limiterSnapshot, len(rt.limiters))}
+	for name, m := range rt.limiters {
+		keys, err := m.snapshot()
+		if err != nil {
+			return nil, fmt.Errorf("limiter %q: %w", name, err)
+		}
+		s.Limiters[name] = limiterSnapshot{Algorithm: m.algorithm, Keys: keys}
+	}
+	return s, nil
+}
+
+// restore loads the saved state into limiters that still exist with the same algorithm,
+// the rest of the snapshot no longer applies and is skipped. So are keys whose state
+// doesn't decode, they are logged and start fresh while the rest is restored.
+func (rt *router) restore(s *snapshot) int {
+	restored := 0
+	for name, ls := range s.Limiters {
+		m, ok := rt.limiter(name)
+		if !ok || m.algorithm != ls.Algorithm {
+			log.Printf("Skipping saved state of limiter %q, it was removed or its algorithm changed", name)
+			continue
+		}
+		if err := m.restore(ls.Keys); err != nil {
+			log.Printf("Skipping part of the saved state of limiter %q:\n%v", name, err)
+		}
+		m.updateLimitMetrics()
+		restored++
+	}
+	return restored
+}
+
+// saveState writes the state of the running limiters to filename, one save at a time. It goes
+// through a synced temp file next to it so a crash halfway never leaves a broken snapshot behind.
+func (rl *reloader) saveState(filename string) error {
+	rl.saveMu.Lock()
+	defer rl.saveMu.Unlock()
+
+	s, err := rl.current.Load().snapshot()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails once renamed
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(0o644)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// loadState restores a snapshot written by saveState and returns how many limiters it restored,
+// a missing file is not an error
+func (rl *reloader) loadState(filename string) (int, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return 0, err
+	}
+	return rl.current.Load().restore(&s), nil
+}
+
+// snapshotLoop saves the state every interval until ctx is done
+func (rl *reloader) snapshotLoop(ctx context.Context, filename string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := rl.saveState(filename); err != nil {
+				log.Printf("Saving state to %s failed: %v", filename, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveAndLoadState(t *testing.T) {
+	dir := t.TempDir()
+	configFile, stateFile := filepath.Join(dir, "config.json"), filepath.Join(dir, "state.json")
+	writeConfig(t, configFile, reloadBase)
+
+	rl, _, err := newReloader(configFile)
+	if err != nil {
+		t.Fatalf("newReloader failed: %v", err)
+	}
+	if n, err := rl.loadState(stateFile); n != 0 || err != nil {
+		t.Fatalf("Missing state file should be skipped, got %d, %v", n, err)
+	}
+
+	rt := rl.current.Load()
+	rt.limiters["api"].get("1.2.3.4").Allow(10)
+	rt.limiters["login"].get("").Allow(5)
+	if err := rl.saveState(stateFile); err != nil {
+		t.Fatalf("saveState failed: %v", err)
+	}
+
+	// login switched algorithm since the snapshot, only api can be restored
+	writeConfig(t, configFile, `{
+		"limiters": [
+			{"name": "api", "algorithm": "token_bucket", "capacity": 10, "fill_rate": 1},
+			{"name": "login", "algorithm": "sliding_log", "window_size": "1m", "max_requests": 5}
+		],
+		"rules": [{"path": "/api/**", "limiter": "api"}]
+	}`)
+	restarted, _, err := newReloader(configFile)
+	if err != nil {
+		t.Fatalf("newReloader failed: %v", err)
+	}
+	n, err := restarted.loadState(stateFile)
+	if n != 1 || err != nil {
+		t.Fatalf("Expected 1 limiter restored, got %d, %v", n, err)
+	}
+
+	rt = restarted.current.Load()
+	if rt.limiters["api"].size() != 2 {
+		t.Errorf("Expected the restored key next to the default one, got %d keys", rt.limiters["api"].size())
+	}
+	if rt.limiters["api"].get("1.2.3.4").Allow(1) {
+		t.Errorf("Restored key should still be out of tokens")
+	}
+	if !rt.limiters["api"].get("5.6.7.8").Allow(1) {
+		t.Errorf("Keys not in the snapshot should start fresh")
+	}
+	if !rt.limiters["login"].get("").Allow(5) {
+		t.Errorf("Limiter with a changed algorithm should start fresh")
+	}
+
+	// a key that doesn't decode is skipped, the rest of the limiter is still restored
+	empty, _ := json.Marshal(rt.limiters["api"].get("1.2.3.4"))
+	os.WriteFile(stateFile, []byte(`{"limiters": {"api": {"algorithm": "token_bucket", "keys": {
+		"9.9.9.9": {"version": 99},
+		"1.1.1.1": `+string(empty)+`}}}}`), 0o644)
+	if n, err := restarted.loadState(stateFile); n != 1 || err != nil {
+		t.Fatalf("Expected 1 limiter restored despite the bad key, got %d, %v", n, err)
+	}
+	if _, ok := rt.limiters["api"].lookup("9.9.9.9"); ok {
+		t.Errorf("Key with a bad state should not be restored")
+	}
+	if rt.limiters["api"].get("1.1.1.1").Allow(1) {
+		t.Errorf("Good key next to a bad one should be restored")
+	}
+	if tmp, _ := filepath.Glob(stateFile + ".*.tmp"); len(tmp) != 0 {
+		t.Errorf("saveState should leave no temp files behind, got %v", tmp)
+	}
+
+	os.WriteFile(stateFile, []byte("{"), 0o644)
+	if _, err := restarted.loadState(stateFile); err == nil {
+		t.Errorf("loadState should fail for a corrupt file")
+	}
+}
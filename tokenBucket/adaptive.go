@@ -0,0 +1,149 @@
+package tokenbucket
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// AIMDConfig tunes how AIMD moves the rate. Latency and errors are judged once per
+// Interval: a healthy interval adds Increase, an unhealthy one multiplies by Decrease.
+type AIMDConfig struct {
+	MinRate  float64
+	MaxRate  float64
+	Increase float64 // tokens per second added after a healthy interval
+	Decrease float64 // factor the rate is multiplied by after an unhealthy interval, between 0 and 1
+
+	TargetLatency time.Duration // mean latency above this is unhealthy, 0 ignores latency
+	MaxErrorRate  float64       // share of failed requests above this is unhealthy, 0 ignores errors
+	Interval      time.Duration
+}
+
+func (c AIMDConfig) validate() error {
+	var errs []error
+	if c.MinRate <= 0 || c.MaxRate < c.MinRate {
+		errs = append(errs, errors.New("rates must satisfy 0 < MinRate <= MaxRate"))
+	}
+	if c.Increase <= 0 {
+		errs = append(errs, errors.New("Increase must be positive"))
+	}
+	if c.Decrease <= 0 || c.Decrease >= 1 {
+		errs = append(errs, errors.New("Decrease must be between 0 and 1"))
+	}
+	if c.TargetLatency < 0 || c.MaxErrorRate < 0 || c.MaxErrorRate > 1 {
+		errs = append(errs, errors.New("TargetLatency cant be negative and MaxErrorRate must be between 0 and 1"))
+	}
+	if c.TargetLatency == 0 && c.MaxErrorRate == 0 {
+		errs = append(errs, errors.New("at least one of TargetLatency or MaxErrorRate is required"))
+	}
+	if c.Interval <= 0 {
+		errs = append(errs, errors.New("Interval must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// AIMD computes a rate from the latency and errors of the requests it lets through,
+// additive increase while they stay under target, multiplicative decrease when not.
+// It only holds the rate, AdaptiveTokenBucket applies it to a bucket.
+type AIMD struct {
+	cfg  AIMDConfig
+	rate float64
+
+	// observations of the current interval
+	start    time.Time
+	requests int
+	failed   int
+	latency  time.Duration
+	mu       sync.Mutex
+}
+
+// NewAIMD starts at rate, clamped to the configured range
+func NewAIMD(cfg AIMDConfig, rate float64) (*AIMD, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &AIMD{cfg: cfg, rate: clamp(rate, cfg.MinRate, cfg.MaxRate), start: time.Now()}, nil
+}
+
+// Observe records one finished request. Once an interval has passed since the last
+// adjustment it adjusts the rate and returns it with true.
+func (a *AIMD) Observe(latency time.Duration, failed bool) (float64, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.requests++
+	a.latency += latency
+	if failed {
+		a.failed++
+	}
+	if time.Since(a.start) < a.cfg.Interval {
+		return a.rate, false
+	}
+	return a.adjust(), true
+}
+
+// Adjust judges the observations since the last adjustment and returns the new rate.
+// An interval without requests says nothing about the backend and keeps the rate.
+func (a *AIMD) Adjust() float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.adjust()
+}
+
+func (a *AIMD) adjust() float64 {
+	if a.requests > 0 {
+		if a.healthy() {
+			a.rate += a.cfg.Increase
+		} else {
+			a.rate *= a.cfg.Decrease
+		}
+		a.rate = clamp(a.rate, a.cfg.MinRate, a.cfg.MaxRate)
+	}
+	a.start = time.Now()
+	a.requests, a.failed, a.latency = 0, 0, 0
+	return a.rate
+}
+
+func (a *AIMD) healthy() bool {
+	if a.cfg.TargetLatency > 0 && a.latency/time.Duration(a.requests) > a.cfg.TargetLatency {
+		return false
+	}
+	if a.cfg.MaxErrorRate > 0 && float64(a.failed)/float64(a.requests) > a.cfg.MaxErrorRate {
+		return false
+	}
+	return true
+}
+
+func (a *AIMD) Rate() float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rate
+}
+
+func clamp(v, lo, hi float64) float64 {
+	return min(max(v, lo), hi)
+}
+
+// AdaptiveTokenBucket is a TokenBucket whose fill rate follows an AIMD controller.
+// Report every request it allowed to Observe once it's done.
+type AdaptiveTokenBucket struct {
+	*TokenBucket
+	aimd *AIMD
+}
+
+// NewAdaptiveTokenBucket wraps tb, its fill rate is moved into the configured range right away
+func NewAdaptiveTokenBucket(tb *TokenBucket, cfg AIMDConfig) (*AdaptiveTokenBucket, error) {
+	aimd, err := NewAIMD(cfg, tb.FillRate())
+	if err != nil {
+		return nil, err
+	}
+	tb.Update(0, aimd.Rate())
+	return &AdaptiveTokenBucket{TokenBucket: tb, aimd: aimd}, nil
+}
+
+// Observe records a finished request and updates the fill rate at the end of each interval
+func (atb *AdaptiveTokenBucket) Observe(latency time.Duration, failed bool) {
+	if rate, adjusted := atb.aimd.Observe(latency, failed); adjusted {
+		atb.Update(0, rate)
+	}
+}
@@ -0,0 +1,393 @@
+package tokenbucket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level configures every node at one depth of a Hierarchy, e.g. the whole service,
+// each tenant or each user of a tenant
+type Level struct {
+	Name     string
+	Capacity int
+	FillRate float64
+	// max fill rate including tokens borrowed from the parent while the node is over
+	// its own FillRate, HTB style. 0 never borrows, the root has nothing to borrow from.
+	Ceil float64
+}
+
+func (l Level) validate(root bool) error {
+	var errs []error
+	if l.Name == "" {
+		errs = append(errs, errors.New("name is required"))
+	}
+	if l.Capacity <= 0 || l.FillRate <= 0 {
+		errs = append(errs, errors.New("capacity and fillRate must be positive"))
+	}
+	if root && l.Ceil != 0 {
+		errs = append(errs, errors.New("the root level has no parent to borrow from"))
+	} else if l.Ceil != 0 && l.Ceil < l.FillRate {
+		errs = append(errs, errors.New("ceil must be at least fillRate"))
+	}
+	return errors.Join(errs...)
+}
+
+// node is one bucket of the tree, created on the first request for its key and
+// dropped again once it and everything below it sat idle until their buckets are full
+type node struct {
+	depth    int
+	bucket   *TokenBucket
+	ceil     *TokenBucket // nil unless the level borrows
+	children map[string]*node
+	allowed  int
+	rejected int
+	borrowed int
+	// last request through this node or any node below it
+	lastUsed time.Time
+}
+
+// HierarchyDecision is the outcome of Hierarchy.Check
+type HierarchyDecision struct {
+	Allowed bool
+	// levels that turned the request away, from the root down
+	DeniedBy []string
+	// levels that were over their own rate and borrowed from the parent
+	Borrowed []string
+	// longest wait until the levels in DeniedBy have room at their own rate, InfDuration if n never fits
+	RetryAfter time.Duration
+}
+
+// NodeStats is what Hierarchy.Nodes reports for each node
+type NodeStats struct {
+	Level    string
+	Path     string // keys from the root down joined with "/", "" for the root
+	Tokens   float64
+	Allowed  int
+	Rejected int
+	Borrowed int
+}
+
+// Hierarchy nests token buckets, e.g. each tenant up to 100 req/s with the whole
+// service at most 2000 req/s. A request is only allowed when every node from its
+// leaf up to the root allows it, and it's taken from all of them.
+type Hierarchy struct {
+	levels []Level
+	root   *node
+	// nodes in the tree, the root included
+	size      int
+	lastSweep time.Time
+	log       *log.Logger
+	mu        sync.Mutex
+}
+
+// NewHierarchy builds the tree, levels[0] is the root and has a single node,
+// every other level has one node per key under its parent
+func NewHierarchy(levels ...Level) (*Hierarchy, error) {
+	if len(levels) == 0 {
+		return nil, errors.New("at least one level is required")
+	}
+	names := make(map[string]bool, len(levels))
+	for i, l := range levels {
+		if err := l.validate(i == 0); err != nil {
+			return nil, fmt.Errorf("level %d %q: %w", i, l.Name, err)
+		}
+		if names[l.Name] {
+			return nil, fmt.Errorf("duplicate level %q", l.Name)
+		}
+		names[l.Name] = true
+	}
+	h := &Hierarchy{levels: append([]Level(nil), levels...), lastSweep: time.Now(), log: log.Default()}
+	h.root = h.newNode(0)
+	return h, nil
+}
+
+// quietLogger keeps the buckets of the tree from logging every rejection, the hierarchy logs its decisions itself
+var quietLogger = log.New(io.Discard, "", 0)
+
+func (h *Hierarchy) newNode(depth int) *node {
+	l := h.levels[depth]
+	// the level was validated, the buckets can't fail
+	n := &node{depth: depth, children: make(map[string]*node), lastUsed: time.Now()}
+	h.size++
+	n.bucket, _ = NewTokenBucket(l.Capacity, float64(l.Capacity), l.FillRate)
+	n.bucket.SetLogger(quietLogger)
+	if l.Ceil > 0 {
+		n.ceil, _ = NewTokenBucket(l.Capacity, float64(l.Capacity), l.Ceil)
+		n.ceil.SetLogger(quietLogger)
+	}
+	return n
+}
+
+func (h *Hierarchy) SetLogger(logger *log.Logger) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if logger != nil {
+		h.log = logger
+	}
+}
+
+// path returns the nodes from the root down to the leaf of keys, h.mu must be held.
+// keys has one key per level below the root, missing keys are the empty key.
+func (h *Hierarchy) path(keys []string) []*node {
+	now := time.Now()
+	if idle := h.idle(len(h.levels) - 1); now.Sub(h.lastSweep) >= idle {
+		h.sweep(h.root, now)
+		h.lastSweep = now
+	}
+
+	h.root.lastUsed = now
+	nodes := []*node{h.root}
+	for depth := 1; depth < len(h.levels); depth++ {
+		key := ""
+		if depth-1 < len(keys) {
+			key = keys[depth-1]
+		}
+		parent := nodes[depth-1]
+		child, ok := parent.children[key]
+		if !ok {
+			child = h.newNode(depth)
+			parent.children[key] = child
+		}
+		child.lastUsed = now
+		nodes = append(nodes, child)
+	}
+	return nodes
+}
+
+// idle is how long a node at depth and every node below it take to fill up from empty,
+// a subtree that saw no request for that long is as good as new. h.mu must be held.
+func (h *Hierarchy) idle(depth int) time.Duration {
+	var idle time.Duration
+	for _, l := range h.levels[depth:] {
+		idle = max(idle, durationOf(float64(l.Capacity)/l.FillRate))
+	}
+	return idle
+}
+
+// sweep drops the children of nd that went idle, h.mu must be held
+func (h *Hierarchy) sweep(nd *node, now time.Time) {
+	for key, child := range nd.children {
+		if now.Sub(child.lastUsed) >= h.idle(child.depth) {
+			delete(nd.children, key)
+			h.size -= h.count(child)
+			continue
+		}
+		h.sweep(child, now)
+	}
+}
+
+// count is the number of nodes from nd down, h.mu must be held
+func (h *Hierarchy) count(nd *node) int {
+	n := 1
+	for _, child := range nd.children {
+		n += h.count(child)
+	}
+	return n
+}
+
+// Len is the number of nodes in the tree, the root included
+func (h *Hierarchy) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.size
+}
+
+// plan decides for every node of path whether cost is taken from its own bucket or borrowed,
+// it doesn't change any bucket. h.mu must be held.
+func (h *Hierarchy) plan(path []*node, cost Cost) (borrow []bool, d HierarchyDecision) {
+	borrow = make([]bool, len(path))
+	for i, nd := range path {
+		wait := nd.bucket.TimeUntilAllowedCost(cost)
+		if wait == 0 {
+			continue
+		}
+		// over its own rate, the parent admits cost on its own level so its tokens are idle
+		if wait != InfDuration && nd.ceil != nil && nd.ceil.TimeUntilAllowedCost(cost) == 0 {
+			borrow[i] = true
+			continue
+		}
+		d.DeniedBy = append(d.DeniedBy, h.levels[i].Name)
+		d.RetryAfter = max(d.RetryAfter, wait)
+	}
+	return borrow, d
+}
+
+// Check asks every node from the root down to the leaf of keys and only takes n
+// from them when all of them allow it
+func (h *Hierarchy) Check(n int, keys ...string) HierarchyDecision {
+	return h.CheckCost(Cost(n), keys...)
+}
+
+// CheckCost is Check for fractional costs
+func (h *Hierarchy) CheckCost(cost Cost, keys ...string) HierarchyDecision {
+	if !(cost > 0) {
+		return HierarchyDecision{}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	path := h.path(keys)
+	borrow, d := h.plan(path, cost)
+	if len(d.DeniedBy) > 0 {
+		for i, nd := range path {
+			if slices.Contains(d.DeniedBy, h.levels[i].Name) {
+				nd.rejected++
+			}
+		}
+		h.log.Printf("Rejected: %g tokens for %s, denied by %s", cost, strings.Join(keys, "/"), strings.Join(d.DeniedBy, ", "))
+		return d
+	}
+
+	for i, nd := range path {
+		if borrow[i] {
+			nd.borrowed++
+			d.Borrowed = append(d.Borrowed, h.levels[i].Name)
+		} else {
+			nd.bucket.AllowCost(cost)
+		}
+		// the ceil counts everything the node lets through, borrowed or not
+		if nd.ceil != nil {
+			nd.ceil.AllowCost(cost)
+		}
+		nd.allowed++
+	}
+	d.Allowed = true
+	return d
+}
+
+func (h *Hierarchy) Allow(n int, keys ...string) bool {
+	return h.Check(n, keys...).Allowed
+}
+
+// Debit takes cost from every node on the way to keys after the fact, e.g. for the
+// bytes of a response that already went out. It never fails, see TokenBucket.Debit.
+func (h *Hierarchy) Debit(cost Cost, keys ...string) {
+	if !(cost > 0) {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, nd := range h.path(keys) {
+		nd.bucket.Debit(cost)
+		if nd.ceil != nil {
+			nd.ceil.Debit(cost)
+		}
+	}
+}
+
+// TimeUntilAllowed is how long until every node on the way to keys has room at its own rate
+func (h *Hierarchy) TimeUntilAllowed(n int, keys ...string) time.Duration {
+	return h.TimeUntilAllowedCost(Cost(n), keys...)
+}
+
+// TimeUntilAllowedCost is TimeUntilAllowed for fractional costs
+func (h *Hierarchy) TimeUntilAllowedCost(cost Cost, keys ...string) time.Duration {
+	if !(cost > 0) {
+		return 0
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, d := h.plan(h.path(keys), cost)
+	return d.RetryAfter
+}
+
+// ExceedsCapacity reports whether n is more than one of the levels can ever hold
+func (h *Hierarchy) ExceedsCapacity(n int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, l := range h.levels {
+		if n > l.Capacity {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateLevel changes the limits of every node of a level, non-positive values are left unchanged.
+// A positive ceil lets the level borrow from now on.
+func (h *Hierarchy) UpdateLevel(name string, newCapacity int, newFillRate, newCeil float64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	depth := -1
+	for i, l := range h.levels {
+		if l.Name == name {
+			depth = i
+		}
+	}
+	if depth < 0 {
+		return fmt.Errorf("unknown level %q", name)
+	}
+
+	l := h.levels[depth]
+	if newCapacity > 0 {
+		l.Capacity = newCapacity
+	}
+	if newFillRate > 0 {
+		l.FillRate = newFillRate
+	}
+	if newCeil > 0 {
+		l.Ceil = newCeil
+	}
+	if err := l.validate(depth == 0); err != nil {
+		return err
+	}
+	h.levels[depth] = l
+
+	h.walk(h.root, "", func(nd *node, _ string) {
+		if nd.depth != depth {
+			return
+		}
+		nd.bucket.Update(l.Capacity, l.FillRate)
+		switch {
+		case nd.ceil != nil:
+			nd.ceil.Update(l.Capacity, l.Ceil)
+		case l.Ceil > 0:
+			nd.ceil, _ = NewTokenBucket(l.Capacity, float64(l.Capacity), l.Ceil)
+			nd.ceil.SetLogger(quietLogger)
+		}
+	})
+	return nil
+}
+
+// walk calls fn for nd and every node below it, h.mu must be held
+func (h *Hierarchy) walk(nd *node, path string, fn func(*node, string)) {
+	fn(nd, path)
+	for key, child := range nd.children {
+		childPath := key
+		if path != "" {
+			childPath = path + "/" + key
+		}
+		h.walk(child, childPath, fn)
+	}
+}
+
+// Nodes returns the stats of every node sorted by path, the root first
+func (h *Hierarchy) Nodes() []NodeStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var stats []NodeStats
+	h.walk(h.root, "", func(nd *node, path string) {
+		stats = append(stats, NodeStats{
+			Level:    h.levels[nd.depth].Name,
+			Path:     path,
+			Tokens:   nd.bucket.AvailableTokens(),
+			Allowed:  nd.allowed,
+			Rejected: nd.rejected,
+			Borrowed: nd.borrowed,
+		})
+	})
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Path < stats[j].Path })
+	return stats
+}
@@ -0,0 +1,495 @@
+package tokenbucket
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Color is how a three color marker classifies a request
+type Color int
+
+const (
+	Green  Color = iota // within the committed rate
+	Yellow              // over the committed rate but within the excess burst or peak rate
+	Red                 // over every limit, should be dropped
+)
+
+func (c Color) String() string {
+	switch c {
+	case Green:
+		return "green"
+	case Yellow:
+		return "yellow"
+	case Red:
+		return "red"
+	}
+	return "unknown"
+}
+
+// colorCounts counts the marked requests per color
+type colorCounts [3]int
+
+// SingleRateMarker is the single rate three color marker (srTCM) of RFC 2697.
+// The committed bucket C fills at cir up to cbs, whatever doesn't fit spills into
+// the excess bucket E of size ebs. Requests C can pay for are green, requests only
+// E can pay for are yellow, the rest are red.
+type SingleRateMarker struct {
+	cir      float64
+	cbs      int
+	ebs      int
+	tc       float64
+	te       float64
+	lastTime time.Time
+	counts   colorCounts
+	log      *log.Logger
+	mu       sync.Mutex
+}
+
+// NewSingleRateMarker starts with both buckets full, ebs 0 never marks yellow
+func NewSingleRateMarker(cir float64, cbs, ebs int) (*SingleRateMarker, error) {
+	if cir <= 0 {
+		return nil, errors.New("cir must be positive")
+	}
+	if cbs <= 0 || ebs < 0 {
+		return nil, errors.New("cbs must be positive and ebs cant be negative")
+	}
+	return &SingleRateMarker{
+		cir:      cir,
+		cbs:      cbs,
+		ebs:      ebs,
+		tc:       float64(cbs),
+		te:       float64(ebs),
+		lastTime: time.Now(),
+		log:      log.Default(),
+	}, nil
+}
+
+func (m *SingleRateMarker) SetLogger(logger *log.Logger) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if logger != nil {
+		m.log = logger
+	}
+}
+
+// buckets returns C and E as they are now, the tokens that don't fit in C spill into E.
+// m.mu must be held.
+func (m *SingleRateMarker) buckets(now time.Time) (tc, te float64) {
+	tc = m.tc + now.Sub(m.lastTime).Seconds()*m.cir
+	te = m.te
+	if overflow := tc - float64(m.cbs); overflow > 0 {
+		tc = float64(m.cbs)
+		te = min(te+overflow, float64(m.ebs))
+	}
+	return tc, te
+}
+
+// refill adds the tokens since the last call, m.mu must be held
+func (m *SingleRateMarker) refill() {
+	now := time.Now()
+	m.tc, m.te = m.buckets(now)
+	m.lastTime = now
+}
+
+// Mark classifies n color blind, only the tokens count
+func (m *SingleRateMarker) Mark(n int) Color {
+	return m.MarkAware(n, Green)
+}
+
+// MarkCost classifies a request of a fractional cost color blind
+func (m *SingleRateMarker) MarkCost(cost Cost) Color {
+	return m.MarkAwareCost(cost, Green)
+}
+
+// MarkAware classifies n color aware, a request already marked by an earlier hop
+// never gets a better color than it came with
+func (m *SingleRateMarker) MarkAware(n int, color Color) Color {
+	if n <= 0 {
+		return Red
+	}
+	return m.MarkAwareCost(Cost(n), color)
+}
+
+// MarkAwareCost is MarkAware for a fractional cost, a cost that isn't positive is red
+func (m *SingleRateMarker) MarkAwareCost(cost Cost, color Color) Color {
+	if !(cost > 0) {
+		return Red
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.mark(cost, color)
+}
+
+// TryMarkCost is MarkCost that also says how long until the request wouldn't be red,
+// decided under one lock. The wait is InfDuration when cost is never anything but red.
+func (m *SingleRateMarker) TryMarkCost(cost Cost) (Color, time.Duration) {
+	if !(cost > 0) {
+		return Red, InfDuration
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	color := m.mark(cost, Green)
+	if color == Red {
+		return Red, m.timeUntilAllowed(cost)
+	}
+	return color, 0
+}
+
+// mark is MarkAwareCost, m.mu must be held
+func (m *SingleRateMarker) mark(cost Cost, color Color) Color {
+	m.refill()
+	tokens := cost
+	switch {
+	case color == Green && tokens <= m.tc:
+		m.tc -= tokens
+	case color != Red && tokens <= m.te:
+		m.te -= tokens
+		color = Yellow
+	default:
+		color = Red
+	}
+	m.counts[color]++
+	m.log.Printf("Marked %g tokens %s: committed %.2f, excess %.2f", cost, color, m.tc, m.te)
+	return color
+}
+
+// Debit takes cost after the fact from the committed bucket and the rest from the
+// excess bucket. It never fails, a big debit empties both instead of going below zero.
+func (m *SingleRateMarker) Debit(cost Cost) {
+	if !(cost > 0) {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.refill()
+	fromCommitted := min(cost, m.tc)
+	m.tc -= fromCommitted
+	m.te = max(m.te-(cost-fromCommitted), 0)
+}
+
+// Allow admits green and yellow requests
+func (m *SingleRateMarker) Allow(n int) bool {
+	return m.Mark(n) != Red
+}
+
+func (m *SingleRateMarker) AllowCost(cost Cost) bool {
+	return m.MarkCost(cost) != Red
+}
+
+// TryCost is AllowCost that also says how long until the request wouldn't be red
+func (m *SingleRateMarker) TryCost(cost Cost) (bool, time.Duration) {
+	color, wait := m.TryMarkCost(cost)
+	return color != Red, wait
+}
+
+// TimeUntilAllowed is how long until n is no longer red
+func (m *SingleRateMarker) TimeUntilAllowed(n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	return m.TimeUntilAllowedCost(Cost(n))
+}
+
+// TimeUntilAllowedCost is how long until a request of cost is no longer red
+func (m *SingleRateMarker) TimeUntilAllowedCost(cost Cost) time.Duration {
+	if !(cost > 0) {
+		return 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.timeUntilAllowed(cost)
+}
+
+// timeUntilAllowed is TimeUntilAllowedCost, m.mu must be held
+func (m *SingleRateMarker) timeUntilAllowed(cost Cost) time.Duration {
+	tokens := cost
+	if tokens > float64(max(m.cbs, m.ebs)) {
+		return InfDuration
+	}
+	tc, te := m.buckets(time.Now())
+	if tokens <= tc || tokens <= te {
+		return 0
+	}
+	if tokens <= float64(m.cbs) {
+		return time.Duration((tokens - tc) / m.cir * float64(time.Second))
+	}
+	// only E can ever hold the cost, and it only fills once C is full
+	missing := float64(m.cbs) - tc + tokens - te
+	return time.Duration(missing / m.cir * float64(time.Second))
+}
+
+// ExceedsCapacity reports whether n can never be allowed, no matter how long the caller waits
+func (m *SingleRateMarker) ExceedsCapacity(n int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return n > max(m.cbs, m.ebs)
+}
+
+// Update changes the rate and bucket sizes at runtime, non-positive values are left unchanged
+func (m *SingleRateMarker) Update(newCIR float64, newCBS, newEBS int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.refill()
+	if newCIR > 0 {
+		m.cir = newCIR
+	}
+	if newCBS > 0 {
+		m.cbs = newCBS
+		m.tc = min(m.tc, float64(newCBS))
+	}
+	if newEBS > 0 {
+		m.ebs = newEBS
+		m.te = min(m.te, float64(newEBS))
+	}
+}
+
+// Stats returns how many requests got each color
+func (m *SingleRateMarker) Stats() (green, yellow, red int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counts[Green], m.counts[Yellow], m.counts[Red]
+}
+
+func (m *SingleRateMarker) ResetStats() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts = colorCounts{}
+}
+
+// TwoRateMarker is the two rate three color marker (trTCM) of RFC 2698. The peak
+// bucket P fills at pir up to pbs and the committed bucket C at cir up to cbs.
+// Requests over the peak rate are red, over the committed rate yellow, the rest green.
+type TwoRateMarker struct {
+	cir      float64
+	cbs      int
+	pir      float64
+	pbs      int
+	tc       float64
+	tp       float64
+	lastTime time.Time
+	counts   colorCounts
+	log      *log.Logger
+	mu       sync.Mutex
+}
+
+// NewTwoRateMarker starts with both buckets full, pir can't be below cir
+func NewTwoRateMarker(cir float64, cbs int, pir float64, pbs int) (*TwoRateMarker, error) {
+	if cir <= 0 || pir < cir {
+		return nil, errors.New("rates must satisfy 0 < cir <= pir")
+	}
+	if cbs <= 0 || pbs <= 0 {
+		return nil, errors.New("cbs and pbs must be positive")
+	}
+	return &TwoRateMarker{
+		cir:      cir,
+		cbs:      cbs,
+		pir:      pir,
+		pbs:      pbs,
+		tc:       float64(cbs),
+		tp:       float64(pbs),
+		lastTime: time.Now(),
+		log:      log.Default(),
+	}, nil
+}
+
+func (m *TwoRateMarker) SetLogger(logger *log.Logger) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if logger != nil {
+		m.log = logger
+	}
+}
+
+// refill adds the tokens since the last call to both buckets, m.mu must be held
+func (m *TwoRateMarker) refill() {
+	now := time.Now()
+	elapsed := now.Sub(m.lastTime).Seconds()
+	m.tc = min(m.tc+elapsed*m.cir, float64(m.cbs))
+	m.tp = min(m.tp+elapsed*m.pir, float64(m.pbs))
+	m.lastTime = now
+}
+
+// Mark classifies n color blind, only the tokens count
+func (m *TwoRateMarker) Mark(n int) Color {
+	return m.MarkAware(n, Green)
+}
+
+// MarkCost classifies a request of a fractional cost color blind
+func (m *TwoRateMarker) MarkCost(cost Cost) Color {
+	return m.MarkAwareCost(cost, Green)
+}
+
+// MarkAware classifies n color aware, a request already marked by an earlier hop
+// never gets a better color than it came with
+func (m *TwoRateMarker) MarkAware(n int, color Color) Color {
+	if n <= 0 {
+		return Red
+	}
+	return m.MarkAwareCost(Cost(n), color)
+}
+
+// MarkAwareCost is MarkAware for a fractional cost, a cost that isn't positive is red
+func (m *TwoRateMarker) MarkAwareCost(cost Cost, color Color) Color {
+	if !(cost > 0) {
+		return Red
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.mark(cost, color)
+}
+
+// TryMarkCost is MarkCost that also says how long until the request wouldn't be red,
+// decided under one lock. The wait is InfDuration when cost is never anything but red.
+func (m *TwoRateMarker) TryMarkCost(cost Cost) (Color, time.Duration) {
+	if !(cost > 0) {
+		return Red, InfDuration
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	color := m.mark(cost, Green)
+	if color == Red {
+		return Red, m.timeUntilAllowed(cost)
+	}
+	return color, 0
+}
+
+// mark is MarkAwareCost, m.mu must be held
+func (m *TwoRateMarker) mark(cost Cost, color Color) Color {
+	m.refill()
+	tokens := cost
+	switch {
+	case color == Red || tokens > m.tp:
+		color = Red
+	case color == Yellow || tokens > m.tc:
+		m.tp -= tokens
+		color = Yellow
+	default:
+		m.tp -= tokens
+		m.tc -= tokens
+	}
+	m.counts[color]++
+	m.log.Printf("Marked %g tokens %s: committed %.2f, peak %.2f", cost, color, m.tc, m.tp)
+	return color
+}
+
+// Debit takes cost after the fact from both buckets, like a green request. It never
+// fails, a big debit empties them instead of going below zero.
+func (m *TwoRateMarker) Debit(cost Cost) {
+	if !(cost > 0) {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.refill()
+	m.tc = max(m.tc-cost, 0)
+	m.tp = max(m.tp-cost, 0)
+}
+
+// Allow admits green and yellow requests
+func (m *TwoRateMarker) Allow(n int) bool {
+	return m.Mark(n) != Red
+}
+
+func (m *TwoRateMarker) AllowCost(cost Cost) bool {
+	return m.MarkCost(cost) != Red
+}
+
+// TryCost is AllowCost that also says how long until the request wouldn't be red
+func (m *TwoRateMarker) TryCost(cost Cost) (bool, time.Duration) {
+	color, wait := m.TryMarkCost(cost)
+	return color != Red, wait
+}
+
+// TimeUntilAllowed is how long until n is no longer red
+func (m *TwoRateMarker) TimeUntilAllowed(n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	return m.TimeUntilAllowedCost(Cost(n))
+}
+
+// TimeUntilAllowedCost is how long until a request of cost is no longer red
+func (m *TwoRateMarker) TimeUntilAllowedCost(cost Cost) time.Duration {
+	if !(cost > 0) {
+		return 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.timeUntilAllowed(cost)
+}
+
+// timeUntilAllowed is TimeUntilAllowedCost, m.mu must be held
+func (m *TwoRateMarker) timeUntilAllowed(cost Cost) time.Duration {
+	if cost > float64(m.pbs) {
+		return InfDuration
+	}
+	tp := min(m.tp+time.Since(m.lastTime).Seconds()*m.pir, float64(m.pbs))
+	missing := cost - tp
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / m.pir * float64(time.Second))
+}
+
+// ExceedsCapacity reports whether n can never be allowed, no matter how long the caller waits
+func (m *TwoRateMarker) ExceedsCapacity(n int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return n > m.pbs
+}
+
+// Update changes the rates and bucket sizes at runtime, non-positive values are left unchanged.
+// A pir below the cir is raised to it.
+func (m *TwoRateMarker) Update(newCIR float64, newCBS int, newPIR float64, newPBS int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.refill()
+	if newCIR > 0 {
+		m.cir = newCIR
+	}
+	if newPIR > 0 {
+		m.pir = newPIR
+	}
+	m.pir = max(m.pir, m.cir)
+	if newCBS > 0 {
+		m.cbs = newCBS
+		m.tc = min(m.tc, float64(newCBS))
+	}
+	if newPBS > 0 {
+		m.pbs = newPBS
+		m.tp = min(m.tp, float64(newPBS))
+	}
+}
+
+// Stats returns how many requests got each color
+func (m *TwoRateMarker) Stats() (green, yellow, red int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counts[Green], m.counts[Yellow], m.counts[Red]
+}
+
+func (m *TwoRateMarker) ResetStats() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts = colorCounts{}
+}
@@ -0,0 +1,330 @@
+package tokenbucket
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dimension is one resource of a MultiBucket, e.g. requests or bytes
+type Dimension struct {
+	Name     string
+	Capacity int
+	FillRate float64
+}
+
+func (d Dimension) validate() error {
+	var errs []error
+	if d.Name == "" {
+		errs = append(errs, errors.New("name is required"))
+	}
+	if d.Capacity <= 0 || d.FillRate <= 0 {
+		errs = append(errs, errors.New("capacity and fillRate must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// MultiDecision is the outcome of MultiBucket.Check
+type MultiDecision struct {
+	Allowed bool
+	// dimensions that didn't have enough tokens, in the order they were added
+	DeniedBy []string
+	// longest wait of the dimensions in DeniedBy, InfDuration if one of the costs never fits
+	RetryAfter time.Duration
+}
+
+// DimensionStats is what MultiBucket.Stats reports for each dimension
+type DimensionStats struct {
+	Name      string
+	Capacity  int
+	FillRate  float64
+	Available float64
+	// requests this dimension turned away, a request short in two dimensions counts for both
+	Rejected int
+}
+
+// MultiBucket caps several resources at once, e.g. 10 requests/s and 1 MiB/s per client.
+// Every call takes a vector of costs, one per dimension, and is only allowed when every
+// dimension has enough tokens. A denial takes nothing from any of them.
+type MultiBucket struct {
+	dims       []Dimension
+	buckets    []*TokenBucket
+	allowed    int
+	rejected   int
+	rejectedBy []int
+	log        *log.Logger
+	mu         sync.Mutex
+}
+
+// NewMultiBucket builds one full bucket per dimension, the order of dims is the order of the costs
+func NewMultiBucket(dims ...Dimension) (*MultiBucket, error) {
+	if len(dims) == 0 {
+		return nil, errors.New("at least one dimension is required")
+	}
+	names := make(map[string]bool, len(dims))
+	for i, d := range dims {
+		if err := d.validate(); err != nil {
+			return nil, fmt.Errorf("dimension %d %q: %w", i, d.Name, err)
+		}
+		if names[d.Name] {
+			return nil, fmt.Errorf("duplicate dimension %q", d.Name)
+		}
+		names[d.Name] = true
+	}
+
+	m := &MultiBucket{
+		dims:       append([]Dimension(nil), dims...),
+		buckets:    make([]*TokenBucket, len(dims)),
+		rejectedBy: make([]int, len(dims)),
+		log:        log.Default(),
+	}
+	for i, d := range dims {
+		// the dimension was validated, the bucket can't fail
+		m.buckets[i], _ = NewTokenBucket(d.Capacity, float64(d.Capacity), d.FillRate)
+		m.buckets[i].SetLogger(quietLogger)
+	}
+	return m, nil
+}
+
+func (m *MultiBucket) SetLogger(logger *log.Logger) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if logger != nil {
+		m.log = logger
+	}
+}
+
+// CostVector orders costs by name the way Check takes them, dimensions left out cost 0
+func (m *MultiBucket) CostVector(costs map[string]Cost) ([]Cost, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	vector := make([]Cost, len(m.dims))
+	for name, cost := range costs {
+		i := m.index(name)
+		if i < 0 {
+			return nil, fmt.Errorf("unknown dimension %q", name)
+		}
+		vector[i] = cost
+	}
+	return vector, nil
+}
+
+// index returns the position of the dimension called name, -1 if there is none. m.mu must be held.
+func (m *MultiBucket) index(name string) int {
+	for i, d := range m.dims {
+		if d.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// valid reports whether costs can be checked at all: at most one per dimension, none
+// negative and at least one positive. m.mu must be held.
+func (m *MultiBucket) valid(costs []Cost) bool {
+	if len(costs) > len(m.dims) {
+		return false
+	}
+	positive := false
+	for _, cost := range costs {
+		// NaN isn't >= 0 either
+		if !(cost >= 0) {
+			return false
+		}
+		positive = positive || cost > 0
+	}
+	return positive
+}
+
+// plan asks every dimension about its cost without taking anything, m.mu must be held
+func (m *MultiBucket) plan(costs []Cost) MultiDecision {
+	var d MultiDecision
+	for i, cost := range costs {
+		// a dimension the request doesn't use always has room
+		if cost == 0 {
+			continue
+		}
+		if wait := m.buckets[i].TimeUntilAllowedCost(cost); wait > 0 {
+			d.DeniedBy = append(d.DeniedBy, m.dims[i].Name)
+			d.RetryAfter = max(d.RetryAfter, wait)
+		}
+	}
+	return d
+}
+
+// Check takes costs[i] from dimension i when every dimension has enough, costs
+// missing at the end are 0. Costs that are negative, all 0 or more than there
+// are dimensions are never allowed.
+func (m *MultiBucket) Check(costs ...Cost) MultiDecision {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.valid(costs) {
+		return MultiDecision{}
+	}
+
+	d := m.plan(costs)
+	if len(d.DeniedBy) > 0 {
+		m.rejected++
+		for i := range costs {
+			if slices.Contains(d.DeniedBy, m.dims[i].Name) {
+				m.rejectedBy[i]++
+			}
+		}
+		m.log.Printf("Rejected: costs %v, short in %s, retry after %v", costs, strings.Join(d.DeniedBy, ", "), d.RetryAfter)
+		return d
+	}
+
+	for i, cost := range costs {
+		if cost > 0 {
+			m.buckets[i].AllowCost(cost)
+		}
+	}
+	m.allowed++
+	d.Allowed = true
+	return d
+}
+
+// Allow takes n tokens from every dimension
+func (m *MultiBucket) Allow(n int) bool {
+	if n <= 0 {
+		return false
+	}
+	return m.AllowCost(Cost(n))
+}
+
+// AllowCost takes cost tokens from every dimension
+func (m *MultiBucket) AllowCost(cost Cost) bool {
+	return m.Check(m.uniform(cost)...).Allowed
+}
+
+// TryCost is AllowCost that also says how long to wait when it rejects, InfDuration
+// when cost never fits one of the dimensions
+func (m *MultiBucket) TryCost(cost Cost) (bool, time.Duration) {
+	d := m.Check(m.uniform(cost)...)
+	return d.Allowed, d.RetryAfter
+}
+
+// uniform is a vector with cost for every dimension
+func (m *MultiBucket) uniform(cost Cost) []Cost {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	costs := make([]Cost, len(m.dims))
+	for i := range costs {
+		costs[i] = cost
+	}
+	return costs
+}
+
+// DebitCosts takes costs[i] from dimension i after the fact, e.g. for the bytes of a
+// response that already went out. It never fails, see TokenBucket.Debit.
+func (m *MultiBucket) DebitCosts(costs ...Cost) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, cost := range costs {
+		if i < len(m.buckets) {
+			m.buckets[i].Debit(cost)
+		}
+	}
+}
+
+// Debit takes cost from every dimension after the fact
+func (m *MultiBucket) Debit(cost Cost) {
+	m.DebitCosts(m.uniform(cost)...)
+}
+
+// TimeUntilAllowedCosts is the longest wait of the dimensions, InfDuration if one of the costs never fits
+func (m *MultiBucket) TimeUntilAllowedCosts(costs ...Cost) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.valid(costs) {
+		return 0
+	}
+	return m.plan(costs).RetryAfter
+}
+
+func (m *MultiBucket) TimeUntilAllowed(n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	return m.TimeUntilAllowedCost(Cost(n))
+}
+
+// TimeUntilAllowedCost is how long until every dimension has cost tokens
+func (m *MultiBucket) TimeUntilAllowedCost(cost Cost) time.Duration {
+	return m.TimeUntilAllowedCosts(m.uniform(cost)...)
+}
+
+// ExceedsCapacityCosts reports whether one of the costs is more than its dimension can ever hold
+func (m *MultiBucket) ExceedsCapacityCosts(costs ...Cost) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, cost := range costs {
+		if i < len(m.dims) && cost > float64(m.dims[i].Capacity) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExceedsCapacity reports whether n is more than one of the dimensions can ever hold
+func (m *MultiBucket) ExceedsCapacity(n int) bool {
+	return m.ExceedsCapacityCosts(m.uniform(Cost(n))...)
+}
+
+// UpdateDimension changes the limits of one dimension, non-positive values are left unchanged
+func (m *MultiBucket) UpdateDimension(name string, newCapacity int, newFillRate float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.index(name)
+	if i < 0 {
+		return fmt.Errorf("unknown dimension %q", name)
+	}
+	if newCapacity > 0 {
+		m.dims[i].Capacity = newCapacity
+	}
+	if newFillRate > 0 {
+		m.dims[i].FillRate = newFillRate
+	}
+	m.buckets[i].Update(newCapacity, newFillRate)
+	return nil
+}
+
+// Dimensions returns the dimensions in the order Check takes their costs
+func (m *MultiBucket) Dimensions() []Dimension {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Dimension(nil), m.dims...)
+}
+
+// Stats returns the allowed and rejected requests and the tokens left in every dimension
+func (m *MultiBucket) Stats() (allowed, rejected int, dims []DimensionStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dims = make([]DimensionStats, len(m.dims))
+	for i, d := range m.dims {
+		dims[i] = DimensionStats{
+			Name:      d.Name,
+			Capacity:  d.Capacity,
+			FillRate:  d.FillRate,
+			Available: m.buckets[i].tokensNow(),
+			Rejected:  m.rejectedBy[i],
+		}
+	}
+	return m.allowed, m.rejected, dims
+}
+
+func (m *MultiBucket) ResetStats() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.allowed = 0
+	m.rejected = 0
+	m.rejectedBy = make([]int, len(m.dims))
+}
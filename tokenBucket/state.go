@@ -0,0 +1,483 @@
+package tokenbucket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// stateVersion is bumped whenever the layout of bucketState changes,
+// JSON of version 1 is still read since it only lacks fields
+const stateVersion = 2
+
+// supportedVersion reports whether a state of version v can be restored
+func supportedVersion(v uint8) bool {
+	return v == 1 || v == stateVersion
+}
+
+// bucketState is everything a TokenBucket needs to pick up where it left off,
+// the same struct is used for the JSON and the binary encoding
+type bucketState struct {
+	Version   uint8   `json:"version"`
+	Capacity  int64   `json:"capacity"`
+	FillRate  float64 `json:"fill_rate"`
+	Tokens    float64 `json:"tokens"`
+	LastTime  int64   `json:"last_time"` // unix nanoseconds
+	Processed int64   `json:"tokens_processed"`
+	Rejected  int64   `json:"tokens_rejected"`
+	// since version 2
+	MaxDebt         float64 `json:"max_debt,omitzero"`
+	UnitsGranted    int64   `json:"units_granted,omitzero"`
+	UnitsDenied     int64   `json:"units_denied,omitzero"`
+	WarmupPeriod    int64   `json:"warmup_period,omitzero"` // nanoseconds
+	WarmupFraction  float64 `json:"warmup_fraction,omitzero"`
+	WarmupIdleReset int64   `json:"warmup_idle_reset,omitzero"` // nanoseconds
+	WarmStart       int64   `json:"warm_start,omitzero"`        // unix nanoseconds
+	LastRequest     int64   `json:"last_request,omitzero"`      // unix nanoseconds
+}
+
+func (tb *TokenBucket) state() bucketState {
+	tb.mu.RLock()
+	defer tb.mu.RUnlock()
+	s := bucketState{
+		Version:      stateVersion,
+		Capacity:     int64(tb.capacity),
+		FillRate:     tb.fillRate,
+		Tokens:       tb.tokens,
+		LastTime:     tb.lastTime.UnixNano(),
+		Processed:    int64(tb.tokensProcessed),
+		Rejected:     int64(tb.tokensRejected),
+		MaxDebt:      tb.maxDebt,
+		UnitsGranted: int64(tb.unitsGranted),
+		UnitsDenied:  int64(tb.unitsDenied),
+	}
+	if tb.warmup.Period > 0 {
+		s.WarmupPeriod = int64(tb.warmup.Period)
+		s.WarmupFraction = tb.warmup.Fraction
+		s.WarmupIdleReset = int64(tb.warmup.IdleReset)
+		s.WarmStart = tb.warmStart.UnixNano()
+		s.LastRequest = tb.lastRequest.UnixNano()
+	}
+	return s
+}
+
+// restore replaces the bucket with s and refills it for the time that passed since s was taken.
+// A state of version 1 has no debt and warm-up in it, the bucket keeps its own.
+func (tb *TokenBucket) restore(s bucketState) error {
+	if !supportedVersion(s.Version) {
+		return fmt.Errorf("unsupported state version %d", s.Version)
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	maxDebt, warmup := tb.maxDebt, tb.warmup
+	warmStart, lastRequest := tb.warmStart, tb.lastRequest
+	if s.Version >= 2 {
+		maxDebt = s.MaxDebt
+		warmup = WarmupConfig{
+			Period:    time.Duration(s.WarmupPeriod),
+			Fraction:  s.WarmupFraction,
+			IdleReset: time.Duration(s.WarmupIdleReset),
+		}
+		warmStart, lastRequest = time.Unix(0, s.WarmStart), time.Unix(0, s.LastRequest)
+	}
+	// a bucket only holds debt when it may go into debt itself
+	if s.Capacity <= 0 || s.FillRate <= 0 || maxDebt < 0 || s.Tokens < -maxDebt ||
+		s.UnitsGranted < 0 || s.UnitsDenied < 0 {
+		return errors.New("invalid token bucket state")
+	}
+	if warmup != (WarmupConfig{}) {
+		if err := warmup.validate(); err != nil {
+			return fmt.Errorf("invalid token bucket state: %w", err)
+		}
+	}
+
+	now := time.Now()
+	tb.capacity = int(s.Capacity)
+	tb.fillRate = s.FillRate
+	tb.tokens = min(s.Tokens, float64(s.Capacity))
+	tb.tokensProcessed = int(s.Processed)
+	tb.tokensRejected = int(s.Rejected)
+	tb.maxDebt = maxDebt
+	if s.Version >= 2 {
+		tb.unitsGranted = int(s.UnitsGranted)
+		tb.unitsDenied = int(s.UnitsDenied)
+	}
+	tb.lastTime = notAfter(time.Unix(0, s.LastTime), now)
+	tb.warmup = warmup
+	tb.warmStart = notAfter(warmStart, now)
+	tb.lastRequest = notAfter(lastRequest, now)
+	if tb.log == nil {
+		tb.log = log.Default()
+	}
+
+	tb.refill()
+	return nil
+}
+
+// notAfter caps t at now, a clock that went backwards would drain tokens instead of adding them
+func notAfter(t, now time.Time) time.Time {
+	if t.After(now) {
+		return now
+	}
+	return t
+}
+
+func (tb *TokenBucket) MarshalJSON() ([]byte, error) {
+	return json.Marshal(tb.state())
+}
+
+func (tb *TokenBucket) UnmarshalJSON(data []byte) error {
+	var s bucketState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return tb.restore(s)
+}
+
+func (tb *TokenBucket) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, tb.state()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (tb *TokenBucket) UnmarshalBinary(data []byte) error {
+	var s bucketState
+	if len(data) != binary.Size(s) {
+		return fmt.Errorf("invalid token bucket state: %d bytes", len(data))
+	}
+	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &s); err != nil {
+		return err
+	}
+	return tb.restore(s)
+}
+
+// singleRateState is the JSON state of a SingleRateMarker
+type singleRateState struct {
+	Version  uint8   `json:"version"`
+	CIR      float64 `json:"cir"`
+	CBS      int64   `json:"cbs"`
+	EBS      int64   `json:"ebs"`
+	TC       float64 `json:"tc"`
+	TE       float64 `json:"te"`
+	LastTime int64   `json:"last_time"` // unix nanoseconds
+	Green    int64   `json:"green"`
+	Yellow   int64   `json:"yellow"`
+	Red      int64   `json:"red"`
+}
+
+func (m *SingleRateMarker) MarshalJSON() ([]byte, error) {
+	m.mu.Lock()
+	s := singleRateState{
+		Version:  stateVersion,
+		CIR:      m.cir,
+		CBS:      int64(m.cbs),
+		EBS:      int64(m.ebs),
+		TC:       m.tc,
+		TE:       m.te,
+		LastTime: m.lastTime.UnixNano(),
+		Green:    int64(m.counts[Green]),
+		Yellow:   int64(m.counts[Yellow]),
+		Red:      int64(m.counts[Red]),
+	}
+	m.mu.Unlock()
+	return json.Marshal(s)
+}
+
+// UnmarshalJSON restores the marker and refills it for the time that passed since the state was taken
+func (m *SingleRateMarker) UnmarshalJSON(data []byte) error {
+	var s singleRateState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if !supportedVersion(s.Version) {
+		return fmt.Errorf("unsupported state version %d", s.Version)
+	}
+	if s.CIR <= 0 || s.CBS <= 0 || s.EBS < 0 || s.TC < 0 || s.TE < 0 {
+		return errors.New("invalid single rate marker state")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cir = s.CIR
+	m.cbs = int(s.CBS)
+	m.ebs = int(s.EBS)
+	m.tc = min(s.TC, float64(s.CBS))
+	m.te = min(s.TE, float64(s.EBS))
+	m.counts = colorCounts{int(s.Green), int(s.Yellow), int(s.Red)}
+	m.lastTime = time.Unix(0, s.LastTime)
+	// a clock that went backwards would drain tokens instead of adding them
+	if now := time.Now(); m.lastTime.After(now) {
+		m.lastTime = now
+	}
+	if m.log == nil {
+		m.log = log.Default()
+	}
+	m.refill()
+	return nil
+}
+
+// twoRateState is the JSON state of a TwoRateMarker
+type twoRateState struct {
+	Version  uint8   `json:"version"`
+	CIR      float64 `json:"cir"`
+	CBS      int64   `json:"cbs"`
+	PIR      float64 `json:"pir"`
+	PBS      int64   `json:"pbs"`
+	TC       float64 `json:"tc"`
+	TP       float64 `json:"tp"`
+	LastTime int64   `json:"last_time"` // unix nanoseconds
+	Green    int64   `json:"green"`
+	Yellow   int64   `json:"yellow"`
+	Red      int64   `json:"red"`
+}
+
+func (m *TwoRateMarker) MarshalJSON() ([]byte, error) {
+	m.mu.Lock()
+	s := twoRateState{
+		Version:  stateVersion,
+		CIR:      m.cir,
+		CBS:      int64(m.cbs),
+		PIR:      m.pir,
+		PBS:      int64(m.pbs),
+		TC:       m.tc,
+		TP:       m.tp,
+		LastTime: m.lastTime.UnixNano(),
+		Green:    int64(m.counts[Green]),
+		Yellow:   int64(m.counts[Yellow]),
+		Red:      int64(m.counts[Red]),
+	}
+	m.mu.Unlock()
+	return json.Marshal(s)
+}
+
+// UnmarshalJSON restores the marker and refills it for the time that passed since the state was taken
+func (m *TwoRateMarker) UnmarshalJSON(data []byte) error {
+	var s twoRateState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if !supportedVersion(s.Version) {
+		return fmt.Errorf("unsupported state version %d", s.Version)
+	}
+	if s.CIR <= 0 || s.PIR < s.CIR || s.CBS <= 0 || s.PBS <= 0 || s.TC < 0 || s.TP < 0 {
+		return errors.New("invalid two rate marker state")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cir = s.CIR
+	m.cbs = int(s.CBS)
+	m.pir = s.PIR
+	m.pbs = int(s.PBS)
+	m.tc = min(s.TC, float64(s.CBS))
+	m.tp = min(s.TP, float64(s.PBS))
+	m.counts = colorCounts{int(s.Green), int(s.Yellow), int(s.Red)}
+	m.lastTime = time.Unix(0, s.LastTime)
+	// a clock that went backwards would drain tokens instead of adding them
+	if now := time.Now(); m.lastTime.After(now) {
+		m.lastTime = now
+	}
+	if m.log == nil {
+		m.log = log.Default()
+	}
+	m.refill()
+	return nil
+}
+
+// multiState is the JSON state of a MultiBucket, every dimension in the format of a TokenBucket
+type multiState struct {
+	Version    uint8                     `json:"version"`
+	Allowed    int64                     `json:"allowed"`
+	Rejected   int64                     `json:"rejected"`
+	Dimensions map[string]dimensionState `json:"dimensions"`
+}
+
+type dimensionState struct {
+	Bucket   json.RawMessage `json:"bucket"`
+	Rejected int64           `json:"rejected"`
+}
+
+func (m *MultiBucket) MarshalJSON() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := multiState{
+		Version:    stateVersion,
+		Allowed:    int64(m.allowed),
+		Rejected:   int64(m.rejected),
+		Dimensions: make(map[string]dimensionState, len(m.dims)),
+	}
+	for i, d := range m.dims {
+		bucket, err := m.buckets[i].MarshalJSON()
+		if err != nil {
+			return nil, fmt.Errorf("dimension %q: %w", d.Name, err)
+		}
+		s.Dimensions[d.Name] = dimensionState{Bucket: bucket, Rejected: int64(m.rejectedBy[i])}
+	}
+	return json.Marshal(s)
+}
+
+// UnmarshalJSON restores the dimensions saved by MarshalJSON. Saved dimensions that no
+// longer exist are skipped and new dimensions keep their current state.
+func (m *MultiBucket) UnmarshalJSON(data []byte) error {
+	var s multiState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if !supportedVersion(s.Version) {
+		return fmt.Errorf("unsupported state version %d", s.Version)
+	}
+	if s.Allowed < 0 || s.Rejected < 0 {
+		return errors.New("invalid multi bucket state")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, d := range m.dims {
+		ds, ok := s.Dimensions[d.Name]
+		if !ok {
+			continue
+		}
+		if err := m.buckets[i].UnmarshalJSON(ds.Bucket); err != nil {
+			return fmt.Errorf("dimension %q: %w", d.Name, err)
+		}
+		m.dims[i].Capacity = m.buckets[i].Capacity()
+		m.dims[i].FillRate = m.buckets[i].FillRate()
+		m.rejectedBy[i] = int(ds.Rejected)
+	}
+	m.allowed = int(s.Allowed)
+	m.rejected = int(s.Rejected)
+	if m.log == nil {
+		m.log = log.Default()
+	}
+	return nil
+}
+
+// hierarchyState is the JSON state of a Hierarchy, every node in the format of a TokenBucket
+type hierarchyState struct {
+	Version uint8       `json:"version"`
+	Nodes   []nodeState `json:"nodes"`
+}
+
+type nodeState struct {
+	// keys from the root down, empty for the root
+	Keys     []string        `json:"keys"`
+	Bucket   json.RawMessage `json:"bucket"`
+	Ceil     json.RawMessage `json:"ceil,omitempty"`
+	Allowed  int64           `json:"allowed"`
+	Rejected int64           `json:"rejected"`
+	Borrowed int64           `json:"borrowed"`
+}
+
+func (h *Hierarchy) MarshalJSON() ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := hierarchyState{Version: stateVersion}
+	var err error
+	var visit func(nd *node, keys []string)
+	visit = func(nd *node, keys []string) {
+		ns := nodeState{
+			Keys:     keys,
+			Allowed:  int64(nd.allowed),
+			Rejected: int64(nd.rejected),
+			Borrowed: int64(nd.borrowed),
+		}
+		ns.Bucket, err = nd.bucket.MarshalJSON()
+		if err == nil && nd.ceil != nil {
+			ns.Ceil, err = nd.ceil.MarshalJSON()
+		}
+		if err != nil {
+			return
+		}
+		s.Nodes = append(s.Nodes, ns)
+		for key, child := range nd.children {
+			visit(child, append(slices.Clip(keys), key))
+		}
+	}
+	visit(h.root, []string{})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(s)
+}
+
+// UnmarshalJSON restores the nodes saved by MarshalJSON with the limits of their level.
+// Saved nodes deeper than the tree are skipped, a saved ceil is skipped when its level
+// no longer borrows. Every node is decoded before the tree changes, a bad one changes nothing.
+func (h *Hierarchy) UnmarshalJSON(data []byte) error {
+	var s hierarchyState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if !supportedVersion(s.Version) {
+		return fmt.Errorf("unsupported state version %d", s.Version)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	type decoded struct {
+		nodeState
+		bucket, ceil *TokenBucket
+	}
+	var nodes []decoded
+	for _, ns := range s.Nodes {
+		if len(ns.Keys) >= len(h.levels) {
+			continue
+		}
+		if ns.Allowed < 0 || ns.Rejected < 0 || ns.Borrowed < 0 {
+			return errors.New("invalid hierarchy state")
+		}
+		l := h.levels[len(ns.Keys)]
+		d := decoded{nodeState: ns, bucket: &TokenBucket{}}
+		if err := d.bucket.UnmarshalJSON(ns.Bucket); err != nil {
+			return fmt.Errorf("node %q: %w", strings.Join(ns.Keys, "/"), err)
+		}
+		if l.Ceil > 0 && ns.Ceil != nil {
+			d.ceil = &TokenBucket{}
+			if err := d.ceil.UnmarshalJSON(ns.Ceil); err != nil {
+				return fmt.Errorf("node %q: %w", strings.Join(ns.Keys, "/"), err)
+			}
+		}
+		nodes = append(nodes, d)
+	}
+
+	for _, d := range nodes {
+		nd := h.root
+		for _, key := range d.Keys {
+			child, ok := nd.children[key]
+			if !ok {
+				child = h.newNode(nd.depth + 1)
+				nd.children[key] = child
+			}
+			nd = child
+		}
+		l := h.levels[nd.depth]
+		nd.bucket = d.bucket
+		nd.bucket.SetLogger(quietLogger)
+		nd.bucket.Update(l.Capacity, l.FillRate)
+		if d.ceil != nil {
+			nd.ceil = d.ceil
+			nd.ceil.SetLogger(quietLogger)
+			nd.ceil.Update(l.Capacity, l.Ceil)
+		}
+		nd.allowed, nd.rejected, nd.borrowed = int(d.Allowed), int(d.Rejected), int(d.Borrowed)
+	}
+	if h.log == nil {
+		h.log = log.Default()
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package tokenbucket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// chunk is how many of n bytes to take from the buckets at once, no more than the
+// smallest of them can hold. At least 1, so a bucket of capacity 0 fails in Wait.
+func chunk(n int, buckets []*TokenBucket) int {
+	for _, tb := range buckets {
+		n = min(n, tb.Capacity())
+	}
+	return max(n, 1)
+}
+
+// waitAll takes n tokens from every bucket, one after the other
+func waitAll(ctx context.Context, n int, buckets []*TokenBucket) error {
+	for _, tb := range buckets {
+		if err := tb.Wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// throttledRead reads at most a chunk into p and then waits until the buckets paid for
+// the bytes it got, so a short read only costs what it read
+func throttledRead(ctx context.Context, r io.Reader, p []byte, buckets []*TokenBucket) (int, error) {
+	if len(p) == 0 || len(buckets) == 0 {
+		return r.Read(p)
+	}
+	n, err := r.Read(p[:chunk(len(p), buckets)])
+	if n > 0 {
+		if werr := waitAll(ctx, n, buckets); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// throttledWrite writes p a chunk at a time, each one after the buckets paid for it
+func throttledWrite(ctx context.Context, w io.Writer, p []byte, buckets []*TokenBucket) (int, error) {
+	if len(buckets) == 0 {
+		return w.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		n := chunk(len(p), buckets)
+		if err := waitAll(ctx, n, buckets); err != nil {
+			return written, err
+		}
+		m, err := w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Reader takes a token from every bucket for each byte read, blocking until they have them
+type Reader struct {
+	r       io.Reader
+	ctx     context.Context
+	buckets []*TokenBucket
+}
+
+func NewReader(r io.Reader, buckets ...*TokenBucket) *Reader {
+	return NewReaderContext(context.Background(), r, buckets...)
+}
+
+// NewReaderContext returns a Reader whose waiting ends with ctx.Err() once ctx is done
+func NewReaderContext(ctx context.Context, r io.Reader, buckets ...*TokenBucket) *Reader {
+	return &Reader{r: r, ctx: ctx, buckets: buckets}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	return throttledRead(r.ctx, r.r, p, r.buckets)
+}
+
+// Writer takes a token from every bucket for each byte written, blocking until they have them
+type Writer struct {
+	w       io.Writer
+	ctx     context.Context
+	buckets []*TokenBucket
+}
+
+func NewWriter(w io.Writer, buckets ...*TokenBucket) *Writer {
+	return NewWriterContext(context.Background(), w, buckets...)
+}
+
+// NewWriterContext returns a Writer whose waiting ends with ctx.Err() once ctx is done
+func NewWriterContext(ctx context.Context, w io.Writer, buckets ...*TokenBucket) *Writer {
+	return &Writer{w: w, ctx: ctx, buckets: buckets}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	return throttledWrite(w.ctx, w.w, p, w.buckets)
+}
+
+// Conn throttles the reads and writes of a net.Conn. Waiting for tokens stops at the
+// read or write deadline with os.ErrDeadlineExceeded, and with net.ErrClosed once the conn is closed.
+type Conn struct {
+	net.Conn
+	read, write []*TokenBucket
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// NewConn throttles c, every byte read takes a token from each of the read buckets and
+// every byte written from each of the write buckets. A bucket may be in both.
+func NewConn(c net.Conn, read, write []*TokenBucket) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Conn{Conn: c, read: read, write: write, ctx: ctx, cancel: cancel}
+}
+
+// waitContext is the context of one read or write, done at deadline or when the conn is closed
+func (c *Conn) waitContext(deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return c.ctx, func() {}
+	}
+	return context.WithDeadline(c.ctx, deadline)
+}
+
+// waitErr turns the error of a canceled wait into the one the conn itself would return
+func waitErr(err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return os.ErrDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return net.ErrClosed
+	}
+	return err
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	ctx, cancel := c.waitContext(c.readDeadline)
+	c.mu.Unlock()
+	defer cancel()
+
+	n, err := throttledRead(ctx, c.Conn, p, c.read)
+	if ctx.Err() != nil {
+		err = waitErr(err)
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	ctx, cancel := c.waitContext(c.writeDeadline)
+	c.mu.Unlock()
+	defer cancel()
+
+	n, err := throttledWrite(ctx, c.Conn, p, c.write)
+	if ctx.Err() != nil {
+		err = waitErr(err)
+	}
+	return n, err
+}
+
+// Close ends every wait for tokens and closes the conn
+func (c *Conn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Bandwidth is a byte rate with bursts of up to Burst bytes, the zero value is no limit
+type Bandwidth struct {
+	BytesPerSecond float64
+	Burst          int
+}
+
+func (b Bandwidth) enabled() bool {
+	return b != Bandwidth{}
+}
+
+// bucket returns a full bucket for b, nil when b is no limit
+func (b Bandwidth) bucket() *TokenBucket {
+	if !b.enabled() {
+		return nil
+	}
+	// validated by NewListener, the bucket can't fail
+	tb, _ := NewTokenBucket(b.Burst, float64(b.Burst), b.BytesPerSecond)
+	tb.SetLogger(quietLogger)
+	return tb
+}
+
+// ListenerLimits caps the connections of a Listener, each one on its own and all of them together
+type ListenerLimits struct {
+	ConnRead, ConnWrite   Bandwidth
+	TotalRead, TotalWrite Bandwidth
+}
+
+// Listener throttles every connection it accepts
+type Listener struct {
+	net.Listener
+	limits ListenerLimits
+	// shared by every connection, nil without a total limit
+	totalRead, totalWrite *TokenBucket
+}
+
+func NewListener(l net.Listener, limits ListenerLimits) (*Listener, error) {
+	for _, b := range []Bandwidth{limits.ConnRead, limits.ConnWrite, limits.TotalRead, limits.TotalWrite} {
+		if b.enabled() && (b.BytesPerSecond <= 0 || b.Burst <= 0) {
+			return nil, errors.New("bytesPerSecond and burst must be positive")
+		}
+	}
+	return &Listener{
+		Listener:   l,
+		limits:     limits,
+		totalRead:  limits.TotalRead.bucket(),
+		totalWrite: limits.TotalWrite.bucket(),
+	}, nil
+}
+
+// Accept wraps the next connection in a Conn with its own buckets and the shared ones
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(c,
+		buckets(l.limits.ConnRead.bucket(), l.totalRead),
+		buckets(l.limits.ConnWrite.bucket(), l.totalWrite),
+	), nil
+}
+
+// buckets drops the nil ones, the connection's own bucket comes first so it waits
+// for that before taking from the shared one
+func buckets(all ...*TokenBucket) []*TokenBucket {
+	var bs []*TokenBucket
+	for _, tb := range all {
+		if tb != nil {
+			bs = append(bs, tb)
+		}
+	}
+	return bs
+}
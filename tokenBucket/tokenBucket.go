@@ -1,13 +1,32 @@
-package main
+package tokenbucket
 
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
+	"math"
 	"sync"
 	"time"
 )
 
+// InfDuration is returned as the wait time for requests that can never be allowed
+const InfDuration = time.Duration(math.MaxInt64)
+
+// Cost is what a request takes from the bucket. Fractions like 0.1 for a cheap read or
+// 5.5 for an export are taken exactly, Allow(n) is AllowCost(Cost(n)).
+type Cost = float64
+
+// ExceedsCapacityError is returned by the waiting APIs when n is larger than the bucket can ever hold
+type ExceedsCapacityError struct {
+	Requested int
+	Capacity  int
+}
+
+func (e *ExceedsCapacityError) Error() string {
+	return fmt.Sprintf("requested %d tokens but bucket capacity is %d", e.Requested, e.Capacity)
+}
+
 type TokenBucket struct {
 	capacity        int
 	fillRate        float64
@@ -17,6 +36,18 @@ type TokenBucket struct {
 	tokensRejected  int
 	log             *log.Logger
 	mu              sync.RWMutex
+
+	// how far tokens may go below zero, zero unless SetMaxDebt was called
+	maxDebt float64
+
+	// tokens handed out and turned away by AllowUpTo
+	unitsGranted int
+	unitsDenied  int
+
+	// zero unless SetWarmup was called
+	warmup      WarmupConfig
+	warmStart   time.Time
+	lastRequest time.Time
 }
 
 func NewTokenBucket(capacity int, tokens, fillRate float64) (*TokenBucket, error) {
@@ -51,21 +82,113 @@ func (tb *TokenBucket) Allow(n int) bool {
 	if n <= 0 {
 		return false
 	}
+	return tb.AllowCost(Cost(n))
+}
+
+// AllowCost takes cost tokens if the bucket has them, a cost that isn't positive is never allowed
+func (tb *TokenBucket) AllowCost(cost Cost) bool {
+	allowed, _ := tb.TryCost(cost)
+	return allowed
+}
+
+// TryCost is AllowCost that also says how long to wait when it rejects, decided under
+// one lock. The wait is InfDuration when cost never fits, whatever the caller does.
+func (tb *TokenBucket) TryCost(cost Cost) (bool, time.Duration) {
+	if !(cost > 0) {
+		return false, InfDuration
+	}
 
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
 
+	if cost > float64(tb.capacity) {
+		tb.tokensRejected++
+		tb.log.Printf("Rejected: need %g tokens, capacity is %d", cost, tb.capacity)
+		return false, InfDuration
+	}
+
+	tb.wake(time.Now())
 	tb.refill()
 
-	if float64(n) > tb.tokens {
+	if tb.need(cost) > tb.tokens {
+		tb.tokensRejected++
+		tb.log.Printf("Rejected: need %g tokens, have %.2f", cost, tb.tokens)
+		return false, tb.timeUntilSpace(cost)
+	}
+
+	tb.tokens -= cost
+	tb.tokensProcessed++
+	return true, 0
+}
+
+// Debit takes cost tokens after the fact, e.g. for the bytes of a response that
+// already went out. It never fails: what the bucket doesn't have is forgiven, so a big
+// debit empties it, or runs it up to its max debt, instead of going further.
+func (tb *TokenBucket) Debit(cost Cost) {
+	if !(cost > 0) {
+		return
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.wake(time.Now())
+	tb.refill()
+	tb.tokens = max(tb.tokens-cost, min(tb.tokens, -tb.maxDebt))
+}
+
+// AllowUpTo takes as many of n tokens as the bucket has and returns how many that were,
+// running it up to its max debt like Allow. Only whole tokens are handed out, Stats counts
+// the call as processed unless nothing was granted and Units counts the tokens.
+func (tb *TokenBucket) AllowUpTo(n int) int {
+	if n <= 0 {
+		return 0
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.wake(time.Now())
+	tb.refill()
+
+	granted := min(n, tb.capacity)
+	if tb.need(float64(granted)) > tb.tokens {
+		// the most that still fits with the debt, nothing while the bucket is in debt already
+		granted = 0
+		if tb.tokens >= 0 {
+			granted = int(tb.tokens + tb.maxDebt)
+		}
+	}
+	tb.unitsGranted += granted
+	tb.unitsDenied += n - granted
+	if granted == 0 {
 		tb.tokensRejected++
 		tb.log.Printf("Rejected: need %d tokens, have %.2f", n, tb.tokens)
-		return false
+		return 0
 	}
 
-	tb.tokens -= float64(n)
+	tb.tokens -= float64(granted)
 	tb.tokensProcessed++
-	return true
+	return granted
+}
+
+// SetMaxDebt lets Allow overdraw the bucket by up to maxDebt tokens, 0 turns it off.
+// A bucket in debt allows nothing until the fill rate has paid it back.
+func (tb *TokenBucket) SetMaxDebt(maxDebt int) error {
+	if maxDebt < 0 {
+		return errors.New("maxDebt cant be negative")
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.maxDebt = float64(maxDebt)
+	return nil
+}
+
+// need is how many tokens the bucket must hold to allow n, less than n when it may go
+// into debt but never below zero, so a bucket in debt pays it back first. tb.mu must be held.
+func (tb *TokenBucket) need(cost float64) float64 {
+	return max(cost-tb.maxDebt, 0)
 }
 
 func (tb *TokenBucket) Update(newCapacity int, newFillRate float64) {
@@ -85,52 +208,65 @@ func (tb *TokenBucket) Update(newCapacity int, newFillRate float64) {
 
 func (tb *TokenBucket) refill() {
 	now := time.Now()
-	timeElapsed := now.Sub(tb.lastTime).Seconds()
+	tb.tokens = tb.tokensAt(now, tb.warmStart)
+	tb.lastTime = now
+}
 
-	const maxRefillSeconds = 60
-	if timeElapsed > maxRefillSeconds {
-		timeElapsed = maxRefillSeconds
-	}
+// tokensAt is how many tokens the bucket holds at now with the ramp that started at start.
+// There is no cap on the idle time, however long it was the tokens only ever reach the
+// capacity: filled may be huge or +Inf, but never NaN since the fill rate is positive.
+func (tb *TokenBucket) tokensAt(now, start time.Time) float64 {
+	return min(tb.tokens+tb.filled(tb.lastTime, now, tb.warmStart), tb.capacityAt(now, start))
+}
 
-	tb.tokens += timeElapsed * tb.fillRate
-	if tb.tokens > float64(tb.capacity) {
-		tb.tokens = float64(tb.capacity)
+// durationOf converts seconds to a Duration, waits too long for a Duration are InfDuration
+func durationOf(seconds float64) time.Duration {
+	if seconds >= float64(InfDuration)/float64(time.Second) {
+		return InfDuration
 	}
-	tb.lastTime = now
+	return time.Duration(seconds * float64(time.Second))
 }
 
 func (tb *TokenBucket) TimeUntilAllowed(n int) time.Duration {
 	if n <= 0 {
 		return 0
 	}
+	return tb.TimeUntilAllowedCost(Cost(n))
+}
+
+// TimeUntilAllowedCost is how long until cost tokens are in the bucket, InfDuration if they never fit
+func (tb *TokenBucket) TimeUntilAllowedCost(cost Cost) time.Duration {
+	if !(cost > 0) {
+		return 0
+	}
 	tb.mu.RLock()
 	defer tb.mu.RUnlock()
 
-	return tb.TimeUntilSpace(n)
+	return tb.timeUntilSpace(cost)
 }
 
 func (tb *TokenBucket) TimeUntilSpace(n int) time.Duration {
+	return tb.timeUntilSpace(float64(n))
+}
 
-	now := time.Now()
-	timeElapsed := now.Sub(tb.lastTime).Seconds()
-
-	const maxRefillSeconds = 60
-	if timeElapsed > maxRefillSeconds {
-		timeElapsed = maxRefillSeconds
+// timeUntilSpace is TimeUntilSpace for a fractional cost, tb.mu must be held
+func (tb *TokenBucket) timeUntilSpace(cost float64) time.Duration {
+	if cost > float64(tb.capacity) {
+		return InfDuration
 	}
 
-	currentTokens := tb.tokens + (timeElapsed * tb.fillRate)
-	if currentTokens > float64(tb.capacity) {
-		currentTokens = float64(tb.capacity)
-	}
+	now := time.Now()
+	// a bucket that has been idle too long starts the warm-up over on the next request
+	start := tb.warmStartAt(now)
+	currentTokens := tb.tokensAt(now, start)
 
-	missing := float64(n) - currentTokens
+	need := tb.need(cost)
+	missing := need - currentTokens
 	if missing <= 0 {
 		return 0
 	}
 
-	seconds := missing / tb.fillRate
-	return time.Duration(seconds * float64(time.Second))
+	return max(tb.untilFilled(missing, now, start), tb.untilCapacity(need, now, start))
 }
 
 func (tb *TokenBucket) WaitAllow(n int, timeout time.Duration) bool {
@@ -140,37 +276,76 @@ func (tb *TokenBucket) WaitAllow(n int, timeout time.Duration) bool {
 }
 
 func (tb *TokenBucket) WaitAllowContext(ctx context.Context, n int) bool {
+	return tb.Wait(ctx, n) == nil
+}
+
+// Wait blocks until n tokens are taken or ctx is done. It takes them right away
+// when the bucket has them, otherwise it sleeps until they should be there.
+func (tb *TokenBucket) Wait(ctx context.Context, n int) error {
 	if n <= 0 {
-		return false
+		return errors.New("n must be positive")
 	}
 
+	// the bucket is checked at least this often since Update can change it while we wait
 	const maxSleep = 100 * time.Millisecond
-	ticker := time.NewTicker(maxSleep)
-	defer ticker.Stop()
+	var timer *time.Timer
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		tb.mu.Lock()
+		if n > tb.capacity {
+			capacity := tb.capacity
+			tb.mu.Unlock()
+			return &ExceedsCapacityError{Requested: n, Capacity: capacity}
+		}
+		tb.wake(time.Now())
+		tb.refill()
+		if tb.need(float64(n)) <= tb.tokens {
+			tb.tokens -= float64(n)
+			tb.tokensProcessed++
+			tb.mu.Unlock()
+			return nil
+		}
+		// at least a millisecond so float rounding can't make it spin
+		sleep := min(max(tb.timeUntilSpace(float64(n)), time.Millisecond), maxSleep)
+		tb.mu.Unlock()
+
+		if timer == nil {
+			timer = time.NewTimer(sleep)
+			defer timer.Stop()
+		} else {
+			timer.Reset(sleep)
+		}
 		select {
 		case <-ctx.Done():
-			return false
-		case <-ticker.C:
-			tb.mu.Lock()
-			tb.refill()
-
-			if float64(n) <= tb.tokens {
-				tb.tokens -= float64(n)
-				tb.tokensProcessed++
-				tb.mu.Unlock()
-				return true
-			}
-			tb.mu.Unlock()
+			return ctx.Err()
+		case <-timer.C:
 		}
 	}
 }
 
-func (tb *TokenBucket) Stats() (processed, rejected int) {
+// ExceedsCapacity reports whether n can never be allowed, no matter how long the caller waits
+func (tb *TokenBucket) ExceedsCapacity(n int) bool {
 	tb.mu.RLock()
 	defer tb.mu.RUnlock()
-	return tb.tokensProcessed, tb.tokensRejected
+	return n > tb.capacity
+}
+
+// Stats returns the allowed and rejected requests and how many tokens the bucket owes
+func (tb *TokenBucket) Stats() (processed, rejected int, debt float64) {
+	tb.mu.RLock()
+	defer tb.mu.RUnlock()
+	return tb.tokensProcessed, tb.tokensRejected, max(-tb.tokens, 0)
+}
+
+// Units returns the tokens AllowUpTo handed out and the ones it turned away
+func (tb *TokenBucket) Units() (granted, denied int) {
+	tb.mu.RLock()
+	defer tb.mu.RUnlock()
+	return tb.unitsGranted, tb.unitsDenied
 }
 
 func (tb *TokenBucket) ResetStats() {
@@ -178,9 +353,32 @@ func (tb *TokenBucket) ResetStats() {
 	defer tb.mu.Unlock()
 	tb.tokensProcessed = 0
 	tb.tokensRejected = 0
+	tb.unitsGranted = 0
+	tb.unitsDenied = 0
 }
+func (tb *TokenBucket) Capacity() int {
+	tb.mu.RLock()
+	defer tb.mu.RUnlock()
+	return tb.capacity
+}
+
+func (tb *TokenBucket) FillRate() float64 {
+	tb.mu.RLock()
+	defer tb.mu.RUnlock()
+	return tb.fillRate
+}
+
+// AvailableTokens is negative while the bucket is in debt
 func (tb *TokenBucket) AvailableTokens() float64 {
 	tb.mu.RLock()
 	defer tb.mu.RUnlock()
 	return tb.tokens
 }
+
+// tokensNow is AvailableTokens including what the bucket refilled since the last request
+func (tb *TokenBucket) tokensNow() float64 {
+	tb.mu.RLock()
+	defer tb.mu.RUnlock()
+	now := time.Now()
+	return tb.tokensAt(now, tb.warmStartAt(now))
+}
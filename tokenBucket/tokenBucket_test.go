@@ -1,6 +1,17 @@
-package main
+package tokenbucket
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 )
@@ -81,6 +92,20 @@ func TestWaitAllow(t *testing.T) {
 	}
 }
 
+// 4 tokens at 2 tokens/s take the whole 2s of refill
+func TestWaitAllowRefill(t *testing.T) {
+	tb, _ := NewTokenBucket(10, 0, 2)
+	tb.SetLogger(log.New(io.Discard, "", 0))
+
+	start := time.Now()
+	if !tb.WaitAllow(4, 3*time.Second) {
+		t.Fatalf("Expected 4 tokens within 3s")
+	}
+	if elapsed := time.Since(start); elapsed < 2*time.Second || elapsed > 3*time.Second {
+		t.Errorf("Expected to wait about 2s, got %v", elapsed)
+	}
+}
+
 func TestUpdate(t *testing.T) {
 	tb, _ := NewTokenBucket(10, 10, 1)
 	//updating capacity only
@@ -114,7 +139,7 @@ func TestStats(t *testing.T) {
 	tb, _ := NewTokenBucket(10, 10, 1)
 	tb.Allow(11)
 
-	processed, rejected := tb.Stats()
+	processed, rejected, _ := tb.Stats()
 	if processed != 0 {
 		t.Errorf("Expected 1 to be processed, but got %v", processed)
 	}
@@ -123,8 +148,906 @@ func TestStats(t *testing.T) {
 	}
 
 	tb.ResetStats()
-	processed, rejected = tb.Stats()
+	processed, rejected, _ = tb.Stats()
 	if processed != 0 || rejected != 0 {
 		t.Errorf("After reset: got %d,%d", processed, rejected)
 	}
 }
+
+func TestCost(t *testing.T) {
+	tb, _ := NewTokenBucket(10, 1, 1)
+	tb.SetLogger(log.New(io.Discard, "", 0))
+
+	for i := range 4 {
+		if !tb.AllowCost(0.25) {
+			t.Errorf("Expected cheap request %d to be allowed", i)
+		}
+	}
+	if tb.AllowCost(0.5) {
+		t.Errorf("Expected the bucket to be out of tokens")
+	}
+	if wait := tb.TimeUntilAllowedCost(0.5); wait < 450*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("Expected to wait about 500ms for half a token, got %v", wait)
+	}
+	if tb.AllowCost(0) || tb.AllowCost(-1) || tb.AllowCost(math.NaN()) {
+		t.Errorf("A cost that isn't positive should never be allowed")
+	}
+	if wait := tb.TimeUntilAllowedCost(10.5); wait != InfDuration {
+		t.Errorf("Expected InfDuration above the capacity, got %v", wait)
+	}
+
+	m, _ := NewTwoRateMarker(1, 1, 2, 2)
+	m.SetLogger(log.New(io.Discard, "", 0))
+	if c := m.MarkCost(0.5); c != Green {
+		t.Errorf("Expected half a token to be green, got %s", c)
+	}
+	if c := m.MarkCost(1.5); c != Yellow {
+		t.Errorf("Expected 1.5 tokens to be yellow, got %s", c)
+	}
+}
+
+func TestAllowUpTo(t *testing.T) {
+	tb, _ := NewTokenBucket(10, 7.5, 1)
+	tb.SetLogger(log.New(io.Discard, "", 0))
+
+	if granted := tb.AllowUpTo(3); granted != 3 {
+		t.Errorf("Expected all 3 to be granted, got %d", granted)
+	}
+	// only whole tokens are handed out, half a token stays in the bucket
+	if granted := tb.AllowUpTo(20); granted != 4 {
+		t.Errorf("Expected the 4 whole tokens left, got %d", granted)
+	}
+	if granted := tb.AllowUpTo(1); granted != 0 {
+		t.Errorf("Expected nothing from an empty bucket, got %d", granted)
+	}
+	// calls like Allow: two that got tokens and the empty one
+	if processed, rejected, _ := tb.Stats(); processed != 2 || rejected != 1 {
+		t.Errorf("Expected 2 processed and 1 rejected, got %d and %d", processed, rejected)
+	}
+	// and the tokens: 3+4 granted, 16+1 turned away
+	if granted, denied := tb.Units(); granted != 7 || denied != 17 {
+		t.Errorf("Expected 7 tokens granted and 17 denied, got %d and %d", granted, denied)
+	}
+
+	// with debt the whole batch goes through, up to the capacity
+	debt, _ := NewTokenBucket(10, 2, 1)
+	debt.SetLogger(log.New(io.Discard, "", 0))
+	debt.SetMaxDebt(5)
+	if granted := debt.AllowUpTo(7); granted != 7 {
+		t.Errorf("Expected 7 granted with debt, got %d", granted)
+	}
+	if granted := debt.AllowUpTo(1); granted != 0 {
+		t.Errorf("Expected nothing while in debt, got %d", granted)
+	}
+
+	// a partial grant may run up the debt too, 2 tokens plus 5 of debt
+	partial, _ := NewTokenBucket(10, 2, 0.01)
+	partial.SetLogger(log.New(io.Discard, "", 0))
+	partial.SetMaxDebt(5)
+	if granted := partial.AllowUpTo(9); granted != 7 {
+		t.Errorf("Expected 7 of 9 granted with debt, got %d", granted)
+	}
+	if _, _, debt := partial.Stats(); debt < 4.9 || debt > 5 {
+		t.Errorf("Expected a debt of 5, got %.2f", debt)
+	}
+}
+
+func TestDebt(t *testing.T) {
+	tb, _ := NewTokenBucket(10, 5, 10)
+	tb.SetLogger(log.New(io.Discard, "", 0))
+	if err := tb.SetMaxDebt(-1); err == nil {
+		t.Errorf("Negative maxDebt should fail")
+	}
+	tb.SetMaxDebt(5)
+
+	// 8 tokens overdraw the 5 in the bucket by 3
+	if !tb.Allow(8) {
+		t.Errorf("Expected Allow(8) to go into debt")
+	}
+	if _, _, debt := tb.Stats(); debt < 2.9 || debt > 3 {
+		t.Errorf("Expected a debt of 3, got %.2f", debt)
+	}
+	if tokens := tb.AvailableTokens(); tokens > -2.9 {
+		t.Errorf("Expected negative available tokens, got %.2f", tokens)
+	}
+
+	// nothing goes through until the debt is paid back at 10 tokens/s
+	if tb.Allow(1) {
+		t.Errorf("Expected a bucket in debt to reject")
+	}
+	if wait := tb.TimeUntilAllowed(1); wait < 250*time.Millisecond || wait > 300*time.Millisecond {
+		t.Errorf("Expected to wait about 300ms for the debt, got %v", wait)
+	}
+	time.Sleep(310 * time.Millisecond)
+	if !tb.Allow(5) {
+		t.Errorf("Expected Allow(5) to go into debt again once paid back")
+	}
+
+	// the state carries the debt and the max debt with it
+	data, _ := json.Marshal(tb)
+	restored, _ := NewTokenBucket(10, 10, 10)
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatalf("Failed to restore the debt: %v", err)
+	}
+	if _, _, debt := restored.Stats(); debt < 0.1 || restored.state().MaxDebt != 5 {
+		t.Errorf("Expected the debt and a max debt of 5, got %.2f and %v", debt, restored.state().MaxDebt)
+	}
+	// more debt than the saved max is no valid state
+	if err := json.Unmarshal([]byte(`{"version":2,"capacity":10,"fill_rate":1,"tokens":-6,"max_debt":5}`), restored); err == nil {
+		t.Errorf("Expected a debt above the max debt to be rejected")
+	}
+}
+
+func TestDebit(t *testing.T) {
+	tb, _ := NewTokenBucket(10, 10, 0.01)
+	tb.SetLogger(log.New(io.Discard, "", 0))
+
+	tb.Debit(7.5)
+	if tokens := tb.AvailableTokens(); tokens < 2.5 || tokens > 2.6 {
+		t.Errorf("Expected 2.5 tokens after a debit of 7.5, got %.2f", tokens)
+	}
+	// without debt a debit only empties the bucket, with it it goes no further than the max
+	tb.Debit(100)
+	if tokens := tb.AvailableTokens(); tokens < 0 || tokens > 0.1 {
+		t.Errorf("Expected an empty bucket, got %.2f", tokens)
+	}
+	tb.SetMaxDebt(5)
+	tb.Debit(100)
+	if _, _, debt := tb.Stats(); debt < 4.9 || debt > 5 {
+		t.Errorf("Expected a debt of 5, got %.2f", debt)
+	}
+
+	m, _ := NewMultiBucket(Dimension{"requests", 10, 1}, Dimension{"bytes", 1000, 1})
+	m.SetLogger(log.New(io.Discard, "", 0))
+	m.DebitCosts(0, 900)
+	if d := m.Check(1, 200); d.Allowed || !slices.Equal(d.DeniedBy, []string{"bytes"}) {
+		t.Errorf("Expected the debited bytes to deny, got %+v", d)
+	}
+	m.Debit(10)
+	if _, _, dims := m.Stats(); dims[0].Available > 0.1 {
+		t.Errorf("Expected no requests left, got %.2f", dims[0].Available)
+	}
+
+	// a debit takes from the committed bucket first
+	sm, _ := NewSingleRateMarker(0.01, 2, 1)
+	sm.SetLogger(log.New(io.Discard, "", 0))
+	sm.Debit(2.5)
+	if c := sm.MarkCost(0.5); c != Yellow {
+		t.Errorf("Expected the excess half token to mark yellow, got %s", c)
+	}
+	tm, _ := NewTwoRateMarker(0.01, 2, 0.01, 4)
+	tm.SetLogger(log.New(io.Discard, "", 0))
+	tm.Debit(2)
+	if c := tm.Mark(1); c != Yellow {
+		t.Errorf("Expected an empty committed bucket to mark yellow, got %s", c)
+	}
+}
+
+func TestExceedsCapacity(t *testing.T) {
+	tb, _ := NewTokenBucket(10, 10, 1)
+
+	if tb.Allow(11) {
+		t.Errorf("Allow(11) with capacity 10 should fail")
+	}
+	if delay := tb.TimeUntilAllowed(11); delay != InfDuration {
+		t.Errorf("Expected infinite delay for 11 tokens, got %v", delay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	err := tb.Wait(ctx, 11)
+	var capErr *ExceedsCapacityError
+	if !errors.As(err, &capErr) {
+		t.Fatalf("Expected ExceedsCapacityError, got %v", err)
+	}
+	if capErr.Requested != 11 || capErr.Capacity != 10 {
+		t.Errorf("Expected requested=11 capacity=10, got %d and %d", capErr.Requested, capErr.Capacity)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Wait should fail right away for impossible requests")
+	}
+
+	if ok, delay := tb.TryCost(11); ok || delay != InfDuration {
+		t.Errorf("Expected TryCost(11) to never fit, got %v and %v", ok, delay)
+	}
+	tb.Allow(10)
+	if ok, delay := tb.TryCost(1); ok || delay <= 0 || delay > time.Second {
+		t.Errorf("Expected TryCost(1) to wait for a token, got %v and %v", ok, delay)
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	tb, _ := NewTokenBucket(10, 10, 1)
+	for i := 0; i < 10; i++ {
+		tb.Allow(1)
+	}
+	tb.Allow(1)
+
+	data, err := tb.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+
+	// restoring overwrites whatever the bucket was created with
+	restored, _ := NewTokenBucket(1, 1, 5)
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %v", err)
+	}
+	if restored.Capacity() != 10 || restored.FillRate() != 1 {
+		t.Errorf("Expected capacity 10 and fillRate 1, got %d and %f", restored.Capacity(), restored.FillRate())
+	}
+	if restored.Allow(1) {
+		t.Errorf("Allow(1) on a restored empty bucket should fail")
+	}
+	if processed, rejected, _ := restored.Stats(); processed != 10 || rejected != 2 {
+		t.Errorf("Expected 10 processed and 2 rejected, got %d and %d", processed, rejected)
+	}
+
+	if err := restored.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Errorf("UnmarshalBinary of truncated data should fail")
+	}
+}
+
+func TestUnmarshalJSON_Refills(t *testing.T) {
+	tb, _ := NewTokenBucket(10, 0, 1)
+	// pretend the snapshot was taken 5 seconds ago
+	tb.lastTime = time.Now().Add(-5 * time.Second)
+
+	data, err := json.Marshal(tb)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	var restored TokenBucket
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if tokens := restored.AvailableTokens(); tokens < 4.9 || tokens > 5.1 {
+		t.Errorf("Expected about 5 tokens after 5s of downtime, got %.2f", tokens)
+	}
+	if !restored.Allow(4) {
+		t.Errorf("Allow(4) should use the refilled tokens")
+	}
+
+	if err := json.Unmarshal([]byte(`{"version":1,"capacity":0,"fill_rate":1}`), &restored); err == nil {
+		t.Errorf("Unmarshal of a zero capacity state should fail")
+	}
+}
+
+func TestAIMD(t *testing.T) {
+	cfg := AIMDConfig{
+		MinRate: 1, MaxRate: 10, Increase: 2, Decrease: 0.5,
+		TargetLatency: 100 * time.Millisecond, MaxErrorRate: 0.1, Interval: time.Hour,
+	}
+	if _, err := NewAIMD(AIMDConfig{MinRate: 1, MaxRate: 10, Increase: 1, Decrease: 0.5, Interval: time.Second}, 5); err == nil {
+		t.Errorf("AIMD without a latency or error target should fail")
+	}
+	aimd, err := NewAIMD(cfg, 20)
+	if err != nil {
+		t.Fatalf("NewAIMD failed: %v", err)
+	}
+	if aimd.Rate() != 10 {
+		t.Errorf("Expected the starting rate clamped to 10, got %f", aimd.Rate())
+	}
+
+	// the interval isn't over, nothing changes yet
+	if _, adjusted := aimd.Observe(time.Second, false); adjusted {
+		t.Errorf("Observe should not adjust before the interval ends")
+	}
+	if rate := aimd.Adjust(); rate != 5 {
+		t.Errorf("Expected slow requests to halve the rate to 5, got %f", rate)
+	}
+
+	for range 10 {
+		aimd.Observe(10*time.Millisecond, false)
+	}
+	if rate := aimd.Adjust(); rate != 7 {
+		t.Errorf("Expected healthy requests to add 2, got %f", rate)
+	}
+
+	// 2 of 10 failed, over the 10% error budget
+	for i := range 10 {
+		aimd.Observe(10*time.Millisecond, i < 2)
+	}
+	if rate := aimd.Adjust(); rate != 3.5 {
+		t.Errorf("Expected errors to halve the rate to 3.5, got %f", rate)
+	}
+
+	if rate := aimd.Adjust(); rate != 3.5 {
+		t.Errorf("An interval without requests should keep the rate, got %f", rate)
+	}
+
+	for range 3 {
+		aimd.Observe(time.Second, true)
+		aimd.Adjust()
+	}
+	if aimd.Rate() != 1 {
+		t.Errorf("Expected the rate to stop at the minimum 1, got %f", aimd.Rate())
+	}
+}
+
+func TestAdaptiveTokenBucket(t *testing.T) {
+	tb, _ := NewTokenBucket(10, 10, 4)
+	atb, err := NewAdaptiveTokenBucket(tb, AIMDConfig{
+		MinRate: 1, MaxRate: 8, Increase: 1, Decrease: 0.5,
+		TargetLatency: 50 * time.Millisecond, Interval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewAdaptiveTokenBucket failed: %v", err)
+	}
+
+	atb.Observe(time.Second, false)
+	if atb.FillRate() != 4 {
+		t.Errorf("Fill rate should not change before the interval ends, got %f", atb.FillRate())
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	atb.Observe(time.Second, false)
+	if atb.FillRate() != 2 {
+		t.Errorf("Expected slow requests to halve the fill rate to 2, got %f", atb.FillRate())
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	atb.Observe(time.Millisecond, false)
+	if atb.FillRate() != 3 {
+		t.Errorf("Expected a fast request to add 1 to the fill rate, got %f", atb.FillRate())
+	}
+}
+
+func newQuietHierarchy(t *testing.T, levels ...Level) *Hierarchy {
+	t.Helper()
+	h, err := NewHierarchy(levels...)
+	if err != nil {
+		t.Fatalf("NewHierarchy failed: %v", err)
+	}
+	h.SetLogger(log.New(io.Discard, "", 0))
+	return h
+}
+
+func TestNewHierarchy(t *testing.T) {
+	if _, err := NewHierarchy(); err == nil {
+		t.Errorf("no levels should fail")
+	}
+	if _, err := NewHierarchy(Level{Name: "service", Capacity: 10, FillRate: 1, Ceil: 2}); err == nil {
+		t.Errorf("the root can't borrow")
+	}
+	if _, err := NewHierarchy(Level{Name: "service", Capacity: 10, FillRate: 1}, Level{Name: "tenant", Capacity: 5, FillRate: 2, Ceil: 1}); err == nil {
+		t.Errorf("ceil below fillRate should fail")
+	}
+	if _, err := NewHierarchy(Level{Name: "service", Capacity: 10, FillRate: 1}, Level{Name: "service", Capacity: 5, FillRate: 1}); err == nil {
+		t.Errorf("duplicate level names should fail")
+	}
+}
+
+func TestHierarchy(t *testing.T) {
+	h := newQuietHierarchy(t,
+		Level{Name: "service", Capacity: 3, FillRate: 0.01},
+		Level{Name: "tenant", Capacity: 2, FillRate: 0.01},
+	)
+
+	for i := 0; i < 2; i++ {
+		if !h.Allow(1, "acme") {
+			t.Fatalf("Allow(1) at %d for acme should succeed", i)
+		}
+	}
+	d := h.Check(1, "acme")
+	if d.Allowed || !slices.Equal(d.DeniedBy, []string{"tenant"}) {
+		t.Errorf("Expected acme to be denied by its tenant limit, got %+v", d)
+	}
+	if d.RetryAfter < 99*time.Second || d.RetryAfter > 100*time.Second {
+		t.Errorf("Expected a retry after about 100s, got %v", d.RetryAfter)
+	}
+
+	// the service budget runs out before globex reaches its own limit
+	if !h.Allow(1, "globex") {
+		t.Fatalf("first request of globex should succeed")
+	}
+	d = h.Check(1, "globex")
+	if d.Allowed || !slices.Equal(d.DeniedBy, []string{"service"}) {
+		t.Errorf("Expected globex to be denied by the service limit, got %+v", d)
+	}
+
+	nodes := h.Nodes()
+	if len(nodes) != 3 || nodes[0].Path != "" || nodes[1].Path != "acme" || nodes[2].Path != "globex" {
+		t.Fatalf("Expected the root, acme and globex, got %+v", nodes)
+	}
+	if nodes[0].Allowed != 3 || nodes[0].Rejected != 1 {
+		t.Errorf("Expected the root with 3 allowed and 1 rejected, got %+v", nodes[0])
+	}
+	// the denial by the service didn't take a token from globex
+	if nodes[2].Tokens != 1 || nodes[2].Rejected != 0 {
+		t.Errorf("Expected globex with 1 token left and no rejections, got %+v", nodes[2])
+	}
+
+	if !h.ExceedsCapacity(3) || h.ExceedsCapacity(2) {
+		t.Errorf("Expected 3 to exceed the tenant capacity and 2 to fit")
+	}
+	if d := h.Check(3, "acme"); d.RetryAfter != InfDuration {
+		t.Errorf("Expected InfDuration for a request that never fits, got %v", d.RetryAfter)
+	}
+
+	if err := h.UpdateLevel("tenant", 3, 0, 0); err != nil {
+		t.Fatalf("UpdateLevel failed: %v", err)
+	}
+	if h.ExceedsCapacity(3) {
+		t.Errorf("Expected 3 to fit after raising the tenant capacity")
+	}
+	if err := h.UpdateLevel("user", 1, 1, 0); err == nil {
+		t.Errorf("UpdateLevel of an unknown level should fail")
+	}
+}
+
+func TestHierarchyBorrowing(t *testing.T) {
+	h := newQuietHierarchy(t,
+		Level{Name: "service", Capacity: 10, FillRate: 0.01},
+		Level{Name: "tenant", Capacity: 1, FillRate: 0.01, Ceil: 100},
+	)
+
+	if d := h.Check(1, "acme"); !d.Allowed || len(d.Borrowed) != 0 {
+		t.Fatalf("first request should be allowed at the tenant's own rate, got %+v", d)
+	}
+	// the ceil bucket was just used up as well
+	if h.Allow(1, "acme") {
+		t.Errorf("Expected a denial until the ceil has room again")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	d := h.Check(1, "acme")
+	if !d.Allowed || !slices.Equal(d.Borrowed, []string{"tenant"}) {
+		t.Errorf("Expected acme to borrow idle service tokens, got %+v", d)
+	}
+	nodes := h.Nodes()
+	if nodes[1].Borrowed != 1 || nodes[0].Allowed != 2 {
+		t.Errorf("Expected 1 borrowed request and 2 on the service, got %+v", nodes)
+	}
+
+	// without a ceil the tenant is held to its own rate
+	h2 := newQuietHierarchy(t,
+		Level{Name: "service", Capacity: 10, FillRate: 0.01},
+		Level{Name: "tenant", Capacity: 1, FillRate: 0.01},
+	)
+	h2.Allow(1, "acme")
+	time.Sleep(20 * time.Millisecond)
+	if h2.Allow(1, "acme") {
+		t.Errorf("a tenant without ceil should not borrow")
+	}
+}
+
+func TestHierarchyEvictsIdleNodes(t *testing.T) {
+	// every level is full again 50ms after its last request
+	h := newQuietHierarchy(t,
+		Level{Name: "service", Capacity: 10, FillRate: 200},
+		Level{Name: "tenant", Capacity: 2, FillRate: 40},
+		Level{Name: "user", Capacity: 1, FillRate: 20},
+	)
+	h.Allow(1, "acme", "alice")
+	h.Allow(1, "acme", "bob")
+	h.Allow(1, "globex", "carol")
+	if h.Len() != 6 {
+		t.Fatalf("Expected the root, 2 tenants and 3 users, got %d nodes", h.Len())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	h.Allow(1, "acme", "alice")
+	if h.Len() != 3 {
+		t.Errorf("Expected only the root, acme and alice to be left, got %+v", h.Nodes())
+	}
+	if nodes := h.Nodes(); nodes[len(nodes)-1].Path != "acme/alice" {
+		t.Errorf("Expected acme/alice to be kept, got %+v", nodes)
+	}
+}
+
+func TestHierarchyMarshalJSON(t *testing.T) {
+	levels := []Level{
+		{Name: "service", Capacity: 10, FillRate: 0.01},
+		{Name: "tenant", Capacity: 5, FillRate: 0.01, Ceil: 1},
+	}
+	h := newQuietHierarchy(t, levels...)
+	h.Allow(3, "acme")
+	h.Allow(1, "globex")
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %v", err)
+	}
+	restored := newQuietHierarchy(t, levels...)
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatalf("UnmarshalJSON failed: %v", err)
+	}
+	nodes := restored.Nodes()
+	if len(nodes) != 3 || nodes[1].Path != "acme" || nodes[2].Path != "globex" {
+		t.Fatalf("Expected the root, acme and globex, got %+v", nodes)
+	}
+	if nodes[0].Allowed != 2 || math.Abs(nodes[0].Tokens-6) > 0.01 || math.Abs(nodes[1].Tokens-2) > 0.01 {
+		t.Errorf("Expected the counts and tokens to carry over, got %+v", nodes)
+	}
+
+	// a bad node after good ones leaves the tree as it was
+	bad := strings.Replace(string(data), `"keys":["globex"],"bucket":{"version":2,"capacity":5`, `"keys":["globex"],"bucket":{"version":2,"capacity":0`, 1)
+	if bad == string(data) {
+		t.Fatalf("Expected to find the globex bucket in %s", data)
+	}
+	fresh := newQuietHierarchy(t, levels...)
+	if err := json.Unmarshal([]byte(bad), fresh); err == nil {
+		t.Errorf("Expected a node with capacity 0 to fail")
+	}
+	if nodes := fresh.Nodes(); len(nodes) != 1 || nodes[0].Allowed != 0 || nodes[0].Tokens != 10 {
+		t.Errorf("Expected only the untouched root after a failed restore, got %+v", nodes)
+	}
+}
+
+func TestMultiBucket(t *testing.T) {
+	if _, err := NewMultiBucket(); err == nil {
+		t.Errorf("no dimensions should fail")
+	}
+	if _, err := NewMultiBucket(Dimension{"requests", 10, 1}, Dimension{"requests", 10, 1}); err == nil {
+		t.Errorf("duplicate dimension names should fail")
+	}
+
+	m, err := NewMultiBucket(Dimension{"requests", 10, 0.01}, Dimension{"bytes", 100 << 10, 1024})
+	if err != nil {
+		t.Fatalf("NewMultiBucket failed: %v", err)
+	}
+	m.SetLogger(log.New(io.Discard, "", 0))
+
+	costs, err := m.CostVector(map[string]Cost{"requests": 1, "bytes": 48 << 10})
+	if err != nil || !slices.Equal(costs, []Cost{1, 48 << 10}) {
+		t.Fatalf("Expected the costs in dimension order, got %v, %v", costs, err)
+	}
+	if _, err := m.CostVector(map[string]Cost{"rows": 1}); err == nil {
+		t.Errorf("an unknown dimension should fail")
+	}
+
+	for i := range 2 {
+		if d := m.Check(costs...); !d.Allowed {
+			t.Fatalf("request %d of 48 KiB should be allowed, denied by %v", i, d.DeniedBy)
+		}
+	}
+	// plenty of requests left, but only 4 KiB
+	d := m.Check(costs...)
+	if d.Allowed || !slices.Equal(d.DeniedBy, []string{"bytes"}) {
+		t.Errorf("Expected a denial by bytes, got %+v", d)
+	}
+	// 44 KiB missing at 1 KiB per second
+	if d.RetryAfter < 43*time.Second || d.RetryAfter > 44*time.Second {
+		t.Errorf("Expected a retry after about 44s, got %v", d.RetryAfter)
+	}
+	// a small request still fits, the denial took nothing
+	if !m.Allow(1) {
+		t.Errorf("Expected one request and one byte to fit")
+	}
+
+	allowed, rejected, dims := m.Stats()
+	if allowed != 3 || rejected != 1 {
+		t.Errorf("Expected 3 allowed and 1 rejected, got %d and %d", allowed, rejected)
+	}
+	if dims[0].Name != "requests" || math.Abs(dims[0].Available-7) > 0.01 || dims[0].Rejected != 0 {
+		t.Errorf("Expected 7 requests left and no rejections, got %+v", dims[0])
+	}
+	if dims[1].Rejected != 1 {
+		t.Errorf("Expected bytes to reject once, got %+v", dims[1])
+	}
+
+	if !m.ExceedsCapacityCosts(1, 200<<10) || m.ExceedsCapacityCosts(1, 100<<10) {
+		t.Errorf("Expected 200 KiB to exceed the bytes capacity and 100 KiB to fit")
+	}
+	if d := m.Check(1, 200<<10); d.RetryAfter != InfDuration {
+		t.Errorf("Expected InfDuration for a request that never fits, got %v", d.RetryAfter)
+	}
+	if m.Check().Allowed || m.Check(0, 0).Allowed || m.Check(1, -1).Allowed || m.Check(1, 1, 1).Allowed {
+		t.Errorf("Expected empty, all zero, negative and too many costs to be rejected")
+	}
+
+	if err := m.UpdateDimension("bytes", 200<<10, 0); err != nil || m.ExceedsCapacityCosts(1, 200<<10) {
+		t.Errorf("Expected 200 KiB to fit after raising the capacity, got %v", err)
+	}
+	if err := m.UpdateDimension("rows", 1, 1); err == nil {
+		t.Errorf("UpdateDimension of an unknown dimension should fail")
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %v", err)
+	}
+	restored, _ := NewMultiBucket(Dimension{"requests", 10, 0.01}, Dimension{"bytes", 100 << 10, 1024})
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatalf("UnmarshalJSON failed: %v", err)
+	}
+	_, _, dims = restored.Stats()
+	if math.Abs(dims[0].Available-7) > 0.01 || dims[1].Capacity != 200<<10 || dims[1].Rejected != 2 {
+		t.Errorf("Expected the saved dimensions back, got %+v", dims)
+	}
+}
+
+func TestSingleRateMarker(t *testing.T) {
+	if _, err := NewSingleRateMarker(1, 0, 1); err == nil {
+		t.Errorf("cbs 0 should fail")
+	}
+
+	m, _ := NewSingleRateMarker(0.01, 2, 1)
+	m.SetLogger(log.New(io.Discard, "", 0))
+	want := []Color{Green, Green, Yellow, Red}
+	for i, w := range want {
+		if c := m.Mark(1); c != w {
+			t.Errorf("Mark(1) at %d: expected %s, got %s", i, w, c)
+		}
+	}
+	if green, yellow, red := m.Stats(); green != 2 || yellow != 1 || red != 1 {
+		t.Errorf("Expected 2 green, 1 yellow and 1 red, got %d, %d, %d", green, yellow, red)
+	}
+	if wait := m.TimeUntilAllowed(1); wait < 99*time.Second || wait > 100*time.Second {
+		t.Errorf("Expected about 100s until a token is back, got %v", wait)
+	}
+	if !m.ExceedsCapacity(3) {
+		t.Errorf("3 is more than either bucket holds")
+	}
+
+	// color aware, a yellow request never turns green
+	m, _ = NewSingleRateMarker(0.01, 2, 1)
+	m.SetLogger(log.New(io.Discard, "", 0))
+	if c := m.MarkAware(1, Yellow); c != Yellow {
+		t.Errorf("Expected a yellow request to stay yellow, got %s", c)
+	}
+	if c := m.MarkAware(1, Red); c != Red {
+		t.Errorf("Expected a red request to stay red, got %s", c)
+	}
+}
+
+func TestSingleRateMarkerOverflow(t *testing.T) {
+	m, _ := NewSingleRateMarker(100, 1, 5)
+	m.SetLogger(log.New(io.Discard, "", 0))
+	m.Mark(1)
+	if c := m.Mark(5); c != Yellow {
+		t.Fatalf("Expected the excess bucket to pay for 5, got %s", c)
+	}
+
+	// C fills up first, the rest spills into E
+	time.Sleep(30 * time.Millisecond)
+	if c := m.Mark(2); c != Yellow {
+		t.Errorf("Expected 2 paid from the overflow in E, got %s", c)
+	}
+	if c := m.Mark(1); c != Green {
+		t.Errorf("Expected C to be full again, got %s", c)
+	}
+}
+
+func TestTwoRateMarker(t *testing.T) {
+	if _, err := NewTwoRateMarker(2, 1, 1, 1); err == nil {
+		t.Errorf("pir below cir should fail")
+	}
+
+	m, _ := NewTwoRateMarker(0.01, 1, 0.02, 2)
+	m.SetLogger(log.New(io.Discard, "", 0))
+	want := []Color{Green, Yellow, Red}
+	for i, w := range want {
+		if c := m.Mark(1); c != w {
+			t.Errorf("Mark(1) at %d: expected %s, got %s", i, w, c)
+		}
+	}
+	if wait := m.TimeUntilAllowed(1); wait < 49*time.Second || wait > 50*time.Second {
+		t.Errorf("Expected about 50s until the peak bucket has a token, got %v", wait)
+	}
+	if !m.ExceedsCapacity(3) || m.ExceedsCapacity(2) {
+		t.Errorf("Expected only requests above pbs to exceed the capacity")
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %v", err)
+	}
+	restored, _ := NewTwoRateMarker(1, 1, 1, 1)
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatalf("UnmarshalJSON failed: %v", err)
+	}
+	if green, yellow, red := restored.Stats(); green != 1 || yellow != 1 || red != 1 {
+		t.Errorf("Expected the counts to be restored, got %d, %d, %d", green, yellow, red)
+	}
+	if restored.Allow(1) {
+		t.Errorf("Expected the restored marker to still be out of peak tokens")
+	}
+}
+
+func TestLongRefill(t *testing.T) {
+	// 10,000 tokens at 10/s take 1000s to fill, idle for longer it is full again
+	tb, _ := NewTokenBucket(10000, 0, 10)
+	tb.SetLogger(log.New(io.Discard, "", 0))
+	if wait := tb.TimeUntilAllowed(10000); wait < 999*time.Second || wait > 1000*time.Second {
+		t.Errorf("Expected to wait 1000s for a full bucket, got %v", wait)
+	}
+	tb.lastTime = time.Now().Add(-20 * time.Minute)
+	if wait := tb.TimeUntilAllowed(10000); wait != 0 {
+		t.Errorf("Expected a long idle bucket to be full, got a wait of %v", wait)
+	}
+	if !tb.Allow(10000) {
+		t.Errorf("Expected a long idle bucket to allow its capacity")
+	}
+
+	// idle for centuries with a huge capacity and rate doesn't overflow
+	huge, _ := NewTokenBucket(math.MaxInt, 0, math.MaxFloat64)
+	huge.SetLogger(log.New(io.Discard, "", 0))
+	huge.lastTime = time.Unix(0, 0)
+	if !huge.Allow(math.MaxInt) {
+		t.Errorf("Expected the huge bucket to be full")
+	}
+	if wait := huge.TimeUntilAllowed(math.MaxInt); wait < 0 {
+		t.Errorf("Expected a positive wait, got %v", wait)
+	}
+
+	// a wait too long for a Duration saturates instead of going negative
+	tiny, _ := NewTokenBucket(1, 0, 1e-12)
+	if wait := tiny.TimeUntilAllowed(1); wait != InfDuration {
+		t.Errorf("Expected InfDuration for a tiny rate, got %v", wait)
+	}
+	slow, _ := NewTokenBucket(1, 0, 0.001)
+	if wait := slow.TimeUntilAllowed(1); wait < 999*time.Second || wait > 1000*time.Second {
+		t.Errorf("Expected to wait 1000s at 0.001 tokens/s, got %v", wait)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	tb, _ := NewTokenBucket(100, 100, 100)
+	tb.SetLogger(log.New(io.Discard, "", 0))
+	if err := tb.SetWarmup(WarmupConfig{Period: time.Second, Fraction: 2}); err == nil {
+		t.Errorf("Fraction above 1 should fail")
+	}
+	if err := tb.SetWarmup(WarmupConfig{Period: 200 * time.Millisecond, Fraction: 0.1, IdleReset: 300 * time.Millisecond}); err != nil {
+		t.Fatalf("SetWarmup failed: %v", err)
+	}
+
+	// a cold bucket only holds a tenth of its capacity
+	if tokens := tb.AvailableTokens(); tokens != 10 {
+		t.Errorf("Expected 10 tokens when cold, got %.2f", tokens)
+	}
+	if !tb.Allow(10) || tb.Allow(20) {
+		t.Errorf("Expected 10 tokens to pass and 20 more to be rejected")
+	}
+	if tb.ExceedsCapacity(20) {
+		t.Errorf("20 fits once the bucket is warm")
+	}
+	// the ramp brings 11 tokens in 200ms, the other 9 take 90ms at the full rate
+	if wait := tb.TimeUntilAllowed(20); wait <= 0 || wait > 300*time.Millisecond {
+		t.Errorf("Expected to wait for the ramp, got %v", wait)
+	}
+	if !tb.Warming() {
+		t.Errorf("Expected the bucket to be warming")
+	}
+	// a restored bucket stays on the ramp instead of coming back warm or starting over
+	data, _ := json.Marshal(tb)
+	restored, _ := NewTokenBucket(100, 100, 100)
+	if err := json.Unmarshal(data, restored); err != nil || !restored.Warming() || restored.AvailableTokens() > 10 {
+		t.Errorf("Expected the restored bucket to be warming with the tokens of the ramp, got %v, %.2f", err, restored.AvailableTokens())
+	}
+
+	// the fill rate ramps from 10 to 100 per second, about 16 tokens after 250ms instead of 25
+	time.Sleep(250 * time.Millisecond)
+	if tb.Warming() {
+		t.Errorf("Expected the ramp to be over")
+	}
+	if !tb.Allow(15) {
+		t.Errorf("Expected the ramp to have filled 15 tokens")
+	}
+
+	// idle longer than IdleReset makes it cold again
+	time.Sleep(350 * time.Millisecond)
+	if !tb.Warming() {
+		t.Errorf("Expected an idle bucket to warm up again")
+	}
+	tb.Allow(1)
+	if tokens := tb.AvailableTokens(); tokens > 10 {
+		t.Errorf("Expected at most the cold capacity after idling, got %.2f", tokens)
+	}
+
+	if err := tb.SetWarmup(WarmupConfig{}); err != nil || tb.Warming() {
+		t.Errorf("Expected a zero config to turn warm-up off, got %v", err)
+	}
+}
+
+func TestThrottledReaderWriter(t *testing.T) {
+	// empty, 100 bytes per chunk at 1000 bytes per second
+	tb, _ := NewTokenBucket(100, 0, 1000)
+	var buf bytes.Buffer
+	w := NewWriter(&buf, tb)
+
+	start := time.Now()
+	n, err := w.Write(make([]byte, 300))
+	elapsed := time.Since(start)
+	if n != 300 || err != nil || buf.Len() != 300 {
+		t.Fatalf("Expected all 300 bytes written, got %d, %v", n, err)
+	}
+	if elapsed < 250*time.Millisecond || elapsed > 600*time.Millisecond {
+		t.Errorf("Expected 300 bytes to take about 300ms, took %v", elapsed)
+	}
+
+	// a full bucket pays for the first chunk, the reads after it wait
+	full, _ := NewTokenBucket(100, 100, 1000)
+	start = time.Now()
+	data, err := io.ReadAll(NewReader(&buf, full))
+	elapsed = time.Since(start)
+	if len(data) != 300 || err != nil {
+		t.Fatalf("Expected to read 300 bytes, got %d, %v", len(data), err)
+	}
+	if elapsed < 150*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("Expected 300 bytes to take about 200ms, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	empty, _ := NewTokenBucket(100, 0, 1)
+	if _, err := NewWriterContext(ctx, io.Discard, empty).Write([]byte("x")); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a canceled context to stop the wait, got %v", err)
+	}
+}
+
+func TestThrottledConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+
+	empty, _ := NewTokenBucket(100, 0, 1)
+	c := NewConn(client, nil, []*TokenBucket{empty})
+
+	c.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.Write([]byte("hello")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected the write deadline to end the wait, got %v", err)
+	}
+
+	c.SetWriteDeadline(time.Time{})
+	done := make(chan error)
+	go func() {
+		_, err := c.Write([]byte("hello"))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Expected net.ErrClosed after Close, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Close should end the wait")
+	}
+}
+
+func TestThrottledListener(t *testing.T) {
+	if _, err := NewListener(nil, ListenerLimits{ConnRead: Bandwidth{BytesPerSecond: 100}}); err == nil {
+		t.Errorf("a bandwidth without burst should fail")
+	}
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	l, _ := NewListener(inner, ListenerLimits{
+		ConnWrite:  Bandwidth{BytesPerSecond: 10000, Burst: 1000},
+		TotalWrite: Bandwidth{BytesPerSecond: 1000, Burst: 100},
+	})
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write(make([]byte, 300))
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	// the total limit is the tighter one, 100 bytes right away and 200 more at 1000 per second
+	start := time.Now()
+	data, err := io.ReadAll(c)
+	elapsed := time.Since(start)
+	if len(data) != 300 || err != nil {
+		t.Fatalf("Expected to read 300 bytes, got %d, %v", len(data), err)
+	}
+	if elapsed < 150*time.Millisecond || elapsed > 600*time.Millisecond {
+		t.Errorf("Expected the total limit to take about 200ms, took %v", elapsed)
+	}
+}
@@ -0,0 +1,141 @@
+package tokenbucket
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// WarmupConfig ramps a cold bucket up to its capacity and fill rate, like Guava's
+// SmoothWarmingUp, so a backend that just started doesn't get the full burst at once
+type WarmupConfig struct {
+	Period   time.Duration // how long the ramp from Fraction to the full values takes
+	Fraction float64       // where capacity and fill rate start, 0.25 is a quarter of them
+	// idle time after which the bucket is cold again and the ramp starts over, 0 never
+	IdleReset time.Duration
+}
+
+func (c WarmupConfig) validate() error {
+	if c.Period <= 0 {
+		return errors.New("Period must be positive")
+	}
+	if c.Fraction <= 0 || c.Fraction > 1 {
+		return errors.New("Fraction must be between 0 and 1")
+	}
+	if c.IdleReset < 0 {
+		return errors.New("IdleReset cant be negative")
+	}
+	return nil
+}
+
+// SetWarmup turns warm-up on, or off with a zero config. A bucket that wasn't warming
+// up starts cold right away, one that was keeps its place on the ramp.
+func (tb *TokenBucket) SetWarmup(cfg WarmupConfig) error {
+	if cfg != (WarmupConfig{}) {
+		if err := cfg.validate(); err != nil {
+			return err
+		}
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	tb.refill()
+	if tb.warmup.Period == 0 {
+		tb.warmStart = now
+		tb.lastRequest = now
+	}
+	tb.warmup = cfg
+	tb.tokens = min(tb.tokens, tb.capacityAt(now, tb.warmStart))
+	return nil
+}
+
+// Warming reports whether the bucket is still below its configured capacity and fill rate
+func (tb *TokenBucket) Warming() bool {
+	tb.mu.RLock()
+	defer tb.mu.RUnlock()
+	now := time.Now()
+	return tb.warmFactor(now, tb.warmStartAt(now)) < 1
+}
+
+// warmStartAt is when the ramp in effect at now started. After IdleReset without
+// requests the next request starts it over, so that is now. tb.mu must be held.
+func (tb *TokenBucket) warmStartAt(now time.Time) time.Time {
+	if tb.warmup.IdleReset > 0 && now.Sub(tb.lastRequest) > tb.warmup.IdleReset {
+		return now
+	}
+	return tb.warmStart
+}
+
+// wake records a request, it restarts the ramp when the bucket was idle for too long.
+// tb.mu must be held.
+func (tb *TokenBucket) wake(now time.Time) {
+	if tb.warmup.Period == 0 {
+		return
+	}
+	if start := tb.warmStartAt(now); start != tb.warmStart {
+		// fill up for the idle time first, the cold capacity then cuts it down
+		tb.refill()
+		tb.warmStart = start
+		tb.tokens = min(tb.tokens, tb.capacityAt(now, start))
+	}
+	tb.lastRequest = now
+}
+
+// warmFactor is the share of capacity and fill rate in effect at t, 1 without warm-up
+func (tb *TokenBucket) warmFactor(t, start time.Time) float64 {
+	if tb.warmup.Period == 0 {
+		return 1
+	}
+	progress := min(max(t.Sub(start).Seconds()/tb.warmup.Period.Seconds(), 0), 1)
+	return tb.warmup.Fraction + (1-tb.warmup.Fraction)*progress
+}
+
+// capacityAt is the capacity in effect at t, never below one token
+func (tb *TokenBucket) capacityAt(t, start time.Time) float64 {
+	return max(float64(tb.capacity)*tb.warmFactor(t, start), min(1, float64(tb.capacity)))
+}
+
+// filled is how many tokens flow in between from and to. The fill rate grows linearly
+// during the ramp, so the mean of both ends is exact up to where the ramp ends.
+func (tb *TokenBucket) filled(from, to, start time.Time) float64 {
+	if !to.After(from) {
+		return 0
+	}
+	if tb.warmup.Period == 0 {
+		return to.Sub(from).Seconds() * tb.fillRate
+	}
+	end := start.Add(tb.warmup.Period)
+	if from.Before(end) && to.After(end) {
+		return tb.filled(from, end, start) + tb.filled(end, to, start)
+	}
+	mean := (tb.warmFactor(from, start) + tb.warmFactor(to, start)) / 2
+	return to.Sub(from).Seconds() * tb.fillRate * mean
+}
+
+// untilCapacity is how long until the ramp makes room for n tokens, tb.mu must be held
+func (tb *TokenBucket) untilCapacity(n float64, now, start time.Time) time.Duration {
+	if n <= tb.capacityAt(now, start) {
+		return 0
+	}
+	share := (n/float64(tb.capacity) - tb.warmup.Fraction) / (1 - tb.warmup.Fraction)
+	return start.Add(time.Duration(share * float64(tb.warmup.Period))).Sub(now)
+}
+
+// untilFilled is how long until missing tokens have flowed in from now on, the fill
+// rate keeps growing until the ramp ends
+func (tb *TokenBucket) untilFilled(missing float64, now, start time.Time) time.Duration {
+	if tb.warmup.Period == 0 || tb.warmFactor(now, start) >= 1 {
+		return durationOf(missing / tb.fillRate)
+	}
+	end := start.Add(tb.warmup.Period)
+	if ramp := tb.filled(now, end, start); ramp < missing {
+		return durationOf(end.Sub(now).Seconds() + (missing-ramp)/tb.fillRate)
+	}
+	// tokens after x seconds are fillRate * (f*x + slope*x*x/2), solved for x
+	f := tb.warmFactor(now, start)
+	slope := (1 - tb.warmup.Fraction) / tb.warmup.Period.Seconds()
+	x := (math.Sqrt(f*f+2*slope*missing/tb.fillRate) - f) / slope
+	return durationOf(x)
+}